@@ -1,9 +1,11 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"net"
 	"os"
+	"os/signal"
 	"time"
 
 	"github.com/1cbyc/go-udp-kit/goudpkit"
@@ -36,25 +38,17 @@ func init() {
 			}
 			defer kit.Close()
 
-			deadline := time.Now().Add(time.Duration(timeout) * time.Second)
-			for {
-				if timeout > 0 && time.Now().After(deadline) {
-					break
-				}
-				kit.Conn().SetReadDeadline(time.Now().Add(1 * time.Second))
-				data, remote, err := kit.ReceivePacket()
-				if err != nil {
-					if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
-						continue
-					}
-					return err
-				}
-				if data != nil {
-					fmt.Printf("Received from %v: %s\n", remote, string(data))
-					os.Stdout.Sync()
-				}
+			ctx, cancel := signal.NotifyContext(cmd.Context(), os.Interrupt)
+			defer cancel()
+			if timeout > 0 {
+				ctx, cancel = context.WithTimeout(ctx, time.Duration(timeout)*time.Second)
+				defer cancel()
 			}
-			return nil
+			// one worker keeps the output in arrival order
+			return kit.Serve(ctx, goudpkit.HandlerFunc(func(w goudpkit.ResponseWriter, packet goudpkit.Packet, remote *net.UDPAddr) {
+				fmt.Printf("Received from %v: %s\n", remote, string(packet.Data))
+				os.Stdout.Sync()
+			}), goudpkit.ServeConfig{Workers: 1})
 		},
 	}
 
@@ -51,6 +51,9 @@ func init() {
 					}
 					rootCmd.SetArgs(args)
 					_ = rootCmd.Execute()
+				case "transfer":
+					rootCmd.SetArgs(fields)
+					_ = rootCmd.Execute()
 				case "simulate-loss":
 					args := []string{"simulate-loss"}
 					if len(fields) > 1 {
@@ -59,7 +62,7 @@ func init() {
 					rootCmd.SetArgs(args)
 					_ = rootCmd.Execute()
 				default:
-					fmt.Println("Unknown command. Available: send, receive, stats, simulate-loss, exit")
+					fmt.Println("Unknown command. Available: send, receive, stats, transfer, simulate-loss, exit")
 				}
 			}
 		},
@@ -1,7 +1,10 @@
 package main
 
 import (
+	"context"
 	"fmt"
+	"net"
+	"time"
 
 	"github.com/1cbyc/go-udp-kit/goudpkit"
 	"github.com/spf13/cobra"
@@ -10,10 +13,11 @@ import (
 func init() {
 	var loss int
 	var count int
+	var burst float64
 
 	simCmd := &cobra.Command{
 		Use:   "simulate-loss",
-		Short: "Simulate packet loss and show dropped count",
+		Short: "Send packets over loopback through injected loss and count what arrives",
 		PreRun: func(cmd *cobra.Command, args []string) {
 			loadConfig()
 			if !cmd.Flags().Changed("loss") {
@@ -23,23 +27,63 @@ func init() {
 				count = 100
 			}
 		},
-		Run: func(cmd *cobra.Command, args []string) {
-			retryConfig := goudpkit.RetryConfig{MaxRetries: 1, BaseTimeout: 1, BackoffRate: 1.0}
+		RunE: func(cmd *cobra.Command, args []string) error {
+			retryConfig := goudpkit.RetryConfig{MaxRetries: 1, BaseTimeout: 100 * time.Millisecond, BackoffRate: 1.0}
 			qosConfig := goudpkit.QoSConfig{PriorityLevels: 1, PriorityQueues: make([][]goudpkit.Packet, 1)}
-			bufferConfig := goudpkit.BufferConfig{MaxBufferSize: 1, FlushInterval: 1}
-			kit, _ := goudpkit.NewGoUDPKit(":0", retryConfig, qosConfig, bufferConfig)
-			defer kit.Close()
-			before := kit.GetStats().PacketsDropped
+			bufferConfig := goudpkit.BufferConfig{MaxBufferSize: 1024, FlushInterval: 2 * time.Second}
+
+			loopback := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}
+			recvConn, err := net.ListenUDP("udp", loopback)
+			if err != nil {
+				return err
+			}
+			receiver, err := goudpkit.NewGoUDPKit("", retryConfig, qosConfig, bufferConfig, recvConn)
+			if err != nil {
+				return err
+			}
+			defer receiver.Close()
+
+			sendConn, err := net.ListenUDP("udp", loopback)
+			if err != nil {
+				return err
+			}
+			var model goudpkit.LossModel = goudpkit.BernoulliLoss{P: float64(loss) / 100}
+			if burst > 1 {
+				model = goudpkit.BurstLoss(float64(loss)/100, burst)
+			}
+			faulty := goudpkit.NewFaultConn(sendConn, goudpkit.FaultConfig{Outbound: goudpkit.FaultProfile{Loss: model}})
+			sender, err := goudpkit.NewGoUDPKit("", retryConfig, qosConfig, bufferConfig, faulty)
+			if err != nil {
+				return err
+			}
+			defer sender.Close()
+
+			dest := recvConn.LocalAddr().(*net.UDPAddr)
 			for i := 0; i < count; i++ {
-				kit.SimulatePacketLoss(loss)
+				if err := sender.SendPacket(goudpkit.Packet{SequenceNumber: uint32(i), Data: []byte("probe")}, dest); err != nil {
+					return err
+				}
+			}
+
+			// stop once the receiver has been idle for a while
+			received := 0
+			for {
+				ctx, cancel := context.WithTimeout(cmd.Context(), 200*time.Millisecond)
+				_, _, err := receiver.ReceiveContext(ctx)
+				cancel()
+				if err != nil {
+					break
+				}
+				received++
 			}
-			after := kit.GetStats().PacketsDropped
-			fmt.Printf("Simulated %d packets with %d%% loss: %d dropped\n", count, loss, after-before)
+			fmt.Printf("Sent %d packets with %d%% loss: %d received, %d dropped\n", count, loss, received, count-received)
+			return nil
 		},
 	}
 
 	simCmd.Flags().IntVar(&loss, "loss", 0, "Loss percentage (0-100)")
-	simCmd.Flags().IntVar(&count, "count", 0, "Number of packets to simulate")
+	simCmd.Flags().IntVar(&count, "count", 0, "Number of packets to send")
+	simCmd.Flags().Float64Var(&burst, "burst", 0, "Mean loss burst length in packets (above 1 uses Gilbert-Elliott burst loss)")
 
 	rootCmd.AddCommand(simCmd)
 }
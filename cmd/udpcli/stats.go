@@ -1,7 +1,11 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"os"
+	"os/signal"
 	"time"
 
 	"github.com/1cbyc/go-udp-kit/goudpkit"
@@ -34,19 +38,29 @@ func init() {
 			}
 			defer kit.Close()
 
-			deadline := time.Now().Add(time.Duration(timeout) * time.Second)
+			ctx, cancel := signal.NotifyContext(cmd.Context(), os.Interrupt)
+			defer cancel()
+			if timeout > 0 {
+				ctx, cancel = context.WithTimeout(ctx, time.Duration(timeout)*time.Second)
+				defer cancel()
+			}
 			for {
-				if timeout > 0 && time.Now().After(deadline) {
+				_, _, err := kit.ReceiveContext(ctx)
+				if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
 					break
 				}
-				kit.Conn().SetReadDeadline(time.Now().Add(1 * time.Second))
-				_, _, err := kit.ReceivePacket()
-				if err != nil {
-					continue
+				// a datagram that failed to decode is counted in the
+				// stats, anything else means the socket is unusable
+				var perr *goudpkit.PacketError
+				if err != nil && !errors.As(err, &perr) {
+					return err
 				}
 			}
-			stats := kit.GetStats()
+			stats := kit.Snapshot()
 			fmt.Printf("Packets Sent: %d\nPackets Received: %d\nPackets Dropped: %d\nRetry Count: %d\n", stats.PacketsSent, stats.PacketsReceived, stats.PacketsDropped, stats.RetryCount)
+			fmt.Printf("Bytes Sent: %d\nBytes Received: %d\n", stats.BytesSent, stats.BytesReceived)
+			fmt.Printf("Errors: read %d, decode %d, auth %d, decompress %d\n", stats.ReadErrors, stats.DecodeErrors, stats.AuthErrors, stats.DecompressErrors)
+			fmt.Printf("Uptime: %v\n", stats.Uptime.Round(time.Millisecond))
 			return nil
 		},
 	}
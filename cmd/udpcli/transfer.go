@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"time"
+
+	"github.com/1cbyc/go-udp-kit/goudpkit"
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	var addr string
+	var dir string
+	var chunkSize int
+	var rate int
+	var timeout int
+	var maxSize uint64
+
+	transferCmd := &cobra.Command{
+		Use:   "transfer",
+		Short: "Send or receive files with resumable, verified transfers",
+	}
+
+	sendCmd := &cobra.Command{
+		Use:   "send FILE",
+		Short: "Send a file, resuming where the receiver's checkpoint left off",
+		Args:  cobra.ExactArgs(1),
+		PreRun: func(cmd *cobra.Command, args []string) {
+			loadConfig()
+			if !cmd.Flags().Changed("addr") {
+				addr = cliConfig.Addr
+			}
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			kit, err := newTransferKit(":0")
+			if err != nil {
+				return err
+			}
+			defer kit.Close()
+			if err := kit.SetPacing(goudpkit.PacingConfig{Kit: goudpkit.RateLimit{BytesPerSecond: rate}}); err != nil {
+				return err
+			}
+
+			f, err := os.Open(args[0])
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			fi, err := f.Stat()
+			if err != nil {
+				return err
+			}
+			destAddr, err := net.ResolveUDPAddr("udp", addr)
+			if err != nil {
+				return err
+			}
+			ctx, cancel := signal.NotifyContext(cmd.Context(), os.Interrupt)
+			defer cancel()
+			m, err := kit.SendFile(ctx, f, fi.Size(), goudpkit.TransferOptions{ChunkSize: chunkSize, Name: filepath.Base(args[0])}, destAddr)
+			if err != nil {
+				return err
+			}
+			fmt.Printf("Sent %s (%d bytes in %d chunks, sha256 %x)\n", m.Name, m.Size, m.ChunkCount, m.Digest)
+			return nil
+		},
+	}
+	sendCmd.Flags().StringVar(&addr, "addr", "", "Destination UDP address")
+	sendCmd.Flags().IntVar(&chunkSize, "chunk-size", goudpkit.DefaultChunkSize, "Chunk size in bytes")
+	sendCmd.Flags().IntVar(&rate, "rate", 0, "Send rate limit in bytes per second (0 for no limit)")
+
+	receiveCmd := &cobra.Command{
+		Use:   "receive",
+		Short: "Receive files into a directory, keeping checkpoints of interrupted transfers",
+		PreRun: func(cmd *cobra.Command, args []string) {
+			loadConfig()
+			if !cmd.Flags().Changed("addr") {
+				addr = cliConfig.Addr
+			}
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			kit, err := newTransferKit(addr)
+			if err != nil {
+				return err
+			}
+			defer kit.Close()
+			if err := kit.SetTransferDir(dir); err != nil {
+				return err
+			}
+			kit.SetTransferLimits(goudpkit.TransferLimits{MaxSize: maxSize})
+
+			ctx, cancel := signal.NotifyContext(cmd.Context(), os.Interrupt)
+			defer cancel()
+			if timeout > 0 {
+				ctx, cancel = context.WithTimeout(ctx, time.Duration(timeout)*time.Second)
+				defer cancel()
+			}
+			for {
+				result, err := kit.ReceiveTransfer(ctx)
+				var incomplete *goudpkit.IncompleteTransferError
+				switch {
+				case errors.As(err, &incomplete):
+					fmt.Printf("Transfer of %s from %v interrupted, %d chunk ranges missing; checkpoint kept\n", result.Manifest.Name, result.Addr, len(incomplete.Missing))
+					if ctx.Err() != nil {
+						return nil
+					}
+				case errors.Is(err, goudpkit.ErrChecksumMismatch):
+					fmt.Printf("Transfer of %s from %v failed verification and was discarded\n", result.Manifest.Name, result.Addr)
+				case ctx.Err() != nil:
+					return nil
+				case err != nil:
+					return err
+				default:
+					fmt.Printf("Received %s from %v (%d bytes, SHA-256 verified)\n", result.Path, result.Addr, result.Manifest.Size)
+				}
+			}
+		},
+	}
+	receiveCmd.Flags().StringVar(&addr, "addr", "", "UDP address to listen on")
+	receiveCmd.Flags().StringVar(&dir, "dir", ".", "Directory to write received files to")
+	receiveCmd.Flags().IntVar(&timeout, "timeout", 0, "Timeout in seconds (0 for no timeout)")
+	receiveCmd.Flags().Uint64Var(&maxSize, "max-size", 0, "Largest file accepted in bytes (0 for the library default)")
+
+	transferCmd.AddCommand(sendCmd, receiveCmd)
+	rootCmd.AddCommand(transferCmd)
+}
+
+func newTransferKit(addr string) (*goudpkit.GoUDPKit, error) {
+	retryConfig := goudpkit.RetryConfig{MaxRetries: cliConfig.Retries, BaseTimeout: time.Duration(cliConfig.Timeout) * time.Millisecond, BackoffRate: cliConfig.Backoff}
+	qosConfig := goudpkit.QoSConfig{PriorityLevels: 1, PriorityQueues: make([][]goudpkit.Packet, 1)}
+	bufferConfig := goudpkit.BufferConfig{MaxBufferSize: 4096, FlushInterval: 2 * time.Second}
+	return goudpkit.NewGoUDPKit(addr, retryConfig, qosConfig, bufferConfig)
+}
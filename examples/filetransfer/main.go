@@ -1,12 +1,14 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"fmt"
-	"io"
 	"log"
 	"net"
 	"os"
+	"path/filepath"
 	"time"
 
 	"github.com/1cbyc/go-udp-kit/goudpkit"
@@ -28,21 +30,33 @@ func main() {
 			log.Fatal(err)
 		}
 		defer kit.Close()
-		f, err := os.Create(*filePath)
-		if err != nil {
+		// chunks are written straight to disk, with a checkpoint so an
+		// interrupted transfer resumes when the sender is run again
+		if err := kit.SetTransferDir(filepath.Dir(*filePath)); err != nil {
 			log.Fatal(err)
 		}
-		defer f.Close()
 		fmt.Println("Waiting for file...")
-		data, err := kit.ReceiveBulkData(10000)
-		if err != nil {
-			log.Fatal(err)
-		}
-		_, err = f.Write(data)
-		if err != nil {
-			log.Fatal(err)
+		for {
+			result, err := kit.ReceiveTransfer(context.Background())
+			var incomplete *goudpkit.IncompleteTransferError
+			if errors.As(err, &incomplete) {
+				fmt.Printf("Transfer from %v interrupted, missing chunks %v; run the sender again to resume\n", result.Addr, incomplete.Missing)
+				continue
+			}
+			if err != nil {
+				log.Fatal(err)
+			}
+			fmt.Printf("Received %s (%d bytes, SHA-256 verified)\n", result.Manifest.Name, result.Manifest.Size)
+			// like the kit, never replace a file that is already there
+			dest := *filePath
+			if _, err := os.Lstat(dest); err == nil {
+				dest = result.Path
+			} else if err := os.Rename(result.Path, dest); err != nil {
+				log.Fatal(err)
+			}
+			fmt.Println("File received and written to", dest)
+			return
 		}
-		fmt.Println("File received and written to", *filePath)
 	} else if *mode == "send" {
 		kit, err := goudpkit.NewGoUDPKit(":0", retryConfig, qosConfig, bufferConfig)
 		if err != nil {
@@ -58,17 +72,12 @@ func main() {
 		if err != nil {
 			log.Fatal(err)
 		}
-		fileSize := fileInfo.Size()
-		data := make([]byte, fileSize)
-		_, err = io.ReadFull(f, data)
-		if err != nil {
-			log.Fatal(err)
-		}
 		destAddr, err := net.ResolveUDPAddr("udp", *addr)
 		if err != nil {
 			log.Fatal(err)
 		}
-		err = kit.SendBulkData(data, 1024, destAddr)
+		// only the chunks the receiver is missing are sent
+		_, err = kit.SendFile(context.Background(), f, fileInfo.Size(), goudpkit.TransferOptions{Name: filepath.Base(*filePath)}, destAddr)
 		if err != nil {
 			log.Fatal(err)
 		}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"log"
@@ -28,15 +29,12 @@ func main() {
 			log.Fatal(err)
 		}
 		defer kit.Close()
-		for {
-			data, remote, err := kit.ReceivePacket()
-			if err != nil {
-				continue
-			}
-			if data != nil {
-				fmt.Printf("Received metric from %v: %s\n", remote, string(data))
-				os.Stdout.Sync()
-			}
+		err = kit.Serve(context.Background(), goudpkit.HandlerFunc(func(w goudpkit.ResponseWriter, packet goudpkit.Packet, remote *net.UDPAddr) {
+			fmt.Printf("Received metric from %v: %s\n", remote, string(packet.Data))
+			os.Stdout.Sync()
+		}), goudpkit.ServeConfig{Workers: 1})
+		if err != nil {
+			log.Print(err)
 		}
 	} else if *mode == "send" {
 		kit, err := goudpkit.NewGoUDPKit(":0", retryConfig, qosConfig, bufferConfig)
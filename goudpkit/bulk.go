@@ -1,50 +1,637 @@
 package goudpkit
 
 import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
 	"net"
+	"sort"
+	"sync/atomic"
 	"time"
 )
 
+// A bulk frame's payload starts with a 24-byte header, big-endian:
+//
+//	offset size field
+//	0      4    transfer ID
+//	4      8    total length of the data
+//	12     4    chunk size
+//	16     4    chunk index, or block index for a repair chunk
+//	20     1    FEC scheme
+//	21     1    data chunks per FEC block
+//	22     1    repair chunks per FEC block
+//	23     1    repair index plus one, or zero for a data chunk
+const bulkHeaderSize = 24
+
+// DefaultMaxTransferSize and DefaultMaxTransferChunks bound the transfers
+// a kit accepts, and DefaultMaxTransfers and DefaultMaxPeerTransfers how
+// many it holds at once, unless SetTransferLimits says otherwise.
+const (
+	DefaultMaxTransferSize   = 64 << 20
+	DefaultMaxTransferChunks = 1 << 20
+	DefaultMaxTransfers      = 64
+	DefaultMaxPeerTransfers  = 8
+)
+
+var errBadBulkFrame = errors.New("malformed bulk frame")
+
+// ErrTransferTooLarge is reported for a bulk transfer whose announced size
+// or chunk count exceeds the kit's TransferLimits. No transfer is started
+// for it.
+var ErrTransferTooLarge = errors.New("transfer exceeds size limit")
+
+// ErrTooManyTransfers is reported for a bulk transfer that would take the
+// kit, or its sender, past the transfers TransferLimits lets it hold at
+// once. No transfer is started for it.
+var ErrTooManyTransfers = errors.New("too many transfers")
+
+// TransferLimits bounds the bulk transfers a kit accepts. The sender
+// announces a transfer's size in every chunk, so without a bound one forged
+// chunk could make the receiver allocate any amount of memory.
+type TransferLimits struct {
+	// MaxSize is the largest transfer accepted, in bytes. Zero means
+	// DefaultMaxTransferSize.
+	MaxSize uint64
+	// MaxChunks is the most data chunks a transfer may have. Zero means
+	// DefaultMaxTransferChunks.
+	MaxChunks uint32
+	// MaxTransfers is the most transfers held at once, counting those in
+	// progress and those ended but not yet collected by ReceiveBulkData
+	// or ReceiveTransfer. Zero means DefaultMaxTransfers.
+	MaxTransfers int
+	// MaxPeerTransfers is the most of those that may come from one
+	// sender. Zero means DefaultMaxPeerTransfers.
+	MaxPeerTransfers int
+}
+
+func (l TransferLimits) withDefaults() TransferLimits {
+	if l.MaxSize == 0 {
+		l.MaxSize = DefaultMaxTransferSize
+	}
+	if l.MaxChunks == 0 {
+		l.MaxChunks = DefaultMaxTransferChunks
+	}
+	if l.MaxTransfers == 0 {
+		l.MaxTransfers = DefaultMaxTransfers
+	}
+	if l.MaxPeerTransfers == 0 {
+		l.MaxPeerTransfers = DefaultMaxPeerTransfers
+	}
+	return l
+}
+
+// SetTransferLimits sets the largest bulk transfer the kit accepts and how
+// many it holds at once. Transfers already in progress are not affected.
+func (kit *GoUDPKit) SetTransferLimits(l TransferLimits) {
+	kit.mu.Lock()
+	kit.transferLimits = l
+	kit.mu.Unlock()
+}
+
+// allows reports whether a transfer of h's size and chunk count is within
+// the limits.
+func (l TransferLimits) allows(h bulkHeader) bool {
+	return h.total <= l.MaxSize && h.chunkCount() <= l.MaxChunks
+}
+
+// admitTransfer reports ErrTooManyTransfers if a new transfer from peer
+// would exceed the transfers limits lets the kit hold. The caller must
+// hold mu.
+func (kit *GoUDPKit) admitTransfer(peer string, limits TransferLimits) error {
+	if len(kit.bulkTransfers)+len(kit.bulkDone) >= limits.MaxTransfers {
+		return ErrTooManyTransfers
+	}
+	n := 0
+	for key := range kit.bulkTransfers {
+		if key.peer == peer {
+			n++
+		}
+	}
+	for _, res := range kit.bulkDone {
+		if res.addr.String() == peer {
+			n++
+		}
+	}
+	if n >= limits.MaxPeerTransfers {
+		return ErrTooManyTransfers
+	}
+	return nil
+}
+
+// ErrTransferStalled is reported by an *IncompleteTransferError when no
+// chunk of a bulk transfer arrived for the buffer's FlushInterval.
+var ErrTransferStalled = errors.New("bulk transfer stalled")
+
+// ChunkRange is an inclusive range of chunk indexes.
+type ChunkRange struct {
+	First, Last uint32
+}
+
+// IncompleteTransferError reports a bulk transfer that ended before every
+// chunk arrived. No data is returned with it, as the size the sender
+// announced may be far more than it sent.
+type IncompleteTransferError struct {
+	Addr       *net.UDPAddr
+	TransferID uint32
+	ChunkSize  int
+	Missing    []ChunkRange
+	// Err is ErrTransferStalled or the context error that ended the wait.
+	Err error
+}
+
+func (e *IncompleteTransferError) Error() string {
+	n := 0
+	for _, r := range e.Missing {
+		n += int(r.Last-r.First) + 1
+	}
+	return fmt.Sprintf("bulk transfer %d from %v incomplete, %d chunks missing: %v", e.TransferID, e.Addr, n, e.Err)
+}
+
+func (e *IncompleteTransferError) Unwrap() error { return e.Err }
+
+type bulkHeader struct {
+	transfer  uint32
+	total     uint64
+	chunkSize uint32
+	index     uint32
+	fec       FECConfig
+	// repair is the repair chunk's index within its block, or -1 for a
+	// data chunk.
+	repair int
+}
+
+func appendBulkHeader(dst []byte, h bulkHeader) []byte {
+	dst = binary.BigEndian.AppendUint32(dst, h.transfer)
+	dst = binary.BigEndian.AppendUint64(dst, h.total)
+	dst = binary.BigEndian.AppendUint32(dst, h.chunkSize)
+	dst = binary.BigEndian.AppendUint32(dst, h.index)
+	return append(dst, byte(h.fec.Scheme), byte(h.fec.DataShards), byte(h.fec.ParityShards), byte(h.repair+1))
+}
+
+// decodeBulkHeader decodes a bulk frame, rejecting a transfer larger than
+// limits allow before anything is allocated for it.
+func decodeBulkHeader(b []byte, limits TransferLimits) (bulkHeader, []byte, error) {
+	if len(b) < bulkHeaderSize {
+		return bulkHeader{}, nil, errBadBulkFrame
+	}
+	h := bulkHeader{
+		transfer:  binary.BigEndian.Uint32(b),
+		total:     binary.BigEndian.Uint64(b[4:]),
+		chunkSize: binary.BigEndian.Uint32(b[12:]),
+		index:     binary.BigEndian.Uint32(b[16:]),
+		fec:       FECConfig{Scheme: FECScheme(b[20]), DataShards: int(b[21]), ParityShards: int(b[22])},
+		repair:    int(b[23]) - 1,
+	}
+	if h.chunkSize == 0 || (h.total+uint64(h.chunkSize)-1)/uint64(h.chunkSize) > 1<<32-1 {
+		return bulkHeader{}, nil, errBadBulkFrame
+	}
+	fec, err := h.fec.normalize()
+	if err != nil || fec != h.fec || (h.repair >= 0 && h.repair >= fec.ParityShards) {
+		return bulkHeader{}, nil, errBadBulkFrame
+	}
+	if !limits.allows(h) {
+		return bulkHeader{}, nil, ErrTransferTooLarge
+	}
+	return h, b[bulkHeaderSize:], nil
+}
+
+// chunkCount is the number of data chunks in the transfer. Empty data is
+// sent as one empty chunk.
+func (h bulkHeader) chunkCount() uint32 {
+	if h.total == 0 {
+		return 1
+	}
+	return uint32((h.total + uint64(h.chunkSize) - 1) / uint64(h.chunkSize))
+}
+
+func (h bulkHeader) chunkLen(i uint32) int {
+	rest := h.total - uint64(i)*uint64(h.chunkSize)
+	return int(min(rest, uint64(h.chunkSize)))
+}
+
+// blockRange returns the first chunk and the number of chunks in block b.
+func (h bulkHeader) blockRange(b uint32) (uint32, int) {
+	first := b * uint32(h.fec.DataShards)
+	return first, int(min(uint32(h.fec.DataShards), h.chunkCount()-first))
+}
+
+// chunkStore holds the data chunks of a transfer as they arrive.
+type chunkStore interface {
+	has(i uint32) bool
+	// get returns chunk i, which is n bytes long.
+	get(i uint32, n int) ([]byte, bool)
+	put(i uint32, b []byte) error
+	len() int
+	// missing lists the chunks below count not held yet.
+	missing(count uint32) []ChunkRange
+}
+
+type memChunks map[uint32][]byte
+
+func (m memChunks) has(i uint32) bool { _, ok := m[i]; return ok }
+
+func (m memChunks) get(i uint32, _ int) ([]byte, bool) {
+	c, ok := m[i]
+	return c, ok
+}
+
+func (m memChunks) put(i uint32, b []byte) error {
+	m[i] = append([]byte(nil), b...)
+	return nil
+}
+
+func (m memChunks) len() int { return len(m) }
+
+// missing finds the gaps between the chunks held, so it costs as much as
+// the chunks that arrived rather than as many as the sender announced.
+func (m memChunks) missing(count uint32) []ChunkRange {
+	held := make([]uint32, 0, len(m))
+	for i := range m {
+		held = append(held, i)
+	}
+	sort.Slice(held, func(a, b int) bool { return held[a] < held[b] })
+	var missing []ChunkRange
+	next := uint64(0)
+	for _, i := range held {
+		if uint64(i) > next {
+			missing = appendRange(missing, uint32(next), i-1)
+		}
+		next = uint64(i) + 1
+	}
+	if next < uint64(count) {
+		missing = appendRange(missing, uint32(next), count-1)
+	}
+	return missing
+}
+
+// appendRange adds first..last to sorted ranges, merging it into the last
+// range if the two touch.
+func appendRange(ranges []ChunkRange, first, last uint32) []ChunkRange {
+	if n := len(ranges); n > 0 && uint64(ranges[n-1].Last)+1 == uint64(first) {
+		ranges[n-1].Last = last
+		return ranges
+	}
+	return append(ranges, ChunkRange{First: first, Last: last})
+}
+
+type bulkTransfer struct {
+	hdr      bulkHeader
+	addr     *net.UDPAddr
+	manifest *Manifest
+	chunks   chunkStore
+	repairs  map[uint32][][]byte
+	lastSeen time.Time
+}
+
+// finishedTransfer is what is kept of a transfer after it ends, to answer
+// manifests and chunks that arrive late.
+type finishedTransfer struct {
+	at       time.Time
+	hdr      bulkHeader
+	manifest *Manifest
+	complete bool
+}
+
+type bulkResult struct {
+	data     []byte
+	file     *transferFile
+	addr     *net.UDPAddr
+	manifest *Manifest
+	err      error
+	// at is when the transfer ended; a result nobody collects is
+	// dropped ackRetention later.
+	at time.Time
+}
+
+// missing lists the chunks not received yet.
+func (t *bulkTransfer) missing() []ChunkRange {
+	return t.chunks.missing(t.hdr.chunkCount())
+}
+
+// assemble joins the chunks of a complete transfer held in memory in
+// index order.
+func (t *bulkTransfer) assemble() []byte {
+	data := make([]byte, t.hdr.total)
+	for i, c := range t.chunks.(memChunks) {
+		copy(data[uint64(i)*uint64(t.hdr.chunkSize):], c)
+	}
+	return data
+}
+
+// finishBulk moves a transfer to the results, as an
+// *IncompleteTransferError wrapping cause and no data if chunks are
+// missing. A transfer received into a file returns the file instead of
+// data if it is complete, and otherwise leaves it and its checkpoint on
+// disk for a later resume. The caller must hold mu.
+func (kit *GoUDPKit) finishBulk(key messageKey, t *bulkTransfer, cause error) bulkResult {
+	delete(kit.bulkTransfers, key)
+	missing := t.missing()
+	kit.bulkFinished[key] = finishedTransfer{at: time.Now(), hdr: t.hdr, manifest: t.manifest, complete: len(missing) == 0}
+	res := bulkResult{addr: t.addr, manifest: t.manifest, at: time.Now()}
+	if f, ok := t.chunks.(*transferFile); ok {
+		if len(missing) > 0 {
+			f.close()
+		} else {
+			res.file = f
+		}
+	} else if len(missing) == 0 {
+		res.data = t.assemble()
+	}
+	if len(missing) > 0 {
+		res.err = &IncompleteTransferError{
+			Addr:       t.addr,
+			TransferID: t.hdr.transfer,
+			ChunkSize:  int(t.hdr.chunkSize),
+			Missing:    missing,
+			Err:        cause,
+		}
+	}
+	return res
+}
+
 func (kit *GoUDPKit) SendBulkData(data []byte, packetSize int, destAddr *net.UDPAddr) error {
-	totalPackets := (len(data) + packetSize - 1) / packetSize
-	for i := 0; i < totalPackets; i++ {
-		start := i * packetSize
-		end := start + packetSize
-		if end > len(data) {
-			end = len(data)
+	kit.mu.Lock()
+	fec := kit.fec
+	kit.mu.Unlock()
+	return kit.SendBulkDataWithFEC(data, packetSize, fec, destAddr)
+}
+
+// SendBulkDataWithFEC sends data in chunks of packetSize bytes, adding the
+// repair chunks fec asks for after each block.
+func (kit *GoUDPKit) SendBulkDataWithFEC(data []byte, packetSize int, fec FECConfig, destAddr *net.UDPAddr) error {
+	if packetSize <= 0 || packetSize > maxDatagramSize-HeaderSize-bulkHeaderSize {
+		return fmt.Errorf("packet size %d out of range", packetSize)
+	}
+	fec, err := fec.normalize()
+	if err != nil {
+		return err
+	}
+	h := bulkHeader{
+		transfer:  atomic.AddUint32(&kit.nextTransferID, 1),
+		total:     uint64(len(data)),
+		chunkSize: uint32(packetSize),
+		fec:       fec,
+		repair:    -1,
+	}
+	return kit.sendBulk(context.Background(), h, bytes.NewReader(data), []ChunkRange{{First: 0, Last: h.chunkCount() - 1}}, destAddr)
+}
+
+// sendBulk sends the chunks of the transfer described by h that fall in
+// want, reading them from src. With FEC, every block holding a wanted chunk
+// is followed by all of its repair chunks. want must be sorted and must not
+// overlap.
+func (kit *GoUDPKit) sendBulk(ctx context.Context, h bulkHeader, src io.ReaderAt, want []ChunkRange, destAddr *net.UDPAddr) error {
+	per := uint32(1)
+	if h.fec.Scheme != FECNone {
+		per = uint32(h.fec.DataShards)
+	}
+	count := h.chunkCount()
+	r := 0
+	for b := uint32(0); uint64(b)*uint64(per) < uint64(count) && r < len(want); b++ {
+		first := b * per
+		last := min(first+per-1, count-1)
+		for r < len(want) && want[r].Last < first {
+			r++
+		}
+		if r == len(want) || want[r].First > last {
+			continue
 		}
 
-		packet := Packet{
-			SequenceNumber: uint32(i),
-			Priority:       0,
-			Data:           data[start:end],
-			Timestamp:      time.Now(),
+		block := make([][]byte, last-first+1)
+		for j := range block {
+			i := first + uint32(j)
+			block[j] = make([]byte, h.chunkLen(i))
+			if n, err := src.ReadAt(block[j], int64(i)*int64(h.chunkSize)); n < len(block[j]) {
+				return err
+			}
+			if !inRanges(want[r:], i) {
+				continue
+			}
+			h.index = i
+			if err := kit.sendBulkFrame(ctx, h, block[j], destAddr); err != nil {
+				return err
+			}
+		}
+		if h.fec.Scheme == FECNone {
+			continue
 		}
 
-		err := kit.SendPacket(packet, destAddr)
-		if err != nil {
-			return err
+		for j, c := range block {
+			block[j] = make([]byte, h.chunkSize)
+			copy(block[j], c)
+		}
+		repair := h
+		repair.index = b
+		for k, p := range fecEncode(h.fec, block) {
+			repair.repair = k
+			if err := kit.sendBulkFrame(ctx, repair, p, destAddr); err != nil {
+				return err
+			}
 		}
 	}
+	return nil
+}
 
+// inRanges reports whether i falls in one of the sorted ranges.
+func inRanges(ranges []ChunkRange, i uint32) bool {
+	for _, r := range ranges {
+		if r.First > i {
+			return false
+		}
+		if i <= r.Last {
+			return true
+		}
+	}
+	return false
+}
+
+func (kit *GoUDPKit) sendBulkFrame(ctx context.Context, h bulkHeader, chunk []byte, addr *net.UDPAddr) error {
+	payload := append(appendBulkHeader(make([]byte, 0, bulkHeaderSize+len(chunk)), h), chunk...)
+	frame := Header{Type: PacketTypeBulk, SequenceNumber: h.index}
+	if err := kit.writeFrame(ctx, frame, payload, addr); err != nil {
+		return err
+	}
+	kit.stats.inc(statPacketsSent)
 	return nil
 }
 
+// ReceiveBulkData returns the data of the next bulk transfer to end.
+// Chunks are put in order by index, and transfers from different senders,
+// or with different IDs, are kept apart. A transfer that stalls for the
+// buffer's FlushInterval is reported with an *IncompleteTransferError and
+// no data. The chunk count travels with the transfer, so
+// expectedPackets is no longer needed and is ignored.
 func (kit *GoUDPKit) ReceiveBulkData(expectedPackets int) ([]byte, error) {
-	var bulkData []byte
-	receivedPackets := 0
+	data, _, err := kit.ReceiveBulkDataContext(context.Background())
+	return data, err
+}
 
-	for receivedPackets < expectedPackets {
-		data, _, err := kit.ReceivePacket()
-		if err != nil {
-			return nil, err
+// ReceiveBulkDataContext is like ReceiveBulkData but also returns the
+// sender and stops waiting when ctx is done. If a transfer is in progress
+// at that point, the one heard from last is ended with an
+// *IncompleteTransferError wrapping ctx.Err(); otherwise the error is
+// ctx.Err().
+func (kit *GoUDPKit) ReceiveBulkDataContext(ctx context.Context) ([]byte, *net.UDPAddr, error) {
+	res, err := kit.receiveBulk(ctx, false)
+	return res.data, res.addr, err
+}
+
+// receiveBulk waits for the next transfer to end, taking only those sent
+// with a manifest if manifest is set and only those without otherwise.
+func (kit *GoUDPKit) receiveBulk(ctx context.Context, manifest bool) (bulkResult, error) {
+	buf := make([]byte, 65535)
+	for {
+		kit.mu.Lock()
+		for i, res := range kit.bulkDone {
+			if (res.manifest != nil) == manifest {
+				kit.bulkDone = append(kit.bulkDone[:i], kit.bulkDone[i+1:]...)
+				kit.mu.Unlock()
+				return res, res.err
+			}
+		}
+		if err := ctx.Err(); err != nil {
+			res, ok := kit.abandonBulk(err, manifest)
+			kit.mu.Unlock()
+			if !ok {
+				return bulkResult{}, err
+			}
+			return res, res.err
+		}
+		kit.mu.Unlock()
+		if kit.isClosed() {
+			return bulkResult{}, ErrClosed
 		}
 
-		if data != nil {
-			bulkData = append(bulkData, data...)
-			receivedPackets++
+		// wake regularly to pick up transfers expired by flushBuffer
+		deadline := time.Now().Add(max(kit.bufferConfig.FlushInterval, minFlushTick))
+		if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+			deadline = d
+		}
+		if err := kit.pollOnce(ctx, buf, deadline); err != nil {
+			return bulkResult{}, err
+		}
+	}
+}
+
+// abandonBulk ends the most recently active transfer of the kind receiveBulk
+// is waiting for with cause. The caller must hold mu.
+func (kit *GoUDPKit) abandonBulk(cause error, manifest bool) (bulkResult, bool) {
+	var key messageKey
+	var latest *bulkTransfer
+	for k, t := range kit.bulkTransfers {
+		if (t.manifest != nil) != manifest {
+			continue
+		}
+		if latest == nil || t.lastSeen.After(latest.lastSeen) {
+			key, latest = k, t
+		}
+	}
+	if latest == nil {
+		return bulkResult{}, false
+	}
+	return kit.finishBulk(key, latest, cause), true
+}
+
+// handleBulk stores one bulk chunk, rebuilding lost chunks from repair
+// chunks where it can, and queues the transfer's data once it is complete.
+func (kit *GoUDPKit) handleBulk(payload []byte, addr *net.UDPAddr) error {
+	kit.mu.Lock()
+	limits := kit.transferLimits.withDefaults()
+	kit.mu.Unlock()
+	h, chunk, err := decodeBulkHeader(payload, limits)
+	if err != nil {
+		return err
+	}
+	if h.repair < 0 && (h.index >= h.chunkCount() || len(chunk) != h.chunkLen(h.index)) {
+		return errBadBulkFrame
+	}
+	if h.repair >= 0 && (h.fec.Scheme == FECNone || h.index > (h.chunkCount()-1)/uint32(h.fec.DataShards) || len(chunk) != int(h.chunkSize)) {
+		return errBadBulkFrame
+	}
+
+	kit.mu.Lock()
+	defer kit.mu.Unlock()
+	key := messageKey{peer: addr.String(), id: h.transfer}
+	if _, done := kit.bulkFinished[key]; done {
+		return nil
+	}
+	t, ok := kit.bulkTransfers[key]
+	if !ok {
+		if err := kit.admitTransfer(key.peer, limits); err != nil {
+			return err
+		}
+		t = &bulkTransfer{hdr: h, addr: addr, chunks: make(memChunks), repairs: make(map[uint32][][]byte)}
+		kit.bulkTransfers[key] = t
+	}
+	if t.hdr.total != h.total || t.hdr.chunkSize != h.chunkSize || t.hdr.fec != h.fec {
+		return errBadBulkFrame
+	}
+	t.lastSeen = time.Now()
+
+	block := h.index
+	if h.repair < 0 {
+		if t.chunks.has(h.index) {
+			return nil
+		}
+		if err := t.chunks.put(h.index, chunk); err != nil {
+			return err
+		}
+		if h.fec.Scheme != FECNone {
+			block = h.index / uint32(h.fec.DataShards)
+		}
+	} else {
+		if t.repairs[block] == nil {
+			t.repairs[block] = make([][]byte, h.fec.ParityShards)
+		}
+		t.repairs[block][h.repair] = append([]byte(nil), chunk...)
+	}
+	if h.fec.Scheme != FECNone {
+		if err := kit.recoverBlock(t, block); err != nil {
+			return err
 		}
 	}
 
-	return bulkData, nil
+	if uint32(t.chunks.len()) == t.hdr.chunkCount() {
+		kit.bulkDone = append(kit.bulkDone, kit.finishBulk(key, t, nil))
+	}
+	return nil
+}
+
+// recoverBlock rebuilds the missing data chunks of block b once enough
+// repair chunks have arrived. The caller must hold mu.
+func (kit *GoUDPKit) recoverBlock(t *bulkTransfer, b uint32) error {
+	parity := t.repairs[b]
+	if parity == nil {
+		return nil
+	}
+	first, n := t.hdr.blockRange(b)
+	data := make([][]byte, n)
+	missing := 0
+	for i := range data {
+		idx := first + uint32(i)
+		c, ok := t.chunks.get(idx, t.hdr.chunkLen(idx))
+		if !ok {
+			missing++
+			continue
+		}
+		data[i] = make([]byte, t.hdr.chunkSize)
+		copy(data[i], c)
+	}
+	if missing == 0 || !fecReconstruct(t.hdr.fec, data, parity, int(t.hdr.chunkSize)) {
+		return nil
+	}
+	for i, d := range data {
+		idx := first + uint32(i)
+		if !t.chunks.has(idx) {
+			if err := t.chunks.put(idx, d[:t.hdr.chunkLen(idx)]); err != nil {
+				return err
+			}
+			kit.stats.inc(statFECRecovered)
+		}
+	}
+	delete(t.repairs, b)
+	return nil
 }
@@ -1,42 +1,369 @@
 package goudpkit
 
-func (kit *GoUDPKit) Compress(data []byte) []byte {
+import (
+	"bytes"
+	"compress/flate"
+	"compress/lzw"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// DefaultMaxDecompressedSize bounds the output of a single decompression
+// unless SetMaxDecompressedSize says otherwise.
+const DefaultMaxDecompressedSize = 16 << 20
+
+var (
+	ErrDecompressedTooLarge = errors.New("decompressed data exceeds size limit")
+	ErrCorruptCompressed    = errors.New("corrupt compressed data")
+	ErrUnknownCodec         = errors.New("unknown compression codec")
+)
+
+type CodecID uint8
+
+const (
+	CodecDeflate CodecID = iota + 1
+	CodecZlib
+	CodecLZW
+	CodecLZ4
+)
+
+// A Codec compresses payloads. Compressed payloads start with the codec's
+// ID so the receiver can pick the matching decoder.
+type Codec interface {
+	ID() CodecID
+	Encode(src []byte) ([]byte, error)
+	// Decode must fail with ErrDecompressedTooLarge rather than produce
+	// more than maxSize bytes.
+	Decode(src []byte, maxSize int) ([]byte, error)
+}
+
+var (
+	codecsMu sync.RWMutex
+	codecs   = map[CodecID]Codec{
+		CodecDeflate: DeflateCodec{Level: flate.DefaultCompression},
+		CodecZlib:    ZlibCodec{Level: zlib.DefaultCompression},
+		CodecLZW:     LZWCodec{},
+		CodecLZ4:     LZ4Codec{},
+	}
+)
+
+// RegisterCodec makes c available to receivers under c.ID(), replacing any
+// codec already registered with that ID.
+func RegisterCodec(c Codec) {
+	codecsMu.Lock()
+	codecs[c.ID()] = c
+	codecsMu.Unlock()
+}
+
+func lookupCodec(id CodecID) (Codec, error) {
+	codecsMu.RLock()
+	c, ok := codecs[id]
+	codecsMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("%w: %d", ErrUnknownCodec, id)
+	}
+	return c, nil
+}
+
+// SetCompression selects the codec used for SendPacket and SendMessage
+// payloads. A nil codec turns compression off.
+func (kit *GoUDPKit) SetCompression(c Codec) {
+	kit.mu.Lock()
+	kit.codec = c
+	kit.mu.Unlock()
+}
+
+func (kit *GoUDPKit) SetMaxDecompressedSize(n int) {
+	kit.mu.Lock()
+	kit.maxDecompressed = n
+	kit.mu.Unlock()
+}
+
+// Compress encodes data with the kit's codec, or DEFLATE if none is set.
+// The result carries the codec ID and is understood by Decompress.
+func (kit *GoUDPKit) Compress(data []byte) ([]byte, error) {
+	kit.mu.Lock()
+	c := kit.codec
+	kit.mu.Unlock()
+	if c == nil {
+		c = DeflateCodec{Level: flate.DefaultCompression}
+	}
+	return encodeWithCodec(c, data)
+}
+
+func (kit *GoUDPKit) Decompress(data []byte) ([]byte, error) {
+	return decodeWithCodec(data, kit.decompressLimit())
+}
+
+func (kit *GoUDPKit) decompressLimit() int {
+	kit.mu.Lock()
+	defer kit.mu.Unlock()
+	if kit.maxDecompressed > 0 {
+		return kit.maxDecompressed
+	}
+	return DefaultMaxDecompressedSize
+}
+
+// compressPayload compresses data with c and reports whether doing so
+// made it smaller. Otherwise data is returned unchanged.
+func compressPayload(c Codec, data []byte) ([]byte, bool) {
+	if c == nil || len(data) == 0 {
+		return data, false
+	}
+	out, err := encodeWithCodec(c, data)
+	if err != nil || len(out) >= len(data) {
+		return data, false
+	}
+	return out, true
+}
+
+func encodeWithCodec(c Codec, data []byte) ([]byte, error) {
+	body, err := c.Encode(data)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte{byte(c.ID())}, body...), nil
+}
+
+func decodeWithCodec(data []byte, maxSize int) ([]byte, error) {
 	if len(data) == 0 {
-		return data
+		return nil, ErrCorruptCompressed
 	}
+	c, err := lookupCodec(CodecID(data[0]))
+	if err != nil {
+		return nil, err
+	}
+	return c.Decode(data[1:], maxSize)
+}
 
-	var compressed []byte
-	count := 1
-	current := data[0]
+// readLimited drains r, failing once more than maxSize bytes come out.
+func readLimited(r io.Reader, maxSize int) ([]byte, error) {
+	out, err := io.ReadAll(io.LimitReader(r, int64(maxSize)+1))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrCorruptCompressed, err)
+	}
+	if len(out) > maxSize {
+		return nil, ErrDecompressedTooLarge
+	}
+	return out, nil
+}
+
+type DeflateCodec struct {
+	Level int
+}
+
+func (DeflateCodec) ID() CodecID { return CodecDeflate }
+
+func (c DeflateCodec) Encode(src []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w, err := flate.NewWriter(&buf, c.Level)
+	if err != nil {
+		return nil, err
+	}
+	w.Write(src)
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (DeflateCodec) Decode(src []byte, maxSize int) ([]byte, error) {
+	r := flate.NewReader(bytes.NewReader(src))
+	defer r.Close()
+	return readLimited(r, maxSize)
+}
 
-	for i := 1; i < len(data); i++ {
-		if data[i] == current && count < 255 {
-			count++
-		} else {
-			compressed = append(compressed, byte(count), current)
-			count = 1
-			current = data[i]
+type ZlibCodec struct {
+	Level int
+}
+
+func (ZlibCodec) ID() CodecID { return CodecZlib }
+
+func (c ZlibCodec) Encode(src []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w, err := zlib.NewWriterLevel(&buf, c.Level)
+	if err != nil {
+		return nil, err
+	}
+	w.Write(src)
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (ZlibCodec) Decode(src []byte, maxSize int) ([]byte, error) {
+	r, err := zlib.NewReader(bytes.NewReader(src))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrCorruptCompressed, err)
+	}
+	defer r.Close()
+	return readLimited(r, maxSize)
+}
+
+type LZWCodec struct{}
+
+func (LZWCodec) ID() CodecID { return CodecLZW }
+
+func (LZWCodec) Encode(src []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w := lzw.NewWriter(&buf, lzw.LSB, 8)
+	w.Write(src)
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (LZWCodec) Decode(src []byte, maxSize int) ([]byte, error) {
+	r := lzw.NewReader(bytes.NewReader(src), lzw.LSB, 8)
+	defer r.Close()
+	return readLimited(r, maxSize)
+}
+
+// LZ4Codec is a fast LZ77 block codec using the LZ4 block sequence layout
+// (token, literals, 2-byte little-endian offset, match length), prefixed
+// with the uncompressed length as a uvarint.
+type LZ4Codec struct{}
+
+const (
+	lz4MinMatch   = 4
+	lz4LastLits   = 5
+	lz4MatchLimit = 12
+	lz4HashLog    = 14
+	lz4MaxOffset  = 65535
+)
+
+func (LZ4Codec) ID() CodecID { return CodecLZ4 }
+
+func (LZ4Codec) Encode(src []byte) ([]byte, error) {
+	dst := binary.AppendUvarint(make([]byte, 0, len(src)/2+16), uint64(len(src)))
+	var table [1 << lz4HashLog]int32
+
+	anchor, pos := 0, 0
+	limit := len(src) - lz4MatchLimit
+	for pos < limit {
+		seq := binary.LittleEndian.Uint32(src[pos:])
+		h := (seq * 2654435761) >> (32 - lz4HashLog)
+		ref := int(table[h]) - 1
+		table[h] = int32(pos + 1)
+		if ref < 0 || pos-ref > lz4MaxOffset || binary.LittleEndian.Uint32(src[ref:]) != seq {
+			pos++
+			continue
+		}
+
+		matchLen := lz4MinMatch
+		for pos+matchLen < len(src)-lz4LastLits && src[ref+matchLen] == src[pos+matchLen] {
+			matchLen++
 		}
+		dst = lz4AppendSequence(dst, src[anchor:pos], pos-ref, matchLen)
+		pos += matchLen
+		anchor = pos
 	}
-	compressed = append(compressed, byte(count), current)
+	return lz4AppendSequence(dst, src[anchor:], 0, 0), nil
+}
 
-	return compressed
+// lz4AppendSequence appends one sequence. A zero matchLen marks the final,
+// literal-only sequence.
+func lz4AppendSequence(dst, literals []byte, offset, matchLen int) []byte {
+	litLen := len(literals)
+	token := byte(min(litLen, 15)) << 4
+	if matchLen > 0 {
+		token |= byte(min(matchLen-lz4MinMatch, 15))
+	}
+	dst = append(dst, token)
+	if litLen >= 15 {
+		dst = lz4AppendLength(dst, litLen-15)
+	}
+	dst = append(dst, literals...)
+	if matchLen == 0 {
+		return dst
+	}
+	dst = append(dst, byte(offset), byte(offset>>8))
+	if matchLen-lz4MinMatch >= 15 {
+		dst = lz4AppendLength(dst, matchLen-lz4MinMatch-15)
+	}
+	return dst
 }
 
-func (kit *GoUDPKit) Decompress(data []byte) []byte {
-	if len(data) == 0 {
-		return data
+func lz4AppendLength(dst []byte, n int) []byte {
+	for n >= 255 {
+		dst = append(dst, 255)
+		n -= 255
 	}
+	return append(dst, byte(n))
+}
+
+func (LZ4Codec) Decode(src []byte, maxSize int) ([]byte, error) {
+	size, n := binary.Uvarint(src)
+	if n <= 0 {
+		return nil, ErrCorruptCompressed
+	}
+	if size > uint64(maxSize) {
+		return nil, ErrDecompressedTooLarge
+	}
+	src = src[n:]
+	// each input byte expands to at most 255 output bytes, so a forged
+	// size cannot make a tiny datagram allocate maxSize up front
+	dst := make([]byte, 0, min(size, uint64(len(src))*255))
 
-	var decompressed []byte
+	for len(src) > 0 {
+		token := src[0]
+		src = src[1:]
 
-	for i := 0; i < len(data); i += 2 {
-		count := int(data[i])
-		value := data[i+1]
-		for j := 0; j < count; j++ {
-			decompressed = append(decompressed, value)
+		litLen, rest, ok := lz4ReadLength(src, int(token>>4))
+		if !ok || litLen > len(rest) || len(dst)+litLen > int(size) {
+			return nil, ErrCorruptCompressed
+		}
+		dst = append(dst, rest[:litLen]...)
+		src = rest[litLen:]
+		if len(src) == 0 {
+			break
+		}
+
+		if len(src) < 2 {
+			return nil, ErrCorruptCompressed
+		}
+		offset := int(src[0]) | int(src[1])<<8
+		src = src[2:]
+		matchLen, rest, ok := lz4ReadLength(src, int(token&0x0F))
+		if !ok {
+			return nil, ErrCorruptCompressed
+		}
+		src = rest
+		matchLen += lz4MinMatch
+		if offset == 0 || offset > len(dst) || len(dst)+matchLen > int(size) {
+			return nil, ErrCorruptCompressed
+		}
+		start := len(dst) - offset
+		for i := 0; i < matchLen; i++ {
+			dst = append(dst, dst[start+i])
 		}
 	}
 
-	return decompressed
+	if len(dst) != int(size) {
+		return nil, ErrCorruptCompressed
+	}
+	return dst, nil
+}
+
+func lz4ReadLength(src []byte, n int) (int, []byte, bool) {
+	if n < 15 {
+		return n, src, true
+	}
+	for {
+		if len(src) == 0 || n > maxDatagramSize<<10 {
+			return 0, nil, false
+		}
+		b := src[0]
+		src = src[1:]
+		n += int(b)
+		if b != 255 {
+			return n, src, true
+		}
+	}
 }
@@ -0,0 +1,249 @@
+package goudpkit
+
+import (
+	"math"
+	"time"
+)
+
+// CongestionController decides how many bytes of reliable packets may be
+// unacknowledged at once on the path to one peer. The kit serializes calls
+// to a controller, so implementations need no locking.
+type CongestionController interface {
+	// Window returns the congestion window in bytes.
+	Window() int
+	// OnAck reports bytes newly acknowledged. rtt is the round-trip time
+	// of a packet sent once, or zero when the sample would be ambiguous
+	// because the packet was retransmitted.
+	OnAck(bytes int, rtt time.Duration)
+	// OnLoss reports bytes declared lost after a retransmission timeout.
+	OnLoss(bytes int)
+}
+
+const (
+	initialWindowPackets = 10
+	minWindowPackets     = 2
+)
+
+// NewReno is additive-increase, multiplicative-decrease congestion control
+// after TCP NewReno: slow start doubles the window each round trip until
+// the first loss, after which it grows by one segment per round trip and
+// halves on loss.
+type NewReno struct {
+	mss        int
+	cwnd       float64
+	ssthresh   float64
+	lastCut    time.Time
+	recoveryRT time.Duration
+}
+
+// NewNewReno returns a NewReno controller for segments of mss bytes.
+func NewNewReno(mss int) CongestionController {
+	return &NewReno{mss: mss, cwnd: float64(initialWindowPackets * mss), ssthresh: math.Inf(1)}
+}
+
+func (c *NewReno) Window() int { return int(c.cwnd) }
+
+func (c *NewReno) OnAck(bytes int, rtt time.Duration) {
+	if rtt > 0 {
+		c.recoveryRT = rtt
+	}
+	if c.cwnd < c.ssthresh {
+		c.cwnd += float64(bytes)
+		return
+	}
+	c.cwnd += float64(c.mss) * float64(bytes) / c.cwnd
+}
+
+func (c *NewReno) OnLoss(int) {
+	// losses from one window count as a single congestion event
+	if time.Since(c.lastCut) < c.recoveryRT {
+		return
+	}
+	c.lastCut = time.Now()
+	c.ssthresh = max(c.cwnd/2, float64(minWindowPackets*c.mss))
+	c.cwnd = c.ssthresh
+}
+
+// CUBIC grows the window as a cubic function of the time since the last
+// loss, as in RFC 8312, so that it returns quickly to the window at which
+// loss last occurred and probes carefully around it.
+type CUBIC struct {
+	mss        int
+	cwnd       float64
+	ssthresh   float64
+	wMax       float64
+	k          float64
+	epoch      time.Time
+	reno       float64
+	lastCut    time.Time
+	recoveryRT time.Duration
+}
+
+const (
+	cubicC    = 0.4
+	cubicBeta = 0.7
+)
+
+// NewCUBIC returns a CUBIC controller for segments of mss bytes.
+func NewCUBIC(mss int) CongestionController {
+	return &CUBIC{mss: mss, cwnd: float64(initialWindowPackets * mss), ssthresh: math.Inf(1)}
+}
+
+func (c *CUBIC) Window() int { return int(c.cwnd) }
+
+func (c *CUBIC) OnAck(bytes int, rtt time.Duration) {
+	if rtt > 0 {
+		c.recoveryRT = rtt
+	}
+	if c.cwnd < c.ssthresh {
+		c.cwnd += float64(bytes)
+		return
+	}
+	if c.epoch.IsZero() {
+		c.epoch = time.Now()
+		c.reno = c.cwnd
+		if c.wMax < c.cwnd {
+			c.k = 0
+			c.wMax = c.cwnd
+		}
+	}
+
+	// the cubic curve, in segments, one round trip ahead
+	mss := float64(c.mss)
+	t := time.Since(c.epoch).Seconds() + c.recoveryRT.Seconds()
+	target := (cubicC*math.Pow(t-c.k, 3) + c.wMax/mss) * mss
+	// never grow slower than Reno would
+	c.reno += 3 * (1 - cubicBeta) / (1 + cubicBeta) * mss * float64(bytes) / c.cwnd
+	target = max(target, c.reno)
+	if target > c.cwnd {
+		c.cwnd += (target - c.cwnd) * float64(bytes) / c.cwnd
+	}
+}
+
+func (c *CUBIC) OnLoss(int) {
+	if time.Since(c.lastCut) < c.recoveryRT {
+		return
+	}
+	c.lastCut = time.Now()
+	c.epoch = time.Time{}
+	// fast convergence: yield bandwidth if the window stopped short of
+	// the previous maximum
+	if c.cwnd < c.wMax {
+		c.wMax = c.cwnd * (1 + cubicBeta) / 2
+	} else {
+		c.wMax = c.cwnd
+	}
+	c.cwnd = max(c.cwnd*cubicBeta, float64(minWindowPackets*c.mss))
+	c.ssthresh = c.cwnd
+	c.k = math.Cbrt(c.wMax / float64(c.mss) * (1 - cubicBeta) / cubicC)
+}
+
+// DelayBased adjusts the window from round-trip times in the manner of TCP
+// Vegas. It compares the lowest RTT seen with the current one to estimate
+// how many segments are queued in the network, growing the window while
+// fewer than Alpha are queued and shrinking it when more than Beta are, so
+// it backs off before the bottleneck queue overflows.
+type DelayBased struct {
+	mss        int
+	cwnd       float64
+	baseRTT    time.Duration
+	slowStart  bool
+	lastCut    time.Time
+	recoveryRT time.Duration
+	// Alpha and Beta are the bounds, in segments, on the queue the
+	// controller aims to keep at the bottleneck.
+	Alpha, Beta float64
+}
+
+// NewDelayBased returns a delay-based controller for segments of mss bytes.
+func NewDelayBased(mss int) CongestionController {
+	return &DelayBased{mss: mss, cwnd: float64(initialWindowPackets * mss), slowStart: true, Alpha: 2, Beta: 4}
+}
+
+func (c *DelayBased) Window() int { return int(c.cwnd) }
+
+func (c *DelayBased) OnAck(bytes int, rtt time.Duration) {
+	if rtt <= 0 {
+		return
+	}
+	c.recoveryRT = rtt
+	if c.baseRTT == 0 || rtt < c.baseRTT {
+		c.baseRTT = rtt
+	}
+	mss := float64(c.mss)
+	queued := c.cwnd / mss * (1 - float64(c.baseRTT)/float64(rtt))
+	switch {
+	case c.slowStart && queued < 1:
+		c.cwnd += float64(bytes)
+	case queued < c.Alpha:
+		c.slowStart = false
+		c.cwnd += mss * float64(bytes) / c.cwnd
+	case queued > c.Beta:
+		c.slowStart = false
+		c.cwnd = max(c.cwnd-mss*float64(bytes)/c.cwnd, float64(minWindowPackets*c.mss))
+	default:
+		c.slowStart = false
+	}
+}
+
+func (c *DelayBased) OnLoss(int) {
+	c.slowStart = false
+	if time.Since(c.lastCut) < c.recoveryRT {
+		return
+	}
+	c.lastCut = time.Now()
+	c.cwnd = max(c.cwnd/2, float64(minWindowPackets*c.mss))
+}
+
+type peerCongestion struct {
+	cc       CongestionController
+	lastUsed time.Time
+}
+
+// SetCongestionControl makes SendReliable keep the bytes unacknowledged on
+// each peer's path within the window of a controller made by
+// newController, which is passed the kit's MTU as the segment size.
+// NewNewReno, NewCUBIC and NewDelayBased can be passed directly. A nil
+// newController turns congestion control off, which is the default.
+func (kit *GoUDPKit) SetCongestionControl(newController func(mss int) CongestionController) {
+	kit.mu.Lock()
+	defer kit.mu.Unlock()
+	kit.newController = newController
+	kit.congestion = make(map[string]*peerCongestion)
+}
+
+// controller returns the congestion controller for peer, or nil if
+// congestion control is off. The caller must hold mu.
+func (kit *GoUDPKit) controller(peer string) CongestionController {
+	if kit.newController == nil {
+		return nil
+	}
+	pc, ok := kit.congestion[peer]
+	if !ok {
+		pc = &peerCongestion{cc: kit.newController(kit.mtu)}
+		kit.congestion[peer] = pc
+	}
+	pc.lastUsed = time.Now()
+	return pc.cc
+}
+
+// congestionWindow sums the windows of all peers' controllers.
+func (kit *GoUDPKit) congestionWindow() int {
+	kit.mu.Lock()
+	defer kit.mu.Unlock()
+	total := 0
+	for _, pc := range kit.congestion {
+		total += pc.cc.Window()
+	}
+	return total
+}
+
+// pruneCongestion forgets the controllers of peers idle for longer than
+// ackRetention. The caller must hold mu.
+func (kit *GoUDPKit) pruneCongestion(now time.Time) {
+	for peer, pc := range kit.congestion {
+		if now.Sub(pc.lastUsed) > ackRetention {
+			delete(kit.congestion, peer)
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package goudpkit
+
+import (
+	"context"
+	"net"
+	"os"
+	"time"
+)
+
+// SendContext is like SendPacket but returns ctx.Err() if ctx is done
+// before the packet is handed to the connection, including while a
+// handshake with addr is in progress.
+func (kit *GoUDPKit) SendContext(ctx context.Context, packet Packet, addr *net.UDPAddr) error {
+	return kit.sendData(ctx, packet, Header{}, addr)
+}
+
+// ReceiveContext is like ReceivePacket but stops waiting when ctx is done,
+// returning ctx.Err(). A deadline on ctx is applied to the connection.
+func (kit *GoUDPKit) ReceiveContext(ctx context.Context) ([]byte, *net.UDPAddr, error) {
+	packet, addr, err := kit.readPacketContext(ctx)
+	if err != nil {
+		return nil, addr, err
+	}
+	return packet.Data, addr, nil
+}
+
+func (kit *GoUDPKit) readPacketContext(ctx context.Context) (Packet, *net.UDPAddr, error) {
+	if err := ctx.Err(); err != nil {
+		return Packet{}, nil, err
+	}
+	packet, addr, err := kit.readPacket(ctx)
+	if err != nil {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return Packet{}, nil, ctxErr
+		}
+		// the connection deadline can fire just before the context's own
+		if deadline, ok := ctx.Deadline(); ok && !time.Now().Before(deadline) {
+			return Packet{}, nil, context.DeadlineExceeded
+		}
+	}
+	return packet, addr, err
+}
+
+// pendingRead is a read in progress on the kit's connection.
+type pendingRead struct {
+	deadline    time.Time
+	interrupted bool
+}
+
+func (r *pendingRead) expired(now time.Time) bool {
+	return r.interrupted || (!r.deadline.IsZero() && !now.Before(r.deadline))
+}
+
+// readFrom reads one datagram from the kit's connection, giving up with a
+// timeout error once deadline passes or ctx is done. Concurrent readers
+// share the connection's one read deadline, so it is set to the earliest
+// any of them needs, and a reader woken by another's deadline reads again.
+func (kit *GoUDPKit) readFrom(ctx context.Context, buf []byte, deadline time.Time) (int, *net.UDPAddr, error) {
+	r := &pendingRead{deadline: deadline}
+	kit.readMu.Lock()
+	kit.reads[r] = struct{}{}
+	kit.applyReadDeadline()
+	kit.readMu.Unlock()
+	stop := context.AfterFunc(ctx, func() {
+		kit.readMu.Lock()
+		r.interrupted = true
+		kit.applyReadDeadline()
+		kit.readMu.Unlock()
+	})
+	defer func() {
+		stop()
+		kit.readMu.Lock()
+		delete(kit.reads, r)
+		kit.applyReadDeadline()
+		kit.readMu.Unlock()
+	}()
+
+	for {
+		kit.readMu.Lock()
+		expired := r.expired(time.Now())
+		applied := kit.deadlinesApplied
+		kit.readMu.Unlock()
+		if expired {
+			return 0, nil, os.ErrDeadlineExceeded
+		}
+		n, addr, err := kit.conn.ReadFromUDP(buf)
+		if nerr, ok := err.(net.Error); !ok || !nerr.Timeout() {
+			return n, addr, err
+		}
+		kit.readMu.Lock()
+		// a deadline the kit never set belongs to the caller's own
+		// connection, and is passed on
+		foreign := kit.deadlinesApplied == applied && kit.readDeadline.IsZero()
+		kit.readMu.Unlock()
+		if foreign {
+			return n, addr, err
+		}
+	}
+}
+
+// applyReadDeadline sets the connection's read deadline to the earliest
+// one a pending read needs, or to the past while one is interrupted. With
+// none, it clears a deadline the kit set but leaves alone one it did not.
+// The caller must hold readMu.
+func (kit *GoUDPKit) applyReadDeadline() {
+	var earliest time.Time
+	for r := range kit.reads {
+		d := r.deadline
+		if r.interrupted {
+			d = time.Unix(1, 0)
+		}
+		if d.IsZero() {
+			continue
+		}
+		if earliest.IsZero() || d.Before(earliest) {
+			earliest = d
+		}
+	}
+	if earliest.Equal(kit.readDeadline) {
+		return
+	}
+	kit.readDeadline = earliest
+	if !earliest.IsZero() {
+		kit.deadlinesApplied++
+	}
+	kit.conn.SetReadDeadline(earliest)
+}
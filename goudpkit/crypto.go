@@ -1,13 +1,251 @@
 package goudpkit
 
-func (kit *GoUDPKit) EncryptData(data []byte, key []byte) []byte {
-	encrypted := make([]byte, len(data))
-	for i := 0; i < len(data); i++ {
-		encrypted[i] = data[i] ^ key[i%len(key)]
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+)
+
+var (
+	ErrAuthenticationFailed = errors.New("message authentication failed")
+	ErrUnencryptedPacket    = errors.New("unencrypted packet rejected")
+	ErrNoEncryptionKey      = errors.New("encrypted packet but no key configured")
+)
+
+type CipherSuite int
+
+const (
+	CipherAESGCM CipherSuite = iota + 1
+	CipherChaCha20Poly1305
+)
+
+func (c CipherSuite) String() string {
+	switch c {
+	case CipherAESGCM:
+		return "AES-GCM"
+	case CipherChaCha20Poly1305:
+		return "ChaCha20-Poly1305"
+	}
+	return fmt.Sprintf("CipherSuite(%d)", int(c))
+}
+
+// An encrypted frame carries the sender's 16-byte ID and 8-byte packet
+// number ahead of the ciphertext, and the encoded header is authenticated
+// as additional data. Under a key set with SetEncryptionKey, each sender
+// seals with its own key, derived from the shared key and its random ID
+// with HKDF-SHA256, so that kits sharing a key never share a nonce space.
+// Session keys from a handshake are already unique to a sender and are
+// used as they are. Either way the AEAD nonce is the packet number,
+// left-padded with zeros.
+const (
+	senderIDSize  = 16
+	packetNumSize = 8
+	sealPrefix    = senderIDSize + packetNumSize
+)
+
+// maxSenderKeys caps the derived keys a cipher keeps for the senders it
+// has heard from.
+const maxSenderKeys = 1024
+
+// NewAEAD returns the AEAD for suite. AES-GCM takes a 16, 24 or 32-byte key;
+// ChaCha20-Poly1305 takes a 32-byte key.
+func NewAEAD(suite CipherSuite, key []byte) (cipher.AEAD, error) {
+	switch suite {
+	case CipherAESGCM:
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		return cipher.NewGCM(block)
+	case CipherChaCha20Poly1305:
+		return chacha20poly1305.New(key)
+	}
+	return nil, fmt.Errorf("unknown cipher suite %v", suite)
+}
+
+type packetCipher struct {
+	suite CipherSuite
+	// key is the shared key per-sender keys are derived from, or nil
+	// when aead is a session key used by a single sender
+	key     []byte
+	aead    cipher.AEAD
+	id      [senderIDSize]byte
+	counter uint64
+
+	mu      sync.Mutex
+	senders map[[senderIDSize]byte]cipher.AEAD
+}
+
+// newPacketCipher returns a cipher for a key shared by any number of
+// kits.
+func newPacketCipher(suite CipherSuite, key []byte) (*packetCipher, error) {
+	if _, err := NewAEAD(suite, key); err != nil {
+		return nil, err
+	}
+	pc := &packetCipher{suite: suite, key: append([]byte(nil), key...), senders: make(map[[senderIDSize]byte]cipher.AEAD)}
+	if _, err := rand.Read(pc.id[:]); err != nil {
+		return nil, err
+	}
+	aead, err := pc.deriveAEAD(pc.id)
+	if err != nil {
+		return nil, err
+	}
+	pc.aead = aead
+	return pc, nil
+}
+
+// newSessionCipher returns a cipher for a key only one sender uses.
+func newSessionCipher(suite CipherSuite, key []byte) (*packetCipher, error) {
+	aead, err := NewAEAD(suite, key)
+	if err != nil {
+		return nil, err
+	}
+	pc := &packetCipher{suite: suite, aead: aead}
+	if _, err := rand.Read(pc.id[:]); err != nil {
+		return nil, err
+	}
+	return pc, nil
+}
+
+// deriveAEAD returns the AEAD of the sender with the given ID.
+func (pc *packetCipher) deriveAEAD(id [senderIDSize]byte) (cipher.AEAD, error) {
+	k := make([]byte, len(pc.key))
+	if _, err := io.ReadFull(hkdf.New(sha256.New, pc.key, id[:], []byte("goudpkit sender key")), k); err != nil {
+		return nil, err
+	}
+	return NewAEAD(pc.suite, k)
+}
+
+// senderAEAD returns the AEAD that opens frames from the sender with the
+// given ID, and whether it was newly derived and not yet cached.
+func (pc *packetCipher) senderAEAD(id [senderIDSize]byte) (cipher.AEAD, bool, error) {
+	if pc.key == nil {
+		return pc.aead, false, nil
+	}
+	pc.mu.Lock()
+	aead, ok := pc.senders[id]
+	pc.mu.Unlock()
+	if ok {
+		return aead, false, nil
 	}
-	return encrypted
+	aead, err := pc.deriveAEAD(id)
+	return aead, err == nil, err
 }
 
-func (kit *GoUDPKit) DecryptData(data []byte, key []byte) []byte {
-	return kit.EncryptData(data, key)
+// remember caches the AEAD of a sender whose frame it opened, forgetting
+// another sender when the cache is full.
+func (pc *packetCipher) remember(id [senderIDSize]byte, aead cipher.AEAD) {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	if len(pc.senders) >= maxSenderKeys {
+		for k := range pc.senders {
+			delete(pc.senders, k)
+			break
+		}
+	}
+	pc.senders[id] = aead
+}
+
+func (pc *packetCipher) overhead() int {
+	return sealPrefix + pc.aead.Overhead()
+}
+
+func (pc *packetCipher) nonce(pn []byte) []byte {
+	nonce := make([]byte, pc.aead.NonceSize())
+	copy(nonce[len(nonce)-packetNumSize:], pn)
+	return nonce
+}
+
+// seal appends the encrypted payload to dst, which must hold the encoded
+// header. The caller must serialise calls.
+func (pc *packetCipher) seal(dst, payload []byte) []byte {
+	pc.counter++
+	header := dst
+	dst = append(dst, pc.id[:]...)
+	dst = binary.BigEndian.AppendUint64(dst, pc.counter)
+	nonce := pc.nonce(dst[len(header)+senderIDSize:])
+	return pc.aead.Seal(dst, nonce, payload, header)
+}
+
+// open authenticates and decrypts the payload of an encrypted frame and
+// returns the plaintext with the sender's packet number.
+func (pc *packetCipher) open(header, sealed []byte) ([]byte, uint64, error) {
+	if len(sealed) < sealPrefix+pc.aead.Overhead() {
+		return nil, 0, ErrAuthenticationFailed
+	}
+	var id [senderIDSize]byte
+	copy(id[:], sealed)
+	aead, derived, err := pc.senderAEAD(id)
+	if err != nil {
+		return nil, 0, ErrAuthenticationFailed
+	}
+	pn := sealed[senderIDSize:sealPrefix]
+	plain, err := aead.Open(nil, pc.nonce(pn), sealed[sealPrefix:], header)
+	if err != nil {
+		return nil, 0, ErrAuthenticationFailed
+	}
+	if derived {
+		pc.remember(id, aead)
+	}
+	return plain, binary.BigEndian.Uint64(pn), nil
+}
+
+// SetEncryptionKey enables authenticated encryption of every frame the kit
+// sends and requires it on every frame it receives. Both peers must use the
+// same suite and key.
+func (kit *GoUDPKit) SetEncryptionKey(suite CipherSuite, key []byte) error {
+	pc, err := newPacketCipher(suite, key)
+	if err != nil {
+		return err
+	}
+	kit.mu.Lock()
+	kit.cipher = pc
+	kit.mu.Unlock()
+	return nil
+}
+
+// EncryptData seals data with AES-256-GCM under a key derived from key by
+// SHA-256. The random nonce is prepended to the result.
+func (kit *GoUDPKit) EncryptData(data []byte, key []byte) ([]byte, error) {
+	aead, err := dataAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(data)+aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, data, nil), nil
+}
+
+func (kit *GoUDPKit) DecryptData(data []byte, key []byte) ([]byte, error) {
+	aead, err := dataAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < aead.NonceSize()+aead.Overhead() {
+		return nil, ErrAuthenticationFailed
+	}
+	plain, err := aead.Open(nil, data[:aead.NonceSize()], data[aead.NonceSize():], nil)
+	if err != nil {
+		return nil, ErrAuthenticationFailed
+	}
+	return plain, nil
+}
+
+func dataAEAD(key []byte) (cipher.AEAD, error) {
+	if len(key) == 0 {
+		return nil, errors.New("empty encryption key")
+	}
+	sum := sha256.Sum256(key)
+	return NewAEAD(CipherAESGCM, sum[:])
 }
@@ -0,0 +1,290 @@
+package goudpkit
+
+import (
+	"container/heap"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+// A LossModel decides, packet by packet, whether to drop. Models may keep
+// state between calls, so give each direction its own instance.
+type LossModel interface {
+	Lose(rng *rand.Rand) bool
+}
+
+// BernoulliLoss drops each packet independently with probability P.
+type BernoulliLoss struct {
+	P float64
+}
+
+func (b BernoulliLoss) Lose(rng *rand.Rand) bool {
+	return rng.Float64() < b.P
+}
+
+// GilbertElliott is a two-state burst-loss model. Packets are lost with
+// probability LossGood in the good state and LossBad in the bad state.
+// After each packet the model moves from good to bad with probability P
+// and from bad to good with probability R.
+type GilbertElliott struct {
+	P, R              float64
+	LossGood, LossBad float64
+
+	bad bool
+}
+
+// BurstLoss returns a Gilbert-Elliott model that loses every packet in the
+// bad state and none in the good one, with the given long-run loss rate and
+// mean burst length in packets.
+func BurstLoss(loss, meanBurst float64) *GilbertElliott {
+	if meanBurst < 1 {
+		meanBurst = 1
+	}
+	r := 1 / meanBurst
+	p := 1.0
+	if loss < 1 {
+		p = min(loss*r/(1-loss), 1)
+	}
+	return &GilbertElliott{P: p, R: r, LossBad: 1}
+}
+
+func (g *GilbertElliott) Lose(rng *rand.Rand) bool {
+	loss := g.LossGood
+	if g.bad {
+		loss = g.LossBad
+	}
+	lost := rng.Float64() < loss
+	if g.bad {
+		g.bad = rng.Float64() >= g.R
+	} else {
+		g.bad = rng.Float64() < g.P
+	}
+	return lost
+}
+
+// FaultProfile describes the faults applied to one direction of traffic.
+// The zero value passes everything through untouched.
+type FaultProfile struct {
+	// Loss is nil for no loss.
+	Loss LossModel
+	// Delay holds each packet back, plus a uniformly random extra of up
+	// to Jitter.
+	Delay  time.Duration
+	Jitter time.Duration
+	// Reorder is the probability that a packet is held back by a further
+	// ReorderDelay, letting later packets overtake it.
+	Reorder      float64
+	ReorderDelay time.Duration
+	// Duplicate is the probability that a packet is passed on twice.
+	Duplicate float64
+}
+
+type FaultConfig struct {
+	Outbound FaultProfile
+	Inbound  FaultProfile
+	// Seed seeds the random choices. Zero seeds from the clock.
+	Seed int64
+}
+
+type FaultStats struct {
+	OutboundDropped uint64
+	InboundDropped  uint64
+	Delayed         uint64
+	Reordered       uint64
+	Duplicated      uint64
+}
+
+// FaultConn wraps a UDPConn and injects loss, delay, reordering and
+// duplication into the datagrams passing through it, in either direction.
+// Pass it to NewGoUDPKit in place of the real connection.
+type FaultConn struct {
+	UDPConn
+
+	mu       sync.Mutex
+	rng      *rand.Rand
+	cfg      FaultConfig
+	stats    FaultStats
+	held     heldDatagrams
+	heldSeq  uint64
+	deadline time.Time
+	closed   bool
+}
+
+func NewFaultConn(conn UDPConn, cfg FaultConfig) *FaultConn {
+	seed := cfg.Seed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	return &FaultConn{UDPConn: conn, rng: rand.New(rand.NewSource(seed)), cfg: cfg}
+}
+
+// SetConfig replaces the fault profiles. The random source is kept.
+func (c *FaultConn) SetConfig(cfg FaultConfig) {
+	c.mu.Lock()
+	c.cfg = cfg
+	c.mu.Unlock()
+}
+
+func (c *FaultConn) Stats() FaultStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.stats
+}
+
+// fate decides what happens to one datagram: whether it is dropped, and
+// otherwise the delay of each copy to pass on. The caller must hold mu.
+func (c *FaultConn) fate(p FaultProfile) (delays []time.Duration, dropped bool) {
+	if p.Loss != nil && p.Loss.Lose(c.rng) {
+		return nil, true
+	}
+	copies := 1
+	if p.Duplicate > 0 && c.rng.Float64() < p.Duplicate {
+		copies = 2
+		c.stats.Duplicated++
+	}
+	for i := 0; i < copies; i++ {
+		d := p.Delay
+		if p.Jitter > 0 {
+			d += time.Duration(c.rng.Int63n(int64(p.Jitter) + 1))
+		}
+		if p.Reorder > 0 && c.rng.Float64() < p.Reorder {
+			d += p.ReorderDelay
+			c.stats.Reordered++
+		}
+		if d > 0 {
+			c.stats.Delayed++
+		}
+		delays = append(delays, d)
+	}
+	return delays, false
+}
+
+// WriteToUDP reports success for dropped and delayed datagrams, as a real
+// network would.
+func (c *FaultConn) WriteToUDP(b []byte, addr *net.UDPAddr) (int, error) {
+	c.mu.Lock()
+	delays, dropped := c.fate(c.cfg.Outbound)
+	if dropped {
+		c.stats.OutboundDropped++
+	}
+	c.mu.Unlock()
+
+	for _, d := range delays {
+		if d == 0 {
+			if _, err := c.UDPConn.WriteToUDP(b, addr); err != nil {
+				return 0, err
+			}
+			continue
+		}
+		data := append([]byte(nil), b...)
+		time.AfterFunc(d, func() {
+			c.mu.Lock()
+			closed := c.closed
+			c.mu.Unlock()
+			if !closed {
+				c.UDPConn.WriteToUDP(data, addr)
+			}
+		})
+	}
+	return len(b), nil
+}
+
+// ReadFromUDP returns the next datagram that survives the inbound profile.
+// Delayed datagrams are held and returned once their delay has passed.
+func (c *FaultConn) ReadFromUDP(b []byte) (int, *net.UDPAddr, error) {
+	for {
+		c.mu.Lock()
+		now := time.Now()
+		if len(c.held) > 0 && !c.held[0].at.After(now) {
+			d := heap.Pop(&c.held).(heldDatagram)
+			c.mu.Unlock()
+			return copy(b, d.data), d.from, nil
+		}
+		deadline := c.deadline
+		if len(c.held) > 0 && (deadline.IsZero() || c.held[0].at.Before(deadline)) {
+			deadline = c.held[0].at
+		}
+		c.mu.Unlock()
+
+		c.UDPConn.SetReadDeadline(deadline)
+		n, from, err := c.UDPConn.ReadFromUDP(b)
+		if err != nil {
+			if nerr, ok := err.(net.Error); ok && nerr.Timeout() && c.heldDue() {
+				continue
+			}
+			return 0, nil, err
+		}
+
+		c.mu.Lock()
+		delays, dropped := c.fate(c.cfg.Inbound)
+		if dropped {
+			c.stats.InboundDropped++
+			c.mu.Unlock()
+			continue
+		}
+		immediate := false
+		for _, d := range delays {
+			if d == 0 && !immediate {
+				immediate = true
+				continue
+			}
+			c.heldSeq++
+			heap.Push(&c.held, heldDatagram{data: append([]byte(nil), b[:n]...), from: from, at: time.Now().Add(d), seq: c.heldSeq})
+		}
+		c.mu.Unlock()
+		if immediate {
+			return n, from, nil
+		}
+	}
+}
+
+// heldDue reports whether a held datagram is ready, as opposed to the
+// caller's own deadline having passed.
+func (c *FaultConn) heldDue() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.held) > 0 && !c.held[0].at.After(time.Now())
+}
+
+func (c *FaultConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.deadline = t
+	if len(c.held) > 0 && (t.IsZero() || c.held[0].at.Before(t)) {
+		t = c.held[0].at
+	}
+	c.mu.Unlock()
+	return c.UDPConn.SetReadDeadline(t)
+}
+
+func (c *FaultConn) Close() error {
+	c.mu.Lock()
+	c.closed = true
+	c.mu.Unlock()
+	return c.UDPConn.Close()
+}
+
+type heldDatagram struct {
+	data []byte
+	from *net.UDPAddr
+	at   time.Time
+	seq  uint64
+}
+
+type heldDatagrams []heldDatagram
+
+func (h heldDatagrams) Len() int { return len(h) }
+func (h heldDatagrams) Less(i, j int) bool {
+	if h[i].at.Equal(h[j].at) {
+		return h[i].seq < h[j].seq
+	}
+	return h[i].at.Before(h[j].at)
+}
+func (h heldDatagrams) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+func (h *heldDatagrams) Push(x any)   { *h = append(*h, x.(heldDatagram)) }
+func (h *heldDatagrams) Pop() any {
+	old := *h
+	d := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return d
+}
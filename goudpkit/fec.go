@@ -0,0 +1,305 @@
+package goudpkit
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+)
+
+var ErrBadFECConfig = errors.New("invalid FEC configuration")
+
+type FECScheme uint8
+
+const (
+	FECNone FECScheme = iota
+	// FECXOR adds one parity chunk per block and repairs one loss.
+	FECXOR
+	// FECReedSolomon adds ParityShards chunks per block and repairs up to
+	// that many losses.
+	FECReedSolomon
+)
+
+func (s FECScheme) String() string {
+	switch s {
+	case FECNone:
+		return "none"
+	case FECXOR:
+		return "xor"
+	case FECReedSolomon:
+		return "reed-solomon"
+	}
+	return fmt.Sprintf("FECScheme(%d)", uint8(s))
+}
+
+// FECConfig adds repair chunks to bulk transfers so the receiver can
+// rebuild lost chunks without a round trip. Each block of DataShards data
+// chunks is followed by ParityShards repair chunks; any DataShards of the
+// block's chunks are enough to recover it.
+type FECConfig struct {
+	Scheme       FECScheme
+	DataShards   int
+	ParityShards int
+}
+
+// normalize checks cfg and fills in the parity count XOR implies.
+func (cfg FECConfig) normalize() (FECConfig, error) {
+	switch cfg.Scheme {
+	case FECNone:
+		return FECConfig{}, nil
+	case FECXOR:
+		if cfg.ParityShards == 0 {
+			cfg.ParityShards = 1
+		}
+		if cfg.ParityShards != 1 {
+			return cfg, fmt.Errorf("%w: XOR has exactly one parity shard", ErrBadFECConfig)
+		}
+	case FECReedSolomon:
+		if cfg.ParityShards < 1 {
+			return cfg, fmt.Errorf("%w: no parity shards", ErrBadFECConfig)
+		}
+	default:
+		return cfg, fmt.Errorf("%w: unknown scheme %v", ErrBadFECConfig, cfg.Scheme)
+	}
+	if cfg.DataShards < 1 || cfg.DataShards+cfg.ParityShards > 255 {
+		return cfg, fmt.Errorf("%w: %d+%d shards", ErrBadFECConfig, cfg.DataShards, cfg.ParityShards)
+	}
+	return cfg, nil
+}
+
+// SetFEC sets the forward error correction used by SendBulkData. A zero
+// config turns it off.
+func (kit *GoUDPKit) SetFEC(cfg FECConfig) error {
+	cfg, err := cfg.normalize()
+	if err != nil {
+		return err
+	}
+	kit.mu.Lock()
+	kit.fec = cfg
+	kit.mu.Unlock()
+	return nil
+}
+
+// fecEncode returns the parity shards for data, whose shards must all be
+// the same length.
+func fecEncode(cfg FECConfig, data [][]byte) [][]byte {
+	size := len(data[0])
+	parity := make([][]byte, cfg.ParityShards)
+	for i := range parity {
+		parity[i] = make([]byte, size)
+	}
+	if cfg.Scheme == FECXOR {
+		for _, d := range data {
+			xorInto(parity[0], d)
+		}
+		return parity
+	}
+	rows := rsParityRows(len(data), cfg.ParityShards)
+	for i, row := range rows {
+		for j, d := range data {
+			gfMulAddInto(parity[i], d, row[j])
+		}
+	}
+	return parity
+}
+
+// fecReconstruct fills in the nil entries of data from the surviving data
+// and parity shards, all of length size. It reports false if too few
+// shards survive.
+func fecReconstruct(cfg FECConfig, data, parity [][]byte, size int) bool {
+	var missing []int
+	for i, d := range data {
+		if d == nil {
+			missing = append(missing, i)
+		}
+	}
+	if len(missing) == 0 {
+		return true
+	}
+
+	if cfg.Scheme == FECXOR {
+		if len(missing) > 1 || parity[0] == nil {
+			return false
+		}
+		out := append([]byte(nil), parity[0]...)
+		for _, d := range data {
+			if d != nil {
+				xorInto(out, d)
+			}
+		}
+		data[missing[0]] = out
+		return true
+	}
+
+	// Pick len(data) surviving shards, data first, and invert the rows of
+	// the encoding matrix that produced them.
+	n := len(data)
+	rows := rsParityRows(n, len(parity))
+	var sub [][]byte
+	var shards [][]byte
+	for i, d := range data {
+		if d != nil {
+			row := make([]byte, n)
+			row[i] = 1
+			sub = append(sub, row)
+			shards = append(shards, d)
+		}
+	}
+	for i, p := range parity {
+		if len(sub) == n {
+			break
+		}
+		if p != nil {
+			sub = append(sub, rows[i])
+			shards = append(shards, p)
+		}
+	}
+	if len(sub) < n {
+		return false
+	}
+	inv, ok := gfInvertMatrix(sub)
+	if !ok {
+		return false
+	}
+	for _, i := range missing {
+		out := make([]byte, size)
+		for j, s := range shards {
+			gfMulAddInto(out, s, inv[i][j])
+		}
+		data[i] = out
+	}
+	return true
+}
+
+func xorInto(dst, src []byte) {
+	for i := range src {
+		dst[i] ^= src[i]
+	}
+}
+
+// GF(2^8) arithmetic over the polynomial x^8+x^4+x^3+x^2+1.
+var gfExp, gfLog = func() ([510]byte, [256]byte) {
+	var exp [510]byte
+	var log [256]byte
+	x := 1
+	for i := 0; i < 255; i++ {
+		exp[i] = byte(x)
+		log[x] = byte(i)
+		x <<= 1
+		if x&0x100 != 0 {
+			x ^= 0x11d
+		}
+	}
+	for i := 255; i < 510; i++ {
+		exp[i] = exp[i-255]
+	}
+	return exp, log
+}()
+
+func gfMul(a, b byte) byte {
+	if a == 0 || b == 0 {
+		return 0
+	}
+	return gfExp[int(gfLog[a])+int(gfLog[b])]
+}
+
+func gfInv(a byte) byte {
+	return gfExp[255-int(gfLog[a])]
+}
+
+func gfPow(a byte, e int) byte {
+	if e == 0 {
+		return 1
+	}
+	if a == 0 {
+		return 0
+	}
+	return gfExp[int(gfLog[a])*e%255]
+}
+
+func gfMulAddInto(dst, src []byte, c byte) {
+	if c == 0 {
+		return
+	}
+	for i, s := range src {
+		dst[i] ^= gfMul(s, c)
+	}
+}
+
+// gfInvertMatrix inverts a square matrix by Gauss-Jordan elimination.
+func gfInvertMatrix(m [][]byte) ([][]byte, bool) {
+	n := len(m)
+	a := make([][]byte, n)
+	for i := range m {
+		a[i] = make([]byte, 2*n)
+		copy(a[i], m[i])
+		a[i][n+i] = 1
+	}
+	for col := 0; col < n; col++ {
+		pivot := -1
+		for r := col; r < n; r++ {
+			if a[r][col] != 0 {
+				pivot = r
+				break
+			}
+		}
+		if pivot < 0 {
+			return nil, false
+		}
+		a[col], a[pivot] = a[pivot], a[col]
+		scale := gfInv(a[col][col])
+		for j := range a[col] {
+			a[col][j] = gfMul(a[col][j], scale)
+		}
+		for r := 0; r < n; r++ {
+			if r != col && a[r][col] != 0 {
+				gfMulAddInto(a[r], a[col], a[r][col])
+			}
+		}
+	}
+	inv := make([][]byte, n)
+	for i := range a {
+		inv[i] = a[i][n:]
+	}
+	return inv, true
+}
+
+type rsKey struct{ data, parity int }
+
+var rsCache sync.Map // rsKey -> [][]byte
+
+// rsParityRows returns the parity rows of a systematic Reed-Solomon
+// encoding matrix: a Vandermonde matrix multiplied by the inverse of its
+// top square, so that the data rows become the identity.
+func rsParityRows(data, parity int) [][]byte {
+	key := rsKey{data, parity}
+	if rows, ok := rsCache.Load(key); ok {
+		return rows.([][]byte)
+	}
+	vander := func(r int) []byte {
+		row := make([]byte, data)
+		for c := range row {
+			row[c] = gfPow(byte(r), c)
+		}
+		return row
+	}
+	top := make([][]byte, data)
+	for r := range top {
+		top[r] = vander(r)
+	}
+	topInv, _ := gfInvertMatrix(top)
+
+	rows := make([][]byte, parity)
+	for i := range rows {
+		v := vander(data + i)
+		rows[i] = make([]byte, data)
+		for c := 0; c < data; c++ {
+			var x byte
+			for k := 0; k < data; k++ {
+				x ^= gfMul(v[k], topInv[k][c])
+			}
+			rows[i][c] = x
+		}
+	}
+	rsCache.Store(key, rows)
+	return rows
+}
@@ -0,0 +1,106 @@
+package goudpkit
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+)
+
+const (
+	// DefaultReceiveWindow is the receive window, in packets, of a kit
+	// whose BufferConfig sets neither ReceiveWindow nor MaxBufferSize.
+	DefaultReceiveWindow = 256
+	// DefaultSendWindow is the credit SendReliable assumes for a peer
+	// that has not yet advertised a window.
+	DefaultSendWindow = 8
+)
+
+// windowUpdate remembers the last packet acknowledged to a peer that was
+// told the receive window had closed.
+type windowUpdate struct {
+	addr  *net.UDPAddr
+	epoch uint32
+	seq   uint32
+}
+
+// receiveWindow returns the number of packets the kit offers to buffer for
+// its application.
+func (kit *GoUDPKit) receiveWindow() int {
+	window := kit.bufferConfig.ReceiveWindow
+	if window <= 0 {
+		window = DefaultReceiveWindow
+		if kit.bufferConfig.MaxBufferSize > 0 {
+			window = kit.bufferConfig.MaxBufferSize
+		}
+	}
+	if limit := kit.bufferConfig.MaxBufferSize; limit > 0 && window > limit {
+		window = limit
+	}
+	return window
+}
+
+// buffered returns the number of packets read but not yet taken by
+// ReceivePacket or a Serve handler. The caller must hold mu.
+func (kit *GoUDPKit) buffered() int {
+	return len(kit.inbox) + kit.serving
+}
+
+// receiveCredit returns how many more packets the kit has room for. The
+// caller must hold mu.
+func (kit *GoUDPKit) receiveCredit() int {
+	return max(kit.receiveWindow()-kit.buffered(), 0)
+}
+
+// bufferFull reports whether MaxBufferSize packets are already buffered,
+// in which case a data packet from addr is dropped unacknowledged and the
+// peer is sent a window update once there is room.
+func (kit *GoUDPKit) bufferFull(addr *net.UDPAddr, h Header) bool {
+	kit.mu.Lock()
+	defer kit.mu.Unlock()
+	if kit.bufferConfig.MaxBufferSize <= 0 || kit.buffered() < kit.bufferConfig.MaxBufferSize {
+		return false
+	}
+	if h.Flags&FlagAckRequested != 0 {
+		kit.closedWindows[addr.String()] = windowUpdate{addr: addr, epoch: h.MessageID, seq: h.SequenceNumber}
+	}
+	return true
+}
+
+// sendWindowUpdates acknowledges again to every peer told the window had
+// closed, once at least half of it is free, so that their senders resume.
+func (kit *GoUDPKit) sendWindowUpdates() {
+	kit.mu.Lock()
+	if len(kit.closedWindows) == 0 || 2*kit.receiveCredit() < kit.receiveWindow() {
+		kit.mu.Unlock()
+		return
+	}
+	updates := kit.closedWindows
+	kit.closedWindows = make(map[string]windowUpdate)
+	kit.mu.Unlock()
+
+	for _, u := range updates {
+		kit.sendAck(u.addr, u.epoch, u.seq, 0)
+	}
+}
+
+// sendCredit returns how many packets SendReliable may have unacknowledged
+// to peer: the window the peer last advertised, or SendWindow until it
+// has advertised one. The caller must hold mu.
+func (kit *GoUDPKit) sendCredit(peer string) int {
+	if w, ok := kit.peerWindows[peer]; ok {
+		return w
+	}
+	if kit.bufferConfig.SendWindow > 0 {
+		return kit.bufferConfig.SendWindow
+	}
+	return DefaultSendWindow
+}
+
+// splitWindow separates the receive window from the selective
+// acknowledgement blocks of an ack carrying FlagWindow.
+func splitWindow(payload []byte) (int, []byte, error) {
+	if len(payload) < 4 {
+		return 0, nil, errors.New("malformed acknowledgement")
+	}
+	return int(binary.BigEndian.Uint32(payload)), payload[4:], nil
+}
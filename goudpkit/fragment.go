@@ -0,0 +1,171 @@
+package goudpkit
+
+import (
+	"context"
+	"errors"
+	"math"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultMTU is the default largest datagram, header included, that
+// SendMessage emits. It stays below the IPv6 minimum MTU once IP and UDP
+// headers are added.
+const DefaultMTU = 1200
+
+const maxDatagramSize = 65507
+
+// DefaultMaxPartialMessages is the number of messages the kit reassembles
+// at once when BufferConfig.MaxPartialMessages is zero.
+const DefaultMaxPartialMessages = 64
+
+type messageKey struct {
+	peer string
+	id   uint32
+}
+
+// partialMessage holds the fragments of a message received so far. They are
+// kept in a map, so that a message announcing many fragments costs no more
+// than the fragments that actually arrive.
+type partialMessage struct {
+	count     uint16
+	fragments map[uint16][]byte
+	received  int
+	size      int
+	firstSeen time.Time
+}
+
+// SetMTU sets the largest datagram, header included, that SendMessage emits.
+func (kit *GoUDPKit) SetMTU(mtu int) error {
+	if mtu <= HeaderSize || mtu > maxDatagramSize {
+		return errors.New("mtu out of range")
+	}
+	kit.mu.Lock()
+	kit.mtu = mtu
+	kit.mu.Unlock()
+	return nil
+}
+
+// SendMessage sends data to addr as a single message, splitting it into
+// fragments that fit the kit's MTU. The receiver reassembles the fragments
+// in any order and delivers the message as a whole. The message is
+// compressed with the kit's codec first when that makes it smaller.
+func (kit *GoUDPKit) SendMessage(data []byte, addr *net.UDPAddr) error {
+	kit.mu.Lock()
+	codec := kit.codec
+	kit.mu.Unlock()
+	return kit.SendMessageWithCodec(data, codec, addr)
+}
+
+// SendMessageWithCodec is like SendMessage but compresses with codec
+// instead of the kit's codec. A nil codec sends the message uncompressed.
+func (kit *GoUDPKit) SendMessageWithCodec(data []byte, codec Codec, addr *net.UDPAddr) error {
+	var flags HeaderFlags
+	data, compressed := compressPayload(codec, data)
+	if compressed {
+		flags |= FlagCompressed
+	}
+
+	overhead := kit.frameOverhead(addr)
+	kit.mu.Lock()
+	chunk := kit.mtu - overhead
+	kit.mu.Unlock()
+	if chunk <= 0 {
+		return errors.New("mtu too small for frame overhead")
+	}
+
+	count := (len(data) + chunk - 1) / chunk
+	if count == 0 {
+		count = 1
+	}
+	if count > math.MaxUint16 {
+		return errors.New("message too large")
+	}
+
+	id := atomic.AddUint32(&kit.nextMessageID, 1)
+	for i := 0; i < count; i++ {
+		start := i * chunk
+		end := start + chunk
+		if end > len(data) {
+			end = len(data)
+		}
+		h := Header{
+			Type:           PacketTypeData,
+			Flags:          flags | FlagFragment,
+			SequenceNumber: atomic.AddUint32(&kit.nextFragmentSeq, 1),
+			MessageID:      id,
+			FragmentIndex:  uint16(i),
+			FragmentCount:  uint16(count),
+		}
+		if err := kit.writeFrame(context.Background(), h, data[start:end], addr); err != nil {
+			return err
+		}
+		kit.stats.inc(statPacketsSent)
+	}
+	return nil
+}
+
+// ReceiveMessage returns the next complete message. Messages sent with
+// SendMessage are reassembled before being returned; packets sent with
+// SendPacket are returned as single-datagram messages.
+func (kit *GoUDPKit) ReceiveMessage() ([]byte, *net.UDPAddr, error) {
+	return kit.ReceivePacket()
+}
+
+// addFragment stores one fragment and returns the whole message once every
+// fragment has arrived. Fragments of a message completed within the last
+// FlushInterval are duplicates and are dropped, as are fragments that
+// would start a message beyond MaxPartialMessages.
+func (kit *GoUDPKit) addFragment(h Header, payload []byte, addr *net.UDPAddr) ([]byte, bool) {
+	if h.FragmentCount == 0 || h.FragmentIndex >= h.FragmentCount {
+		kit.stats.inc(statPacketsDropped)
+		return nil, false
+	}
+
+	kit.mu.Lock()
+	defer kit.mu.Unlock()
+
+	key := messageKey{peer: addr.String(), id: h.MessageID}
+	if _, done := kit.completedMessages[key]; done {
+		kit.stats.inc(statPacketsDropped)
+		return nil, false
+	}
+	msg, exists := kit.reassemblyQueue[key]
+	if exists && msg.count != h.FragmentCount {
+		kit.stats.inc(statPacketsDropped)
+		return nil, false
+	}
+	if exists && msg.fragments[h.FragmentIndex] != nil {
+		return nil, false
+	}
+	if kit.bufferConfig.MaxBufferSize > 0 && kit.bufferedFrags >= kit.bufferConfig.MaxBufferSize {
+		kit.stats.inc(statPacketsDropped)
+		return nil, false
+	}
+	if !exists {
+		if len(kit.reassemblyQueue) >= kit.maxPartialMessages() {
+			kit.stats.inc(statPacketsDropped)
+			return nil, false
+		}
+		msg = &partialMessage{count: h.FragmentCount, fragments: make(map[uint16][]byte), firstSeen: time.Now()}
+		kit.reassemblyQueue[key] = msg
+	}
+
+	msg.fragments[h.FragmentIndex] = append([]byte{}, payload...)
+	msg.received++
+	msg.size += len(payload)
+	kit.bufferedFrags++
+
+	data := kit.tryReassemble(key)
+	return data, data != nil
+}
+
+// maxPartialMessages returns the number of messages that may be partly
+// reassembled at once. The caller must hold mu.
+func (kit *GoUDPKit) maxPartialMessages() int {
+	if kit.bufferConfig.MaxPartialMessages > 0 {
+		return kit.bufferConfig.MaxPartialMessages
+	}
+	return DefaultMaxPartialMessages
+}
@@ -1,13 +1,25 @@
 package goudpkit
 
 import (
+	"context"
+	"crypto/rand"
 	"encoding/binary"
 	"errors"
+	"fmt"
 	"net"
 	"sync"
 	"time"
 )
 
+// ErrClosed is returned by calls made on a kit after Close.
+var ErrClosed = errors.New("kit is closed")
+
+// DefaultFlushInterval is used when BufferConfig.FlushInterval is zero.
+const DefaultFlushInterval = 2 * time.Second
+
+// minFlushTick keeps a tiny FlushInterval from spinning the flush loop.
+const minFlushTick = 10 * time.Millisecond
+
 type UDPConn interface {
 	WriteToUDP(b []byte, addr *net.UDPAddr) (int, error)
 	ReadFromUDP(b []byte) (int, *net.UDPAddr, error)
@@ -18,12 +30,84 @@ type UDPConn interface {
 
 type GoUDPKit struct {
 	conn            UDPConn
-	reassemblyQueue map[uint32]*Packet
+	reassemblyQueue map[messageKey]*partialMessage
 	retryConfig     RetryConfig
 	qosConfig       QoSConfig
 	bufferConfig    BufferConfig
-	stats           Stats
+	stats           statCounters
+	started         time.Time
+	latency         [numLatencyKinds]*histogram
 	mu              sync.Mutex
+
+	// readMu guards the read deadline shared by concurrent readers
+	readMu           sync.Mutex
+	reads            map[*pendingRead]struct{}
+	readDeadline     time.Time
+	deadlinesApplied uint64
+
+	received  map[messageKey]map[uint32]time.Time
+	ackWait   map[string]*reliableSend
+	nextEpoch uint32
+	inbox     []inboundPacket
+	serving   int
+
+	peerWindows   map[string]int
+	closedWindows map[string]windowUpdate
+
+	// completedMessages remembers recently reassembled messages, so that
+	// late duplicates of their fragments are dropped
+	completedMessages map[messageKey]time.Time
+
+	mtu             int
+	nextMessageID   uint32
+	nextFragmentSeq uint32
+	bufferedFrags   int
+
+	sched     *scheduler
+	done      chan struct{}
+	closed    chan struct{}
+	closeOnce sync.Once
+	wg        sync.WaitGroup
+	unsent    []Packet
+	unsentErr error
+
+	cipher    *packetCipher
+	handshake *handshakeState
+
+	replayWindowSize int
+	replayWindows    map[replayKey]*replayWindow
+
+	codec           Codec
+	maxDecompressed int
+
+	fec            FECConfig
+	nextTransferID uint32
+	bulkTransfers  map[messageKey]*bulkTransfer
+	bulkFinished   map[messageKey]finishedTransfer
+	bulkDone       []bulkResult
+	manifestAcks   map[messageKey]*manifestAck
+	transferDir    string
+	transferLimits TransferLimits
+	// transferReplace lets received files replace existing ones
+	transferReplace bool
+
+	newController func(mss int) CongestionController
+	congestion    map[string]*peerCongestion
+
+	pacing     PacingConfig
+	kitPacer   *pacer
+	peerPacers map[string]*pacer
+
+	sessionConfig  SessionConfig
+	sessions       map[ConnectionID]*Session
+	acceptQueue    []*Session
+	closedSessions map[ConnectionID]closedSession
+	resetWindow    time.Time
+	resetsSent     int
+
+	keepalive        KeepaliveConfig
+	keepaliveChanged chan struct{}
+	peers            map[string]*peerState
 }
 
 type RetryConfig struct {
@@ -34,21 +118,42 @@ type RetryConfig struct {
 
 type QoSConfig struct {
 	PriorityLevels int
+	// PriorityQueues is kept for compatibility. Its length sets the number
+	// of levels when PriorityLevels is zero.
 	PriorityQueues [][]Packet
+	Policy         SchedulingPolicy
+	// Weights gives each level's share under WeightedFair. Missing or
+	// non-positive entries count as 1.
+	Weights []int
+	// QueueLimits caps how many packets wait at each level. Missing or
+	// non-positive entries mean no limit.
+	QueueLimits []int
 }
 
 type BufferConfig struct {
+	// MaxBufferSize caps the number of fragments held for reassembly, and
+	// the number of packets read but not yet taken by ReceivePacket or a
+	// Serve handler. Packets beyond it are dropped unacknowledged. Zero or
+	// less means no limit.
 	MaxBufferSize int
+	// ReceiveWindow is the number of packets the kit advertises room for
+	// in its acknowledgements, less those it is holding. Senders using
+	// SendReliable keep no more than that unacknowledged. Zero means
+	// MaxBufferSize, or DefaultReceiveWindow if that is not set either.
+	ReceiveWindow int
+	// SendWindow is the number of packets SendReliable sends to a peer
+	// before the peer first advertises its receive window. Zero means
+	// DefaultSendWindow.
+	SendWindow int
+	// MaxPartialMessages caps the number of messages being reassembled
+	// at once. Fragments that would start another are dropped. Zero
+	// means DefaultMaxPartialMessages.
+	MaxPartialMessages int
+	// FlushInterval is how long a partial message may wait for its missing
+	// fragments. Zero means DefaultFlushInterval.
 	FlushInterval time.Duration
 }
 
-type Stats struct {
-	PacketsSent     uint64
-	PacketsReceived uint64
-	PacketsDropped  uint64
-	RetryCount      uint64
-}
-
 func NewGoUDPKit(addr string, retryConfig RetryConfig, qosConfig QoSConfig, bufferConfig BufferConfig, customConn ...UDPConn) (*GoUDPKit, error) {
 	var conn UDPConn
 	if len(customConn) > 0 && customConn[0] != nil {
@@ -64,91 +169,377 @@ func NewGoUDPKit(addr string, retryConfig RetryConfig, qosConfig QoSConfig, buff
 		}
 	}
 
+	if bufferConfig.FlushInterval <= 0 {
+		bufferConfig.FlushInterval = DefaultFlushInterval
+	}
+
 	kit := &GoUDPKit{
-		conn:            conn,
-		reassemblyQueue: make(map[uint32]*Packet),
-		retryConfig:     retryConfig,
-		qosConfig:       qosConfig,
-		bufferConfig:    bufferConfig,
-		mu:              sync.Mutex{},
+		conn:              conn,
+		reassemblyQueue:   make(map[messageKey]*partialMessage),
+		completedMessages: make(map[messageKey]time.Time),
+		retryConfig:       retryConfig,
+		qosConfig:         qosConfig,
+		bufferConfig:      bufferConfig,
+		mu:                sync.Mutex{},
+		started:           time.Now(),
+		reads:             make(map[*pendingRead]struct{}),
+		received:          make(map[messageKey]map[uint32]time.Time),
+		ackWait:           make(map[string]*reliableSend),
+		peerWindows:       make(map[string]int),
+		closedWindows:     make(map[string]windowUpdate),
+		mtu:               DefaultMTU,
+		sched:             newScheduler(qosConfig),
+		done:              make(chan struct{}),
+		closed:            make(chan struct{}),
+
+		replayWindowSize: DefaultReplayWindow,
+		replayWindows:    make(map[replayKey]*replayWindow),
+
+		bulkTransfers: make(map[messageKey]*bulkTransfer),
+		bulkFinished:  make(map[messageKey]finishedTransfer),
+		manifestAcks:  make(map[messageKey]*manifestAck),
+
+		congestion: make(map[string]*peerCongestion),
+		peerPacers: make(map[string]*pacer),
+		sessions:   make(map[ConnectionID]*Session),
+
+		closedSessions: make(map[ConnectionID]closedSession),
+
+		keepaliveChanged: make(chan struct{}, 1),
+		peers:            make(map[string]*peerState),
 	}
 
+	var epoch [4]byte
+	rand.Read(epoch[:])
+	kit.nextEpoch = binary.BigEndian.Uint32(epoch[:])
+
+	for i := range kit.latency {
+		kit.latency[i] = newHistogram(DefaultLatencyBuckets)
+	}
+
+	kit.wg.Add(3)
 	go kit.flushBufferPeriodically()
+	go kit.runScheduler()
+	go kit.runKeepalive()
 
 	return kit, nil
 }
 
 func (kit *GoUDPKit) SendPacket(packet Packet, addr *net.UDPAddr) error {
-	buf := make([]byte, 4+len(packet.Data))
-	binary.BigEndian.PutUint32(buf[:4], packet.SequenceNumber)
-	copy(buf[4:], packet.Data)
-	_, err := kit.conn.WriteToUDP(buf, addr)
+	return kit.sendData(context.Background(), packet, Header{}, addr)
+}
+
+// sendData sends packet as a data frame. base supplies the flags and
+// message ID; the rest of the header comes from packet.
+func (kit *GoUDPKit) sendData(ctx context.Context, packet Packet, base Header, addr *net.UDPAddr) error {
+	kit.mu.Lock()
+	codec := kit.codec
+	kit.mu.Unlock()
+	data, compressed := compressPayload(codec, packet.Data)
+	h := base
+	if compressed {
+		h.Flags |= FlagCompressed
+	}
+	h.Type = PacketTypeData
+	h.Priority = priorityByte(packet.Priority)
+	h.SequenceNumber = packet.SequenceNumber
+	err := kit.writeFrame(ctx, h, data, addr)
 	if err == nil {
-		kit.stats.PacketsSent++
+		kit.stats.inc(statPacketsSent)
 	}
 	return err
 }
 
-func (kit *GoUDPKit) sendWithRetry(packet Packet, destAddr *net.UDPAddr) error {
-	timeout := kit.retryConfig.BaseTimeout
-	for retry := 0; retry < kit.retryConfig.MaxRetries; retry++ {
-		_, err := kit.conn.WriteToUDP(packet.Data, destAddr)
-		if err == nil {
-			return nil
+// writeFrame stamps h with the send time and writes it with payload,
+// sealing the payload when an encryption key or peer session is in place.
+// Handshake frames are always sent in the clear.
+func (kit *GoUDPKit) writeFrame(ctx context.Context, h Header, payload []byte, addr *net.UDPAddr) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if kit.isClosed() {
+		return ErrClosed
+	}
+	// keepalives never start a handshake, as there is no point keeping
+	// alive a peer the kit has no session with
+	if h.Type != PacketTypeHandshake && h.Type != PacketTypeKeepalive {
+		if err := kit.ensureSession(ctx, addr); err != nil {
+			return err
+		}
+	}
+	if h.Type == PacketTypeData || h.Type == PacketTypeBulk {
+		if err := kit.pace(ctx, kit.frameOverhead(addr)+len(payload), addr); err != nil {
+			return err
 		}
+	}
+	h.Timestamp = time.Now()
 
-		kit.stats.RetryCount++
-		time.Sleep(timeout)
-		timeout = time.Duration(float64(timeout) * kit.retryConfig.BackoffRate)
+	kit.mu.Lock()
+	var pc *packetCipher
+	if h.Type != PacketTypeHandshake {
+		pc = kit.sessionCipher(addr.String())
+	}
+	if pc == nil && h.Type == PacketTypeKeepalive && kit.handshake != nil {
+		kit.mu.Unlock()
+		return errNoPeerSession
+	}
+	var buf []byte
+	if pc == nil {
+		buf = AppendHeader(make([]byte, 0, HeaderSize+len(payload)), h, payload)
+	} else {
+		h.Flags |= FlagEncrypted
+		buf = AppendHeader(make([]byte, 0, HeaderSize+pc.overhead()+len(payload)), h, nil)
+		buf = pc.seal(buf, payload)
 	}
+	kit.mu.Unlock()
 
-	return errors.New("maximum retries reached")
+	if _, err := kit.conn.WriteToUDP(buf, addr); err != nil {
+		kit.stats.inc(statSendErrors)
+		return err
+	}
+	kit.stats.add(statBytesSent, uint64(len(buf)))
+	kit.peerSent(addr)
+	return nil
 }
 
-func (kit *GoUDPKit) ReceivePacket() ([]byte, *net.UDPAddr, error) {
-	buf := make([]byte, 65535)
-	n, addr, err := kit.conn.ReadFromUDP(buf)
+// frameOverhead is the number of bytes each datagram to addr adds to its
+// payload.
+func (kit *GoUDPKit) frameOverhead(addr *net.UDPAddr) int {
+	kit.mu.Lock()
+	defer kit.mu.Unlock()
+	pc := kit.cipher
+	if kit.handshake != nil {
+		pc = kit.handshake.sessionOrDefault(addr.String())
+	}
+	if pc != nil {
+		return HeaderSize + pc.overhead()
+	}
+	return HeaderSize
+}
+
+// openFrame enforces the kit's encryption setting on a received frame and
+// returns its plaintext payload. Replayed frames are reported as not
+// deliverable.
+func (kit *GoUDPKit) openFrame(h Header, header, payload []byte, addr *net.UDPAddr) ([]byte, bool, error) {
+	kit.mu.Lock()
+	pc := kit.cipher
+	hs := kit.handshake
+	kit.mu.Unlock()
+
+	if h.Flags&FlagEncrypted == 0 {
+		if pc != nil || hs != nil {
+			return nil, false, ErrUnencryptedPacket
+		}
+		return payload, true, nil
+	}
+
+	var session *peerSession
+	var plain []byte
+	var pn uint64
+	var err error
+	switch {
+	case hs != nil:
+		session, plain, pn, err = kit.openSession(hs, addr.String(), header, payload)
+	case pc != nil:
+		plain, pn, err = pc.open(header, payload)
+	default:
+		err = ErrNoEncryptionKey
+	}
 	if err != nil {
-		kit.stats.PacketsDropped++
-		return nil, nil, err
+		return nil, false, err
 	}
-	if n < 4 {
-		kit.stats.PacketsDropped++
-		return nil, addr, errors.New("packet too short")
+	return plain, kit.acceptPacketNumber(session, addr, payload, pn), nil
+}
+
+func (kit *GoUDPKit) ReceivePacket() ([]byte, *net.UDPAddr, error) {
+	packet, addr, err := kit.ReadPacket()
+	if err != nil {
+		return nil, addr, err
 	}
-	data := buf[4:n]
-	kit.stats.PacketsReceived++
-	return data, addr, nil
+	return packet.Data, addr, nil
+}
+
+// ReadPacket is like ReceivePacket but also returns the sequence number,
+// priority and send timestamp carried in the header.
+func (kit *GoUDPKit) ReadPacket() (Packet, *net.UDPAddr, error) {
+	return kit.readPacket(context.Background())
 }
 
-func (kit *GoUDPKit) tryReassemble() []byte {
-	var assembledData []byte
-	expectedSeq := uint32(0)
+// readPacket reads until a packet is deliverable, giving up once ctx is
+// done or its deadline passes.
+func (kit *GoUDPKit) readPacket(ctx context.Context) (Packet, *net.UDPAddr, error) {
+	if in, ok := kit.popInbox(); ok {
+		kit.stats.inc(statPacketsReceived)
+		return in.packet, in.addr, nil
+	}
+	if kit.isClosed() {
+		return Packet{}, nil, ErrClosed
+	}
 
+	deadline, _ := ctx.Deadline()
+	buf := make([]byte, 65535)
 	for {
-		packet, exists := kit.reassemblyQueue[expectedSeq]
-		if !exists {
-			break
+		n, addr, err := kit.readFrom(ctx, buf, deadline)
+		if err != nil {
+			if kit.isClosed() {
+				return Packet{}, nil, ErrClosed
+			}
+			if nerr, ok := err.(net.Error); !ok || !nerr.Timeout() {
+				kit.stats.inc(statReadErrors)
+			}
+			return Packet{}, nil, err
+		}
+		packet, ok, err := kit.handleDatagram(buf[:n], addr)
+		if err != nil {
+			return Packet{}, addr, &PacketError{Addr: addr, Err: err}
+		}
+		if ok {
+			kit.sendWindowUpdates()
+			kit.stats.inc(statPacketsReceived)
+			return packet, addr, nil
 		}
+	}
+}
 
-		assembledData = append(assembledData, packet.Data...)
-		delete(kit.reassemblyQueue, expectedSeq)
-		expectedSeq++
+// handleDatagram processes one raw datagram. Control frames such as
+// acknowledgements are consumed here and reported as not deliverable.
+func (kit *GoUDPKit) handleDatagram(b []byte, addr *net.UDPAddr) (Packet, bool, error) {
+	kit.stats.add(statBytesReceived, uint64(len(b)))
+	h, payload, err := DecodeHeader(b)
+	if err != nil {
+		kit.stats.inc(statDecodeErrors)
+		kit.stats.inc(statPacketsDropped)
+		return Packet{}, false, err
 	}
+	if h.Type == PacketTypeHandshake {
+		kit.handleHandshake(payload, addr)
+		return Packet{}, false, nil
+	}
+	payload, fresh, err := kit.openFrame(h, b[:HeaderSize], payload, addr)
+	if err != nil {
+		kit.stats.inc(statAuthErrors)
+		kit.stats.inc(statPacketsDropped)
+		return Packet{}, false, err
+	}
+	if !fresh {
+		return Packet{}, false, nil
+	}
+	kit.peerReceived(addr, h.Flags&FlagEncrypted != 0)
 
-	if len(assembledData) > 0 {
-		return assembledData
+	if h.Type == PacketTypeData && !h.Timestamp.IsZero() {
+		kit.observeLatency(latencyTransit, time.Since(h.Timestamp))
 	}
 
-	return nil
+	switch h.Type {
+	case PacketTypeAck:
+		kit.handleAck(h, payload, addr)
+		return Packet{}, false, nil
+	case PacketTypeBulk:
+		if err := kit.handleBulk(payload, addr); err != nil {
+			kit.stats.inc(statDecodeErrors)
+			kit.stats.inc(statPacketsDropped)
+			return Packet{}, false, err
+		}
+		return Packet{}, false, nil
+	case PacketTypeTransfer:
+		if err := kit.handleTransfer(payload, addr); err != nil {
+			kit.stats.inc(statDecodeErrors)
+			kit.stats.inc(statPacketsDropped)
+			return Packet{}, false, err
+		}
+		return Packet{}, false, nil
+	case PacketTypeSession:
+		if err := kit.handleSession(h, payload, addr); err != nil {
+			kit.stats.inc(statDecodeErrors)
+			kit.stats.inc(statPacketsDropped)
+			return Packet{}, false, err
+		}
+		return Packet{}, false, nil
+	case PacketTypeKeepalive:
+		if err := kit.handleKeepalive(payload, addr); err != nil {
+			kit.stats.inc(statDecodeErrors)
+			kit.stats.inc(statPacketsDropped)
+			return Packet{}, false, err
+		}
+		return Packet{}, false, nil
+	case PacketTypeData:
+	default:
+		kit.stats.inc(statDecodeErrors)
+		kit.stats.inc(statPacketsDropped)
+		return Packet{}, false, fmt.Errorf("unknown packet type %v", h.Type)
+	}
+
+	if kit.bufferFull(addr, h) {
+		kit.stats.inc(statPacketsDropped)
+		return Packet{}, false, nil
+	}
+	if h.Flags&FlagAckRequested != 0 {
+		duplicate := kit.recordReceived(addr, h.MessageID, h.SequenceNumber)
+		// a whole new packet takes a place in the window until the
+		// application has it
+		held := 0
+		if !duplicate && h.Flags&FlagFragment == 0 {
+			held = 1
+		}
+		kit.sendAck(addr, h.MessageID, h.SequenceNumber, held)
+		if duplicate {
+			kit.stats.inc(statPacketsDropped)
+			return Packet{}, false, nil
+		}
+	}
+	if h.Flags&FlagFragment != 0 {
+		data, ok := kit.addFragment(h, payload, addr)
+		if !ok {
+			return Packet{}, false, nil
+		}
+		payload = data
+	}
+	if h.Flags&FlagCompressed != 0 {
+		data, err := decodeWithCodec(payload, kit.decompressLimit())
+		if err != nil {
+			kit.stats.inc(statDecompressErrors)
+			kit.stats.inc(statPacketsDropped)
+			return Packet{}, false, err
+		}
+		payload = data
+	}
+	return Packet{
+		SequenceNumber: h.SequenceNumber,
+		Priority:       int(h.Priority),
+		Data:           append([]byte(nil), payload...),
+		Timestamp:      h.Timestamp,
+	}, true, nil
+}
+
+func (kit *GoUDPKit) tryReassemble(key messageKey) []byte {
+	msg, exists := kit.reassemblyQueue[key]
+	if !exists || msg.received < int(msg.count) {
+		return nil
+	}
+
+	assembledData := make([]byte, 0, msg.size)
+	for i := 0; i < int(msg.count); i++ {
+		assembledData = append(assembledData, msg.fragments[uint16(i)]...)
+	}
+	delete(kit.reassemblyQueue, key)
+	kit.completedMessages[key] = time.Now()
+	kit.bufferedFrags -= msg.received
+	kit.observeLatency(latencyReassembly, time.Since(msg.firstSeen))
+	return assembledData
 }
 
 func (kit *GoUDPKit) flushBufferPeriodically() {
-	ticker := time.NewTicker(kit.bufferConfig.FlushInterval)
+	defer kit.wg.Done()
+	ticker := time.NewTicker(max(kit.bufferConfig.FlushInterval, minFlushTick))
 	defer ticker.Stop()
 
-	for range ticker.C {
-		kit.flushBuffer()
+	for {
+		select {
+		case <-ticker.C:
+			kit.flushBuffer()
+		case <-kit.done:
+			return
+		}
 	}
 }
 
@@ -157,22 +548,78 @@ func (kit *GoUDPKit) flushBuffer() {
 	defer kit.mu.Unlock()
 
 	now := time.Now()
-	for seq, packet := range kit.reassemblyQueue {
-		if now.Sub(packet.Timestamp) > kit.bufferConfig.FlushInterval {
-			delete(kit.reassemblyQueue, seq)
-			kit.stats.PacketsDropped++
+	for key, msg := range kit.reassemblyQueue {
+		if now.Sub(msg.firstSeen) > kit.bufferConfig.FlushInterval {
+			delete(kit.reassemblyQueue, key)
+			kit.bufferedFrags -= msg.received
+			kit.stats.add(statPacketsDropped, uint64(msg.received))
+		}
+	}
+	for key, at := range kit.completedMessages {
+		if now.Sub(at) > kit.bufferConfig.FlushInterval {
+			delete(kit.completedMessages, key)
 		}
 	}
+	for key, t := range kit.bulkTransfers {
+		if now.Sub(t.lastSeen) > kit.bufferConfig.FlushInterval {
+			kit.bulkDone = append(kit.bulkDone, kit.finishBulk(key, t, ErrTransferStalled))
+		}
+	}
+	for key, f := range kit.bulkFinished {
+		if now.Sub(f.at) > ackRetention {
+			delete(kit.bulkFinished, key)
+		}
+	}
+	// results nobody is reading bulk transfers for would otherwise be
+	// held forever
+	kept := kit.bulkDone[:0]
+	for _, res := range kit.bulkDone {
+		if now.Sub(res.at) <= ackRetention {
+			kept = append(kept, res)
+		} else if res.file != nil {
+			res.file.close()
+		}
+	}
+	clear(kit.bulkDone[len(kept):])
+	kit.bulkDone = kept
+	kit.pruneReceived(now)
+	kit.pruneCongestion(now)
+	kit.prunePacers(now)
+	kit.pruneReplayWindows(now)
+	kit.pruneClosedSessions(now)
 }
 
-func (kit *GoUDPKit) GetStats() Stats {
-	kit.mu.Lock()
-	defer kit.mu.Unlock()
-	return kit.stats
+// Close sends any packets still queued by Enqueue, stops the kit's
+// background goroutines and closes the connection. Packets that could not
+// be sent are reported in an *UnsentError. Calling Close again does nothing
+// and returns nil; other calls on a closed kit return ErrClosed.
+func (kit *GoUDPKit) Close() error {
+	var err error
+	kit.closeOnce.Do(func() {
+		kit.sched.close()
+		close(kit.done)
+		kit.wg.Wait()
+		kit.closeSessions()
+		close(kit.closed)
+		err = kit.conn.Close()
+
+		kit.mu.Lock()
+		defer kit.mu.Unlock()
+		kit.closeTransferFiles()
+		if len(kit.unsent) > 0 {
+			err = &UnsentError{Packets: kit.unsent, Err: kit.unsentErr}
+		}
+	})
+	return err
 }
 
-func (kit *GoUDPKit) Close() error {
-	return kit.conn.Close()
+func (kit *GoUDPKit) isClosed() bool {
+	select {
+	case <-kit.closed:
+		return true
+	default:
+		return false
+	}
 }
 
 func (kit *GoUDPKit) Conn() UDPConn {
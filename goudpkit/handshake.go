@@ -0,0 +1,573 @@
+package goudpkit
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdh"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+var (
+	ErrHandshakeFailed  = errors.New("handshake failed")
+	ErrHandshakeTimeout = errors.New("handshake timed out")
+)
+
+// HandshakeConfig enables an X25519 handshake that derives per-peer session
+// keys before the first data packet is sent.
+//
+// The handshake follows the Noise IK/XX shape in a single round trip. The
+// initiator sends its ephemeral and static public keys; the responder
+// answers with its own and a confirmation tag. Both sides mix the
+// ephemeral-ephemeral and, where present, ephemeral-static Diffie-Hellman
+// results with the PSK through HKDF-SHA256, so only holders of the PSK and
+// of the advertised static private keys can derive the session keys. The
+// initiator authenticates the responder through the tag; the responder
+// authenticates the initiator when its first encrypted frame opens.
+type HandshakeConfig struct {
+	Suite CipherSuite
+	// StaticKey is this kit's long-term X25519 key. It may be nil when a
+	// PSK is used.
+	StaticKey *ecdh.PrivateKey
+	// TrustedKeys lists the static public keys accepted from peers. When
+	// empty, any static key (or none) is accepted and the PSK alone
+	// authenticates the peer.
+	TrustedKeys [][]byte
+	PSK         []byte
+}
+
+const (
+	handshakeInit     = 1
+	handshakeResponse = 2
+
+	handshakeKeySize = 32
+	handshakeTagSize = sha256.Size
+	handshakeLabel   = "goudpkit handshake v1"
+)
+
+type peerSession struct {
+	send   *packetCipher
+	recv   *packetCipher
+	replay *replayWindow
+}
+
+// responderState is a session a responder has derived but not yet seen
+// used. Its cached response is re-sent if the initiator retransmits.
+type responderState struct {
+	ephemeral []byte
+	response  []byte
+	session   *peerSession
+}
+
+type initiatorState struct {
+	ephemeral *ecdh.PrivateKey
+	init      []byte
+	err       error
+	done      chan struct{}
+	once      sync.Once
+	// yielded is set when the peer's own init won the tie-break, so the
+	// session comes from answering it instead. confirm is set when the
+	// peer may hold a pending session of its own, which a frame under
+	// the new session settles. Both are guarded by kit.mu.
+	yielded bool
+	confirm bool
+}
+
+// finish ends the handshake with err, waking those waiting for it. Only
+// the first call has an effect.
+func (st *initiatorState) finish(err error) {
+	st.once.Do(func() {
+		st.err = err
+		close(st.done)
+	})
+}
+
+type handshakeState struct {
+	config     HandshakeConfig
+	sessions   map[string]*peerSession
+	responding map[string]*responderState
+	initiating map[string]*initiatorState
+}
+
+// EnableHandshake requires an authenticated session with every peer. The
+// first send to a peer without one runs Handshake, and peers may start a
+// handshake with this kit while it is receiving.
+func (kit *GoUDPKit) EnableHandshake(cfg HandshakeConfig) error {
+	if len(cfg.PSK) == 0 && (cfg.StaticKey == nil || len(cfg.TrustedKeys) == 0) {
+		return errors.New("handshake needs a PSK or a static key with trusted peer keys")
+	}
+	if cfg.StaticKey != nil && cfg.StaticKey.Curve() != ecdh.X25519() {
+		return errors.New("handshake static key must be X25519")
+	}
+	if cfg.Suite == 0 {
+		cfg.Suite = CipherChaCha20Poly1305
+	}
+	if _, err := NewAEAD(cfg.Suite, make([]byte, handshakeKeySize)); err != nil {
+		return err
+	}
+
+	kit.mu.Lock()
+	kit.handshake = &handshakeState{
+		config:     cfg,
+		sessions:   make(map[string]*peerSession),
+		responding: make(map[string]*responderState),
+		initiating: make(map[string]*initiatorState),
+	}
+	kit.mu.Unlock()
+	return nil
+}
+
+// Handshake establishes session keys with addr, retransmitting the first
+// message according to RetryConfig. It is a no-op when a session exists.
+func (kit *GoUDPKit) Handshake(addr *net.UDPAddr) error {
+	return kit.HandshakeContext(context.Background(), addr)
+}
+
+// HandshakeContext is like Handshake but gives up with ctx.Err() once ctx
+// is done. Concurrent calls for the same peer wait for the handshake
+// already under way; handshakes with different peers run in parallel.
+func (kit *GoUDPKit) HandshakeContext(ctx context.Context, addr *net.UDPAddr) error {
+	kit.mu.Lock()
+	hs := kit.handshake
+	kit.mu.Unlock()
+	if hs == nil {
+		return errors.New("handshake not enabled")
+	}
+
+	peer := addr.String()
+	var st *initiatorState
+	for st == nil {
+		kit.mu.Lock()
+		if _, ok := hs.sessions[peer]; ok {
+			kit.mu.Unlock()
+			return nil
+		}
+		if other, ok := hs.initiating[peer]; ok {
+			kit.mu.Unlock()
+			select {
+			case <-other.done:
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-kit.done:
+				return ErrClosed
+			}
+			continue
+		}
+		ephemeral, err := ecdh.X25519().GenerateKey(rand.Reader)
+		if err != nil {
+			kit.mu.Unlock()
+			return err
+		}
+		st = &initiatorState{
+			ephemeral: ephemeral,
+			init:      encodeHandshake(handshakeInit, hs.config.Suite, ephemeral.PublicKey().Bytes(), staticPublic(hs.config), nil),
+			done:      make(chan struct{}),
+		}
+		hs.initiating[peer] = st
+		kit.mu.Unlock()
+	}
+	defer func() {
+		kit.mu.Lock()
+		if hs.initiating[peer] == st {
+			delete(hs.initiating, peer)
+		}
+		kit.mu.Unlock()
+		st.finish(ErrHandshakeTimeout)
+	}()
+
+	timeout, backoff := kit.retryTiming()
+	buf := make([]byte, 65535)
+	for attempt := 0; attempt <= kit.retryConfig.MaxRetries; attempt++ {
+		if attempt > 0 {
+			kit.stats.inc(statRetryCount)
+		}
+		if err := kit.writeFrame(ctx, Header{Type: PacketTypeHandshake}, st.init, addr); err != nil {
+			return err
+		}
+		deadline := time.Now().Add(timeout)
+		for time.Now().Before(deadline) {
+			select {
+			case <-st.done:
+				return st.err
+			default:
+			}
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			if err := kit.pollOnce(ctx, buf, deadline); err != nil {
+				return err
+			}
+		}
+		timeout = time.Duration(float64(timeout) * backoff)
+	}
+
+	select {
+	case <-st.done:
+		return st.err
+	default:
+	}
+	kit.stats.inc(statHandshakesFailed)
+	return ErrHandshakeTimeout
+}
+
+// ensureSession runs the handshake with addr when handshakes are enabled
+// and no session is established yet. A session this kit is responding
+// with does not count until the initiator has used it.
+func (kit *GoUDPKit) ensureSession(ctx context.Context, addr *net.UDPAddr) error {
+	kit.mu.Lock()
+	hs := kit.handshake
+	ready := true
+	if hs != nil {
+		_, ready = hs.sessions[addr.String()]
+	}
+	kit.mu.Unlock()
+	if ready {
+		return nil
+	}
+	return kit.HandshakeContext(ctx, addr)
+}
+
+func (kit *GoUDPKit) handleHandshake(payload []byte, addr *net.UDPAddr) {
+	kit.mu.Lock()
+	hs := kit.handshake
+	kit.mu.Unlock()
+	if hs == nil {
+		kit.stats.inc(statPacketsDropped)
+		return
+	}
+
+	kind, suite, ephemeral, static, tag, err := decodeHandshake(payload)
+	if err != nil {
+		kit.stats.inc(statPacketsDropped)
+		return
+	}
+	switch kind {
+	case handshakeInit:
+		kit.respondHandshake(hs, suite, ephemeral, static, addr)
+	case handshakeResponse:
+		kit.completeHandshake(hs, suite, ephemeral, static, tag, addr)
+	}
+}
+
+// respondHandshake answers an init with a pending session. The session
+// stays pending, and does not replace an established one, until a frame
+// from the initiator opens with it, which proves the init was genuine.
+//
+// When both kits initiate at once, the exchange whose init carries the
+// lower ephemeral key wins on both sides: the init that loses is ignored,
+// and the kit that sent it answers the other instead of finishing its own.
+func (kit *GoUDPKit) respondHandshake(hs *handshakeState, suite CipherSuite, initEphemeral, initStatic []byte, addr *net.UDPAddr) {
+	peer := addr.String()
+	kit.mu.Lock()
+	if prev, ok := hs.responding[peer]; ok && bytes.Equal(prev.ephemeral, initEphemeral) {
+		response := prev.response
+		kit.mu.Unlock()
+		kit.writeFrame(context.Background(), Header{Type: PacketTypeHandshake}, response, addr)
+		return
+	}
+	if st, ok := hs.initiating[peer]; ok && !st.yielded {
+		if bytes.Compare(st.ephemeral.PublicKey().Bytes(), initEphemeral) < 0 {
+			st.confirm = true
+			kit.mu.Unlock()
+			return
+		}
+		st.yielded = true
+	}
+	kit.mu.Unlock()
+
+	if suite != hs.config.Suite || !hs.trusts(initStatic) {
+		kit.stats.inc(statHandshakesFailed)
+		return
+	}
+	ephemeral, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		kit.stats.inc(statHandshakesFailed)
+		return
+	}
+	respEphemeral := ephemeral.PublicKey().Bytes()
+	respStatic := staticPublic(hs.config)
+	transcript := handshakeTranscript(suite, initEphemeral, initStatic, respEphemeral, respStatic)
+
+	ikm, err := mixDH(ephemeral, initEphemeral)
+	if err == nil && initStatic != nil {
+		ikm, err = appendDH(ikm, ephemeral, initStatic)
+	}
+	if err == nil && hs.config.StaticKey != nil {
+		ikm, err = appendDH(ikm, hs.config.StaticKey, initEphemeral)
+	}
+	if err != nil {
+		kit.stats.inc(statHandshakesFailed)
+		return
+	}
+	initToResp, respToInit, confirm, err := deriveSessionKeys(ikm, hs.config.PSK, transcript)
+	if err != nil {
+		kit.stats.inc(statHandshakesFailed)
+		return
+	}
+	session, err := newPeerSession(suite, respToInit, initToResp)
+	if err != nil {
+		kit.stats.inc(statHandshakesFailed)
+		return
+	}
+
+	response := encodeHandshake(handshakeResponse, suite, respEphemeral, respStatic, handshakeTag(confirm, transcript))
+	kit.mu.Lock()
+	hs.responding[peer] = &responderState{ephemeral: initEphemeral, response: response, session: session}
+	kit.mu.Unlock()
+	kit.writeFrame(context.Background(), Header{Type: PacketTypeHandshake}, response, addr)
+}
+
+func (kit *GoUDPKit) completeHandshake(hs *handshakeState, suite CipherSuite, respEphemeral, respStatic, tag []byte, addr *net.UDPAddr) {
+	peer := addr.String()
+	kit.mu.Lock()
+	st, ok := hs.initiating[peer]
+	if ok && st.yielded {
+		// the session comes from the peer's init instead
+		ok = false
+	}
+	kit.mu.Unlock()
+	if !ok {
+		return
+	}
+
+	fail := func() {
+		kit.stats.inc(statHandshakesFailed)
+		st.finish(ErrHandshakeFailed)
+	}
+	if suite != hs.config.Suite || !hs.trusts(respStatic) {
+		fail()
+		return
+	}
+
+	initStatic := staticPublic(hs.config)
+	transcript := handshakeTranscript(suite, st.ephemeral.PublicKey().Bytes(), initStatic, respEphemeral, respStatic)
+	ikm, err := mixDH(st.ephemeral, respEphemeral)
+	if err == nil && hs.config.StaticKey != nil {
+		ikm, err = appendDH(ikm, hs.config.StaticKey, respEphemeral)
+	}
+	if err == nil && respStatic != nil {
+		ikm, err = appendDH(ikm, st.ephemeral, respStatic)
+	}
+	if err != nil {
+		fail()
+		return
+	}
+	initToResp, respToInit, confirm, err := deriveSessionKeys(ikm, hs.config.PSK, transcript)
+	if err != nil || !hmac.Equal(tag, handshakeTag(confirm, transcript)) {
+		fail()
+		return
+	}
+	session, err := newPeerSession(suite, initToResp, respToInit)
+	if err != nil {
+		fail()
+		return
+	}
+
+	kit.mu.Lock()
+	if hs.initiating[peer] != st {
+		// a concurrent response already settled it
+		kit.mu.Unlock()
+		return
+	}
+	hs.sessions[peer] = session
+	delete(hs.initiating, peer)
+	_, responding := hs.responding[peer]
+	delete(hs.responding, peer)
+	settle := st.confirm || responding
+	kit.mu.Unlock()
+	kit.stats.inc(statHandshakesCompleted)
+	st.finish(nil)
+	if settle {
+		// a ping under the new session settles the peer's pending one,
+		// even if this kit has nothing else to send
+		kit.writeFrame(context.Background(), Header{Type: PacketTypeKeepalive}, appendKeepaliveFrame(keepalivePing, time.Now()), addr)
+	}
+}
+
+// sessionCipher picks the cipher used to send to peer. The caller must hold
+// kit.mu.
+func (kit *GoUDPKit) sessionCipher(peer string) *packetCipher {
+	if hs := kit.handshake; hs != nil {
+		return hs.sessionOrDefault(peer)
+	}
+	return kit.cipher
+}
+
+// sessionOrDefault returns the send cipher of peer's established session,
+// or nil. The caller must hold kit.mu.
+func (hs *handshakeState) sessionOrDefault(peer string) *packetCipher {
+	if s, ok := hs.sessions[peer]; ok {
+		return s.send
+	}
+	return nil
+}
+
+// openSession decrypts a frame from peer with its session keys. A pending
+// responder session becomes established once a frame opens with it.
+func (kit *GoUDPKit) openSession(hs *handshakeState, peer string, header, sealed []byte) (*peerSession, []byte, uint64, error) {
+	kit.mu.Lock()
+	established := hs.sessions[peer]
+	pending := hs.responding[peer]
+	kit.mu.Unlock()
+
+	if established != nil {
+		if plain, pn, err := established.recv.open(header, sealed); err == nil {
+			return established, plain, pn, nil
+		}
+	}
+	if pending == nil {
+		if established == nil {
+			return nil, nil, 0, ErrNoEncryptionKey
+		}
+		return nil, nil, 0, ErrAuthenticationFailed
+	}
+	plain, pn, err := pending.session.recv.open(header, sealed)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+
+	kit.mu.Lock()
+	var yielded *initiatorState
+	if hs.responding[peer] == pending {
+		hs.sessions[peer] = pending.session
+		delete(hs.responding, peer)
+		kit.stats.inc(statHandshakesCompleted)
+		// a handshake this kit started with the peer is settled too
+		if st, ok := hs.initiating[peer]; ok {
+			delete(hs.initiating, peer)
+			yielded = st
+		}
+	}
+	kit.mu.Unlock()
+	if yielded != nil {
+		yielded.finish(nil)
+	}
+	return pending.session, plain, pn, nil
+}
+
+func (hs *handshakeState) trusts(static []byte) bool {
+	if len(hs.config.TrustedKeys) == 0 {
+		return true
+	}
+	for _, k := range hs.config.TrustedKeys {
+		if static != nil && bytes.Equal(k, static) {
+			return true
+		}
+	}
+	return false
+}
+
+func newPeerSession(suite CipherSuite, sendKey, recvKey []byte) (*peerSession, error) {
+	send, err := newSessionCipher(suite, sendKey)
+	if err != nil {
+		return nil, err
+	}
+	recv, err := newSessionCipher(suite, recvKey)
+	if err != nil {
+		return nil, err
+	}
+	return &peerSession{send: send, recv: recv}, nil
+}
+
+func staticPublic(cfg HandshakeConfig) []byte {
+	if cfg.StaticKey == nil {
+		return nil
+	}
+	return cfg.StaticKey.PublicKey().Bytes()
+}
+
+func mixDH(priv *ecdh.PrivateKey, peerPublic []byte) ([]byte, error) {
+	return appendDH(nil, priv, peerPublic)
+}
+
+func appendDH(dst []byte, priv *ecdh.PrivateKey, peerPublic []byte) ([]byte, error) {
+	pub, err := ecdh.X25519().NewPublicKey(peerPublic)
+	if err != nil {
+		return nil, err
+	}
+	secret, err := priv.ECDH(pub)
+	if err != nil {
+		return nil, err
+	}
+	return append(dst, secret...), nil
+}
+
+func handshakeTranscript(suite CipherSuite, initEphemeral, initStatic, respEphemeral, respStatic []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte(handshakeLabel))
+	h.Write([]byte{byte(suite)})
+	for _, k := range [][]byte{initEphemeral, initStatic, respEphemeral, respStatic} {
+		h.Write([]byte{byte(len(k))})
+		h.Write(k)
+	}
+	return h.Sum(nil)
+}
+
+func deriveSessionKeys(ikm, psk, transcript []byte) (initToResp, respToInit, confirm []byte, err error) {
+	okm := make([]byte, 3*handshakeKeySize)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, ikm, psk, transcript), okm); err != nil {
+		return nil, nil, nil, err
+	}
+	return okm[:handshakeKeySize], okm[handshakeKeySize : 2*handshakeKeySize], okm[2*handshakeKeySize:], nil
+}
+
+func handshakeTag(key, transcript []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(transcript)
+	return mac.Sum(nil)
+}
+
+// A handshake payload is kind (1), suite (1), ephemeral key (32), a static
+// key flag (1) with the static key (32) when set, and for responses the
+// confirmation tag (32).
+func encodeHandshake(kind byte, suite CipherSuite, ephemeral, static, tag []byte) []byte {
+	b := []byte{kind, byte(suite)}
+	b = append(b, ephemeral...)
+	if static != nil {
+		b = append(b, 1)
+		b = append(b, static...)
+	} else {
+		b = append(b, 0)
+	}
+	return append(b, tag...)
+}
+
+func decodeHandshake(b []byte) (kind byte, suite CipherSuite, ephemeral, static, tag []byte, err error) {
+	malformed := errors.New("malformed handshake message")
+	if len(b) < 3+handshakeKeySize {
+		return 0, 0, nil, nil, nil, malformed
+	}
+	kind, suite = b[0], CipherSuite(b[1])
+	ephemeral = b[2 : 2+handshakeKeySize]
+	rest := b[2+handshakeKeySize:]
+	hasStatic := rest[0] == 1
+	rest = rest[1:]
+	if hasStatic {
+		if len(rest) < handshakeKeySize {
+			return 0, 0, nil, nil, nil, malformed
+		}
+		static, rest = rest[:handshakeKeySize], rest[handshakeKeySize:]
+	}
+	switch kind {
+	case handshakeInit:
+		if len(rest) != 0 {
+			return 0, 0, nil, nil, nil, malformed
+		}
+	case handshakeResponse:
+		if len(rest) != handshakeTagSize {
+			return 0, 0, nil, nil, nil, malformed
+		}
+		tag = rest
+	default:
+		return 0, 0, nil, nil, nil, malformed
+	}
+	return kind, suite, ephemeral, static, tag, nil
+}
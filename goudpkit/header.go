@@ -0,0 +1,154 @@
+package goudpkit
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Every datagram starts with a fixed 24-byte header, all fields big-endian:
+//
+//	offset size field
+//	0      1    magic (high nibble, 0xC) and version (low nibble)
+//	1      1    packet type
+//	2      1    flags
+//	3      1    priority
+//	4      4    sequence number
+//	8      4    message ID
+//	12     2    fragment index
+//	14     2    fragment count
+//	16     8    send timestamp, Unix nanoseconds
+//	24     -    payload
+const (
+	HeaderVersion = 1
+	HeaderSize    = 24
+
+	headerMagic = 0xC0
+)
+
+var (
+	ErrShortHeader        = errors.New("datagram shorter than header")
+	ErrBadMagic           = errors.New("bad header magic")
+	ErrUnsupportedVersion = errors.New("unsupported header version")
+)
+
+type PacketType uint8
+
+const (
+	PacketTypeData PacketType = iota + 1
+	PacketTypeAck
+	PacketTypeHandshake
+	PacketTypeBulk
+	PacketTypeTransfer
+	PacketTypeSession
+	PacketTypeKeepalive
+)
+
+func (t PacketType) String() string {
+	switch t {
+	case PacketTypeData:
+		return "data"
+	case PacketTypeAck:
+		return "ack"
+	case PacketTypeHandshake:
+		return "handshake"
+	case PacketTypeBulk:
+		return "bulk"
+	case PacketTypeTransfer:
+		return "transfer"
+	case PacketTypeSession:
+		return "session"
+	case PacketTypeKeepalive:
+		return "keepalive"
+	}
+	return fmt.Sprintf("PacketType(%d)", uint8(t))
+}
+
+type HeaderFlags uint8
+
+const (
+	FlagCompressed HeaderFlags = 1 << iota
+	FlagEncrypted
+	FlagFragment
+	FlagAckRequested
+	// FlagWindow marks an ack whose payload starts with the sender's
+	// receive window, in packets, as a 4-byte big-endian count.
+	FlagWindow
+)
+
+type Header struct {
+	Version        uint8
+	Type           PacketType
+	Flags          HeaderFlags
+	Priority       uint8
+	SequenceNumber uint32
+	MessageID      uint32
+	FragmentIndex  uint16
+	FragmentCount  uint16
+	Timestamp      time.Time
+}
+
+// AppendHeader appends the encoded header followed by payload to dst. A zero
+// Version is encoded as HeaderVersion.
+func AppendHeader(dst []byte, h Header, payload []byte) []byte {
+	version := h.Version
+	if version == 0 {
+		version = HeaderVersion
+	}
+	var ts int64
+	if !h.Timestamp.IsZero() {
+		ts = h.Timestamp.UnixNano()
+	}
+
+	var b [HeaderSize]byte
+	b[0] = headerMagic | version&0x0F
+	b[1] = byte(h.Type)
+	b[2] = byte(h.Flags)
+	b[3] = h.Priority
+	binary.BigEndian.PutUint32(b[4:], h.SequenceNumber)
+	binary.BigEndian.PutUint32(b[8:], h.MessageID)
+	binary.BigEndian.PutUint16(b[12:], h.FragmentIndex)
+	binary.BigEndian.PutUint16(b[14:], h.FragmentCount)
+	binary.BigEndian.PutUint64(b[16:], uint64(ts))
+	dst = append(dst, b[:]...)
+	return append(dst, payload...)
+}
+
+// DecodeHeader parses the header at the start of b and returns it with the
+// remaining payload, which aliases b.
+func DecodeHeader(b []byte) (Header, []byte, error) {
+	if len(b) < HeaderSize {
+		return Header{}, nil, ErrShortHeader
+	}
+	if b[0]&0xF0 != headerMagic {
+		return Header{}, nil, ErrBadMagic
+	}
+	h := Header{
+		Version:        b[0] & 0x0F,
+		Type:           PacketType(b[1]),
+		Flags:          HeaderFlags(b[2]),
+		Priority:       b[3],
+		SequenceNumber: binary.BigEndian.Uint32(b[4:]),
+		MessageID:      binary.BigEndian.Uint32(b[8:]),
+		FragmentIndex:  binary.BigEndian.Uint16(b[12:]),
+		FragmentCount:  binary.BigEndian.Uint16(b[14:]),
+	}
+	if h.Version != HeaderVersion {
+		return Header{}, nil, fmt.Errorf("%w: %d", ErrUnsupportedVersion, h.Version)
+	}
+	if ts := int64(binary.BigEndian.Uint64(b[16:])); ts != 0 {
+		h.Timestamp = time.Unix(0, ts)
+	}
+	return h, b[HeaderSize:], nil
+}
+
+func priorityByte(p int) uint8 {
+	if p < 0 {
+		return 0
+	}
+	if p > 0xFF {
+		return 0xFF
+	}
+	return uint8(p)
+}
@@ -0,0 +1,358 @@
+package goudpkit
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"time"
+)
+
+// DefaultIdleTimeout is how long a peer may stay silent before it is
+// evicted from the peer table and its sessions closed, unless
+// SetKeepalive says otherwise.
+const DefaultIdleTimeout = 2 * time.Minute
+
+// DefaultMaxPeers is how many peers the peer table holds unless
+// SetKeepalive says otherwise.
+const DefaultMaxPeers = 1024
+
+// ErrBadKeepaliveConfig is returned by SetKeepalive for negative durations.
+var ErrBadKeepaliveConfig = errors.New("invalid keepalive configuration")
+
+// errNoPeerSession is returned for a keepalive to a peer the kit has no
+// handshake session with, as keepalives never start a handshake.
+var errNoPeerSession = errors.New("no session with peer")
+
+// Keepalive frames are PacketTypeKeepalive datagrams with a 9-byte
+// payload, big-endian:
+//
+//	offset size field
+//	0      1    kind (ping, pong)
+//	1      8    ping send time, Unix nanoseconds, echoed by the pong
+const keepaliveFrameSize = 9
+
+const (
+	keepalivePing = iota + 1
+	keepalivePong
+)
+
+// KeepaliveConfig sets how the kit watches the peers in its peer table.
+type KeepaliveConfig struct {
+	// Interval is how long a peer may stay silent before it is pinged,
+	// and how often it is pinged while it stays silent. Any kit answers
+	// pings as it reads. Zero sends no pings.
+	Interval time.Duration
+	// IdleTimeout is how long a peer may stay silent before it is
+	// evicted and its established sessions are closed with
+	// ErrSessionIdle. Zero means DefaultIdleTimeout.
+	IdleTimeout time.Duration
+	// OnDisconnect, when set, is called with a peer's last state when it
+	// is evicted.
+	OnDisconnect func(p Peer)
+	// MaxPeers caps the peer table, counting addresses not yet known to
+	// be peers. A new address replaces the least recently seen of those,
+	// or is not tracked if there are none. Zero means DefaultMaxPeers.
+	MaxPeers int
+}
+
+// enabled reports whether cfg asks for a peer table at all.
+func (cfg KeepaliveConfig) enabled() bool {
+	return cfg.Interval > 0 || cfg.IdleTimeout > 0 || cfg.OnDisconnect != nil || cfg.MaxPeers > 0
+}
+
+// Peer describes a remote address the kit has exchanged datagrams with
+// and knows to be real: one that sent an encrypted datagram that opened,
+// or answered a keepalive ping. Addresses that only sent plain datagrams
+// are pinged but are not reported until they answer, since anyone can
+// send those.
+type Peer struct {
+	Addr *net.UDPAddr
+	// FirstSeen is when the kit first sent to or heard from the peer.
+	FirstSeen time.Time
+	// LastReceived is when the kit last read an authentic datagram from
+	// the peer, or zero if it never has.
+	LastReceived time.Time
+	// LastSent is when the kit last wrote to the peer, or zero if it
+	// never has.
+	LastSent time.Time
+	// RTT is the round-trip time of the latest keepalive the peer
+	// answered, or zero if it has answered none.
+	RTT time.Duration
+}
+
+type peerState struct {
+	Peer
+	// pingSent is when the unanswered keepalive was sent, or zero.
+	pingSent time.Time
+	// confirmed is set once the address has proved to be a peer.
+	confirmed bool
+}
+
+// silentSince returns the time from which the peer's idleness counts.
+func (p *peerState) silentSince() time.Time {
+	if p.LastReceived.IsZero() {
+		return p.FirstSeen
+	}
+	return p.LastReceived
+}
+
+// lastSeen returns when the kit last exchanged a datagram with the peer.
+func (p *peerState) lastSeen() time.Time {
+	t := p.silentSince()
+	if p.LastSent.After(t) {
+		t = p.LastSent
+	}
+	return t
+}
+
+// SetKeepalive sets how the kit pings and evicts the peers in its peer
+// table. The kit only keeps a peer table once keepalives are configured,
+// and a zero config drops it again. The peer table is also how sessions
+// go idle: without keepalives, they stay open until closed. Pings and evictions happen in the
+// background, but a pong only counts once the kit reads it through
+// ReceivePacket, Serve or any other read. With a handshake enabled, only
+// peers with an established session are pinged.
+func (kit *GoUDPKit) SetKeepalive(cfg KeepaliveConfig) error {
+	if cfg.Interval < 0 || cfg.IdleTimeout < 0 || cfg.MaxPeers < 0 {
+		return fmt.Errorf("%w: %+v", ErrBadKeepaliveConfig, cfg)
+	}
+	kit.mu.Lock()
+	kit.keepalive = cfg
+	if !cfg.enabled() {
+		kit.peers = make(map[string]*peerState)
+	}
+	kit.mu.Unlock()
+	select {
+	case kit.keepaliveChanged <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// Peers returns the peer table, ordered by address.
+func (kit *GoUDPKit) Peers() []Peer {
+	kit.mu.Lock()
+	peers := make([]Peer, 0, len(kit.peers))
+	for _, p := range kit.peers {
+		if p.confirmed {
+			peers = append(peers, p.Peer)
+		}
+	}
+	kit.mu.Unlock()
+	sort.Slice(peers, func(i, j int) bool { return peers[i].Addr.String() < peers[j].Addr.String() })
+	return peers
+}
+
+// LookupPeer returns the peer table entry for addr.
+func (kit *GoUDPKit) LookupPeer(addr *net.UDPAddr) (Peer, bool) {
+	kit.mu.Lock()
+	defer kit.mu.Unlock()
+	p, ok := kit.peers[addr.String()]
+	if !ok || !p.confirmed {
+		return Peer{}, false
+	}
+	return p.Peer, true
+}
+
+// confirmedPeers counts the entries of the peer table known to be peers.
+// The caller must hold mu.
+func (kit *GoUDPKit) confirmedPeers() int {
+	n := 0
+	for _, p := range kit.peers {
+		if p.confirmed {
+			n++
+		}
+	}
+	return n
+}
+
+// peer returns the peer table entry for addr, adding one if there is
+// none, or nil if keepalives are off or the table is full of confirmed
+// peers. The caller must hold mu.
+func (kit *GoUDPKit) peer(addr *net.UDPAddr, now time.Time) *peerState {
+	if !kit.keepalive.enabled() {
+		return nil
+	}
+	p, ok := kit.peers[addr.String()]
+	if !ok {
+		limit := kit.keepalive.MaxPeers
+		if limit == 0 {
+			limit = DefaultMaxPeers
+		}
+		if len(kit.peers) >= limit && !kit.dropUnconfirmedPeer() {
+			return nil
+		}
+		p = &peerState{Peer: Peer{Addr: addr, FirstSeen: now}}
+		kit.peers[addr.String()] = p
+	}
+	return p
+}
+
+// dropUnconfirmedPeer removes the least recently seen entry not known to
+// be a peer, reporting whether there was one. Spoofed addresses therefore
+// only push each other out. The caller must hold mu.
+func (kit *GoUDPKit) dropUnconfirmedPeer() bool {
+	var oldest *peerState
+	for _, p := range kit.peers {
+		if !p.confirmed && (oldest == nil || p.lastSeen().Before(oldest.lastSeen())) {
+			oldest = p
+		}
+	}
+	if oldest == nil {
+		return false
+	}
+	delete(kit.peers, oldest.Addr.String())
+	return true
+}
+
+func (kit *GoUDPKit) peerSent(addr *net.UDPAddr) {
+	now := time.Now()
+	kit.mu.Lock()
+	if p := kit.peer(addr, now); p != nil {
+		p.LastSent = now
+	}
+	kit.mu.Unlock()
+}
+
+// peerReceived records a datagram from addr, which confirms it as a peer
+// if it was authentic.
+func (kit *GoUDPKit) peerReceived(addr *net.UDPAddr, authentic bool) {
+	now := time.Now()
+	kit.mu.Lock()
+	if p := kit.peer(addr, now); p != nil {
+		p.LastReceived = now
+		p.confirmed = p.confirmed || authentic
+	}
+	kit.mu.Unlock()
+}
+
+// idleTimeout returns how long a peer may stay silent. The caller must
+// hold mu.
+func (kit *GoUDPKit) idleTimeout() time.Duration {
+	if kit.keepalive.IdleTimeout > 0 {
+		return kit.keepalive.IdleTimeout
+	}
+	return DefaultIdleTimeout
+}
+
+// keepaliveTick returns how often the peer table is checked, a quarter of
+// the shorter of the ping interval and the idle timeout. The caller must
+// hold mu.
+func (kit *GoUDPKit) keepaliveTick() time.Duration {
+	d := kit.idleTimeout()
+	if i := kit.keepalive.Interval; i > 0 && i < d {
+		d = i
+	}
+	return max(d/4, minFlushTick)
+}
+
+func (kit *GoUDPKit) runKeepalive() {
+	defer kit.wg.Done()
+	for {
+		kit.mu.Lock()
+		timer := time.NewTimer(kit.keepaliveTick())
+		kit.mu.Unlock()
+
+		select {
+		case <-timer.C:
+			kit.checkPeers(time.Now())
+		case <-kit.keepaliveChanged:
+			timer.Stop()
+		case <-kit.done:
+			timer.Stop()
+			return
+		}
+	}
+}
+
+// checkPeers evicts the peers silent for longer than the idle timeout,
+// closing their sessions, and pings those silent for an interval. Only
+// confirmed peers are reported to OnDisconnect.
+func (kit *GoUDPKit) checkPeers(now time.Time) {
+	kit.mu.Lock()
+	interval := kit.keepalive.Interval
+	onDisconnect := kit.keepalive.OnDisconnect
+	var evicted []Peer
+	idle := make(map[string]bool)
+	var pings []*net.UDPAddr
+	for key, p := range kit.peers {
+		silent := now.Sub(p.silentSince())
+		switch {
+		case silent > kit.idleTimeout():
+			delete(kit.peers, key)
+			idle[key] = true
+			if p.confirmed {
+				evicted = append(evicted, p.Peer)
+			}
+		case interval > 0 && silent >= interval && (p.pingSent.IsZero() || now.Sub(p.pingSent) >= interval):
+			// a peer still without a handshake session is left to the
+			// idle timeout rather than handshaken with from here
+			if kit.handshake != nil && kit.handshake.sessions[key] == nil {
+				continue
+			}
+			p.pingSent = now
+			pings = append(pings, p.Addr)
+		}
+	}
+	kit.mu.Unlock()
+
+	if len(idle) > 0 {
+		kit.closeIdleSessions(idle)
+	}
+	for _, addr := range pings {
+		if err := kit.writeFrame(context.Background(), Header{Type: PacketTypeKeepalive}, appendKeepaliveFrame(keepalivePing, now), addr); err == nil {
+			kit.stats.inc(statKeepalivesSent)
+		}
+	}
+	for _, p := range evicted {
+		kit.stats.inc(statPeersEvicted)
+		if onDisconnect != nil {
+			onDisconnect(p)
+		}
+	}
+}
+
+// handleKeepalive answers a ping with a pong echoing its send time, and
+// records the round-trip time of a pong answering the peer's outstanding
+// ping.
+func (kit *GoUDPKit) handleKeepalive(payload []byte, addr *net.UDPAddr) error {
+	if len(payload) != keepaliveFrameSize {
+		return errors.New("malformed keepalive frame")
+	}
+	sent := int64(binary.BigEndian.Uint64(payload[1:]))
+	switch payload[0] {
+	case keepalivePing:
+		pong := appendKeepaliveFrame(keepalivePong, time.Time{})
+		copy(pong[1:], payload[1:])
+		kit.writeFrame(context.Background(), Header{Type: PacketTypeKeepalive}, pong, addr)
+	case keepalivePong:
+		now := time.Now()
+		kit.mu.Lock()
+		p, ok := kit.peers[addr.String()]
+		if !ok || p.pingSent.IsZero() || p.pingSent.UnixNano() != sent {
+			kit.mu.Unlock()
+			return nil
+		}
+		p.RTT = now.Sub(p.pingSent)
+		p.pingSent = time.Time{}
+		p.confirmed = true
+		rtt := p.RTT
+		kit.mu.Unlock()
+		kit.observeLatency(latencyKeepaliveRTT, rtt)
+	default:
+		return fmt.Errorf("unknown keepalive kind %d", payload[0])
+	}
+	return nil
+}
+
+func appendKeepaliveFrame(kind byte, sent time.Time) []byte {
+	b := make([]byte, keepaliveFrameSize)
+	b[0] = kind
+	if !sent.IsZero() {
+		binary.BigEndian.PutUint64(b[1:], uint64(sent.UnixNano()))
+	}
+	return b
+}
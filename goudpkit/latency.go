@@ -0,0 +1,229 @@
+package goudpkit
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"time"
+)
+
+// DefaultLatencyBuckets are the histogram bucket upper bounds used until
+// SetLatencyBuckets says otherwise: 100µs doubling up to about 3.3s.
+var DefaultLatencyBuckets = func() []time.Duration {
+	b := make([]time.Duration, 16)
+	for i := range b {
+		b[i] = 100 * time.Microsecond << i
+	}
+	return b
+}()
+
+// ErrLatencyObserved is returned by SetLatencyBuckets once a latency has
+// been recorded, since changing the buckets would make the exported
+// histogram totals go backwards.
+var ErrLatencyObserved = errors.New("latency buckets cannot change after the first observation")
+
+type latencyKind int
+
+const (
+	latencyTransit latencyKind = iota
+	latencyAckRTT
+	latencyReassembly
+	latencyQueueing
+	latencyKeepaliveRTT
+	numLatencyKinds
+)
+
+// LatencySummary describes one latency distribution. Percentiles are
+// estimated from the histogram buckets, so they are only as precise as the
+// buckets are fine.
+type LatencySummary struct {
+	Count uint64
+	Mean  time.Duration
+	P50   time.Duration
+	P90   time.Duration
+	P99   time.Duration
+}
+
+type LatencyStats struct {
+	// Transit is the one-way time from the sender's header timestamp to
+	// receipt. It is only meaningful when the peers' clocks agree.
+	Transit LatencySummary
+	// AckRTT is the time from sending a reliable packet to its
+	// acknowledgement, for packets that were not retransmitted.
+	AckRTT LatencySummary
+	// Reassembly is the time from a message's first fragment arriving to
+	// the message being complete.
+	Reassembly LatencySummary
+	// Queueing is the time a packet waits in the priority queues.
+	Queueing LatencySummary
+	// KeepaliveRTT is the time from sending a keepalive ping to its pong.
+	KeepaliveRTT LatencySummary
+}
+
+type histogram struct {
+	mu     sync.Mutex
+	bounds []time.Duration
+	// counts has one entry per bound plus a final +Inf bucket; entries are
+	// not cumulative.
+	counts []uint64
+	count  uint64
+	sum    time.Duration
+	// base is the histogram as of the last reset. The totals above keep
+	// growing, so exporters see them as counters.
+	base histogramData
+}
+
+type histogramData struct {
+	bounds []time.Duration
+	counts []uint64
+	count  uint64
+	sum    time.Duration
+}
+
+func newHistogram(bounds []time.Duration) *histogram {
+	h := &histogram{}
+	h.setBounds(bounds)
+	return h
+}
+
+// setBounds replaces the buckets of an empty histogram. The caller must
+// hold mu or be the only user of h.
+func (h *histogram) setBounds(bounds []time.Duration) {
+	h.bounds = append([]time.Duration(nil), bounds...)
+	h.counts = make([]uint64, len(bounds)+1)
+	h.base = histogramData{counts: make([]uint64, len(bounds)+1)}
+}
+
+func (h *histogram) observe(d time.Duration) {
+	if d < 0 {
+		d = 0
+	}
+	h.mu.Lock()
+	i := sort.Search(len(h.bounds), func(i int) bool { return d <= h.bounds[i] })
+	h.counts[i]++
+	h.count++
+	h.sum += d
+	h.mu.Unlock()
+}
+
+// load returns the observations since the last reset, starting a new
+// interval if reset is set.
+func (h *histogram) load(reset bool) histogramData {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	d := histogramData{
+		bounds: h.bounds,
+		counts: make([]uint64, len(h.counts)),
+		count:  h.count - h.base.count,
+		sum:    h.sum - h.base.sum,
+	}
+	for i, c := range h.counts {
+		d.counts[i] = c - h.base.counts[i]
+	}
+	if reset {
+		h.base = histogramData{
+			counts: append([]uint64(nil), h.counts...),
+			count:  h.count,
+			sum:    h.sum,
+		}
+	}
+	return d
+}
+
+// total returns every observation, regardless of resets.
+func (h *histogram) total() histogramData {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return histogramData{
+		bounds: h.bounds,
+		counts: append([]uint64(nil), h.counts...),
+		count:  h.count,
+		sum:    h.sum,
+	}
+}
+
+// quantile estimates the q-quantile by interpolating linearly within the
+// bucket it falls in. Observations above the last bound are reported as
+// that bound.
+func (d histogramData) quantile(q float64) time.Duration {
+	if d.count == 0 {
+		return 0
+	}
+	rank := q * float64(d.count)
+	var seen float64
+	for i, c := range d.counts {
+		if c == 0 || seen+float64(c) < rank {
+			seen += float64(c)
+			continue
+		}
+		if i == len(d.bounds) {
+			break
+		}
+		var lower time.Duration
+		if i > 0 {
+			lower = d.bounds[i-1]
+		}
+		frac := (rank - seen) / float64(c)
+		return lower + time.Duration(frac*float64(d.bounds[i]-lower))
+	}
+	if len(d.bounds) == 0 {
+		return 0
+	}
+	return d.bounds[len(d.bounds)-1]
+}
+
+func (d histogramData) summary() LatencySummary {
+	s := LatencySummary{Count: d.count}
+	if d.count > 0 {
+		s.Mean = d.sum / time.Duration(d.count)
+		s.P50 = d.quantile(0.5)
+		s.P90 = d.quantile(0.9)
+		s.P99 = d.quantile(0.99)
+	}
+	return s
+}
+
+// latencyStats summarises the kit's histograms, zeroing them if reset is
+// set.
+func (kit *GoUDPKit) latencyStats(reset bool) LatencyStats {
+	return LatencyStats{
+		Transit:      kit.latency[latencyTransit].load(reset).summary(),
+		AckRTT:       kit.latency[latencyAckRTT].load(reset).summary(),
+		Reassembly:   kit.latency[latencyReassembly].load(reset).summary(),
+		Queueing:     kit.latency[latencyQueueing].load(reset).summary(),
+		KeepaliveRTT: kit.latency[latencyKeepaliveRTT].load(reset).summary(),
+	}
+}
+
+func (kit *GoUDPKit) observeLatency(k latencyKind, d time.Duration) {
+	kit.latency[k].observe(d)
+}
+
+// SetLatencyBuckets sets the upper bounds of the latency histogram buckets,
+// which must be positive and increasing. The buckets can only change
+// before any latency is recorded; after that ErrLatencyObserved is
+// returned, so exported histograms stay monotonic.
+func (kit *GoUDPKit) SetLatencyBuckets(buckets []time.Duration) error {
+	if len(buckets) == 0 {
+		return errors.New("no latency buckets")
+	}
+	for i, b := range buckets {
+		if b <= 0 || (i > 0 && b <= buckets[i-1]) {
+			return errors.New("latency buckets must be positive and increasing")
+		}
+	}
+	// hold every histogram so that none changes unless all can
+	for _, h := range kit.latency {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+	}
+	for _, h := range kit.latency {
+		if h.count > 0 {
+			return ErrLatencyObserved
+		}
+	}
+	for _, h := range kit.latency {
+		h.setBounds(buckets)
+	}
+	return nil
+}
@@ -1,12 +1,16 @@
 package goudpkit
 
 import (
+	"errors"
 	"net/http"
+	"strconv"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
+// The process-wide counters below sum every kit in the process. Register
+// them with RegisterMetrics, or use NewCollector for per-kit metrics.
 var (
 	packetsSent = prometheus.NewCounter(prometheus.CounterOpts{
 		Name: "goudpkit_packets_sent_total",
@@ -24,18 +28,177 @@ var (
 		Name: "goudpkit_retry_count_total",
 		Help: "Total retry attempts.",
 	})
+
+	processCounters = [numStatCounters]prometheus.Counter{
+		statPacketsSent:     packetsSent,
+		statPacketsReceived: packetsReceived,
+		statPacketsDropped:  packetsDropped,
+		statRetryCount:      retryCount,
+	}
 )
 
+// RegisterMetrics registers the process-wide counters with the default
+// registry. Calling it more than once is harmless. Per-kit collectors use
+// the same metric names with extra labels, so register them on a different
+// registry.
 func RegisterMetrics() {
-	prometheus.MustRegister(packetsSent, packetsReceived, packetsDropped, retryCount)
+	for _, c := range []prometheus.Collector{packetsSent, packetsReceived, packetsDropped, retryCount} {
+		if err := prometheus.Register(c); err != nil {
+			var already prometheus.AlreadyRegisteredError
+			if !errors.As(err, &already) {
+				panic(err)
+			}
+		}
+	}
 }
 
+// ExportMetricsHTTP serves the default registry at /metrics on addr.
 func ExportMetricsHTTP(addr string) error {
-	http.Handle("/metrics", promhttp.Handler())
-	return http.ListenAndServe(addr, nil)
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	return http.ListenAndServe(addr, mux)
 }
 
 func IncPacketsSent()     { packetsSent.Inc() }
 func IncPacketsReceived() { packetsReceived.Inc() }
 func IncPacketsDropped()  { packetsDropped.Inc() }
 func IncRetryCount()      { retryCount.Inc() }
+
+type CollectorOpts struct {
+	// Name is reported in the "kit" label to tell kits apart.
+	Name string
+	// ConstLabels are added to every metric, alongside "kit" and
+	// "local_addr".
+	ConstLabels prometheus.Labels
+}
+
+// Collector exports the live statistics of one kit, including its latency
+// histograms. It reads the kit's counters at scrape time, so it never
+// drifts from Snapshot. Its counters are totals since the kit was created
+// and keep growing across Reset.
+type Collector struct {
+	kit        *GoUDPKit
+	counters   []kitCounter
+	errors     *prometheus.Desc
+	queueDepth *prometheus.Desc
+	uptime     *prometheus.Desc
+	cwnd       *prometheus.Desc
+	lossRate   *prometheus.Desc
+	peers      *prometheus.Desc
+	latency    [numLatencyKinds]*prometheus.Desc
+}
+
+type kitCounter struct {
+	desc  *prometheus.Desc
+	value func(Stats) uint64
+}
+
+// NewCollector returns a prometheus.Collector for kit. Register it on a
+// registry of your choice. Several kits may share a registry if their
+// collectors use the same ConstLabels names with different values.
+func NewCollector(kit *GoUDPKit, opts CollectorOpts) *Collector {
+	labels := prometheus.Labels{
+		"kit":        opts.Name,
+		"local_addr": kit.conn.LocalAddr().String(),
+	}
+	for k, v := range opts.ConstLabels {
+		labels[k] = v
+	}
+	desc := func(name, help string, variable ...string) *prometheus.Desc {
+		return prometheus.NewDesc("goudpkit_"+name, help, variable, labels)
+	}
+	counter := func(name, help string, value func(Stats) uint64) kitCounter {
+		return kitCounter{desc: desc(name, help), value: value}
+	}
+
+	return &Collector{
+		kit: kit,
+		counters: []kitCounter{
+			counter("packets_sent_total", "Total packets sent.", func(s Stats) uint64 { return s.PacketsSent }),
+			counter("packets_received_total", "Total packets received.", func(s Stats) uint64 { return s.PacketsReceived }),
+			counter("packets_dropped_total", "Total packets dropped.", func(s Stats) uint64 { return s.PacketsDropped }),
+			counter("retry_count_total", "Total retry attempts.", func(s Stats) uint64 { return s.RetryCount }),
+			counter("bytes_sent_total", "Total bytes written, headers included.", func(s Stats) uint64 { return s.BytesSent }),
+			counter("bytes_received_total", "Total bytes read, headers included.", func(s Stats) uint64 { return s.BytesReceived }),
+			counter("handshakes_completed_total", "Total handshakes completed.", func(s Stats) uint64 { return s.HandshakesCompleted }),
+			counter("handshakes_failed_total", "Total handshakes failed.", func(s Stats) uint64 { return s.HandshakesFailed }),
+			counter("replay_duplicates_total", "Total replayed packets dropped.", func(s Stats) uint64 { return s.ReplayDuplicates }),
+			counter("replay_too_old_total", "Total packets dropped as older than the replay window.", func(s Stats) uint64 { return s.ReplayTooOld }),
+			counter("handler_panics_total", "Total panics recovered from Serve handlers.", func(s Stats) uint64 { return s.HandlerPanics }),
+			counter("fec_recovered_total", "Total bulk chunks rebuilt from repair chunks.", func(s Stats) uint64 { return s.FECRecovered }),
+			counter("packets_acked_total", "Total reliable packets acknowledged.", func(s Stats) uint64 { return s.PacketsAcked }),
+			counter("packets_lost_total", "Total reliable packet retransmission timeouts.", func(s Stats) uint64 { return s.PacketsLost }),
+			counter("sends_throttled_total", "Total datagrams delayed or refused by the pacer.", func(s Stats) uint64 { return s.SendsThrottled }),
+			counter("flow_control_stalls_total", "Total reliable sends that waited for the peer's receive window.", func(s Stats) uint64 { return s.FlowControlStalls }),
+			counter("sessions_established_total", "Total sessions established.", func(s Stats) uint64 { return s.SessionsEstablished }),
+			counter("sessions_closed_total", "Total established sessions closed.", func(s Stats) uint64 { return s.SessionsClosed }),
+			counter("keepalives_sent_total", "Total keepalive pings sent to silent peers.", func(s Stats) uint64 { return s.KeepalivesSent }),
+			counter("peers_evicted_total", "Total peers evicted after the idle timeout.", func(s Stats) uint64 { return s.PeersEvicted }),
+		},
+		errors:     desc("errors_total", "Total errors by category.", "category"),
+		queueDepth: desc("queue_depth", "Packets waiting at each priority level.", "level"),
+		uptime:     desc("uptime_seconds", "Seconds since the kit was created."),
+		cwnd:       desc("congestion_window_bytes", "Sum of the peers' congestion windows."),
+		lossRate:   desc("loss_rate", "Fraction of reliable packets lost."),
+		peers:      desc("peers", "Peers in the peer table."),
+		latency: [numLatencyKinds]*prometheus.Desc{
+			latencyTransit:      desc("transit_seconds", "One-way transit time from the sender's header timestamp."),
+			latencyAckRTT:       desc("ack_rtt_seconds", "Round-trip time of acknowledged reliable packets."),
+			latencyReassembly:   desc("reassembly_wait_seconds", "Time from a message's first fragment to its last."),
+			latencyQueueing:     desc("queueing_delay_seconds", "Time packets wait in the priority queues."),
+			latencyKeepaliveRTT: desc("keepalive_rtt_seconds", "Round-trip time of answered keepalive pings."),
+		},
+	}
+}
+
+func (c *Collector) Describe(ch chan<- *prometheus.Desc) {
+	for _, kc := range c.counters {
+		ch <- kc.desc
+	}
+	ch <- c.errors
+	ch <- c.queueDepth
+	ch <- c.uptime
+	ch <- c.cwnd
+	ch <- c.lossRate
+	ch <- c.peers
+	for _, d := range c.latency {
+		ch <- d
+	}
+}
+
+func (c *Collector) Collect(ch chan<- prometheus.Metric) {
+	s := c.kit.totals()
+	for _, kc := range c.counters {
+		ch <- prometheus.MustNewConstMetric(kc.desc, prometheus.CounterValue, float64(kc.value(s)))
+	}
+	for _, e := range []struct {
+		category string
+		value    uint64
+	}{
+		{"send", s.SendErrors},
+		{"read", s.ReadErrors},
+		{"decode", s.DecodeErrors},
+		{"auth", s.AuthErrors},
+		{"decompress", s.DecompressErrors},
+	} {
+		ch <- prometheus.MustNewConstMetric(c.errors, prometheus.CounterValue, float64(e.value), e.category)
+	}
+	for level, depth := range s.QueueDepths {
+		ch <- prometheus.MustNewConstMetric(c.queueDepth, prometheus.GaugeValue, float64(depth), strconv.Itoa(level))
+	}
+	ch <- prometheus.MustNewConstMetric(c.uptime, prometheus.GaugeValue, s.Uptime.Seconds())
+	ch <- prometheus.MustNewConstMetric(c.cwnd, prometheus.GaugeValue, float64(s.CongestionWindow))
+	ch <- prometheus.MustNewConstMetric(c.lossRate, prometheus.GaugeValue, s.LossRate)
+	ch <- prometheus.MustNewConstMetric(c.peers, prometheus.GaugeValue, float64(s.Peers))
+
+	for k, d := range c.latency {
+		h := c.kit.latency[k].total()
+		buckets := make(map[float64]uint64, len(h.bounds))
+		var cumulative uint64
+		for i, b := range h.bounds {
+			cumulative += h.counts[i]
+			buckets[b.Seconds()] = cumulative
+		}
+		ch <- prometheus.MustNewConstHistogram(d, h.count, h.sum.Seconds(), buckets)
+	}
+}
@@ -0,0 +1,370 @@
+// Package netsim is an in-memory network for testing code built on
+// goudpkit. Each Conn implements goudpkit.UDPConn, and every directed link
+// between two addresses can lose, delay, reorder, duplicate and corrupt
+// datagrams, limit bandwidth and enforce an MTU. All random choices come
+// from one seeded source, so a test that writes in the same order sees the
+// same fate for every datagram.
+package netsim
+
+import (
+	"container/heap"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+var ErrAddrInUse = errors.New("netsim: address already in use")
+
+// LinkConfig describes one direction of the path between two endpoints.
+// The zero value is a perfect link: no loss, no delay, unlimited bandwidth.
+type LinkConfig struct {
+	// Loss is the probability, from 0 to 1, that a datagram is dropped.
+	Loss float64
+	// Latency is the fixed one-way delay.
+	Latency time.Duration
+	// Jitter adds a uniformly random delay of up to Jitter.
+	Jitter time.Duration
+	// Reorder is the probability that a datagram is held back by
+	// ReorderDelay, letting later ones overtake it.
+	Reorder      float64
+	ReorderDelay time.Duration
+	// Duplicate is the probability that a datagram is delivered twice.
+	Duplicate float64
+	// Corrupt is the probability that one bit of a datagram is flipped.
+	Corrupt float64
+	// Bandwidth limits the link to this many bytes per second. Zero means
+	// unlimited.
+	Bandwidth int
+	// QueueBytes is how many bytes may wait for a bandwidth-limited link
+	// before further datagrams are dropped. Zero means no limit.
+	QueueBytes int
+	// MTU drops datagrams larger than this many bytes. Zero means no limit.
+	MTU int
+}
+
+// Stats counts what the network did with the datagrams written to it.
+type Stats struct {
+	Sent       uint64
+	Delivered  uint64
+	Lost       uint64
+	QueueDrops uint64
+	Oversize   uint64
+	Unroutable uint64
+	Duplicated uint64
+	Corrupted  uint64
+	Reordered  uint64
+}
+
+type linkKey struct {
+	from, to string
+}
+
+type link struct {
+	cfg       *LinkConfig // nil means the network default
+	busyUntil time.Time
+}
+
+type Network struct {
+	mu          sync.Mutex
+	rng         *rand.Rand
+	conns       map[string]*Conn
+	links       map[linkKey]*link
+	defaultLink LinkConfig
+	nextPort    int
+	seq         uint64
+	stats       Stats
+}
+
+// New returns an empty network whose random choices are drawn from seed.
+func New(seed int64) *Network {
+	return &Network{
+		rng:      rand.New(rand.NewSource(seed)),
+		conns:    make(map[string]*Conn),
+		links:    make(map[linkKey]*link),
+		nextPort: 49152,
+	}
+}
+
+// SetDefaultLink sets the behaviour of every link without its own
+// configuration.
+func (n *Network) SetDefaultLink(cfg LinkConfig) {
+	n.mu.Lock()
+	n.defaultLink = cfg
+	n.mu.Unlock()
+}
+
+// SetLink configures the direction from one address to another. Use it
+// twice, with the addresses swapped, for a symmetric path.
+func (n *Network) SetLink(from, to net.Addr, cfg LinkConfig) {
+	n.mu.Lock()
+	n.link(from.String(), to.String()).cfg = &cfg
+	n.mu.Unlock()
+}
+
+func (n *Network) link(from, to string) *link {
+	key := linkKey{from: from, to: to}
+	l, ok := n.links[key]
+	if !ok {
+		l = &link{}
+		n.links[key] = l
+	}
+	return l
+}
+
+func (n *Network) Stats() Stats {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.stats
+}
+
+// Listen attaches a new endpoint at addr, such as "10.0.0.1:9000". A zero
+// port picks a free one and a missing host means 127.0.0.1.
+func (n *Network) Listen(addr string) (*Conn, error) {
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if udpAddr.IP == nil {
+		udpAddr.IP = net.IPv4(127, 0, 0, 1)
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if udpAddr.Port == 0 {
+		for {
+			udpAddr.Port = n.nextPort
+			n.nextPort++
+			if _, taken := n.conns[udpAddr.String()]; !taken {
+				break
+			}
+		}
+	}
+	if _, taken := n.conns[udpAddr.String()]; taken {
+		return nil, fmt.Errorf("%w: %v", ErrAddrInUse, udpAddr)
+	}
+	c := &Conn{net: n, addr: udpAddr, changed: make(chan struct{})}
+	n.conns[udpAddr.String()] = c
+	return c, nil
+}
+
+// send decides the fate of one datagram and queues any copies that
+// survive on the destination.
+func (n *Network) send(from *net.UDPAddr, b []byte, to *net.UDPAddr) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.stats.Sent++
+
+	l := n.link(from.String(), to.String())
+	cfg := n.defaultLink
+	if l.cfg != nil {
+		cfg = *l.cfg
+	}
+	if cfg.MTU > 0 && len(b) > cfg.MTU {
+		n.stats.Oversize++
+		return
+	}
+	if n.rng.Float64() < cfg.Loss {
+		n.stats.Lost++
+		return
+	}
+
+	now := time.Now()
+	departs := now
+	if cfg.Bandwidth > 0 {
+		if l.busyUntil.After(now) {
+			departs = l.busyUntil
+		}
+		backlog := int(departs.Sub(now).Seconds() * float64(cfg.Bandwidth))
+		if cfg.QueueBytes > 0 && backlog+len(b) > cfg.QueueBytes {
+			n.stats.QueueDrops++
+			return
+		}
+		departs = departs.Add(time.Duration(float64(len(b)) / float64(cfg.Bandwidth) * float64(time.Second)))
+		l.busyUntil = departs
+	}
+
+	copies := 1
+	if n.rng.Float64() < cfg.Duplicate {
+		copies = 2
+		n.stats.Duplicated++
+	}
+	dst, ok := n.conns[to.String()]
+	for i := 0; i < copies; i++ {
+		data := append([]byte(nil), b...)
+		if len(data) > 0 && n.rng.Float64() < cfg.Corrupt {
+			data[n.rng.Intn(len(data))] ^= 1 << n.rng.Intn(8)
+			n.stats.Corrupted++
+		}
+		at := departs.Add(cfg.Latency)
+		if cfg.Jitter > 0 {
+			at = at.Add(time.Duration(n.rng.Int63n(int64(cfg.Jitter) + 1)))
+		}
+		if n.rng.Float64() < cfg.Reorder {
+			at = at.Add(cfg.ReorderDelay)
+			n.stats.Reordered++
+		}
+		if !ok {
+			continue
+		}
+		n.seq++
+		dst.push(datagram{data: data, from: from, at: at, seq: n.seq})
+	}
+	if !ok {
+		n.stats.Unroutable++
+	}
+}
+
+func (n *Network) delivered() {
+	n.mu.Lock()
+	n.stats.Delivered++
+	n.mu.Unlock()
+}
+
+func (n *Network) remove(c *Conn) {
+	n.mu.Lock()
+	if n.conns[c.addr.String()] == c {
+		delete(n.conns, c.addr.String())
+	}
+	n.mu.Unlock()
+}
+
+type datagram struct {
+	data []byte
+	from *net.UDPAddr
+	at   time.Time
+	seq  uint64
+}
+
+// arrivals orders datagrams by arrival time, then by send order.
+type arrivals []datagram
+
+func (a arrivals) Len() int { return len(a) }
+func (a arrivals) Less(i, j int) bool {
+	if a[i].at.Equal(a[j].at) {
+		return a[i].seq < a[j].seq
+	}
+	return a[i].at.Before(a[j].at)
+}
+func (a arrivals) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
+func (a *arrivals) Push(x any)   { *a = append(*a, x.(datagram)) }
+func (a *arrivals) Pop() any {
+	old := *a
+	d := old[len(old)-1]
+	*a = old[:len(old)-1]
+	return d
+}
+
+// Conn is one endpoint on a Network. It implements goudpkit.UDPConn.
+type Conn struct {
+	net  *Network
+	addr *net.UDPAddr
+
+	mu       sync.Mutex
+	pending  arrivals
+	deadline time.Time
+	closed   bool
+	// changed is closed and replaced whenever a waiting reader should look
+	// again. The caller must hold mu.
+	changed chan struct{}
+}
+
+func (c *Conn) wakeLocked() {
+	close(c.changed)
+	c.changed = make(chan struct{})
+}
+
+func (c *Conn) push(d datagram) {
+	c.mu.Lock()
+	if !c.closed {
+		heap.Push(&c.pending, d)
+		c.wakeLocked()
+	}
+	c.mu.Unlock()
+}
+
+// WriteToUDP sends b to addr through the network. Like UDP, it succeeds
+// whether or not the datagram arrives.
+func (c *Conn) WriteToUDP(b []byte, addr *net.UDPAddr) (int, error) {
+	c.mu.Lock()
+	closed := c.closed
+	c.mu.Unlock()
+	if closed {
+		return 0, net.ErrClosed
+	}
+	c.net.send(c.addr, b, addr)
+	return len(b), nil
+}
+
+// ReadFromUDP waits for the next datagram to arrive, or for the read
+// deadline, which fails with an error whose Timeout method reports true.
+func (c *Conn) ReadFromUDP(b []byte) (int, *net.UDPAddr, error) {
+	for {
+		c.mu.Lock()
+		if c.closed {
+			c.mu.Unlock()
+			return 0, nil, net.ErrClosed
+		}
+		now := time.Now()
+		if len(c.pending) > 0 && !c.pending[0].at.After(now) {
+			d := heap.Pop(&c.pending).(datagram)
+			c.mu.Unlock()
+			c.net.delivered()
+			return copy(b, d.data), d.from, nil
+		}
+		if !c.deadline.IsZero() && !c.deadline.After(now) {
+			c.mu.Unlock()
+			return 0, nil, os.ErrDeadlineExceeded
+		}
+		var wakeAt time.Time
+		if len(c.pending) > 0 {
+			wakeAt = c.pending[0].at
+		}
+		if !c.deadline.IsZero() && (wakeAt.IsZero() || c.deadline.Before(wakeAt)) {
+			wakeAt = c.deadline
+		}
+		changed := c.changed
+		c.mu.Unlock()
+
+		if wakeAt.IsZero() {
+			<-changed
+			continue
+		}
+		timer := time.NewTimer(time.Until(wakeAt))
+		select {
+		case <-changed:
+		case <-timer.C:
+		}
+		timer.Stop()
+	}
+}
+
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.deadline = t
+	c.wakeLocked()
+	c.mu.Unlock()
+	return nil
+}
+
+// Close detaches the endpoint from the network and unblocks any reader.
+func (c *Conn) Close() error {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return net.ErrClosed
+	}
+	c.closed = true
+	c.pending = nil
+	c.wakeLocked()
+	c.mu.Unlock()
+	c.net.remove(c)
+	return nil
+}
+
+func (c *Conn) LocalAddr() net.Addr {
+	return c.addr
+}
@@ -0,0 +1,316 @@
+package netsim_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/1cbyc/go-udp-kit/goudpkit"
+	"github.com/1cbyc/go-udp-kit/goudpkit/netsim"
+)
+
+var _ goudpkit.UDPConn = (*netsim.Conn)(nil)
+
+func listen(t *testing.T, n *netsim.Network, addr string) *netsim.Conn {
+	t.Helper()
+	c, err := n.Listen(addr)
+	if err != nil {
+		t.Fatalf("Listen(%q): %v", addr, err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+func read(t *testing.T, c *netsim.Conn, timeout time.Duration) ([]byte, *net.UDPAddr, error) {
+	t.Helper()
+	c.SetReadDeadline(time.Now().Add(timeout))
+	buf := make([]byte, 2048)
+	n, from, err := c.ReadFromUDP(buf)
+	return buf[:n], from, err
+}
+
+func TestAddressingLatencyAndDeadlines(t *testing.T) {
+	t.Parallel()
+	n := netsim.New(1)
+	a := listen(t, n, "10.0.0.1:1000")
+	b := listen(t, n, "10.0.0.2:2000")
+	c := listen(t, n, "10.0.0.3:0")
+	if _, err := n.Listen("10.0.0.1:1000"); !errors.Is(err, netsim.ErrAddrInUse) {
+		t.Fatalf("expected ErrAddrInUse, got %v", err)
+	}
+	n.SetLink(a.LocalAddr(), b.LocalAddr(), netsim.LinkConfig{Latency: 30 * time.Millisecond})
+
+	start := time.Now()
+	a.WriteToUDP([]byte("to b"), b.LocalAddr().(*net.UDPAddr))
+	a.WriteToUDP([]byte("to c"), c.LocalAddr().(*net.UDPAddr))
+
+	data, from, err := read(t, c, time.Second)
+	if err != nil || string(data) != "to c" || from.String() != "10.0.0.1:1000" {
+		t.Fatalf("c got %q from %v, %v", data, from, err)
+	}
+	if _, _, err := read(t, b, 10*time.Millisecond); !isTimeout(err) {
+		t.Fatalf("expected a timeout before the latency elapsed, got %v", err)
+	}
+	data, _, err = read(t, b, time.Second)
+	if err != nil || string(data) != "to b" {
+		t.Fatalf("b got %q, %v", data, err)
+	}
+	if elapsed := time.Since(start); elapsed < 30*time.Millisecond {
+		t.Fatalf("datagram arrived after %v, before the link latency", elapsed)
+	}
+
+	b.Close()
+	if _, _, err := b.ReadFromUDP(make([]byte, 10)); !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("expected net.ErrClosed after Close, got %v", err)
+	}
+	a.WriteToUDP([]byte("gone"), b.LocalAddr().(*net.UDPAddr))
+	if s := n.Stats(); s.Unroutable != 1 {
+		t.Fatalf("expected 1 unroutable datagram, got %+v", s)
+	}
+}
+
+func isTimeout(err error) bool {
+	var nerr net.Error
+	return errors.As(err, &nerr) && nerr.Timeout()
+}
+
+func TestSeededLossIsDeterministic(t *testing.T) {
+	t.Parallel()
+	run := func() []string {
+		n := netsim.New(42)
+		n.SetDefaultLink(netsim.LinkConfig{Loss: 0.3})
+		a := listen(t, n, "10.0.0.1:1000")
+		b := listen(t, n, "10.0.0.2:2000")
+		for i := 0; i < 200; i++ {
+			a.WriteToUDP([]byte(fmt.Sprint(i)), b.LocalAddr().(*net.UDPAddr))
+		}
+		var got []string
+		for {
+			data, _, err := read(t, b, 0)
+			if err != nil {
+				return got
+			}
+			got = append(got, string(data))
+		}
+	}
+	first, second := run(), run()
+	if len(first) < 120 || len(first) > 160 {
+		t.Fatalf("expected about 140 of 200 datagrams at 30%% loss, got %d", len(first))
+	}
+	if fmt.Sprint(first) != fmt.Sprint(second) {
+		t.Fatalf("same seed delivered different datagrams")
+	}
+}
+
+func TestLinkImpairments(t *testing.T) {
+	t.Parallel()
+	n := netsim.New(7)
+	a := listen(t, n, "10.0.0.1:1000")
+	b := listen(t, n, "10.0.0.2:2000")
+	to := b.LocalAddr().(*net.UDPAddr)
+	payload := bytes.Repeat([]byte{0xAA}, 100)
+
+	n.SetLink(a.LocalAddr(), to, netsim.LinkConfig{MTU: 50})
+	a.WriteToUDP(payload, to)
+	if _, _, err := read(t, b, 0); !isTimeout(err) || n.Stats().Oversize != 1 {
+		t.Fatalf("expected the oversize datagram to be dropped, stats %+v", n.Stats())
+	}
+
+	n.SetLink(a.LocalAddr(), to, netsim.LinkConfig{Duplicate: 1, Corrupt: 1})
+	a.WriteToUDP(payload, to)
+	for i := 0; i < 2; i++ {
+		data, _, err := read(t, b, time.Second)
+		if err != nil || bytes.Equal(data, payload) || len(data) != len(payload) {
+			t.Fatalf("copy %d: expected a corrupted duplicate, got %v", i, err)
+		}
+	}
+
+	n.SetLink(a.LocalAddr(), to, netsim.LinkConfig{Reorder: 1, ReorderDelay: 20 * time.Millisecond})
+	a.WriteToUDP([]byte("late"), to)
+	n.SetLink(a.LocalAddr(), to, netsim.LinkConfig{})
+	a.WriteToUDP([]byte("early"), to)
+	if data, _, _ := read(t, b, time.Second); string(data) != "early" {
+		t.Fatalf("expected the held-back datagram to be overtaken, got %q", data)
+	}
+	if data, _, _ := read(t, b, time.Second); string(data) != "late" {
+		t.Fatalf("expected the held-back datagram second, got %q", data)
+	}
+
+	// 10 kB/s with room for two 1 kB datagrams in the queue
+	n.SetLink(a.LocalAddr(), to, netsim.LinkConfig{Bandwidth: 10000, QueueBytes: 2000})
+	start := time.Now()
+	for i := 0; i < 5; i++ {
+		a.WriteToUDP(make([]byte, 1000), to)
+	}
+	for i := 0; i < 2; i++ {
+		if _, _, err := read(t, b, time.Second); err != nil {
+			t.Fatalf("datagram %d: %v", i, err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed < 190*time.Millisecond {
+		t.Fatalf("two 1 kB datagrams crossed a 10 kB/s link in %v", elapsed)
+	}
+	if _, _, err := read(t, b, 50*time.Millisecond); !isTimeout(err) || n.Stats().QueueDrops != 3 {
+		t.Fatalf("expected 3 queue drops, stats %+v", n.Stats())
+	}
+}
+
+func TestReliableDeliveryOverLossyNetwork(t *testing.T) {
+	t.Parallel()
+	n := netsim.New(3)
+	n.SetDefaultLink(netsim.LinkConfig{Loss: 0.3, Latency: time.Millisecond, Jitter: time.Millisecond})
+	retryConfig := goudpkit.RetryConfig{MaxRetries: 20, BaseTimeout: 10 * time.Millisecond, BackoffRate: 1.2}
+	qosConfig := goudpkit.QoSConfig{PriorityLevels: 1}
+	bufferConfig := goudpkit.BufferConfig{MaxBufferSize: 128, FlushInterval: time.Second}
+	sender, _ := goudpkit.NewGoUDPKit("", retryConfig, qosConfig, bufferConfig, listen(t, n, "10.0.0.1:1000"))
+	defer sender.Close()
+	recvConn := listen(t, n, "10.0.0.2:2000")
+	receiver, _ := goudpkit.NewGoUDPKit("", retryConfig, qosConfig, bufferConfig, recvConn)
+	defer receiver.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	got := make(chan string, 32)
+	go receiver.Serve(ctx, goudpkit.HandlerFunc(func(w goudpkit.ResponseWriter, p goudpkit.Packet, addr *net.UDPAddr) {
+		got <- string(p.Data)
+	}))
+
+	packets := make([]goudpkit.Packet, 20)
+	for i := range packets {
+		packets[i] = goudpkit.Packet{SequenceNumber: uint32(i + 1), Data: []byte(fmt.Sprint(i))}
+	}
+	results, err := sender.SendReliable(packets, recvConn.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatalf("SendReliable: %v", err)
+	}
+	for _, r := range results {
+		if r.Status != goudpkit.Delivered {
+			t.Fatalf("packet %d: %v after %d attempts", r.SequenceNumber, r.Status, r.Attempts)
+		}
+	}
+	seen := map[string]bool{}
+	for len(seen) < len(packets) {
+		select {
+		case s := <-got:
+			seen[s] = true
+		case <-time.After(time.Second):
+			t.Fatalf("received %d of %d packets", len(seen), len(packets))
+		}
+	}
+	if s := n.Stats(); s.Lost == 0 {
+		t.Fatalf("expected the network to drop some datagrams, stats %+v", s)
+	}
+}
+
+// bottleneckRun sends 100 reliable 1 kB packets over a 200 kB/s link with
+// a 6 kB queue and returns the network's statistics and the sender's.
+func bottleneckRun(t *testing.T, newController func(mss int) goudpkit.CongestionController) (netsim.Stats, goudpkit.Stats) {
+	t.Helper()
+	n := netsim.New(5)
+	n.SetDefaultLink(netsim.LinkConfig{Latency: 5 * time.Millisecond})
+	retryConfig := goudpkit.RetryConfig{MaxRetries: 50, BaseTimeout: 50 * time.Millisecond, BackoffRate: 1.1}
+	qosConfig := goudpkit.QoSConfig{PriorityLevels: 1}
+	bufferConfig := goudpkit.BufferConfig{MaxBufferSize: 128, FlushInterval: time.Second}
+	sendConn := listen(t, n, "10.0.0.1:1000")
+	sender, _ := goudpkit.NewGoUDPKit("", retryConfig, qosConfig, bufferConfig, sendConn)
+	defer sender.Close()
+	sender.SetCongestionControl(newController)
+	recvConn := listen(t, n, "10.0.0.2:2000")
+	receiver, _ := goudpkit.NewGoUDPKit("", retryConfig, qosConfig, bufferConfig, recvConn)
+	defer receiver.Close()
+	n.SetLink(sendConn.LocalAddr(), recvConn.LocalAddr(), netsim.LinkConfig{Latency: 5 * time.Millisecond, Bandwidth: 200000, QueueBytes: 6000})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go receiver.Serve(ctx, goudpkit.HandlerFunc(func(goudpkit.ResponseWriter, goudpkit.Packet, *net.UDPAddr) {}))
+
+	packets := make([]goudpkit.Packet, 100)
+	for i := range packets {
+		packets[i] = goudpkit.Packet{SequenceNumber: uint32(i + 1), Data: make([]byte, 1000)}
+	}
+	results, err := sender.SendReliable(packets, recvConn.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatalf("SendReliable: %v", err)
+	}
+	for _, r := range results {
+		if r.Status != goudpkit.Delivered {
+			t.Fatalf("packet %d: %v after %d attempts", r.SequenceNumber, r.Status, r.Attempts)
+		}
+	}
+	return n.Stats(), sender.Snapshot()
+}
+
+func TestCongestionControlOverBottleneck(t *testing.T) {
+	t.Parallel()
+	uncontrolled, _ := bottleneckRun(t, nil)
+	if uncontrolled.QueueDrops == 0 {
+		t.Fatalf("expected an uncontrolled burst to overflow the queue, stats %+v", uncontrolled)
+	}
+
+	for name, newController := range map[string]func(int) goudpkit.CongestionController{
+		"newreno": goudpkit.NewNewReno,
+		"cubic":   goudpkit.NewCUBIC,
+		"delay":   goudpkit.NewDelayBased,
+	} {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			ns, stats := bottleneckRun(t, newController)
+			if ns.QueueDrops >= uncontrolled.QueueDrops {
+				t.Fatalf("%d queue drops with congestion control, %d without", ns.QueueDrops, uncontrolled.QueueDrops)
+			}
+			if stats.PacketsAcked != 100 || stats.CongestionWindow <= 0 {
+				t.Fatalf("unexpected sender stats %+v", stats)
+			}
+			if want := float64(stats.PacketsLost) / float64(stats.PacketsAcked+stats.PacketsLost); stats.LossRate != want {
+				t.Fatalf("LossRate %v, want %v", stats.LossRate, want)
+			}
+		})
+	}
+}
+
+func TestPacingAvoidsBottleneckDrops(t *testing.T) {
+	t.Parallel()
+	n := netsim.New(6)
+	retryConfig := goudpkit.RetryConfig{MaxRetries: 1, BaseTimeout: 10 * time.Millisecond, BackoffRate: 1}
+	qosConfig := goudpkit.QoSConfig{PriorityLevels: 1}
+	bufferConfig := goudpkit.BufferConfig{MaxBufferSize: 128, FlushInterval: time.Second}
+	sendConn := listen(t, n, "10.0.0.1:1000")
+	sender, _ := goudpkit.NewGoUDPKit("", retryConfig, qosConfig, bufferConfig, sendConn)
+	defer sender.Close()
+	recvConn := listen(t, n, "10.0.0.2:2000")
+	receiver, _ := goudpkit.NewGoUDPKit("", retryConfig, qosConfig, bufferConfig, recvConn)
+	defer receiver.Close()
+	// 100 kB/s with room for three 1 kB chunks in the queue
+	n.SetLink(sendConn.LocalAddr(), recvConn.LocalAddr(), netsim.LinkConfig{Bandwidth: 100000, QueueBytes: 3200})
+
+	data := make([]byte, 30000)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	sender.SetPacing(goudpkit.PacingConfig{PerDestination: goudpkit.RateLimit{BytesPerSecond: 90000}})
+	errc := make(chan error, 1)
+	go func() { errc <- sender.SendBulkData(data, 1000, recvConn.LocalAddr().(*net.UDPAddr)) }()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	got, _, err := receiver.ReceiveBulkDataContext(ctx)
+	if err != nil {
+		t.Fatalf("ReceiveBulkDataContext: %v, stats %+v", err, n.Stats())
+	}
+	if err := <-errc; err != nil {
+		t.Fatalf("SendBulkData: %v", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatalf("received %d bytes, want %d", len(got), len(data))
+	}
+	if s := n.Stats(); s.QueueDrops != 0 {
+		t.Fatalf("paced transfer overflowed the queue, stats %+v", s)
+	}
+	if s := sender.Snapshot(); s.SendsThrottled == 0 {
+		t.Fatalf("expected throttled sends, stats %+v", s)
+	}
+}
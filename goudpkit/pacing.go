@@ -0,0 +1,211 @@
+package goudpkit
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+var (
+	// ErrRateLimited is returned by sends that would exceed the pacing
+	// limits when PacingConfig.NonBlocking is set.
+	ErrRateLimited = errors.New("send rate limit exceeded")
+	// ErrBadPacingConfig is returned by SetPacing for negative limits.
+	ErrBadPacingConfig = errors.New("invalid pacing configuration")
+)
+
+// RateLimit caps a flow of datagrams, headers included. A zero rate is
+// unlimited.
+type RateLimit struct {
+	BytesPerSecond   int
+	PacketsPerSecond int
+	// BurstBytes and BurstPackets are how far a flow that has been idle
+	// may run ahead of its rate. Zero allows a single datagram, which
+	// spaces datagrams evenly.
+	BurstBytes   int
+	BurstPackets int
+}
+
+func (l RateLimit) enabled() bool {
+	return l.BytesPerSecond > 0 || l.PacketsPerSecond > 0
+}
+
+// PacingConfig sets the token buckets that data and bulk datagrams must
+// pass before they are written. Acks, handshakes and transfer manifests
+// are never paced.
+type PacingConfig struct {
+	// Kit limits the kit's traffic to all destinations together.
+	Kit RateLimit
+	// PerDestination limits the traffic to each destination address.
+	PerDestination RateLimit
+	// NonBlocking makes a send that would exceed a limit fail with
+	// ErrRateLimited instead of waiting for the tokens it needs.
+	NonBlocking bool
+}
+
+// tokenBucket holds up to burst tokens, refilled at rate per second.
+// Tokens are taken as datagrams are admitted, so they may go negative,
+// and the deficit is the time later datagrams must wait.
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate, burst int, now time.Time) *tokenBucket {
+	if rate <= 0 {
+		return nil
+	}
+	b := &tokenBucket{rate: float64(rate), burst: float64(burst), last: now}
+	b.tokens = b.burst
+	return b
+}
+
+// delay returns how long to wait until n tokens are available. A datagram
+// larger than the burst only waits for a full bucket, so with no burst at
+// all each datagram waits out the deficit left by the one before.
+func (b *tokenBucket) delay(n float64, now time.Time) time.Duration {
+	if b == nil {
+		return 0
+	}
+	b.tokens = min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+	short := min(n, b.burst) - b.tokens
+	if short <= 0 {
+		return 0
+	}
+	return time.Duration(short / b.rate * float64(time.Second))
+}
+
+func (b *tokenBucket) take(n float64) {
+	if b != nil {
+		b.tokens -= n
+	}
+}
+
+// refund returns n tokens taken for a datagram that was never sent.
+func (b *tokenBucket) refund(n float64) {
+	if b != nil {
+		b.tokens = min(b.burst, b.tokens+n)
+	}
+}
+
+// pacer applies one RateLimit with a bucket for bytes and one for packets.
+type pacer struct {
+	bytes    *tokenBucket
+	packets  *tokenBucket
+	lastUsed time.Time
+}
+
+func newPacer(l RateLimit, now time.Time) *pacer {
+	if !l.enabled() {
+		return nil
+	}
+	return &pacer{
+		bytes:    newTokenBucket(l.BytesPerSecond, l.BurstBytes, now),
+		packets:  newTokenBucket(l.PacketsPerSecond, l.BurstPackets, now),
+		lastUsed: now,
+	}
+}
+
+func (p *pacer) delay(size int, now time.Time) time.Duration {
+	if p == nil {
+		return 0
+	}
+	p.lastUsed = now
+	return max(p.bytes.delay(float64(size), now), p.packets.delay(1, now))
+}
+
+func (p *pacer) take(size int) {
+	if p != nil {
+		p.bytes.take(float64(size))
+		p.packets.take(1)
+	}
+}
+
+func (p *pacer) refund(size int) {
+	if p != nil {
+		p.bytes.refund(float64(size))
+		p.packets.refund(1)
+	}
+}
+
+// SetPacing limits the rate at which SendPacket, SendMessage, SendReliable,
+// SendBulkData and the transfer functions write datagrams. A zero config
+// turns pacing off, which is the default.
+func (kit *GoUDPKit) SetPacing(cfg PacingConfig) error {
+	for _, l := range []RateLimit{cfg.Kit, cfg.PerDestination} {
+		if l.BytesPerSecond < 0 || l.PacketsPerSecond < 0 || l.BurstBytes < 0 || l.BurstPackets < 0 {
+			return fmt.Errorf("%w: %+v", ErrBadPacingConfig, l)
+		}
+	}
+	kit.mu.Lock()
+	defer kit.mu.Unlock()
+	kit.pacing = cfg
+	kit.kitPacer = newPacer(cfg.Kit, time.Now())
+	kit.peerPacers = make(map[string]*pacer)
+	return nil
+}
+
+// pace admits a datagram of size bytes to addr, waiting until the kit's
+// and the destination's buckets hold enough tokens, or failing with
+// ErrRateLimited in non-blocking mode. If the wait is cut short, the
+// tokens go back to the buckets they were taken from.
+func (kit *GoUDPKit) pace(ctx context.Context, size int, addr *net.UDPAddr) error {
+	kit.mu.Lock()
+	if !kit.pacing.Kit.enabled() && !kit.pacing.PerDestination.enabled() {
+		kit.mu.Unlock()
+		return nil
+	}
+	now := time.Now()
+	peer := kit.peerPacers[addr.String()]
+	if peer == nil && kit.pacing.PerDestination.enabled() {
+		peer = newPacer(kit.pacing.PerDestination, now)
+		kit.peerPacers[addr.String()] = peer
+	}
+	wait := max(kit.kitPacer.delay(size, now), peer.delay(size, now))
+	if wait > 0 && kit.pacing.NonBlocking {
+		kit.mu.Unlock()
+		kit.stats.inc(statSendsThrottled)
+		return ErrRateLimited
+	}
+	own := kit.kitPacer
+	own.take(size)
+	peer.take(size)
+	kit.mu.Unlock()
+
+	if wait == 0 {
+		return nil
+	}
+	kit.stats.inc(statSendsThrottled)
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	var err error
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		err = ctx.Err()
+	case <-kit.done:
+		err = ErrClosed
+	}
+	kit.mu.Lock()
+	own.refund(size)
+	peer.refund(size)
+	kit.mu.Unlock()
+	return err
+}
+
+// prunePacers forgets the buckets of destinations idle for longer than
+// ackRetention, by which time they have refilled. The caller must hold
+// mu.
+func (kit *GoUDPKit) prunePacers(now time.Time) {
+	for peer, p := range kit.peerPacers {
+		if now.Sub(p.lastUsed) > ackRetention {
+			delete(kit.peerPacers, peer)
+		}
+	}
+}
@@ -1,14 +1,273 @@
 package goudpkit
 
 import (
+	"errors"
+	"fmt"
 	"math/rand"
+	"net"
+	"sync"
 	"time"
 )
 
+var ErrQueueFull = errors.New("priority queue full")
+
+type SchedulingPolicy int
+
+const (
+	// StrictPriority always sends from the highest non-empty level.
+	StrictPriority SchedulingPolicy = iota
+	// WeightedFair shares the link between levels in proportion to
+	// QoSConfig.Weights using deficit round robin.
+	WeightedFair
+)
+
+type QueueStats struct {
+	Level    int
+	Depth    int
+	Enqueued uint64
+	Sent     uint64
+	Dropped  uint64
+}
+
+type queuedPacket struct {
+	packet   Packet
+	addr     *net.UDPAddr
+	enqueued time.Time
+}
+
+type priorityQueue struct {
+	items   []queuedPacket
+	limit   int
+	weight  int
+	deficit int
+	stats   QueueStats
+}
+
+type scheduler struct {
+	mu      sync.Mutex
+	policy  SchedulingPolicy
+	queues  []*priorityQueue
+	next    int
+	visited bool
+	signal  chan struct{}
+	closed  bool
+}
+
+func newScheduler(cfg QoSConfig) *scheduler {
+	levels := cfg.PriorityLevels
+	if levels <= 0 {
+		levels = len(cfg.PriorityQueues)
+	}
+	if levels <= 0 {
+		levels = 1
+	}
+
+	s := &scheduler{
+		policy: cfg.Policy,
+		queues: make([]*priorityQueue, levels),
+		next:   levels - 1,
+		signal: make(chan struct{}, 1),
+	}
+	for i := range s.queues {
+		q := &priorityQueue{weight: 1, stats: QueueStats{Level: i}}
+		if i < len(cfg.Weights) && cfg.Weights[i] > 0 {
+			q.weight = cfg.Weights[i]
+		}
+		if i < len(cfg.QueueLimits) && cfg.QueueLimits[i] > 0 {
+			q.limit = cfg.QueueLimits[i]
+		}
+		s.queues[i] = q
+	}
+	return s
+}
+
+// level maps a packet priority onto a queue index. Higher priorities are
+// more urgent; out-of-range values are clamped.
+func (s *scheduler) level(priority int) int {
+	if priority < 0 {
+		return 0
+	}
+	if priority >= len(s.queues) {
+		return len(s.queues) - 1
+	}
+	return priority
+}
+
+func (s *scheduler) enqueue(qp queuedPacket) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return ErrClosed
+	}
+	q := s.queues[s.level(qp.packet.Priority)]
+	if q.limit > 0 && len(q.items) >= q.limit {
+		q.stats.Dropped++
+		s.mu.Unlock()
+		return ErrQueueFull
+	}
+	q.items = append(q.items, qp)
+	q.stats.Enqueued++
+	s.mu.Unlock()
+
+	select {
+	case s.signal <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// dequeue picks the next packet to send. quantum is the number of bytes a
+// level of weight 1 may send per WeightedFair round.
+func (s *scheduler) dequeue(quantum int) (queuedPacket, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	empty := true
+	for _, q := range s.queues {
+		if len(q.items) > 0 {
+			empty = false
+			break
+		}
+	}
+	if empty {
+		return queuedPacket{}, false
+	}
+
+	if s.policy != WeightedFair {
+		for i := len(s.queues) - 1; i >= 0; i-- {
+			if q := s.queues[i]; len(q.items) > 0 {
+				return s.pop(q), true
+			}
+		}
+	}
+
+	for {
+		q := s.queues[s.next]
+		if len(q.items) == 0 {
+			q.deficit = 0
+			s.advance()
+			continue
+		}
+		if !s.visited {
+			q.deficit += q.weight * quantum
+			s.visited = true
+		}
+		if cost := HeaderSize + len(q.items[0].packet.Data); q.deficit >= cost {
+			q.deficit -= cost
+			return s.pop(q), true
+		}
+		s.advance()
+	}
+}
+
+func (s *scheduler) advance() {
+	s.next--
+	if s.next < 0 {
+		s.next = len(s.queues) - 1
+	}
+	s.visited = false
+}
+
+func (s *scheduler) pop(q *priorityQueue) queuedPacket {
+	qp := q.items[0]
+	q.items[0] = queuedPacket{}
+	q.items = q.items[1:]
+	q.stats.Sent++
+	return qp
+}
+
+// close stops the scheduler accepting packets. Those already queued are
+// still handed out by dequeue.
+func (s *scheduler) close() {
+	s.mu.Lock()
+	s.closed = true
+	s.mu.Unlock()
+}
+
+func (s *scheduler) snapshot() []QueueStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := make([]QueueStats, len(s.queues))
+	for i, q := range s.queues {
+		out[i] = q.stats
+		out[i].Depth = len(q.items)
+	}
+	return out
+}
+
+// UnsentError is returned by Close when packets queued with Enqueue failed
+// to send while the kit was shutting down.
+type UnsentError struct {
+	Packets []Packet
+	// Err is the first send error.
+	Err error
+}
+
+func (e *UnsentError) Error() string {
+	return fmt.Sprintf("%d queued packets not sent: %v", len(e.Packets), e.Err)
+}
+
+func (e *UnsentError) Unwrap() error { return e.Err }
+
+// Enqueue queues packet for asynchronous sending to addr at the level given
+// by packet.Priority. It returns ErrQueueFull when that level is at its
+// QueueLimits entry, or ErrClosed once the kit is closed.
+func (kit *GoUDPKit) Enqueue(packet Packet, addr *net.UDPAddr) error {
+	err := kit.sched.enqueue(queuedPacket{packet: packet, addr: addr, enqueued: time.Now()})
+	if err == ErrQueueFull {
+		kit.stats.inc(statPacketsDropped)
+	}
+	return err
+}
+
+// QueueStats reports the depth and counters of every priority level,
+// lowest priority first.
+func (kit *GoUDPKit) QueueStats() []QueueStats {
+	return kit.sched.snapshot()
+}
+
+// runScheduler sends queued packets until the kit is closed, and then
+// until the queues are empty.
+func (kit *GoUDPKit) runScheduler() {
+	defer kit.wg.Done()
+	for {
+		kit.mu.Lock()
+		quantum := kit.mtu
+		kit.mu.Unlock()
+
+		qp, ok := kit.sched.dequeue(quantum)
+		if !ok {
+			select {
+			case <-kit.sched.signal:
+				continue
+			case <-kit.done:
+				return
+			}
+		}
+		kit.observeLatency(latencyQueueing, time.Since(qp.enqueued))
+		if err := kit.SendPacket(qp.packet, qp.addr); err != nil {
+			kit.mu.Lock()
+			kit.stats.inc(statPacketsDropped)
+			select {
+			case <-kit.done:
+				kit.unsent = append(kit.unsent, qp.packet)
+				if kit.unsentErr == nil {
+					kit.unsentErr = err
+				}
+			default:
+			}
+			kit.mu.Unlock()
+		}
+	}
+}
+
+// SimulatePacketLoss counts a dropped packet with the given probability.
+//
+// Deprecated: it affects no traffic. Wrap the connection in a FaultConn to
+// drop real packets.
 func (kit *GoUDPKit) SimulatePacketLoss(lossPercentage int) {
-	rand.Seed(time.Now().UnixNano())
 	if rand.Intn(100) < lossPercentage {
-		kit.stats.PacketsDropped++
+		kit.stats.inc(statPacketsDropped)
 		return
 	}
 }
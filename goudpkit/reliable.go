@@ -0,0 +1,437 @@
+package goudpkit
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
+	"sort"
+	"time"
+)
+
+const (
+	maxSackBlocks      = 32
+	ackRetention       = 30 * time.Second
+	defaultBaseTimeout = 100 * time.Millisecond
+)
+
+type DeliveryStatus int
+
+const (
+	Delivered DeliveryStatus = iota
+	GaveUp
+)
+
+func (s DeliveryStatus) String() string {
+	switch s {
+	case Delivered:
+		return "delivered"
+	case GaveUp:
+		return "gave up"
+	}
+	return "unknown"
+}
+
+type DeliveryResult struct {
+	SequenceNumber uint32
+	Status         DeliveryStatus
+	Attempts       int
+}
+
+type inboundPacket struct {
+	packet Packet
+	addr   *net.UDPAddr
+}
+
+type sackBlock struct {
+	start, end uint32
+}
+
+// reliableSend collects the acknowledgements for one SendReliable call.
+// Its epoch travels in the message ID of every packet the call sends, so
+// that the receiver keeps each call's sequence numbers apart and a later
+// call, or a restarted sender, may reuse them.
+type reliableSend struct {
+	epoch uint32
+	acked map[uint32]bool
+}
+
+// header returns the header fields the send's packets share.
+func (rs *reliableSend) header() Header {
+	return Header{Flags: FlagAckRequested, MessageID: rs.epoch}
+}
+
+type pendingSend struct {
+	packet   Packet
+	size     int
+	sent     time.Time
+	deadline time.Time
+	timeout  time.Duration
+	attempts int
+}
+
+// SendReliable sends packets to addr with FlagAckRequested set and
+// retransmits every packet the peer has not selectively acknowledged,
+// following the kit's RetryConfig. No more packets are left unacknowledged
+// than the receive window the peer advertises in its acks, and with
+// congestion control on, packets also wait until the peer's congestion
+// window has room for them. Results are
+// returned in the order of packets. If a send fails, the results so far
+// are returned with the error, and packets not yet settled are reported as
+// GaveUp. Data packets read while waiting for acknowledgements are queued
+// for ReceivePacket.
+func (kit *GoUDPKit) SendReliable(packets []Packet, addr *net.UDPAddr) ([]DeliveryResult, error) {
+	peer := addr.String()
+	kit.mu.Lock()
+	if _, busy := kit.ackWait[peer]; busy {
+		kit.mu.Unlock()
+		return nil, errors.New("reliable send to peer already in progress")
+	}
+	rs := &reliableSend{epoch: kit.newEpoch(), acked: make(map[uint32]bool, len(packets))}
+	for _, p := range packets {
+		rs.acked[p.SequenceNumber] = false
+	}
+	kit.ackWait[peer] = rs
+	kit.mu.Unlock()
+	defer func() {
+		kit.mu.Lock()
+		delete(kit.ackWait, peer)
+		delete(kit.peerWindows, peer)
+		kit.mu.Unlock()
+	}()
+
+	baseTimeout, backoff := kit.retryTiming()
+
+	results := make([]DeliveryResult, len(packets))
+	for i, p := range packets {
+		results[i] = DeliveryResult{SequenceNumber: p.SequenceNumber, Status: GaveUp}
+	}
+	pending := make(map[int]*pendingSend, len(packets))
+	inflight, unsent := 0, 0
+	// stalled is when to probe a peer whose window is closed
+	var stalled time.Time
+
+	buf := make([]byte, 65535)
+	for len(pending) > 0 || unsent < len(packets) {
+		inflight -= kit.collectAcks(peer, pending, results)
+
+		// always allow one packet in flight, however small the window
+		for unsent < len(packets) {
+			size := HeaderSize + len(packets[unsent].Data)
+			kit.mu.Lock()
+			cc := kit.controller(peer)
+			full := cc != nil && inflight > 0 && inflight+size > cc.Window()
+			credit := kit.sendCredit(peer)
+			kit.mu.Unlock()
+			if full {
+				break
+			}
+			if len(pending) >= credit {
+				// out of credit: wait for acks to reopen the window, or
+				// for a window update, probing with one packet if none
+				// comes within a retransmission timeout
+				if stalled.IsZero() {
+					kit.stats.inc(statFlowControlStalls)
+					stalled = time.Now().Add(baseTimeout)
+				}
+				if len(pending) > 0 || time.Now().Before(stalled) {
+					break
+				}
+			}
+			stalled = time.Time{}
+			if err := kit.sendData(context.Background(), packets[unsent], rs.header(), addr); err != nil {
+				return results, err
+			}
+			pending[unsent] = &pendingSend{packet: packets[unsent], size: size, sent: time.Now(), deadline: time.Now().Add(baseTimeout), timeout: baseTimeout, attempts: 1}
+			inflight += size
+			unsent++
+		}
+		if len(pending) == 0 && stalled.IsZero() {
+			continue
+		}
+
+		now := time.Now()
+		next := time.Time{}
+		for i, ps := range pending {
+			if now.Before(ps.deadline) {
+				if next.IsZero() || ps.deadline.Before(next) {
+					next = ps.deadline
+				}
+				continue
+			}
+			kit.stats.inc(statPacketsLost)
+			kit.mu.Lock()
+			if cc := kit.controller(peer); cc != nil {
+				cc.OnLoss(ps.size)
+			}
+			kit.mu.Unlock()
+			if ps.attempts > kit.retryConfig.MaxRetries {
+				results[i].Attempts = ps.attempts
+				delete(pending, i)
+				inflight -= ps.size
+				continue
+			}
+			if err := kit.sendData(context.Background(), ps.packet, rs.header(), addr); err != nil {
+				return results, err
+			}
+			kit.stats.inc(statRetryCount)
+			ps.attempts++
+			ps.timeout = time.Duration(float64(ps.timeout) * backoff)
+			ps.deadline = now.Add(ps.timeout)
+			if next.IsZero() || ps.deadline.Before(next) {
+				next = ps.deadline
+			}
+		}
+		if len(pending) == 0 && !stalled.IsZero() {
+			next = stalled
+		}
+		if next.IsZero() {
+			continue
+		}
+
+		if err := kit.pollOnce(context.Background(), buf, next); err != nil {
+			return results, err
+		}
+	}
+
+	return results, nil
+}
+
+// newEpoch returns the epoch for a new reliable send. Epochs count up from
+// a random start, so they differ between calls and across restarts. Zero,
+// the message ID of packets sent by other means, is skipped. The caller
+// must hold mu.
+func (kit *GoUDPKit) newEpoch() uint32 {
+	kit.nextEpoch++
+	if kit.nextEpoch == 0 {
+		kit.nextEpoch++
+	}
+	return kit.nextEpoch
+}
+
+// retryTiming returns the initial retransmission timeout and backoff
+// factor from RetryConfig, with defaults for unusable values.
+func (kit *GoUDPKit) retryTiming() (time.Duration, float64) {
+	baseTimeout := kit.retryConfig.BaseTimeout
+	if baseTimeout <= 0 {
+		baseTimeout = defaultBaseTimeout
+	}
+	backoff := kit.retryConfig.BackoffRate
+	if backoff < 1 {
+		backoff = 1
+	}
+	return baseTimeout, backoff
+}
+
+// pollOnce reads and dispatches at most one datagram, waiting no later than
+// deadline or until ctx is done. Deliverable packets are queued for
+// ReceivePacket. A timeout is not an error.
+func (kit *GoUDPKit) pollOnce(ctx context.Context, buf []byte, deadline time.Time) error {
+	n, from, err := kit.readFrom(ctx, buf, deadline)
+	if err != nil {
+		if kit.isClosed() {
+			return ErrClosed
+		}
+		if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
+			return nil
+		}
+		return err
+	}
+	packet, ok, err := kit.handleDatagram(buf[:n], from)
+	if err == nil && ok {
+		kit.mu.Lock()
+		kit.inbox = append(kit.inbox, inboundPacket{packet: packet, addr: from})
+		kit.mu.Unlock()
+	}
+	return nil
+}
+
+// collectAcks settles the pending packets the peer has acknowledged and
+// returns the number of bytes they took up in flight.
+func (kit *GoUDPKit) collectAcks(peer string, pending map[int]*pendingSend, results []DeliveryResult) int {
+	kit.mu.Lock()
+	defer kit.mu.Unlock()
+	rs := kit.ackWait[peer]
+	cc := kit.controller(peer)
+	settled := 0
+	for i, ps := range pending {
+		if rs.acked[ps.packet.SequenceNumber] {
+			results[i].Status = Delivered
+			results[i].Attempts = ps.attempts
+			delete(pending, i)
+			settled += ps.size
+			kit.stats.inc(statPacketsAcked)
+			// a retransmitted packet's ack could answer any attempt
+			var rtt time.Duration
+			if ps.attempts == 1 {
+				rtt = time.Since(ps.sent)
+				kit.observeLatency(latencyAckRTT, rtt)
+			}
+			if cc != nil {
+				cc.OnAck(ps.size, rtt)
+			}
+		}
+	}
+	return settled
+}
+
+func (kit *GoUDPKit) popInbox() (inboundPacket, bool) {
+	kit.mu.Lock()
+	if len(kit.inbox) == 0 {
+		kit.mu.Unlock()
+		return inboundPacket{}, false
+	}
+	in := kit.inbox[0]
+	kit.inbox = kit.inbox[1:]
+	kit.mu.Unlock()
+	kit.sendWindowUpdates()
+	return in, true
+}
+
+// handleAck marks the packets h acknowledges as acked, if they belong to
+// the reliable send in progress to addr.
+func (kit *GoUDPKit) handleAck(h Header, payload []byte, addr *net.UDPAddr) {
+	flags := h.Flags
+	window := -1
+	if flags&FlagWindow != 0 {
+		var err error
+		if window, payload, err = splitWindow(payload); err != nil {
+			kit.stats.inc(statDecodeErrors)
+			kit.stats.inc(statPacketsDropped)
+			return
+		}
+	}
+	blocks, err := decodeSack(payload)
+	if err != nil {
+		kit.stats.inc(statDecodeErrors)
+		kit.stats.inc(statPacketsDropped)
+		return
+	}
+
+	kit.mu.Lock()
+	defer kit.mu.Unlock()
+	rs, ok := kit.ackWait[addr.String()]
+	if !ok || rs.epoch != h.MessageID {
+		return
+	}
+	if window >= 0 {
+		kit.peerWindows[addr.String()] = window
+	}
+	for seq := range rs.acked {
+		for _, b := range blocks {
+			if seq >= b.start && seq <= b.end {
+				rs.acked[seq] = true
+				break
+			}
+		}
+	}
+}
+
+// recordReceived remembers seq for the sending peer's reliable send epoch
+// and reports whether it had already been seen.
+func (kit *GoUDPKit) recordReceived(addr *net.UDPAddr, epoch, seq uint32) bool {
+	kit.mu.Lock()
+	defer kit.mu.Unlock()
+	key := messageKey{peer: addr.String(), id: epoch}
+	seen, ok := kit.received[key]
+	if !ok {
+		seen = make(map[uint32]time.Time)
+		kit.received[key] = seen
+	}
+	_, duplicate := seen[seq]
+	seen[seq] = time.Now()
+	return duplicate
+}
+
+// sendAck acknowledges seq and the other packets received from addr in the
+// same epoch, advertising the room left in the receive window after the
+// held packets the caller is about to hand over.
+func (kit *GoUDPKit) sendAck(addr *net.UDPAddr, epoch, seq uint32, held int) {
+	kit.mu.Lock()
+	seen := kit.received[messageKey{peer: addr.String(), id: epoch}]
+	seqs := make([]uint32, 0, len(seen))
+	for s := range seen {
+		seqs = append(seqs, s)
+	}
+	window := max(kit.receiveCredit()-held, 0)
+	if window == 0 {
+		kit.closedWindows[addr.String()] = windowUpdate{addr: addr, epoch: epoch, seq: seq}
+	}
+	kit.mu.Unlock()
+
+	payload := binary.BigEndian.AppendUint32(nil, uint32(window))
+	payload = append(payload, encodeSack(sackBlocks(seqs, seq))...)
+	h := Header{Type: PacketTypeAck, Flags: FlagWindow, SequenceNumber: seq, MessageID: epoch}
+	kit.writeFrame(context.Background(), h, payload, addr)
+}
+
+// pruneReceived forgets sequence numbers older than ackRetention. The
+// caller must hold kit.mu.
+func (kit *GoUDPKit) pruneReceived(now time.Time) {
+	for key, seen := range kit.received {
+		for seq, at := range seen {
+			if now.Sub(at) > ackRetention {
+				delete(seen, seq)
+			}
+		}
+		if len(seen) == 0 {
+			delete(kit.received, key)
+		}
+	}
+}
+
+// sackBlocks merges seqs into contiguous ranges. As with TCP SACK, the
+// block containing the triggering sequence number comes first, followed by
+// the highest remaining blocks, up to maxSackBlocks.
+func sackBlocks(seqs []uint32, trigger uint32) []sackBlock {
+	if len(seqs) == 0 {
+		return nil
+	}
+	sort.Slice(seqs, func(i, j int) bool { return seqs[i] < seqs[j] })
+
+	var blocks []sackBlock
+	for _, s := range seqs {
+		if n := len(blocks); n > 0 && blocks[n-1].end+1 == s {
+			blocks[n-1].end = s
+			continue
+		}
+		blocks = append(blocks, sackBlock{start: s, end: s})
+	}
+
+	ordered := make([]sackBlock, 0, maxSackBlocks)
+	for i, b := range blocks {
+		if trigger >= b.start && trigger <= b.end {
+			ordered = append(ordered, b)
+			blocks = append(blocks[:i], blocks[i+1:]...)
+			break
+		}
+	}
+	for i := len(blocks) - 1; i >= 0 && len(ordered) < maxSackBlocks; i-- {
+		ordered = append(ordered, blocks[i])
+	}
+	return ordered
+}
+
+func encodeSack(blocks []sackBlock) []byte {
+	buf := make([]byte, 8*len(blocks))
+	for i, b := range blocks {
+		binary.BigEndian.PutUint32(buf[i*8:], b.start)
+		binary.BigEndian.PutUint32(buf[i*8+4:], b.end)
+	}
+	return buf
+}
+
+func decodeSack(payload []byte) ([]sackBlock, error) {
+	if len(payload)%8 != 0 || len(payload) > 8*maxSackBlocks {
+		return nil, errors.New("malformed acknowledgement")
+	}
+	blocks := make([]sackBlock, len(payload)/8)
+	for i := range blocks {
+		blocks[i].start = binary.BigEndian.Uint32(payload[i*8:])
+		blocks[i].end = binary.BigEndian.Uint32(payload[i*8+4:])
+		if blocks[i].end < blocks[i].start {
+			return nil, errors.New("malformed acknowledgement")
+		}
+	}
+	return blocks, nil
+}
@@ -0,0 +1,140 @@
+package goudpkit
+
+import (
+	"errors"
+	"net"
+	"time"
+)
+
+// DefaultReplayWindow is the number of packet numbers, below the highest
+// one seen, that the anti-replay window tracks for each peer session.
+const DefaultReplayWindow = 1024
+
+type replayVerdict int
+
+const (
+	replayAccept replayVerdict = iota
+	replayDuplicate
+	replayTooOld
+)
+
+// replayWindow is a sliding bitmap over the packet numbers of one sender,
+// in the style of the IPsec and DTLS anti-replay windows.
+type replayWindow struct {
+	size     uint64
+	top      uint64
+	bits     []uint64
+	lastUsed time.Time
+}
+
+func newReplayWindow(size int) *replayWindow {
+	words := (size + 63) / 64
+	return &replayWindow{size: uint64(words * 64), bits: make([]uint64, words)}
+}
+
+func (w *replayWindow) bit(pn uint64) (int, uint64) {
+	i := pn % w.size
+	return int(i / 64), 1 << (i % 64)
+}
+
+// check records pn and reports whether it is new, a duplicate, or too far
+// behind the highest packet number to tell.
+func (w *replayWindow) check(pn uint64) replayVerdict {
+	if pn == 0 {
+		return replayTooOld
+	}
+	if pn > w.top {
+		if pn-w.top >= w.size {
+			for i := range w.bits {
+				w.bits[i] = 0
+			}
+		} else {
+			for n := w.top + 1; n < pn; n++ {
+				word, mask := w.bit(n)
+				w.bits[word] &^= mask
+			}
+		}
+		w.top = pn
+		word, mask := w.bit(pn)
+		w.bits[word] |= mask
+		return replayAccept
+	}
+	if w.top-pn >= w.size {
+		return replayTooOld
+	}
+	word, mask := w.bit(pn)
+	if w.bits[word]&mask != 0 {
+		return replayDuplicate
+	}
+	w.bits[word] |= mask
+	return replayAccept
+}
+
+type replayKey struct {
+	peer   string
+	sender [senderIDSize]byte
+}
+
+// SetReplayWindow sets how many packet numbers behind the newest one are
+// tracked per peer session. Zero disables replay protection.
+func (kit *GoUDPKit) SetReplayWindow(size int) error {
+	if size < 0 {
+		return errors.New("replay window size must not be negative")
+	}
+	kit.mu.Lock()
+	kit.replayWindowSize = size
+	kit.replayWindows = make(map[replayKey]*replayWindow)
+	kit.mu.Unlock()
+	return nil
+}
+
+// acceptPacketNumber runs pn through the replay window of the session it
+// was opened with: session for handshake peers, or the sender's ID under a
+// shared key. It reports whether the packet should be delivered.
+func (kit *GoUDPKit) acceptPacketNumber(session *peerSession, addr *net.UDPAddr, sealed []byte, pn uint64) bool {
+	kit.mu.Lock()
+	defer kit.mu.Unlock()
+	if kit.replayWindowSize == 0 {
+		return true
+	}
+
+	var w *replayWindow
+	if session != nil {
+		if session.replay == nil {
+			session.replay = newReplayWindow(kit.replayWindowSize)
+		}
+		w = session.replay
+	} else {
+		key := replayKey{peer: addr.String()}
+		copy(key.sender[:], sealed)
+		w = kit.replayWindows[key]
+		if w == nil {
+			w = newReplayWindow(kit.replayWindowSize)
+			kit.replayWindows[key] = w
+		}
+		w.lastUsed = time.Now()
+	}
+
+	switch w.check(pn) {
+	case replayDuplicate:
+		kit.stats.inc(statReplayDuplicates)
+		kit.stats.inc(statPacketsDropped)
+		return false
+	case replayTooOld:
+		kit.stats.inc(statReplayTooOld)
+		kit.stats.inc(statPacketsDropped)
+		return false
+	}
+	return true
+}
+
+// pruneReplayWindows forgets the windows of shared-key senders not heard
+// from for ackRetention. Session windows go with their session. The
+// caller must hold mu.
+func (kit *GoUDPKit) pruneReplayWindows(now time.Time) {
+	for key, w := range kit.replayWindows {
+		if now.Sub(w.lastUsed) > ackRetention {
+			delete(kit.replayWindows, key)
+		}
+	}
+}
@@ -0,0 +1,170 @@
+package goudpkit
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"net"
+	"runtime"
+	"sync"
+)
+
+// PacketError reports a datagram that was read but could not be delivered,
+// such as one that failed to decode or authenticate. Unlike errors from the
+// connection itself, it does not stop Serve.
+type PacketError struct {
+	Addr *net.UDPAddr
+	Err  error
+}
+
+func (e *PacketError) Error() string {
+	return fmt.Sprintf("packet from %v: %v", e.Addr, e.Err)
+}
+
+func (e *PacketError) Unwrap() error { return e.Err }
+
+// ResponseWriter sends replies to the peer a packet came from.
+type ResponseWriter interface {
+	// Write sends b to the peer as the payload of one packet.
+	Write(b []byte) (int, error)
+	WritePacket(packet Packet) error
+}
+
+type Handler interface {
+	ServeUDP(w ResponseWriter, packet Packet, addr *net.UDPAddr)
+}
+
+type HandlerFunc func(w ResponseWriter, packet Packet, addr *net.UDPAddr)
+
+func (f HandlerFunc) ServeUDP(w ResponseWriter, packet Packet, addr *net.UDPAddr) {
+	f(w, packet, addr)
+}
+
+type ServeConfig struct {
+	// Workers is the number of handler goroutines. It defaults to
+	// runtime.NumCPU().
+	Workers int
+	// QueueSize is how many received packets may wait for a worker before
+	// reading pauses. It defaults to 64 per worker.
+	QueueSize int
+	// OrderedPerPeer hands all packets from one peer to the same worker,
+	// so a peer's packets are handled one at a time in arrival order.
+	OrderedPerPeer bool
+	// OnPanic, when set, is called with the value recovered from a
+	// panicking handler.
+	OnPanic func(recovered interface{}, packet Packet, addr *net.UDPAddr)
+}
+
+type serveJob struct {
+	packet Packet
+	addr   *net.UDPAddr
+}
+
+type replyWriter struct {
+	kit  *GoUDPKit
+	addr *net.UDPAddr
+}
+
+func (w replyWriter) Write(b []byte) (int, error) {
+	if err := w.kit.SendPacket(Packet{Data: b}, w.addr); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (w replyWriter) WritePacket(packet Packet) error {
+	return w.kit.SendPacket(packet, w.addr)
+}
+
+// Serve reads packets until ctx is done and passes each one to handler on
+// a pool of worker goroutines. Undeliverable datagrams are skipped. When
+// ctx is done, Serve stops reading, waits for queued packets to be handled
+// and returns nil. Other reads on the kit, such as SendReliable waiting for
+// acknowledgements, may run alongside it. It returns early only if the
+// connection fails or the kit is closed, in which case the error is
+// ErrClosed.
+func (kit *GoUDPKit) Serve(ctx context.Context, handler Handler, config ...ServeConfig) error {
+	var cfg ServeConfig
+	if len(config) > 0 {
+		cfg = config[0]
+	}
+	if cfg.Workers <= 0 {
+		cfg.Workers = runtime.NumCPU()
+	}
+	if cfg.QueueSize <= 0 {
+		cfg.QueueSize = 64 * cfg.Workers
+	}
+
+	queues := make([]chan serveJob, 1)
+	if cfg.OrderedPerPeer {
+		queues = make([]chan serveJob, cfg.Workers)
+	}
+	for i := range queues {
+		queues[i] = make(chan serveJob, cfg.QueueSize/len(queues)+1)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < cfg.Workers; i++ {
+		wg.Add(1)
+		go func(jobs <-chan serveJob) {
+			defer wg.Done()
+			for job := range jobs {
+				kit.handle(handler, cfg.OnPanic, job)
+				kit.mu.Lock()
+				kit.serving--
+				kit.mu.Unlock()
+				kit.sendWindowUpdates()
+			}
+		}(queues[i%len(queues)])
+	}
+	defer func() {
+		for _, q := range queues {
+			close(q)
+		}
+		wg.Wait()
+	}()
+
+	for {
+		packet, addr, err := kit.readPacketContext(ctx)
+		if err != nil {
+			if ctx.Err() != nil || errors.Is(err, context.DeadlineExceeded) {
+				return nil
+			}
+			var perr *PacketError
+			if errors.As(err, &perr) {
+				continue
+			}
+			// a timeout ctx did not cause comes from a deadline set on
+			// the connection by someone else
+			if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
+				continue
+			}
+			return err
+		}
+
+		q := queues[0]
+		if cfg.OrderedPerPeer {
+			h := fnv.New32a()
+			h.Write([]byte(addr.String()))
+			q = queues[h.Sum32()%uint32(len(queues))]
+		}
+		// packets waiting for a worker count against the receive window
+		kit.mu.Lock()
+		kit.serving++
+		kit.mu.Unlock()
+		q <- serveJob{packet: packet, addr: addr}
+	}
+}
+
+func (kit *GoUDPKit) handle(handler Handler, onPanic func(interface{}, Packet, *net.UDPAddr), job serveJob) {
+	defer func() {
+		if r := recover(); r != nil {
+			kit.stats.inc(statHandlerPanics)
+			if onPanic != nil {
+				onPanic(r, job.packet, job.addr)
+			}
+		}
+	}()
+	handler.ServeUDP(replyWriter{kit: kit, addr: job.addr}, job.packet, job.addr)
+}
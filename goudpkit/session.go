@@ -0,0 +1,637 @@
+package goudpkit
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	// ErrSessionClosed is returned by calls on a session that has closed.
+	ErrSessionClosed = errors.New("session closed")
+	// ErrSessionTimeout is returned by Connect when the peer never
+	// accepts.
+	ErrSessionTimeout = errors.New("session connect timed out")
+	// ErrConnectionRefused is returned by Connect when the peer does not
+	// accept sessions, or has too many open.
+	ErrConnectionRefused = errors.New("session refused by peer")
+	// ErrSessionReset is passed to OnDisconnect when the peer no longer
+	// knows the session, for instance after it restarted.
+	ErrSessionReset = errors.New("session reset by peer")
+	// ErrSessionIdle is passed to OnDisconnect when a session is closed
+	// because its peer was evicted from the peer table as idle.
+	ErrSessionIdle = errors.New("session idle")
+)
+
+// DefaultAcceptBacklog is how many accepted sessions may wait for Accept
+// unless SessionConfig says otherwise.
+const DefaultAcceptBacklog = 64
+
+// maxUnknownResets bounds the resets sent each second for data on
+// connection IDs the kit has no record of, since anyone can send those.
+const maxUnknownResets = 16
+
+// closedSession remembers a session that ended, for ackRetention, so that
+// its late frames are answered with a reset rather than reopening it.
+type closedSession struct {
+	addr string
+	at   time.Time
+}
+
+// Session frames are PacketTypeSession datagrams whose payload starts
+// with a 9-byte prefix, big-endian:
+//
+//	offset size field
+//	0      1    kind (connect, accept, data, close, close ack, reset)
+//	1      8    connection ID
+//	9      -    data, for data frames
+//
+// The header's sequence number counts the data frames of each session
+// from 1 and is zero on control frames.
+const sessionHeaderSize = 9
+
+const (
+	sessionConnect = iota + 1
+	sessionAccept
+	sessionData
+	sessionClose
+	sessionCloseAck
+	sessionReset
+)
+
+// ConnectionID identifies a session on both of its ends. The connecting
+// side picks it at random.
+type ConnectionID uint64
+
+func (id ConnectionID) String() string {
+	return fmt.Sprintf("%016x", uint64(id))
+}
+
+type SessionState int
+
+const (
+	// SessionConnecting is a session Connect has asked the peer for.
+	SessionConnecting SessionState = iota
+	// SessionEstablished is a session both ends have agreed on.
+	SessionEstablished
+	// SessionClosing is a session Close is waiting for the peer to
+	// acknowledge closing.
+	SessionClosing
+	// SessionClosed is a session that has ended and left the peer table.
+	SessionClosed
+)
+
+func (s SessionState) String() string {
+	switch s {
+	case SessionConnecting:
+		return "connecting"
+	case SessionEstablished:
+		return "established"
+	case SessionClosing:
+		return "closing"
+	case SessionClosed:
+		return "closed"
+	}
+	return fmt.Sprintf("SessionState(%d)", int(s))
+}
+
+// SessionConfig sets how a kit treats sessions peers open with it, and the
+// callbacks for sessions on either side.
+type SessionConfig struct {
+	// Accept lets peers open sessions with this kit. Without it, their
+	// attempts are refused.
+	Accept bool
+	// MaxSessions caps the sessions open at once; further attempts by
+	// peers are refused. Zero means no limit.
+	MaxSessions int
+	// AcceptBacklog caps the accepted sessions waiting for Accept;
+	// further attempts by peers are refused until Accept takes one. Zero
+	// means DefaultAcceptBacklog.
+	AcceptBacklog int
+	// OnConnect, when set, is called once a session is established,
+	// whichever end opened it. Accepted sessions are queued for Accept
+	// only when it is not set.
+	OnConnect func(s *Session)
+	// OnDisconnect, when set, is called once an established session has
+	// closed. err is nil when either end closed it, ErrSessionReset when
+	// the peer had lost it and ErrClosed when the kit was closed.
+	OnDisconnect func(s *Session, err error)
+}
+
+// Session is a connection with one peer, with a sequence space of its
+// own. Any number of sessions may run between the same two kits.
+type Session struct {
+	kit  *GoUDPKit
+	id   ConnectionID
+	addr *net.UDPAddr
+
+	nextSeq uint32
+
+	// guarded by kit.mu
+	state       SessionState
+	connected   bool
+	replay      *replayWindow
+	inbox       []Packet
+	err         error
+	established chan struct{}
+	closed      chan struct{}
+}
+
+// ID returns the session's connection ID.
+func (s *Session) ID() ConnectionID { return s.id }
+
+// RemoteAddr returns the address of the peer.
+func (s *Session) RemoteAddr() *net.UDPAddr { return s.addr }
+
+// State returns the session's current state.
+func (s *Session) State() SessionState {
+	s.kit.mu.Lock()
+	defer s.kit.mu.Unlock()
+	return s.state
+}
+
+// Err returns why the session closed, as passed to OnDisconnect, or nil.
+func (s *Session) Err() error {
+	s.kit.mu.Lock()
+	defer s.kit.mu.Unlock()
+	return s.err
+}
+
+// SetSessionConfig sets how sessions are accepted and the callbacks for
+// their lifecycle. Sessions already open keep running.
+func (kit *GoUDPKit) SetSessionConfig(cfg SessionConfig) {
+	kit.mu.Lock()
+	kit.sessionConfig = cfg
+	kit.mu.Unlock()
+}
+
+func (kit *GoUDPKit) newSession(id ConnectionID, addr *net.UDPAddr, state SessionState) *Session {
+	s := &Session{
+		kit:         kit,
+		id:          id,
+		addr:        addr,
+		state:       state,
+		established: make(chan struct{}),
+		closed:      make(chan struct{}),
+	}
+	if kit.replayWindowSize > 0 {
+		s.replay = newReplayWindow(kit.replayWindowSize)
+	}
+	return s
+}
+
+// Connect opens a session with addr, retransmitting the request according
+// to RetryConfig until the peer accepts.
+func (kit *GoUDPKit) Connect(ctx context.Context, addr *net.UDPAddr) (*Session, error) {
+	if kit.isClosed() {
+		return nil, ErrClosed
+	}
+	var b [8]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return nil, err
+	}
+	id := ConnectionID(binary.BigEndian.Uint64(b[:]))
+
+	kit.mu.Lock()
+	if _, taken := kit.sessions[id]; taken {
+		kit.mu.Unlock()
+		return nil, errors.New("connection ID already in use")
+	}
+	s := kit.newSession(id, addr, SessionConnecting)
+	kit.sessions[id] = s
+	kit.mu.Unlock()
+
+	err := kit.exchange(ctx, s, sessionConnect, s.established)
+	if err == nil {
+		return s, nil
+	}
+	if errors.Is(err, ErrSessionClosed) && s.Err() != nil {
+		err = s.Err()
+	}
+	kit.endSession(s, err)
+	return nil, err
+}
+
+// Accept returns the next session a peer opened with this kit, reading the
+// connection until one arrives or ctx is done. It needs SessionConfig's
+// Accept and no OnConnect callback.
+func (kit *GoUDPKit) Accept(ctx context.Context) (*Session, error) {
+	buf := make([]byte, 65535)
+	for {
+		kit.mu.Lock()
+		if len(kit.acceptQueue) > 0 {
+			s := kit.acceptQueue[0]
+			kit.acceptQueue = kit.acceptQueue[1:]
+			kit.mu.Unlock()
+			return s, nil
+		}
+		kit.mu.Unlock()
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		if err := kit.pollSession(ctx, buf); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// Sessions returns the sessions in the peer table: those connecting,
+// established or closing.
+func (kit *GoUDPKit) Sessions() []*Session {
+	kit.mu.Lock()
+	defer kit.mu.Unlock()
+	sessions := make([]*Session, 0, len(kit.sessions))
+	for _, s := range kit.sessions {
+		sessions = append(sessions, s)
+	}
+	return sessions
+}
+
+// LookupSession returns the open session with the given connection ID.
+func (kit *GoUDPKit) LookupSession(id ConnectionID) (*Session, bool) {
+	kit.mu.Lock()
+	defer kit.mu.Unlock()
+	s, ok := kit.sessions[id]
+	return s, ok
+}
+
+// Send sends data to the peer as one packet numbered in the session's own
+// sequence space.
+func (s *Session) Send(data []byte) error {
+	return s.SendContext(context.Background(), data)
+}
+
+// SendContext is like Send but returns ctx.Err() if ctx is done before the
+// packet is handed to the connection.
+func (s *Session) SendContext(ctx context.Context, data []byte) error {
+	kit := s.kit
+	if s.State() != SessionEstablished {
+		return ErrSessionClosed
+	}
+	if err := kit.pace(ctx, kit.frameOverhead(s.addr)+sessionHeaderSize+len(data), s.addr); err != nil {
+		return err
+	}
+	h := Header{Type: PacketTypeSession, SequenceNumber: atomic.AddUint32(&s.nextSeq, 1)}
+	if err := kit.writeFrame(ctx, h, appendSessionFrame(sessionData, s.id, data), s.addr); err != nil {
+		return err
+	}
+	kit.stats.inc(statPacketsSent)
+	return nil
+}
+
+// Receive returns the session's next packet, reading the connection until
+// one arrives or ctx is done. Packets other calls read for the session are
+// kept for it. Once the session has closed and its packets have been
+// received, Receive returns ErrSessionClosed.
+func (s *Session) Receive(ctx context.Context) (Packet, error) {
+	kit := s.kit
+	buf := make([]byte, 65535)
+	for {
+		kit.mu.Lock()
+		if len(s.inbox) > 0 {
+			p := s.inbox[0]
+			s.inbox = s.inbox[1:]
+			kit.mu.Unlock()
+			kit.stats.inc(statPacketsReceived)
+			return p, nil
+		}
+		state := s.state
+		kit.mu.Unlock()
+		if state == SessionClosed {
+			return Packet{}, ErrSessionClosed
+		}
+		if err := ctx.Err(); err != nil {
+			return Packet{}, err
+		}
+		if err := kit.pollSession(ctx, buf); err != nil {
+			return Packet{}, err
+		}
+	}
+}
+
+// Close ends the session, telling the peer and waiting, according to
+// RetryConfig, for it to acknowledge. The session is closed when Close
+// returns whether or not the peer answered. Calling Close again does
+// nothing.
+func (s *Session) Close() error {
+	kit := s.kit
+	kit.mu.Lock()
+	switch s.state {
+	case SessionClosed, SessionClosing:
+		kit.mu.Unlock()
+		return nil
+	case SessionConnecting:
+		kit.mu.Unlock()
+		kit.endSession(s, nil)
+		return nil
+	}
+	s.state = SessionClosing
+	kit.mu.Unlock()
+
+	err := kit.exchange(context.Background(), s, sessionClose, s.closed)
+	kit.endSession(s, nil)
+	if errors.Is(err, ErrSessionTimeout) || errors.Is(err, ErrSessionClosed) {
+		return nil
+	}
+	return err
+}
+
+// exchange sends a control frame of the given kind for s until done is
+// closed, retransmitting it according to RetryConfig. It fails with
+// ErrSessionClosed if s closes first.
+func (kit *GoUDPKit) exchange(ctx context.Context, s *Session, kind byte, done <-chan struct{}) error {
+	timeout, backoff := kit.retryTiming()
+	buf := make([]byte, 65535)
+	for attempt := 0; attempt <= kit.retryConfig.MaxRetries; attempt++ {
+		if attempt > 0 {
+			kit.stats.inc(statRetryCount)
+		}
+		if err := kit.writeFrame(ctx, Header{Type: PacketTypeSession}, appendSessionFrame(kind, s.id, nil), s.addr); err != nil {
+			return err
+		}
+		deadline := time.Now().Add(timeout)
+		for time.Now().Before(deadline) {
+			select {
+			case <-done:
+				return nil
+			case <-s.closed:
+				return ErrSessionClosed
+			default:
+			}
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			if err := kit.pollOnce(ctx, buf, deadline); err != nil {
+				return err
+			}
+		}
+		timeout = time.Duration(float64(timeout) * backoff)
+	}
+
+	select {
+	case <-done:
+		return nil
+	case <-s.closed:
+		return ErrSessionClosed
+	default:
+	}
+	return ErrSessionTimeout
+}
+
+// pollSession reads and dispatches at most one datagram, waking regularly
+// to pick up what other readers dispatched.
+func (kit *GoUDPKit) pollSession(ctx context.Context, buf []byte) error {
+	deadline := time.Now().Add(max(kit.bufferConfig.FlushInterval, minFlushTick))
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	if kit.isClosed() {
+		return ErrClosed
+	}
+	return kit.pollOnce(ctx, buf, deadline)
+}
+
+// handleSession runs the session state machine for one frame from addr.
+func (kit *GoUDPKit) handleSession(h Header, payload []byte, addr *net.UDPAddr) error {
+	if len(payload) < sessionHeaderSize {
+		return errors.New("short session frame")
+	}
+	kind := payload[0]
+	id := ConnectionID(binary.BigEndian.Uint64(payload[1:]))
+	data := payload[sessionHeaderSize:]
+
+	kit.mu.Lock()
+	s := kit.sessions[id]
+	if s != nil && s.addr.String() != addr.String() {
+		// connection IDs are only honoured from the address that opened
+		// the session
+		s = nil
+	}
+	closed, wasClosed := kit.closedSessions[id]
+	wasClosed = wasClosed && closed.addr == addr.String()
+	switch kind {
+	case sessionConnect:
+		if s != nil {
+			kit.mu.Unlock()
+			kit.sendSessionControl(sessionAccept, id, addr)
+			return nil
+		}
+		if wasClosed {
+			// a retransmitted connect for a session that already ended
+			kit.mu.Unlock()
+			kit.sendSessionControl(sessionReset, id, addr)
+			return nil
+		}
+		cfg := kit.sessionConfig
+		backlog := cfg.AcceptBacklog
+		if backlog <= 0 {
+			backlog = DefaultAcceptBacklog
+		}
+		full := cfg.OnConnect == nil && len(kit.acceptQueue) >= backlog
+		if !cfg.Accept || full || (cfg.MaxSessions > 0 && len(kit.sessions) >= cfg.MaxSessions) || kit.sessions[id] != nil {
+			kit.mu.Unlock()
+			kit.sendSessionControl(sessionReset, id, addr)
+			return nil
+		}
+		s = kit.newSession(id, addr, SessionConnecting)
+		kit.sessions[id] = s
+		kit.establish(s)
+		if cfg.OnConnect == nil {
+			kit.acceptQueue = append(kit.acceptQueue, s)
+		}
+		kit.mu.Unlock()
+		kit.sendSessionControl(sessionAccept, id, addr)
+		if cfg.OnConnect != nil {
+			cfg.OnConnect(s)
+		}
+
+	case sessionAccept:
+		if s == nil || s.state != SessionConnecting {
+			kit.mu.Unlock()
+			return nil
+		}
+		kit.establish(s)
+		onConnect := kit.sessionConfig.OnConnect
+		kit.mu.Unlock()
+		if onConnect != nil {
+			onConnect(s)
+		}
+
+	case sessionData:
+		if s == nil {
+			allowed := wasClosed || kit.allowReset(time.Now())
+			kit.mu.Unlock()
+			if !allowed {
+				kit.stats.inc(statPacketsDropped)
+				return nil
+			}
+			kit.sendSessionControl(sessionReset, id, addr)
+			return nil
+		}
+		defer kit.mu.Unlock()
+		if s.state != SessionEstablished && s.state != SessionClosing {
+			kit.stats.inc(statPacketsDropped)
+			return nil
+		}
+		if s.replay != nil {
+			switch s.replay.check(uint64(h.SequenceNumber)) {
+			case replayDuplicate:
+				kit.stats.inc(statReplayDuplicates)
+				return nil
+			case replayTooOld:
+				kit.stats.inc(statReplayTooOld)
+				return nil
+			}
+		}
+		if len(s.inbox) >= kit.receiveWindow() {
+			kit.stats.inc(statPacketsDropped)
+			return nil
+		}
+		s.inbox = append(s.inbox, Packet{
+			SequenceNumber: h.SequenceNumber,
+			Priority:       int(h.Priority),
+			Data:           append([]byte(nil), data...),
+			Timestamp:      h.Timestamp,
+		})
+
+	case sessionClose:
+		kit.mu.Unlock()
+		// acknowledge even unknown sessions, as the first ack may be lost
+		kit.sendSessionControl(sessionCloseAck, id, addr)
+		if s != nil {
+			kit.endSession(s, nil)
+		}
+
+	case sessionCloseAck:
+		kit.mu.Unlock()
+		if s != nil && s.State() == SessionClosing {
+			kit.endSession(s, nil)
+		}
+
+	case sessionReset:
+		kit.mu.Unlock()
+		if s != nil {
+			err := ErrSessionReset
+			if s.State() == SessionConnecting {
+				err = ErrConnectionRefused
+			}
+			kit.endSession(s, err)
+		}
+
+	default:
+		kit.mu.Unlock()
+		return fmt.Errorf("unknown session frame kind %d", kind)
+	}
+	return nil
+}
+
+// establish moves s to SessionEstablished. The caller must hold mu.
+func (kit *GoUDPKit) establish(s *Session) {
+	s.state = SessionEstablished
+	s.connected = true
+	close(s.established)
+	kit.stats.inc(statSessionsEstablished)
+}
+
+// endSession closes s with err, removes it from the peer table and calls
+// OnDisconnect if it had been established. It does nothing if s has
+// already closed.
+func (kit *GoUDPKit) endSession(s *Session, err error) {
+	kit.mu.Lock()
+	if s.state == SessionClosed {
+		kit.mu.Unlock()
+		return
+	}
+	s.state = SessionClosed
+	s.err = err
+	close(s.closed)
+	if kit.sessions[s.id] == s {
+		delete(kit.sessions, s.id)
+		kit.closedSessions[s.id] = closedSession{addr: s.addr.String(), at: time.Now()}
+	}
+	for i, q := range kit.acceptQueue {
+		if q == s {
+			kit.acceptQueue = append(kit.acceptQueue[:i], kit.acceptQueue[i+1:]...)
+			break
+		}
+	}
+	onDisconnect := kit.sessionConfig.OnDisconnect
+	connected := s.connected
+	kit.mu.Unlock()
+
+	if connected {
+		kit.stats.inc(statSessionsClosed)
+		if onDisconnect != nil {
+			onDisconnect(s, err)
+		}
+	}
+}
+
+// allowReset reports whether a reset for an unknown connection ID may be
+// sent now, allowing maxUnknownResets a second. The caller must hold mu.
+func (kit *GoUDPKit) allowReset(now time.Time) bool {
+	if now.Sub(kit.resetWindow) >= time.Second {
+		kit.resetWindow, kit.resetsSent = now, 0
+	}
+	if kit.resetsSent >= maxUnknownResets {
+		return false
+	}
+	kit.resetsSent++
+	return true
+}
+
+// pruneClosedSessions forgets sessions that ended more than ackRetention
+// ago. The caller must hold mu.
+func (kit *GoUDPKit) pruneClosedSessions(now time.Time) {
+	for id, c := range kit.closedSessions {
+		if now.Sub(c.at) > ackRetention {
+			delete(kit.closedSessions, id)
+		}
+	}
+}
+
+// closeIdleSessions closes the established sessions with the peers
+// evicted from the peer table as idle, telling the peers without waiting
+// for acknowledgements.
+func (kit *GoUDPKit) closeIdleSessions(idle map[string]bool) {
+	kit.mu.Lock()
+	var closing []*Session
+	for _, s := range kit.sessions {
+		if s.state == SessionEstablished && idle[s.addr.String()] {
+			closing = append(closing, s)
+		}
+	}
+	kit.mu.Unlock()
+
+	for _, s := range closing {
+		kit.sendSessionControl(sessionClose, s.id, s.addr)
+		kit.endSession(s, ErrSessionIdle)
+	}
+}
+
+// closeSessions tells every peer its session is ending, without waiting
+// for acknowledgements, and closes the sessions with ErrClosed.
+func (kit *GoUDPKit) closeSessions() {
+	for _, s := range kit.Sessions() {
+		if s.State() != SessionConnecting {
+			kit.sendSessionControl(sessionClose, s.id, s.addr)
+		}
+		kit.endSession(s, ErrClosed)
+	}
+}
+
+func (kit *GoUDPKit) sendSessionControl(kind byte, id ConnectionID, addr *net.UDPAddr) {
+	kit.writeFrame(context.Background(), Header{Type: PacketTypeSession}, appendSessionFrame(kind, id, nil), addr)
+}
+
+func appendSessionFrame(kind byte, id ConnectionID, data []byte) []byte {
+	b := make([]byte, sessionHeaderSize, sessionHeaderSize+len(data))
+	b[0] = kind
+	binary.BigEndian.PutUint64(b[1:], uint64(id))
+	return append(b, data...)
+}
@@ -0,0 +1,265 @@
+package goudpkit
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type Stats struct {
+	PacketsSent     uint64
+	PacketsReceived uint64
+	PacketsDropped  uint64
+	RetryCount      uint64
+	BytesSent       uint64
+	BytesReceived   uint64
+
+	HandshakesCompleted uint64
+	HandshakesFailed    uint64
+	ReplayDuplicates    uint64
+	ReplayTooOld        uint64
+	HandlerPanics       uint64
+	// FECRecovered counts bulk chunks rebuilt from repair chunks.
+	FECRecovered uint64
+	// PacketsAcked and PacketsLost count reliable packets acknowledged by
+	// the peer and retransmission timeouts, respectively.
+	PacketsAcked uint64
+	PacketsLost  uint64
+	// SendsThrottled counts datagrams the pacer delayed or, in
+	// non-blocking mode, refused.
+	SendsThrottled uint64
+	// FlowControlStalls counts the times SendReliable ran out of the
+	// credit its peer advertised and had to wait.
+	FlowControlStalls uint64
+	// SessionsEstablished and SessionsClosed count sessions reaching the
+	// established and, after that, the closed state.
+	SessionsEstablished uint64
+	SessionsClosed      uint64
+	// KeepalivesSent counts keepalive pings sent to silent peers, and
+	// PeersEvicted the peers dropped from the peer table for staying
+	// silent past the idle timeout.
+	KeepalivesSent uint64
+	PeersEvicted   uint64
+
+	// Errors by category. Packets rejected with a decode, authentication
+	// or decompression error also count as dropped.
+	SendErrors       uint64
+	ReadErrors       uint64
+	DecodeErrors     uint64
+	AuthErrors       uint64
+	DecompressErrors uint64
+
+	// QueueDepths holds the number of packets waiting at each priority
+	// level, lowest priority first.
+	QueueDepths []int
+	// Uptime is the time since the kit was created.
+	Uptime time.Duration
+	// CongestionWindow is the sum of the congestion windows, in bytes, of
+	// the peers SendReliable is talking to, or zero with congestion
+	// control off.
+	CongestionWindow int
+	// LossRate is PacketsLost as a fraction of PacketsAcked plus
+	// PacketsLost.
+	LossRate float64
+	// Peers is the number of peers in the peer table.
+	Peers int
+
+	Latency LatencyStats
+}
+
+// Sub returns the counts accumulated between prev and s, both taken from
+// the same kit. QueueDepths, CongestionWindow, Peers and Latency are those of s,
+// LossRate is that of the interval and Uptime is the interval.
+func (s Stats) Sub(prev Stats) Stats {
+	d := s
+	d.PacketsSent -= prev.PacketsSent
+	d.PacketsReceived -= prev.PacketsReceived
+	d.PacketsDropped -= prev.PacketsDropped
+	d.RetryCount -= prev.RetryCount
+	d.BytesSent -= prev.BytesSent
+	d.BytesReceived -= prev.BytesReceived
+	d.HandshakesCompleted -= prev.HandshakesCompleted
+	d.HandshakesFailed -= prev.HandshakesFailed
+	d.ReplayDuplicates -= prev.ReplayDuplicates
+	d.ReplayTooOld -= prev.ReplayTooOld
+	d.HandlerPanics -= prev.HandlerPanics
+	d.FECRecovered -= prev.FECRecovered
+	d.PacketsAcked -= prev.PacketsAcked
+	d.PacketsLost -= prev.PacketsLost
+	d.SendsThrottled -= prev.SendsThrottled
+	d.FlowControlStalls -= prev.FlowControlStalls
+	d.SessionsEstablished -= prev.SessionsEstablished
+	d.SessionsClosed -= prev.SessionsClosed
+	d.KeepalivesSent -= prev.KeepalivesSent
+	d.PeersEvicted -= prev.PeersEvicted
+	d.SendErrors -= prev.SendErrors
+	d.ReadErrors -= prev.ReadErrors
+	d.DecodeErrors -= prev.DecodeErrors
+	d.AuthErrors -= prev.AuthErrors
+	d.DecompressErrors -= prev.DecompressErrors
+	d.Uptime -= prev.Uptime
+	d.LossRate = lossRate(d.PacketsAcked, d.PacketsLost)
+	return d
+}
+
+type statCounter int
+
+const (
+	statPacketsSent statCounter = iota
+	statPacketsReceived
+	statPacketsDropped
+	statRetryCount
+	statBytesSent
+	statBytesReceived
+	statHandshakesCompleted
+	statHandshakesFailed
+	statReplayDuplicates
+	statReplayTooOld
+	statHandlerPanics
+	statFECRecovered
+	statPacketsAcked
+	statPacketsLost
+	statSendsThrottled
+	statFlowControlStalls
+	statSessionsEstablished
+	statSessionsClosed
+	statKeepalivesSent
+	statPeersEvicted
+	statSendErrors
+	statReadErrors
+	statDecodeErrors
+	statAuthErrors
+	statDecompressErrors
+	numStatCounters
+)
+
+// statCounters are updated with atomic adds under a shared lock, so that
+// taking the lock exclusively yields a snapshot no update is half way
+// through. The counters never go down: Reset moves base, the values as of
+// the last reset, which load subtracts.
+type statCounters struct {
+	mu   sync.RWMutex
+	v    [numStatCounters]atomic.Uint64
+	base [numStatCounters]uint64
+}
+
+func (s *statCounters) add(c statCounter, n uint64) {
+	s.mu.RLock()
+	s.v[c].Add(n)
+	s.mu.RUnlock()
+	if pc := processCounters[c]; pc != nil {
+		pc.Add(float64(n))
+	}
+}
+
+func (s *statCounters) inc(c statCounter) {
+	s.add(c, 1)
+}
+
+// load returns the counts since the last reset, starting a new interval if
+// reset is set.
+func (s *statCounters) load(reset bool) Stats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var v [numStatCounters]uint64
+	for i := range s.v {
+		total := s.v[i].Load()
+		v[i] = total - s.base[i]
+		if reset {
+			s.base[i] = total
+		}
+	}
+	return statsOf(v)
+}
+
+// total returns the counts since the kit was created, regardless of
+// resets.
+func (s *statCounters) total() Stats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var v [numStatCounters]uint64
+	for i := range s.v {
+		v[i] = s.v[i].Load()
+	}
+	return statsOf(v)
+}
+
+func statsOf(v [numStatCounters]uint64) Stats {
+	return Stats{
+		PacketsSent:         v[statPacketsSent],
+		PacketsReceived:     v[statPacketsReceived],
+		PacketsDropped:      v[statPacketsDropped],
+		RetryCount:          v[statRetryCount],
+		BytesSent:           v[statBytesSent],
+		BytesReceived:       v[statBytesReceived],
+		HandshakesCompleted: v[statHandshakesCompleted],
+		HandshakesFailed:    v[statHandshakesFailed],
+		ReplayDuplicates:    v[statReplayDuplicates],
+		ReplayTooOld:        v[statReplayTooOld],
+		HandlerPanics:       v[statHandlerPanics],
+		FECRecovered:        v[statFECRecovered],
+		PacketsAcked:        v[statPacketsAcked],
+		PacketsLost:         v[statPacketsLost],
+		SendsThrottled:      v[statSendsThrottled],
+		FlowControlStalls:   v[statFlowControlStalls],
+		SessionsEstablished: v[statSessionsEstablished],
+		SessionsClosed:      v[statSessionsClosed],
+		KeepalivesSent:      v[statKeepalivesSent],
+		PeersEvicted:        v[statPeersEvicted],
+		SendErrors:          v[statSendErrors],
+		ReadErrors:          v[statReadErrors],
+		DecodeErrors:        v[statDecodeErrors],
+		AuthErrors:          v[statAuthErrors],
+		DecompressErrors:    v[statDecompressErrors],
+	}
+}
+
+// Snapshot returns the kit's counters as of one instant, with the current
+// queue depths, uptime and latency percentiles. It is safe to call
+// concurrently with any other method.
+func (kit *GoUDPKit) Snapshot() Stats {
+	s := kit.withGauges(kit.stats.load(false))
+	s.Latency = kit.latencyStats(false)
+	return s
+}
+
+// GetStats is the same as Snapshot.
+func (kit *GoUDPKit) GetStats() Stats {
+	return kit.Snapshot()
+}
+
+// Reset zeroes the counters and latency histograms as seen by Snapshot and
+// returns their values from just before, so that successive calls report
+// one interval each without losing updates. The totals exported by a
+// Collector are not affected.
+func (kit *GoUDPKit) Reset() Stats {
+	s := kit.withGauges(kit.stats.load(true))
+	s.Latency = kit.latencyStats(true)
+	return s
+}
+
+// totals is like Snapshot but counts from the kit's creation, ignoring
+// Reset. It leaves Latency empty.
+func (kit *GoUDPKit) totals() Stats {
+	return kit.withGauges(kit.stats.total())
+}
+
+func (kit *GoUDPKit) withGauges(s Stats) Stats {
+	for _, q := range kit.sched.snapshot() {
+		s.QueueDepths = append(s.QueueDepths, q.Depth)
+	}
+	s.Uptime = time.Since(kit.started)
+	s.CongestionWindow = kit.congestionWindow()
+	s.LossRate = lossRate(s.PacketsAcked, s.PacketsLost)
+	kit.mu.Lock()
+	s.Peers = kit.confirmedPeers()
+	kit.mu.Unlock()
+	return s
+}
+
+func lossRate(acked, lost uint64) float64 {
+	if acked+lost == 0 {
+		return 0
+	}
+	return float64(lost) / float64(acked+lost)
+}
@@ -0,0 +1,484 @@
+package goudpkit
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultChunkSize is the chunk size SendTransfer uses when
+// TransferOptions.ChunkSize is zero.
+const DefaultChunkSize = 1024
+
+var (
+	// ErrChecksumMismatch is returned by ReceiveTransfer when the
+	// reassembled data does not match the manifest's SHA-256 digest.
+	ErrChecksumMismatch = errors.New("transfer checksum mismatch")
+	// ErrManifestUnacknowledged is returned by SendTransfer when the peer
+	// does not acknowledge the manifest within the kit's RetryConfig.
+	ErrManifestUnacknowledged = errors.New("transfer manifest not acknowledged")
+	// ErrManifestTooLarge is returned when the name and metadata do not
+	// fit in one datagram.
+	ErrManifestTooLarge = errors.New("transfer manifest too large")
+	// ErrTransferRefused is returned by SendTransfer when the receiver
+	// will not take the transfer, for instance because it exceeds the
+	// receiver's TransferLimits or its ID belongs to a transfer that
+	// ended differently.
+	ErrTransferRefused = errors.New("transfer refused by peer")
+)
+
+// Transfer control frames carry a one-byte kind and a body.
+const (
+	transferManifest byte = iota + 1
+	transferManifestAck
+	transferRefused
+)
+
+// A manifest body is, big-endian:
+//
+//	offset size field
+//	0      4    transfer ID
+//	4      8    size
+//	12     4    chunk size
+//	16     4    chunk count
+//	20     3    FEC scheme, data shards, parity shards
+//	23     32   SHA-256 digest
+//	55     2    name length, then the name
+//	-      2    metadata entry count, then for each entry a 2-byte key
+//	            length, key, 2-byte value length and value
+const manifestFixedSize = 55
+
+// A manifest ack body is the transfer ID followed by a 2-byte count and
+// that many ranges of chunks the receiver still needs, each as 4-byte first
+// and last indexes. Ranges beyond maxAckRanges are merged into the last.
+// A refusal body is the transfer ID alone.
+const maxAckRanges = 4096
+
+type manifestAck struct {
+	acked   bool
+	refused bool
+	missing []ChunkRange
+}
+
+// Manifest describes a transfer to the receiver before any of its chunks
+// are sent.
+type Manifest struct {
+	TransferID uint32
+	Size       uint64
+	ChunkSize  int
+	ChunkCount uint32
+	FEC        FECConfig
+	Digest     [sha256.Size]byte
+	Name       string
+	Metadata   map[string]string
+}
+
+type TransferOptions struct {
+	// ChunkSize defaults to DefaultChunkSize. A resumed transfer must use
+	// the same chunk size as the interrupted one.
+	ChunkSize int
+	// FEC defaults to the kit's, as set with SetFEC.
+	FEC      *FECConfig
+	Name     string
+	Metadata map[string]string
+}
+
+// TransferResult is a verified transfer returned by ReceiveTransfer.
+type TransferResult struct {
+	Manifest Manifest
+	// Data holds the transfer, unless it was received into a file.
+	Data []byte
+	// Path names the file the transfer was written to when the kit has a
+	// transfer directory.
+	Path string
+	Addr *net.UDPAddr
+}
+
+func (m Manifest) header() bulkHeader {
+	return bulkHeader{transfer: m.TransferID, total: m.Size, chunkSize: uint32(m.ChunkSize), fec: m.FEC, repair: -1}
+}
+
+func appendManifest(dst []byte, m Manifest) ([]byte, error) {
+	dst = append(dst, transferManifest)
+	dst = binary.BigEndian.AppendUint32(dst, m.TransferID)
+	dst = binary.BigEndian.AppendUint64(dst, m.Size)
+	dst = binary.BigEndian.AppendUint32(dst, uint32(m.ChunkSize))
+	dst = binary.BigEndian.AppendUint32(dst, m.ChunkCount)
+	dst = append(dst, byte(m.FEC.Scheme), byte(m.FEC.DataShards), byte(m.FEC.ParityShards))
+	dst = append(dst, m.Digest[:]...)
+
+	keys := make([]string, 0, len(m.Metadata))
+	for k := range m.Metadata {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	if len(keys) > 0xffff {
+		return nil, ErrManifestTooLarge
+	}
+	var err error
+	if dst, err = appendString16(dst, m.Name); err != nil {
+		return nil, err
+	}
+	dst = binary.BigEndian.AppendUint16(dst, uint16(len(keys)))
+	for _, k := range keys {
+		if dst, err = appendString16(dst, k); err != nil {
+			return nil, err
+		}
+		if dst, err = appendString16(dst, m.Metadata[k]); err != nil {
+			return nil, err
+		}
+	}
+	if len(dst) > maxDatagramSize-HeaderSize {
+		return nil, ErrManifestTooLarge
+	}
+	return dst, nil
+}
+
+func appendManifestAck(dst []byte, id uint32, missing []ChunkRange) []byte {
+	if len(missing) > maxAckRanges {
+		last := missing[len(missing)-1].Last
+		missing = append(missing[:maxAckRanges-1:maxAckRanges-1], ChunkRange{First: missing[maxAckRanges-1].First, Last: last})
+	}
+	dst = append(dst, transferManifestAck)
+	dst = binary.BigEndian.AppendUint32(dst, id)
+	dst = binary.BigEndian.AppendUint16(dst, uint16(len(missing)))
+	for _, r := range missing {
+		dst = binary.BigEndian.AppendUint32(dst, r.First)
+		dst = binary.BigEndian.AppendUint32(dst, r.Last)
+	}
+	return dst
+}
+
+func decodeManifestAck(b []byte) (uint32, []ChunkRange, error) {
+	if len(b) < 6 || len(b) != 6+8*int(binary.BigEndian.Uint16(b[4:])) {
+		return 0, nil, errBadBulkFrame
+	}
+	missing := make([]ChunkRange, 0, binary.BigEndian.Uint16(b[4:]))
+	for p := b[6:]; len(p) > 0; p = p[8:] {
+		r := ChunkRange{First: binary.BigEndian.Uint32(p), Last: binary.BigEndian.Uint32(p[4:])}
+		if r.First > r.Last || (len(missing) > 0 && r.First <= missing[len(missing)-1].Last) {
+			return 0, nil, errBadBulkFrame
+		}
+		missing = append(missing, r)
+	}
+	return binary.BigEndian.Uint32(b), missing, nil
+}
+
+func appendString16(dst []byte, s string) ([]byte, error) {
+	if len(s) > 0xffff {
+		return nil, ErrManifestTooLarge
+	}
+	dst = binary.BigEndian.AppendUint16(dst, uint16(len(s)))
+	return append(dst, s...), nil
+}
+
+// decodeManifest decodes a manifest body, rejecting a transfer larger than
+// limits allow before a file or any memory is set aside for it.
+func decodeManifest(b []byte, limits TransferLimits) (Manifest, error) {
+	if len(b) < manifestFixedSize+4 {
+		return Manifest{}, errBadBulkFrame
+	}
+	m := Manifest{
+		TransferID: binary.BigEndian.Uint32(b),
+		Size:       binary.BigEndian.Uint64(b[4:]),
+		ChunkSize:  int(binary.BigEndian.Uint32(b[12:])),
+		ChunkCount: binary.BigEndian.Uint32(b[16:]),
+		FEC:        FECConfig{Scheme: FECScheme(b[20]), DataShards: int(b[21]), ParityShards: int(b[22])},
+	}
+	copy(m.Digest[:], b[23:manifestFixedSize])
+	fec, err := m.FEC.normalize()
+	if err != nil || fec != m.FEC || m.ChunkSize == 0 {
+		return Manifest{}, errBadBulkFrame
+	}
+	if m.Size > uint64(m.ChunkSize)*(1<<32-1) || m.header().chunkCount() != m.ChunkCount {
+		return Manifest{}, errBadBulkFrame
+	}
+	if !limits.allows(m.header()) {
+		return Manifest{}, ErrTransferTooLarge
+	}
+
+	rest := b[manifestFixedSize:]
+	next := func() (string, bool) {
+		if len(rest) < 2 || len(rest) < 2+int(binary.BigEndian.Uint16(rest)) {
+			return "", false
+		}
+		n := int(binary.BigEndian.Uint16(rest))
+		s := string(rest[2 : 2+n])
+		rest = rest[2+n:]
+		return s, true
+	}
+	var ok bool
+	if m.Name, ok = next(); !ok || len(rest) < 2 {
+		return Manifest{}, errBadBulkFrame
+	}
+	entries := int(binary.BigEndian.Uint16(rest))
+	rest = rest[2:]
+	if entries > 0 {
+		m.Metadata = make(map[string]string, entries)
+	}
+	for i := 0; i < entries; i++ {
+		k, ok := next()
+		if !ok {
+			return Manifest{}, errBadBulkFrame
+		}
+		v, ok := next()
+		if !ok {
+			return Manifest{}, errBadBulkFrame
+		}
+		m.Metadata[k] = v
+	}
+	if len(rest) != 0 {
+		return Manifest{}, errBadBulkFrame
+	}
+	return m, nil
+}
+
+// SendTransfer sends data to addr as a transfer described by a manifest.
+// The manifest is retransmitted following the kit's RetryConfig until the
+// receiver acknowledges it, and the data chunks follow as in SendBulkData.
+// Only the chunks the receiver reports missing in its acknowledgement are
+// sent. It returns the manifest that was sent.
+func (kit *GoUDPKit) SendTransfer(ctx context.Context, data []byte, opts TransferOptions, addr *net.UDPAddr) (Manifest, error) {
+	return kit.sendTransfer(ctx, bytes.NewReader(data), int64(len(data)), sha256.Sum256(data), opts, addr)
+}
+
+func (kit *GoUDPKit) sendTransfer(ctx context.Context, src io.ReaderAt, size int64, digest [sha256.Size]byte, opts TransferOptions, addr *net.UDPAddr) (Manifest, error) {
+	chunkSize := opts.ChunkSize
+	if chunkSize == 0 {
+		chunkSize = DefaultChunkSize
+	}
+	if chunkSize < 0 || chunkSize > maxDatagramSize-HeaderSize-bulkHeaderSize {
+		return Manifest{}, fmt.Errorf("chunk size %d out of range", chunkSize)
+	}
+	kit.mu.Lock()
+	fec := kit.fec
+	kit.mu.Unlock()
+	if opts.FEC != nil {
+		fec = *opts.FEC
+	}
+	fec, err := fec.normalize()
+	if err != nil {
+		return Manifest{}, err
+	}
+
+	m := Manifest{
+		TransferID: atomic.AddUint32(&kit.nextTransferID, 1),
+		Size:       uint64(size),
+		ChunkSize:  chunkSize,
+		FEC:        fec,
+		Digest:     digest,
+		Name:       opts.Name,
+		Metadata:   opts.Metadata,
+	}
+	m.ChunkCount = m.header().chunkCount()
+	missing, err := kit.sendManifest(ctx, m, addr)
+	if err != nil {
+		return Manifest{}, err
+	}
+	return m, kit.sendBulk(ctx, m.header(), src, missing, addr)
+}
+
+// sendManifest sends m until addr acknowledges it and returns the chunks
+// the receiver still needs.
+func (kit *GoUDPKit) sendManifest(ctx context.Context, m Manifest, addr *net.UDPAddr) ([]ChunkRange, error) {
+	payload, err := appendManifest(nil, m)
+	if err != nil {
+		return nil, err
+	}
+	key := messageKey{peer: addr.String(), id: m.TransferID}
+	ack := &manifestAck{}
+	kit.mu.Lock()
+	kit.manifestAcks[key] = ack
+	kit.mu.Unlock()
+	defer func() {
+		kit.mu.Lock()
+		delete(kit.manifestAcks, key)
+		kit.mu.Unlock()
+	}()
+
+	timeout, backoff := kit.retryTiming()
+	buf := make([]byte, 65535)
+	for attempt := 0; attempt <= kit.retryConfig.MaxRetries; attempt++ {
+		if attempt > 0 {
+			kit.stats.inc(statRetryCount)
+		}
+		if err := kit.writeFrame(ctx, Header{Type: PacketTypeTransfer, SequenceNumber: m.TransferID}, payload, addr); err != nil {
+			return nil, err
+		}
+		kit.stats.inc(statPacketsSent)
+
+		deadline := time.Now().Add(timeout)
+		for time.Now().Before(deadline) {
+			kit.mu.Lock()
+			acked, refused, missing := ack.acked, ack.refused, ack.missing
+			kit.mu.Unlock()
+			if refused {
+				return nil, ErrTransferRefused
+			}
+			if acked {
+				return missing, nil
+			}
+			if err := ctx.Err(); err != nil {
+				return nil, err
+			}
+			if err := kit.pollOnce(ctx, buf, deadline); err != nil {
+				return nil, err
+			}
+		}
+		timeout = time.Duration(float64(timeout) * backoff)
+	}
+	return nil, ErrManifestUnacknowledged
+}
+
+// handleTransfer handles a transfer control frame.
+func (kit *GoUDPKit) handleTransfer(payload []byte, addr *net.UDPAddr) error {
+	if len(payload) == 0 {
+		return errBadBulkFrame
+	}
+	switch payload[0] {
+	case transferManifest:
+		kit.mu.Lock()
+		limits := kit.transferLimits.withDefaults()
+		kit.mu.Unlock()
+		m, err := decodeManifest(payload[1:], limits)
+		if errors.Is(err, ErrTransferTooLarge) {
+			kit.refuseTransfer(binary.BigEndian.Uint32(payload[1:]), addr)
+		}
+		if err != nil {
+			return err
+		}
+		key := messageKey{peer: addr.String(), id: m.TransferID}
+		kit.mu.Lock()
+		t, ok := kit.bulkTransfers[key]
+		f, finished := kit.bulkFinished[key]
+		refused := false
+		switch {
+		case finished:
+			// only confirm a manifest retransmitted after the transfer
+			// ended if it describes the same data and all of it arrived,
+			// since no more chunks are taken under this ID
+			refused = f.manifest == nil || f.hdr != m.header() || f.manifest.Digest != m.Digest || !f.complete
+		case ok:
+			if t.manifest == nil || t.hdr != m.header() || t.manifest.Digest != m.Digest {
+				err = errBadBulkFrame
+			}
+		default:
+			if err = kit.admitTransfer(key.peer, limits); err != nil {
+				refused = true
+				break
+			}
+			t, err = kit.startTransfer(key, m, addr)
+			refused = errors.Is(err, ErrTransferFileExists)
+			if refused {
+				// drop the refused sender's chunks rather than take
+				// them as a transfer without a manifest
+				kit.bulkFinished[key] = finishedTransfer{at: time.Now(), hdr: m.header(), manifest: &m}
+			}
+		}
+		var missing []ChunkRange
+		if err == nil && !finished {
+			missing = t.missing()
+		}
+		kit.mu.Unlock()
+		if refused {
+			kit.refuseTransfer(m.TransferID, addr)
+			return err
+		}
+		if err != nil {
+			return err
+		}
+		// acknowledge retransmissions too, in case the first ack was lost
+		ack := appendManifestAck(nil, m.TransferID, missing)
+		return kit.writeFrame(context.Background(), Header{Type: PacketTypeTransfer, SequenceNumber: m.TransferID}, ack, addr)
+	case transferManifestAck:
+		id, missing, err := decodeManifestAck(payload[1:])
+		if err != nil {
+			return err
+		}
+		key := messageKey{peer: addr.String(), id: id}
+		kit.mu.Lock()
+		if ack, waiting := kit.manifestAcks[key]; waiting && !ack.acked {
+			ack.acked, ack.missing = true, missing
+		}
+		kit.mu.Unlock()
+		return nil
+	case transferRefused:
+		if len(payload) != 5 {
+			return errBadBulkFrame
+		}
+		key := messageKey{peer: addr.String(), id: binary.BigEndian.Uint32(payload[1:])}
+		kit.mu.Lock()
+		if ack, waiting := kit.manifestAcks[key]; waiting && !ack.acked {
+			ack.refused = true
+		}
+		kit.mu.Unlock()
+		return nil
+	}
+	return errBadBulkFrame
+}
+
+// refuseTransfer tells addr that its transfer id will not be received.
+func (kit *GoUDPKit) refuseTransfer(id uint32, addr *net.UDPAddr) error {
+	frame := binary.BigEndian.AppendUint32([]byte{transferRefused}, id)
+	return kit.writeFrame(context.Background(), Header{Type: PacketTypeTransfer, SequenceNumber: id}, frame, addr)
+}
+
+// startTransfer begins receiving the transfer m describes, into a file if
+// the kit has a transfer directory. The caller must hold mu.
+func (kit *GoUDPKit) startTransfer(key messageKey, m Manifest, addr *net.UDPAddr) (*bulkTransfer, error) {
+	t := &bulkTransfer{hdr: m.header(), addr: addr, manifest: &m, chunks: make(memChunks), repairs: make(map[uint32][][]byte), lastSeen: time.Now()}
+	if kit.transferDir != "" {
+		f, err := kit.openTransferFile(m)
+		if err != nil {
+			return nil, err
+		}
+		t.chunks = f
+	}
+	kit.bulkTransfers[key] = t
+	// a checkpoint may already hold every chunk
+	if uint32(t.chunks.len()) == t.hdr.chunkCount() {
+		kit.bulkDone = append(kit.bulkDone, kit.finishBulk(key, t, nil))
+	}
+	return t, nil
+}
+
+// ReceiveTransfer waits for the next transfer sent with SendTransfer or
+// SendFile and checks it against its manifest. A transfer whose digest does
+// not match returns ErrChecksumMismatch, and one that ends with chunks
+// missing returns an *IncompleteTransferError as ReceiveBulkDataContext
+// does; in both cases the result carries the manifest but no data. With a
+// transfer directory set, the data is written to the file named in the
+// result's Path instead of being returned.
+func (kit *GoUDPKit) ReceiveTransfer(ctx context.Context) (*TransferResult, error) {
+	res, err := kit.receiveBulk(ctx, true)
+	if res.manifest == nil {
+		return nil, err
+	}
+	result := &TransferResult{Manifest: *res.manifest, Addr: res.addr}
+	if err != nil {
+		return result, err
+	}
+	if res.file != nil {
+		kit.mu.Lock()
+		replace := kit.transferReplace
+		kit.mu.Unlock()
+		if err := res.file.commit(res.manifest, replace); err != nil {
+			return result, err
+		}
+		result.Path = res.file.path
+		return result, nil
+	}
+	if sha256.Sum256(res.data) != res.manifest.Digest {
+		return result, ErrChecksumMismatch
+	}
+	result.Data = res.data
+	return result, nil
+}
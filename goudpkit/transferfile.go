@@ -0,0 +1,331 @@
+package goudpkit
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"math/bits"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// A checkpoint file starts with a fixed header, big-endian, followed by a
+// bitmap with one bit per chunk, set once the chunk is on disk:
+//
+//	offset size field
+//	0      8    magic "GUKCKPT1"
+//	8      8    transfer size
+//	16     4    chunk size
+//	20     32   SHA-256 digest of the transfer
+const checkpointHeaderSize = 52
+
+var checkpointMagic = []byte("GUKCKPT1")
+
+// ErrTransferFileExists is reported when a received transfer would write
+// over a part or checkpoint file the kit did not create. The sender is
+// refused.
+var ErrTransferFileExists = errors.New("transfer file exists")
+
+// maxUniqueNames bounds the numbered names tried for a received file whose
+// name is taken.
+const maxUniqueNames = 1000
+
+// transferFile receives a transfer into path+".part", recording the chunks
+// it holds in the checkpoint path+".ckpt" so that an interrupted transfer
+// of the same data can resume.
+type transferFile struct {
+	path     string
+	part     *os.File
+	ckpt     *os.File
+	bitmap   []byte
+	received int
+	size     uint64
+	chunk    uint32
+}
+
+// SetTransferDir makes the kit receive transfers sent with SendTransfer or
+// SendFile into files in dir, named after the manifest, instead of memory.
+// Each file is written as name.part with a checkpoint name.ckpt beside it
+// and is renamed to name once its digest checks out, or to name-1, name-2
+// and so on if name is taken, unless SetTransferReplace allows replacing
+// it. Part and checkpoint files the kit did not create, or that another
+// transfer is still receiving into, are never written over; such a
+// transfer is refused. A transfer of the
+// same data that finds a checkpoint resumes from it, and the sender is
+// told to send only the chunks still missing. An empty dir goes back to
+// receiving into memory.
+func (kit *GoUDPKit) SetTransferDir(dir string) error {
+	if dir != "" {
+		fi, err := os.Stat(dir)
+		if err != nil {
+			return err
+		}
+		if !fi.IsDir() {
+			return fmt.Errorf("%s is not a directory", dir)
+		}
+	}
+	kit.mu.Lock()
+	kit.transferDir = dir
+	kit.mu.Unlock()
+	return nil
+}
+
+// SetTransferReplace lets a received file replace an existing file of the
+// same name in the transfer directory. By default it is given a free name
+// instead, as the sender chooses the name.
+func (kit *GoUDPKit) SetTransferReplace(replace bool) {
+	kit.mu.Lock()
+	kit.transferReplace = replace
+	kit.mu.Unlock()
+}
+
+// SendFile is like SendTransfer but reads the size bytes to send from r,
+// so the data need not fit in memory. The digest is computed in one pass
+// over r before the manifest is sent.
+func (kit *GoUDPKit) SendFile(ctx context.Context, r io.ReaderAt, size int64, opts TransferOptions, addr *net.UDPAddr) (Manifest, error) {
+	h := sha256.New()
+	if _, err := io.Copy(h, io.NewSectionReader(r, 0, size)); err != nil {
+		return Manifest{}, err
+	}
+	var digest [sha256.Size]byte
+	h.Sum(digest[:0])
+	return kit.sendTransfer(ctx, r, size, digest, opts, addr)
+}
+
+// transferFileName picks a file name for m that cannot leave the
+// transfer directory.
+func transferFileName(m Manifest) string {
+	name := filepath.Base(filepath.Clean("/" + m.Name))
+	if name == "/" || name == "." {
+		name = fmt.Sprintf("transfer-%x", m.Digest[:8])
+	}
+	return name
+}
+
+// openTransferFile opens the part file and checkpoint for m, resuming from
+// an existing checkpoint of the same data. m must be within the kit's
+// TransferLimits, as decodeManifest makes sure, since the part file is
+// truncated to m.Size and the bitmap sized by m.ChunkCount. A file another
+// transfer is still writing, or that is waiting for ReceiveTransfer, is
+// reported as ErrTransferFileExists. The caller must hold mu.
+func (kit *GoUDPKit) openTransferFile(m Manifest) (*transferFile, error) {
+	path := filepath.Join(kit.transferDir, transferFileName(m))
+	if kit.transferFileInUse(path) {
+		return nil, fmt.Errorf("%w: %s is being received", ErrTransferFileExists, path)
+	}
+
+	f := &transferFile{path: path, size: m.Size, chunk: uint32(m.ChunkSize)}
+	hdr := binary.BigEndian.AppendUint64(append([]byte(nil), checkpointMagic...), m.Size)
+	hdr = binary.BigEndian.AppendUint32(hdr, uint32(m.ChunkSize))
+	hdr = append(hdr, m.Digest[:]...)
+	bitmapLen := (int(m.ChunkCount) + 7) / 8
+
+	// resume only if both files survive and the checkpoint is for this data
+	var err error
+	old, rerr := os.ReadFile(path + ".ckpt")
+	if rerr == nil && len(old) == checkpointHeaderSize+bitmapLen && bytes.Equal(old[:checkpointHeaderSize], hdr) {
+		if f.part, err = os.OpenFile(path+".part", os.O_RDWR, 0o644); err == nil {
+			f.bitmap = old[checkpointHeaderSize:]
+		}
+	}
+	if f.bitmap == nil {
+		// start over on the files of an earlier transfer, but leave
+		// anything else in the way alone
+		flags := os.O_RDWR | os.O_CREATE | os.O_EXCL
+		if rerr == nil && bytes.HasPrefix(old, checkpointMagic) {
+			flags = os.O_RDWR | os.O_CREATE | os.O_TRUNC
+		}
+		f.bitmap = make([]byte, bitmapLen)
+		if f.part, err = openTransferPart(path+".part", flags); err != nil {
+			return nil, err
+		}
+		if f.ckpt, err = openTransferPart(path+".ckpt", flags); err == nil {
+			_, err = f.ckpt.Write(append(hdr, f.bitmap...))
+		}
+		if err != nil {
+			f.close()
+			return nil, err
+		}
+	}
+	if err := f.part.Truncate(int64(m.Size)); err != nil {
+		f.close()
+		return nil, err
+	}
+	if f.ckpt == nil {
+		if f.ckpt, err = os.OpenFile(path+".ckpt", os.O_RDWR, 0o644); err != nil {
+			f.part.Close()
+			return nil, err
+		}
+	}
+	for _, b := range f.bitmap {
+		f.received += bits.OnesCount8(b)
+	}
+	return f, nil
+}
+
+// transferFileInUse reports whether a transfer in progress or not yet
+// collected writes to path. The caller must hold mu.
+func (kit *GoUDPKit) transferFileInUse(path string) bool {
+	for _, t := range kit.bulkTransfers {
+		if f, ok := t.chunks.(*transferFile); ok && f.path == path {
+			return true
+		}
+	}
+	for _, res := range kit.bulkDone {
+		if res.file != nil && res.file.path == path {
+			return true
+		}
+	}
+	return false
+}
+
+// openTransferPart opens a part or checkpoint file, reporting one that
+// exists when flags forbid it as ErrTransferFileExists.
+func openTransferPart(path string, flags int) (*os.File, error) {
+	f, err := os.OpenFile(path, flags, 0o644)
+	if errors.Is(err, fs.ErrExist) {
+		return nil, fmt.Errorf("%w: %s", ErrTransferFileExists, path)
+	}
+	return f, err
+}
+
+func (f *transferFile) has(i uint32) bool {
+	return f.bitmap[i/8]&(1<<(i%8)) != 0
+}
+
+func (f *transferFile) get(i uint32, n int) ([]byte, bool) {
+	if !f.has(i) {
+		return nil, false
+	}
+	b := make([]byte, n)
+	if _, err := f.part.ReadAt(b, int64(i)*int64(f.chunk)); err != nil && !(err == io.EOF && n == 0) {
+		return nil, false
+	}
+	return b, true
+}
+
+// put writes chunk i to the part file before marking it in the checkpoint,
+// so the checkpoint never claims a chunk that is not on disk.
+func (f *transferFile) put(i uint32, b []byte) error {
+	if _, err := f.part.WriteAt(b, int64(i)*int64(f.chunk)); err != nil {
+		return err
+	}
+	f.bitmap[i/8] |= 1 << (i % 8)
+	if _, err := f.ckpt.WriteAt(f.bitmap[i/8:i/8+1], checkpointHeaderSize+int64(i/8)); err != nil {
+		f.bitmap[i/8] &^= 1 << (i % 8)
+		return err
+	}
+	f.received++
+	return nil
+}
+
+func (f *transferFile) len() int { return f.received }
+
+// missing walks the checkpoint bitmap a byte at a time, taking bytes with
+// no chunk or every chunk in one step.
+func (f *transferFile) missing(count uint32) []ChunkRange {
+	var missing []ChunkRange
+	for i := uint64(0); i < uint64(count); {
+		if b := f.bitmap[i/8]; i%8 == 0 && (b == 0 || b == 0xff) {
+			if b == 0 {
+				missing = appendRange(missing, uint32(i), uint32(min(i+7, uint64(count)-1)))
+			}
+			i += 8
+			continue
+		}
+		if !f.has(uint32(i)) {
+			missing = appendRange(missing, uint32(i), uint32(i))
+		}
+		i++
+	}
+	return missing
+}
+
+func (f *transferFile) close() {
+	if f.part != nil {
+		f.part.Close()
+	}
+	if f.ckpt != nil {
+		f.ckpt.Close()
+	}
+}
+
+// commit checks the complete part file against m's digest. A match is
+// renamed into place and its checkpoint removed; a mismatch is removed
+// along with its checkpoint, since the bad chunk cannot be told apart.
+// Unless replace is set, an existing file is kept and the part file takes
+// the first free numbered name instead, which f.path is updated to.
+func (f *transferFile) commit(m *Manifest, replace bool) error {
+	h := sha256.New()
+	_, err := io.Copy(h, io.NewSectionReader(f.part, 0, int64(f.size)))
+	if err == nil {
+		err = f.part.Sync()
+	}
+	f.close()
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(h.Sum(nil), m.Digest[:]) {
+		os.Remove(f.path + ".part")
+		os.Remove(f.path + ".ckpt")
+		return ErrChecksumMismatch
+	}
+	ckpt := f.path + ".ckpt"
+	path := f.path
+	if !replace {
+		if path, err = claimName(f.path); err != nil {
+			return err
+		}
+	}
+	if err := os.Rename(f.path+".part", path); err != nil {
+		if path != f.path {
+			os.Remove(path)
+		}
+		return err
+	}
+	f.path = path
+	return os.Remove(ckpt)
+}
+
+// claimName creates an empty file at path, or if that exists at path with
+// -1, -2 and so on added before the extension, and returns the name it
+// took. Creating the file keeps another commit from taking the same name.
+func claimName(path string) (string, error) {
+	ext := filepath.Ext(path)
+	stem := strings.TrimSuffix(path, ext)
+	name := path
+	for n := 1; n <= maxUniqueNames; n++ {
+		f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+		if err == nil {
+			return name, f.Close()
+		}
+		if !errors.Is(err, fs.ErrExist) {
+			return "", err
+		}
+		name = fmt.Sprintf("%s-%d%s", stem, n, ext)
+	}
+	return "", fmt.Errorf("%w: %s", ErrTransferFileExists, path)
+}
+
+// closeTransferFiles closes the files of transfers still in progress or
+// not yet collected, leaving them on disk to resume. The caller must hold
+// mu.
+func (kit *GoUDPKit) closeTransferFiles() {
+	for _, t := range kit.bulkTransfers {
+		if f, ok := t.chunks.(*transferFile); ok {
+			f.close()
+		}
+	}
+	for _, res := range kit.bulkDone {
+		if res.file != nil {
+			res.file.close()
+		}
+	}
+}
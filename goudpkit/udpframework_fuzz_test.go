@@ -9,13 +9,19 @@ import (
 func FuzzCompressDecompress(f *testing.F) {
 	f.Add([]byte("aaabbbccccccdddddddeee"))
 	f.Fuzz(func(t *testing.T, data []byte) {
-		kit, err := NewGoUDPKit(":0", RetryConfig{1, 1, 1.0}, QoSConfig{1, make([][]Packet, 1)}, BufferConfig{1, 1})
+		kit, err := NewGoUDPKit(":0", RetryConfig{MaxRetries: 1, BaseTimeout: 1, BackoffRate: 1.0}, QoSConfig{PriorityLevels: 1, PriorityQueues: make([][]Packet, 1)}, BufferConfig{MaxBufferSize: 1, FlushInterval: 1})
 		if err != nil {
 			t.Skip()
 		}
 		defer kit.Close()
-		compressed := kit.Compress(data)
-		decompressed := kit.Decompress(compressed)
+		compressed, err := kit.Compress(data)
+		if err != nil {
+			t.Fatalf("Compress failed: %v", err)
+		}
+		decompressed, err := kit.Decompress(compressed)
+		if err != nil {
+			t.Fatalf("Decompress failed: %v", err)
+		}
 		if string(decompressed) != string(data) {
 			t.Fatalf("Compress/Decompress mismatch: got '%s', want '%s'", string(decompressed), string(data))
 		}
@@ -25,15 +31,52 @@ func FuzzCompressDecompress(f *testing.F) {
 func FuzzEncryptDecrypt(f *testing.F) {
 	f.Add([]byte("secret"), []byte("encrypt-this-data"))
 	f.Fuzz(func(t *testing.T, key []byte, data []byte) {
-		kit, err := NewGoUDPKit(":0", RetryConfig{1, 1, 1.0}, QoSConfig{1, make([][]Packet, 1)}, BufferConfig{1, 1})
+		kit, err := NewGoUDPKit(":0", RetryConfig{MaxRetries: 1, BaseTimeout: 1, BackoffRate: 1.0}, QoSConfig{PriorityLevels: 1, PriorityQueues: make([][]Packet, 1)}, BufferConfig{MaxBufferSize: 1, FlushInterval: 1})
 		if err != nil {
 			t.Skip()
 		}
 		defer kit.Close()
-		cipher := kit.EncryptData(data, key)
-		decrypted := kit.DecryptData(cipher, key)
+		cipher, err := kit.EncryptData(data, key)
+		if len(key) == 0 {
+			if err == nil {
+				t.Fatalf("expected an error for an empty key")
+			}
+			return
+		}
+		if err != nil {
+			t.Fatalf("EncryptData failed: %v", err)
+		}
+		decrypted, err := kit.DecryptData(cipher, key)
+		if err != nil {
+			t.Fatalf("DecryptData failed: %v", err)
+		}
 		if string(decrypted) != string(data) {
 			t.Fatalf("Encrypt/Decrypt mismatch: got '%s', want '%s'", string(decrypted), string(data))
 		}
 	})
 }
+
+func FuzzDecodeHeader(f *testing.F) {
+	f.Add(AppendHeader(nil, Header{Type: PacketTypeData, SequenceNumber: 1}, []byte("data")))
+	f.Fuzz(func(t *testing.T, b []byte) {
+		h, payload, err := DecodeHeader(b)
+		if err != nil {
+			return
+		}
+		again, _, err := DecodeHeader(AppendHeader(nil, h, payload))
+		if err != nil || again != h {
+			t.Fatalf("re-encoded header mismatch: got %+v (%v), want %+v", again, err, h)
+		}
+	})
+}
+
+func FuzzLZ4Decode(f *testing.F) {
+	enc, _ := LZ4Codec{}.Encode([]byte("aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"))
+	f.Add(enc)
+	f.Fuzz(func(t *testing.T, b []byte) {
+		out, err := LZ4Codec{}.Decode(b, 1<<16)
+		if err == nil && len(out) > 1<<16 {
+			t.Fatalf("decoded %d bytes past the limit", len(out))
+		}
+	})
+}
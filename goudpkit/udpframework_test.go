@@ -1,10 +1,24 @@
 package goudpkit
 
 import (
+	"bytes"
+	"context"
+	"crypto/ecdh"
+	"crypto/rand"
 	"errors"
+	"fmt"
+	mrand "math/rand"
 	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
 )
 
 type mockUDPConn struct {
@@ -45,6 +59,91 @@ func (m *mockUDPConn) SetReadDeadline(t time.Time) error { return nil }
 func (m *mockUDPConn) Close() error                      { m.closed = true; return nil }
 func (m *mockUDPConn) LocalAddr() net.Addr               { return &net.UDPAddr{} }
 
+type mockDatagram struct {
+	data []byte
+	from *net.UDPAddr
+}
+
+// mockPeerConn is one end of an addressed, deadline-aware loopback pair.
+// drop, when set, decides whether an outgoing datagram is lost.
+type mockPeerConn struct {
+	addr     *net.UDPAddr
+	peer     *mockPeerConn
+	inbox    chan mockDatagram
+	wake     chan struct{}
+	mu       sync.Mutex
+	deadline time.Time
+	drop     func(b []byte) bool
+}
+
+func newMockPeerPair() (*mockPeerConn, *mockPeerConn) {
+	a := &mockPeerConn{addr: &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 1000}, inbox: make(chan mockDatagram, 64), wake: make(chan struct{}, 1)}
+	b := &mockPeerConn{addr: &net.UDPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 2000}, inbox: make(chan mockDatagram, 64), wake: make(chan struct{}, 1)}
+	a.peer, b.peer = b, a
+	return a, b
+}
+
+func (m *mockPeerConn) WriteToUDP(b []byte, _ *net.UDPAddr) (int, error) {
+	m.mu.Lock()
+	drop := m.drop
+	m.mu.Unlock()
+	if drop != nil && drop(b) {
+		return len(b), nil
+	}
+	m.peer.inbox <- mockDatagram{data: append([]byte{}, b...), from: m.addr}
+	return len(b), nil
+}
+
+func (m *mockPeerConn) ReadFromUDP(b []byte) (int, *net.UDPAddr, error) {
+	for {
+		m.mu.Lock()
+		deadline := m.deadline
+		m.mu.Unlock()
+		if !deadline.IsZero() && !time.Now().Before(deadline) {
+			return 0, nil, os.ErrDeadlineExceeded
+		}
+		var timeout <-chan time.Time
+		var timer *time.Timer
+		if !deadline.IsZero() {
+			timer = time.NewTimer(time.Until(deadline))
+			timeout = timer.C
+		}
+		select {
+		case d := <-m.inbox:
+			if timer != nil {
+				timer.Stop()
+			}
+			return copy(b, d.data), d.from, nil
+		case <-timeout:
+			return 0, nil, os.ErrDeadlineExceeded
+		case <-m.wake:
+			if timer != nil {
+				timer.Stop()
+			}
+		}
+	}
+}
+
+func (m *mockPeerConn) SetReadDeadline(t time.Time) error {
+	m.mu.Lock()
+	m.deadline = t
+	m.mu.Unlock()
+	select {
+	case m.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+func (m *mockPeerConn) setDrop(drop func(b []byte) bool) {
+	m.mu.Lock()
+	m.drop = drop
+	m.mu.Unlock()
+}
+
+func (m *mockPeerConn) Close() error        { return nil }
+func (m *mockPeerConn) LocalAddr() net.Addr { return m.addr }
+
 func TestNewGoUDPKitInitialization(t *testing.T) {
 	t.Parallel()
 	retryConfig := RetryConfig{MaxRetries: 2, BaseTimeout: time.Millisecond * 10, BackoffRate: 1.2}
@@ -103,8 +202,14 @@ func TestCompressDecompress(t *testing.T) {
 	defer kit.Close()
 
 	original := []byte("aaabbbccccccdddddddeee")
-	compressed := kit.Compress(original)
-	decompressed := kit.Decompress(compressed)
+	compressed, err := kit.Compress(original)
+	if err != nil {
+		t.Fatalf("Compress failed: %v", err)
+	}
+	decompressed, err := kit.Decompress(compressed)
+	if err != nil {
+		t.Fatalf("Decompress failed: %v", err)
+	}
 	if string(decompressed) != string(original) {
 		t.Fatalf("Compress/Decompress failed: got '%s', want '%s'", string(decompressed), string(original))
 	}
@@ -123,11 +228,22 @@ func TestEncryptDecrypt(t *testing.T) {
 
 	key := []byte("secret")
 	plaintext := []byte("encrypt-this-data")
-	cipher := kit.EncryptData(plaintext, key)
-	decrypted := kit.DecryptData(cipher, key)
+	cipher, err := kit.EncryptData(plaintext, key)
+	if err != nil {
+		t.Fatalf("EncryptData failed: %v", err)
+	}
+	decrypted, err := kit.DecryptData(cipher, key)
+	if err != nil {
+		t.Fatalf("DecryptData failed: %v", err)
+	}
 	if string(decrypted) != string(plaintext) {
 		t.Fatalf("Encrypt/Decrypt failed: got '%s', want '%s'", string(decrypted), string(plaintext))
 	}
+
+	cipher[len(cipher)-1] ^= 1
+	if _, err := kit.DecryptData(cipher, key); !errors.Is(err, ErrAuthenticationFailed) {
+		t.Fatalf("expected ErrAuthenticationFailed for tampered data, got %v", err)
+	}
 }
 
 func TestSendAndReceiveBulkData(t *testing.T) {
@@ -219,3 +335,2882 @@ func TestStatsTracking(t *testing.T) {
 		t.Fatalf("Stats tracking failed: PacketsSent should be > 0")
 	}
 }
+
+func TestSendReliableRetransmitsUnacked(t *testing.T) {
+	t.Parallel()
+	retryConfig := RetryConfig{MaxRetries: 4, BaseTimeout: time.Millisecond * 20, BackoffRate: 1.5}
+	qosConfig := QoSConfig{PriorityLevels: 1, PriorityQueues: make([][]Packet, 1)}
+	bufferConfig := BufferConfig{MaxBufferSize: 128, FlushInterval: time.Millisecond * 50}
+	sendConn, recvConn := newMockPeerPair()
+	sendKit, err := NewGoUDPKit(":0", retryConfig, qosConfig, bufferConfig, sendConn)
+	if err != nil {
+		t.Fatalf("Failed to initialize sender: %v", err)
+	}
+	defer sendKit.Close()
+	recvKit, err := NewGoUDPKit(":0", retryConfig, qosConfig, bufferConfig, recvConn)
+	if err != nil {
+		t.Fatalf("Failed to initialize receiver: %v", err)
+	}
+	defer recvKit.Close()
+
+	var once sync.Once
+	sendConn.setDrop(func(b []byte) bool {
+		dropped := false
+		if h, _, _ := DecodeHeader(b); h.Type == PacketTypeData && h.SequenceNumber == 2 {
+			once.Do(func() { dropped = true })
+		}
+		return dropped
+	})
+
+	got := make(chan string, 3)
+	go func() {
+		for i := 0; i < 3; i++ {
+			data, _, err := recvKit.ReceivePacket()
+			if err != nil {
+				return
+			}
+			got <- string(data)
+		}
+	}()
+
+	packets := []Packet{
+		{SequenceNumber: 1, Data: []byte("one")},
+		{SequenceNumber: 2, Data: []byte("two")},
+		{SequenceNumber: 3, Data: []byte("three")},
+	}
+	results, err := sendKit.SendReliable(packets, recvConn.addr)
+	if err != nil {
+		t.Fatalf("SendReliable failed: %v", err)
+	}
+	for _, r := range results {
+		if r.Status != Delivered {
+			t.Fatalf("packet %d: expected delivered, got %v", r.SequenceNumber, r.Status)
+		}
+	}
+	if results[1].Attempts < 2 {
+		t.Fatalf("expected packet 2 to be retransmitted, attempts=%d", results[1].Attempts)
+	}
+	if sendKit.GetStats().RetryCount == 0 {
+		t.Fatalf("expected RetryCount > 0")
+	}
+	for i := 0; i < 3; i++ {
+		<-got
+	}
+}
+
+func TestSendReliableGivesUp(t *testing.T) {
+	t.Parallel()
+	retryConfig := RetryConfig{MaxRetries: 2, BaseTimeout: time.Millisecond * 5, BackoffRate: 1.0}
+	qosConfig := QoSConfig{PriorityLevels: 1, PriorityQueues: make([][]Packet, 1)}
+	bufferConfig := BufferConfig{MaxBufferSize: 128, FlushInterval: time.Millisecond * 50}
+	sendConn, recvConn := newMockPeerPair()
+	sendConn.setDrop(func([]byte) bool { return true })
+	kit, err := NewGoUDPKit(":0", retryConfig, qosConfig, bufferConfig, sendConn)
+	if err != nil {
+		t.Fatalf("Failed to initialize: %v", err)
+	}
+	defer kit.Close()
+
+	results, err := kit.SendReliable([]Packet{{SequenceNumber: 7, Data: []byte("lost")}}, recvConn.addr)
+	if err != nil {
+		t.Fatalf("SendReliable failed: %v", err)
+	}
+	if results[0].Status != GaveUp || results[0].Attempts != 3 {
+		t.Fatalf("expected gave up after 3 attempts, got %v after %d", results[0].Status, results[0].Attempts)
+	}
+	if kit.GetStats().RetryCount != 2 {
+		t.Fatalf("expected RetryCount 2, got %d", kit.GetStats().RetryCount)
+	}
+}
+
+func TestSendReliableReusedSequenceNumbers(t *testing.T) {
+	t.Parallel()
+	retryConfig := RetryConfig{MaxRetries: 4, BaseTimeout: time.Millisecond * 20, BackoffRate: 1.5}
+	qosConfig := QoSConfig{PriorityLevels: 1, PriorityQueues: make([][]Packet, 1)}
+	bufferConfig := BufferConfig{MaxBufferSize: 128, FlushInterval: time.Millisecond * 50}
+	sendConn, recvConn := newMockPeerPair()
+	recvKit, err := NewGoUDPKit(":0", retryConfig, qosConfig, bufferConfig, recvConn)
+	if err != nil {
+		t.Fatalf("Failed to initialize receiver: %v", err)
+	}
+	defer recvKit.Close()
+
+	got := make(chan string, 2)
+	go func() {
+		for i := 0; i < 2; i++ {
+			data, _, err := recvKit.ReceivePacket()
+			if err != nil {
+				return
+			}
+			got <- string(data)
+		}
+	}()
+
+	// a second call, and a restarted sender, may start from 1 again
+	for _, data := range []string{"first", "second"} {
+		sendKit, err := NewGoUDPKit(":0", retryConfig, qosConfig, bufferConfig, sendConn)
+		if err != nil {
+			t.Fatalf("Failed to initialize sender: %v", err)
+		}
+		results, err := sendKit.SendReliable([]Packet{{SequenceNumber: 1, Data: []byte(data)}}, recvConn.addr)
+		sendKit.Close()
+		if err != nil || results[0].Status != Delivered {
+			t.Fatalf("SendReliable: %v %+v", err, results)
+		}
+		select {
+		case g := <-got:
+			if g != data {
+				t.Fatalf("expected %q, got %q", data, g)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("%q was acknowledged but not delivered", data)
+		}
+	}
+}
+
+// failSeqConn fails the writes of data packets with one sequence number.
+type failSeqConn struct {
+	*mockPeerConn
+	seq uint32
+}
+
+func (c *failSeqConn) WriteToUDP(b []byte, addr *net.UDPAddr) (int, error) {
+	if h, _, _ := DecodeHeader(b); h.Type == PacketTypeData && h.SequenceNumber == c.seq {
+		return 0, errors.New("network down")
+	}
+	return c.mockPeerConn.WriteToUDP(b, addr)
+}
+
+func TestSendReliableReturnsPartialResults(t *testing.T) {
+	t.Parallel()
+	retryConfig := RetryConfig{MaxRetries: 4, BaseTimeout: time.Millisecond * 20, BackoffRate: 1.5}
+	qosConfig := QoSConfig{PriorityLevels: 1, PriorityQueues: make([][]Packet, 1)}
+	bufferConfig := BufferConfig{MaxBufferSize: 128, SendWindow: 1, FlushInterval: time.Millisecond * 50}
+	sendConn, recvConn := newMockPeerPair()
+	sendKit, err := NewGoUDPKit(":0", retryConfig, qosConfig, bufferConfig, &failSeqConn{mockPeerConn: sendConn, seq: 2})
+	if err != nil {
+		t.Fatalf("Failed to initialize sender: %v", err)
+	}
+	defer sendKit.Close()
+	recvKit, err := NewGoUDPKit(":0", retryConfig, qosConfig, bufferConfig, recvConn)
+	if err != nil {
+		t.Fatalf("Failed to initialize receiver: %v", err)
+	}
+	defer recvKit.Close()
+	go recvKit.ReceivePacket()
+
+	packets := []Packet{
+		{SequenceNumber: 1, Data: []byte("one")},
+		{SequenceNumber: 2, Data: []byte("two")},
+		{SequenceNumber: 3, Data: []byte("three")},
+	}
+	results, err := sendKit.SendReliable(packets, recvConn.addr)
+	if err == nil {
+		t.Fatal("expected the failed write to be reported")
+	}
+	if len(results) != 3 || results[0].Status != Delivered || results[1].Status != GaveUp || results[2].SequenceNumber != 3 {
+		t.Fatalf("unexpected partial results %+v", results)
+	}
+}
+
+func TestHeaderRoundTrip(t *testing.T) {
+	t.Parallel()
+	h := Header{
+		Type:           PacketTypeData,
+		Flags:          FlagCompressed | FlagFragment,
+		Priority:       3,
+		SequenceNumber: 42,
+		MessageID:      7,
+		FragmentIndex:  1,
+		FragmentCount:  4,
+		Timestamp:      time.Unix(0, 1700000000123456789),
+	}
+	b := AppendHeader(nil, h, []byte("payload"))
+	if len(b) != HeaderSize+len("payload") {
+		t.Fatalf("unexpected encoded length %d", len(b))
+	}
+	got, payload, err := DecodeHeader(b)
+	if err != nil {
+		t.Fatalf("DecodeHeader failed: %v", err)
+	}
+	h.Version = HeaderVersion
+	if got != h {
+		t.Fatalf("header mismatch: got %+v, want %+v", got, h)
+	}
+	if string(payload) != "payload" {
+		t.Fatalf("payload mismatch: got '%s'", string(payload))
+	}
+
+	b[0] = headerMagic | (HeaderVersion + 1)
+	if _, _, err := DecodeHeader(b); !errors.Is(err, ErrUnsupportedVersion) {
+		t.Fatalf("expected ErrUnsupportedVersion, got %v", err)
+	}
+	if _, _, err := DecodeHeader(b[:HeaderSize-1]); !errors.Is(err, ErrShortHeader) {
+		t.Fatalf("expected ErrShortHeader, got %v", err)
+	}
+}
+
+func TestReadPacketCarriesHeaderFields(t *testing.T) {
+	t.Parallel()
+	retryConfig := RetryConfig{MaxRetries: 1, BaseTimeout: time.Millisecond * 10, BackoffRate: 1.1}
+	qosConfig := QoSConfig{PriorityLevels: 3, PriorityQueues: make([][]Packet, 3)}
+	bufferConfig := BufferConfig{MaxBufferSize: 128, FlushInterval: time.Millisecond * 50}
+	mockConn := newMockUDPConn()
+	kit, err := NewGoUDPKit(":0", retryConfig, qosConfig, bufferConfig, mockConn)
+	if err != nil {
+		t.Fatalf("Failed to initialize: %v", err)
+	}
+	defer kit.Close()
+
+	before := time.Now()
+	if err := kit.SendPacket(Packet{SequenceNumber: 9, Priority: 2, Data: []byte("hdr")}, &net.UDPAddr{}); err != nil {
+		t.Fatalf("SendPacket failed: %v", err)
+	}
+	packet, _, err := kit.ReadPacket()
+	if err != nil {
+		t.Fatalf("ReadPacket failed: %v", err)
+	}
+	if packet.SequenceNumber != 9 || packet.Priority != 2 || string(packet.Data) != "hdr" {
+		t.Fatalf("unexpected packet %+v", packet)
+	}
+	if packet.Timestamp.Before(before) {
+		t.Fatalf("timestamp %v not stamped at send time", packet.Timestamp)
+	}
+}
+
+func TestSendMessageReassemblesOutOfOrder(t *testing.T) {
+	t.Parallel()
+	retryConfig := RetryConfig{MaxRetries: 1, BaseTimeout: time.Millisecond * 10, BackoffRate: 1.1}
+	qosConfig := QoSConfig{PriorityLevels: 1, PriorityQueues: make([][]Packet, 1)}
+	bufferConfig := BufferConfig{MaxBufferSize: 128, FlushInterval: time.Second}
+	sendConn, recvConn := newMockPeerPair()
+	sendKit, err := NewGoUDPKit(":0", retryConfig, qosConfig, bufferConfig, sendConn)
+	if err != nil {
+		t.Fatalf("Failed to initialize sender: %v", err)
+	}
+	defer sendKit.Close()
+	recvKit, err := NewGoUDPKit(":0", retryConfig, qosConfig, bufferConfig, recvConn)
+	if err != nil {
+		t.Fatalf("Failed to initialize receiver: %v", err)
+	}
+	defer recvKit.Close()
+	if err := sendKit.SetMTU(HeaderSize + 100); err != nil {
+		t.Fatalf("SetMTU failed: %v", err)
+	}
+
+	var frames [][]byte
+	sendConn.setDrop(func(b []byte) bool {
+		frames = append(frames, append([]byte{}, b...))
+		return true
+	})
+	message := make([]byte, 1050)
+	for i := range message {
+		message[i] = byte(i)
+	}
+	if err := sendKit.SendMessage(message, recvConn.addr); err != nil {
+		t.Fatalf("SendMessage failed: %v", err)
+	}
+	if len(frames) != 11 {
+		t.Fatalf("expected 11 fragments, got %d", len(frames))
+	}
+	for i := len(frames) - 1; i >= 0; i-- {
+		recvConn.inbox <- mockDatagram{data: frames[i], from: sendConn.addr}
+	}
+
+	got, _, err := recvKit.ReceiveMessage()
+	if err != nil {
+		t.Fatalf("ReceiveMessage failed: %v", err)
+	}
+	if string(got) != string(message) {
+		t.Fatalf("reassembled message mismatch: got %d bytes", len(got))
+	}
+}
+
+func TestPartialMessagesExpireAndRespectBufferLimit(t *testing.T) {
+	t.Parallel()
+	retryConfig := RetryConfig{MaxRetries: 1, BaseTimeout: time.Millisecond * 10, BackoffRate: 1.1}
+	qosConfig := QoSConfig{PriorityLevels: 1, PriorityQueues: make([][]Packet, 1)}
+	bufferConfig := BufferConfig{MaxBufferSize: 2, FlushInterval: time.Millisecond * 20}
+	kit, err := NewGoUDPKit(":0", retryConfig, qosConfig, bufferConfig, newMockUDPConn())
+	if err != nil {
+		t.Fatalf("Failed to initialize: %v", err)
+	}
+	defer kit.Close()
+
+	from := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 9), Port: 9}
+	for i := 0; i < 3; i++ {
+		h := Header{Type: PacketTypeData, Flags: FlagFragment, MessageID: uint32(i), FragmentCount: 2}
+		if _, ok, _ := kit.handleDatagram(AppendHeader(nil, h, []byte("part")), from); ok {
+			t.Fatalf("fragment %d should not complete a message", i)
+		}
+	}
+	kit.mu.Lock()
+	buffered := kit.bufferedFrags
+	kit.mu.Unlock()
+	if buffered != 2 {
+		t.Fatalf("expected 2 buffered fragments, got %d", buffered)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	kit.mu.Lock()
+	remaining := len(kit.reassemblyQueue)
+	kit.mu.Unlock()
+	if remaining != 0 {
+		t.Fatalf("expected partial messages to expire, %d remain", remaining)
+	}
+	if dropped := kit.GetStats().PacketsDropped; dropped != 3 {
+		t.Fatalf("expected 3 dropped fragments, got %d", dropped)
+	}
+}
+
+func TestFragmentLimitsAndLateDuplicates(t *testing.T) {
+	t.Parallel()
+	retryConfig := RetryConfig{MaxRetries: 1, BaseTimeout: time.Millisecond * 10, BackoffRate: 1.1}
+	qosConfig := QoSConfig{PriorityLevels: 1, PriorityQueues: make([][]Packet, 1)}
+	bufferConfig := BufferConfig{MaxPartialMessages: 2, FlushInterval: time.Second}
+	kit, err := NewGoUDPKit(":0", retryConfig, qosConfig, bufferConfig, newMockUDPConn())
+	if err != nil {
+		t.Fatalf("Failed to initialize: %v", err)
+	}
+	defer kit.Close()
+
+	from := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 9), Port: 9}
+	fragment := func(id uint32, index, count uint16) bool {
+		h := Header{Type: PacketTypeData, Flags: FlagFragment, MessageID: id, FragmentIndex: index, FragmentCount: count}
+		_, ok, _ := kit.handleDatagram(AppendHeader(nil, h, []byte("part")), from)
+		return ok
+	}
+	// a message claiming the most fragments costs only what arrives
+	for id := uint32(1); id <= 3; id++ {
+		fragment(id, 0, 65535)
+	}
+	kit.mu.Lock()
+	partial := len(kit.reassemblyQueue)
+	kit.mu.Unlock()
+	if partial != 2 {
+		t.Fatalf("expected 2 partial messages, got %d", partial)
+	}
+
+	kit.mu.Lock()
+	kit.reassemblyQueue = make(map[messageKey]*partialMessage)
+	kit.mu.Unlock()
+	if !fragment(4, 0, 1) {
+		t.Fatal("single fragment message not delivered")
+	}
+	if fragment(4, 0, 1) {
+		t.Fatal("late duplicate fragment delivered the message again")
+	}
+	if dropped := kit.GetStats().PacketsDropped; dropped != 2 {
+		t.Fatalf("expected 2 dropped fragments, got %d", dropped)
+	}
+}
+
+// gatedConn holds every write until the test releases it, so that packets
+// pile up in the scheduler's queues.
+type gatedConn struct {
+	*mockPeerConn
+	entered chan struct{}
+	gate    chan struct{}
+}
+
+func (g *gatedConn) WriteToUDP(b []byte, addr *net.UDPAddr) (int, error) {
+	g.entered <- struct{}{}
+	<-g.gate
+	return g.mockPeerConn.WriteToUDP(b, addr)
+}
+
+func newGatedKit(t *testing.T, qosConfig QoSConfig) (*GoUDPKit, *gatedConn, *mockPeerConn) {
+	retryConfig := RetryConfig{MaxRetries: 1, BaseTimeout: time.Millisecond * 10, BackoffRate: 1.1}
+	bufferConfig := BufferConfig{MaxBufferSize: 128, FlushInterval: time.Second}
+	local, remote := newMockPeerPair()
+	conn := &gatedConn{mockPeerConn: local, entered: make(chan struct{}, 256), gate: make(chan struct{})}
+	kit, err := NewGoUDPKit(":0", retryConfig, qosConfig, bufferConfig, conn)
+	if err != nil {
+		t.Fatalf("Failed to initialize: %v", err)
+	}
+	if err := kit.SetMTU(HeaderSize + 10); err != nil {
+		t.Fatalf("SetMTU failed: %v", err)
+	}
+	return kit, conn, remote
+}
+
+func drainPriorities(t *testing.T, remote *mockPeerConn, n int) []int {
+	priorities := make([]int, 0, n)
+	for i := 0; i < n; i++ {
+		select {
+		case d := <-remote.inbox:
+			h, _, err := DecodeHeader(d.data)
+			if err != nil {
+				t.Fatalf("DecodeHeader failed: %v", err)
+			}
+			priorities = append(priorities, int(h.Priority))
+		case <-time.After(time.Second):
+			t.Fatalf("timed out after %d of %d packets", i, n)
+		}
+	}
+	return priorities
+}
+
+func TestStrictPrioritySchedulerAndQueueLimits(t *testing.T) {
+	t.Parallel()
+	qosConfig := QoSConfig{PriorityLevels: 3, QueueLimits: []int{2, 2, 2}}
+	kit, conn, remote := newGatedKit(t, qosConfig)
+	defer kit.Close()
+
+	dest := remote.addr
+	if err := kit.Enqueue(Packet{Priority: 0, Data: []byte("first")}, dest); err != nil {
+		t.Fatalf("Enqueue failed: %v", err)
+	}
+	<-conn.entered
+	for _, p := range []int{0, 0, 2, 1} {
+		if err := kit.Enqueue(Packet{Priority: p, Data: []byte("x")}, dest); err != nil {
+			t.Fatalf("Enqueue failed: %v", err)
+		}
+	}
+	if err := kit.Enqueue(Packet{Priority: 0, Data: []byte("x")}, dest); !errors.Is(err, ErrQueueFull) {
+		t.Fatalf("expected ErrQueueFull, got %v", err)
+	}
+	if qs := kit.QueueStats(); qs[0].Depth != 2 || qs[0].Dropped != 1 {
+		t.Fatalf("unexpected level 0 stats %+v", qs[0])
+	}
+	close(conn.gate)
+
+	got := drainPriorities(t, remote, 5)
+	want := []int{0, 2, 1, 0, 0}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("send order %v, want %v", got, want)
+		}
+	}
+}
+
+func TestWeightedFairScheduler(t *testing.T) {
+	t.Parallel()
+	qosConfig := QoSConfig{PriorityLevels: 2, Policy: WeightedFair, Weights: []int{1, 3}}
+	kit, conn, remote := newGatedKit(t, qosConfig)
+	defer kit.Close()
+
+	dest := remote.addr
+	if err := kit.Enqueue(Packet{Priority: 1, Data: make([]byte, 10)}, dest); err != nil {
+		t.Fatalf("Enqueue failed: %v", err)
+	}
+	<-conn.entered
+	for i := 0; i < 20; i++ {
+		kit.Enqueue(Packet{Priority: 0, Data: make([]byte, 10)}, dest)
+		kit.Enqueue(Packet{Priority: 1, Data: make([]byte, 10)}, dest)
+	}
+	close(conn.gate)
+
+	got := drainPriorities(t, remote, 17)[1:]
+	high := 0
+	for _, p := range got {
+		if p == 1 {
+			high++
+		}
+	}
+	if high != 12 {
+		t.Fatalf("expected 12 of 16 packets from the weight-3 level, got %d (%v)", high, got)
+	}
+}
+
+func TestEncryptedSendReceive(t *testing.T) {
+	t.Parallel()
+	for _, suite := range []CipherSuite{CipherAESGCM, CipherChaCha20Poly1305} {
+		retryConfig := RetryConfig{MaxRetries: 1, BaseTimeout: time.Millisecond * 10, BackoffRate: 1.1}
+		qosConfig := QoSConfig{PriorityLevels: 1, PriorityQueues: make([][]Packet, 1)}
+		bufferConfig := BufferConfig{MaxBufferSize: 128, FlushInterval: time.Second}
+		sendConn, recvConn := newMockPeerPair()
+		sendKit, err := NewGoUDPKit(":0", retryConfig, qosConfig, bufferConfig, sendConn)
+		if err != nil {
+			t.Fatalf("Failed to initialize sender: %v", err)
+		}
+		defer sendKit.Close()
+		recvKit, err := NewGoUDPKit(":0", retryConfig, qosConfig, bufferConfig, recvConn)
+		if err != nil {
+			t.Fatalf("Failed to initialize receiver: %v", err)
+		}
+		defer recvKit.Close()
+
+		key := make([]byte, 32)
+		for i := range key {
+			key[i] = byte(i)
+		}
+		if err := sendKit.SetEncryptionKey(suite, key); err != nil {
+			t.Fatalf("%v: SetEncryptionKey failed: %v", suite, err)
+		}
+		if err := recvKit.SetEncryptionKey(suite, key); err != nil {
+			t.Fatalf("%v: SetEncryptionKey failed: %v", suite, err)
+		}
+
+		if err := sendKit.SendPacket(Packet{SequenceNumber: 1, Data: []byte("secret-data")}, recvConn.addr); err != nil {
+			t.Fatalf("%v: SendPacket failed: %v", suite, err)
+		}
+		d := <-recvConn.inbox
+		if strings.Contains(string(d.data), "secret-data") {
+			t.Fatalf("%v: plaintext visible on the wire", suite)
+		}
+		recvConn.inbox <- d
+		data, _, err := recvKit.ReceivePacket()
+		if err != nil || string(data) != "secret-data" {
+			t.Fatalf("%v: ReceivePacket got '%s', %v", suite, string(data), err)
+		}
+
+		d.data[5] ^= 1
+		recvConn.inbox <- d
+		if _, _, err := recvKit.ReceivePacket(); !errors.Is(err, ErrAuthenticationFailed) {
+			t.Fatalf("%v: expected ErrAuthenticationFailed for tampered header, got %v", suite, err)
+		}
+
+		recvConn.inbox <- mockDatagram{data: AppendHeader(nil, Header{Type: PacketTypeData}, []byte("plain")), from: sendConn.addr}
+		if _, _, err := recvKit.ReceivePacket(); !errors.Is(err, ErrUnencryptedPacket) {
+			t.Fatalf("%v: expected ErrUnencryptedPacket, got %v", suite, err)
+		}
+	}
+}
+
+func newHandshakePair(t *testing.T, initCfg, respCfg HandshakeConfig) (*GoUDPKit, *GoUDPKit, *mockPeerConn, *mockPeerConn) {
+	retryConfig := RetryConfig{MaxRetries: 3, BaseTimeout: time.Millisecond * 20, BackoffRate: 1.5}
+	qosConfig := QoSConfig{PriorityLevels: 1, PriorityQueues: make([][]Packet, 1)}
+	bufferConfig := BufferConfig{MaxBufferSize: 128, FlushInterval: time.Second}
+	initConn, respConn := newMockPeerPair()
+	initKit, err := NewGoUDPKit(":0", retryConfig, qosConfig, bufferConfig, initConn)
+	if err != nil {
+		t.Fatalf("Failed to initialize initiator: %v", err)
+	}
+	respKit, err := NewGoUDPKit(":0", retryConfig, qosConfig, bufferConfig, respConn)
+	if err != nil {
+		t.Fatalf("Failed to initialize responder: %v", err)
+	}
+	if err := initKit.EnableHandshake(initCfg); err != nil {
+		t.Fatalf("EnableHandshake failed: %v", err)
+	}
+	if err := respKit.EnableHandshake(respCfg); err != nil {
+		t.Fatalf("EnableHandshake failed: %v", err)
+	}
+	return initKit, respKit, initConn, respConn
+}
+
+func TestHandshakeWithStaticKeys(t *testing.T) {
+	t.Parallel()
+	initStatic, _ := ecdh.X25519().GenerateKey(rand.Reader)
+	respStatic, _ := ecdh.X25519().GenerateKey(rand.Reader)
+	initKit, respKit, _, respConn := newHandshakePair(t,
+		HandshakeConfig{StaticKey: initStatic, TrustedKeys: [][]byte{respStatic.PublicKey().Bytes()}},
+		HandshakeConfig{StaticKey: respStatic, TrustedKeys: [][]byte{initStatic.PublicKey().Bytes()}},
+	)
+	defer initKit.Close()
+	defer respKit.Close()
+
+	got := make(chan string, 1)
+	go func() {
+		data, from, err := respKit.ReceivePacket()
+		if err != nil {
+			got <- err.Error()
+			return
+		}
+		respKit.SendPacket(Packet{SequenceNumber: 2, Data: []byte("pong")}, from)
+		got <- string(data)
+	}()
+
+	if err := initKit.SendPacket(Packet{SequenceNumber: 1, Data: []byte("ping")}, respConn.addr); err != nil {
+		t.Fatalf("SendPacket failed: %v", err)
+	}
+	if s := <-got; s != "ping" {
+		t.Fatalf("responder got '%s'", s)
+	}
+	data, _, err := initKit.ReceivePacket()
+	if err != nil || string(data) != "pong" {
+		t.Fatalf("initiator got '%s', %v", string(data), err)
+	}
+	if s := initKit.GetStats(); s.HandshakesCompleted != 1 || s.HandshakesFailed != 0 {
+		t.Fatalf("unexpected initiator handshake stats %+v", s)
+	}
+	if s := respKit.GetStats(); s.HandshakesCompleted != 1 || s.HandshakesFailed != 0 {
+		t.Fatalf("unexpected responder handshake stats %+v", s)
+	}
+}
+
+func TestHandshakeBothSidesAtOnce(t *testing.T) {
+	t.Parallel()
+	psk := []byte("correct horse battery staple")
+	for i := 0; i < 10; i++ {
+		kitA, kitB, connA, connB := newHandshakePair(t, HandshakeConfig{PSK: psk}, HandshakeConfig{PSK: psk})
+		errs := make(chan error, 2)
+		start := make(chan struct{})
+		go func() { <-start; errs <- kitA.Handshake(connB.addr) }()
+		go func() { <-start; errs <- kitB.Handshake(connA.addr) }()
+		close(start)
+		for j := 0; j < 2; j++ {
+			if err := <-errs; err != nil {
+				t.Fatalf("round %d: Handshake failed: %v", i, err)
+			}
+		}
+
+		// both sides must have settled on the same session
+		for _, dir := range []struct {
+			from, to *GoUDPKit
+			addr     *net.UDPAddr
+		}{{kitA, kitB, connB.addr}, {kitB, kitA, connA.addr}} {
+			if err := dir.from.SendPacket(Packet{Data: []byte("hello")}, dir.addr); err != nil {
+				t.Fatalf("round %d: SendPacket failed: %v", i, err)
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			data, _, err := dir.to.ReceiveContext(ctx)
+			cancel()
+			if err != nil || string(data) != "hello" {
+				t.Fatalf("round %d: got %q, %v", i, data, err)
+			}
+		}
+		kitA.Close()
+		kitB.Close()
+	}
+}
+
+func TestHandshakeFailsWithWrongPSK(t *testing.T) {
+	t.Parallel()
+	initKit, respKit, _, respConn := newHandshakePair(t,
+		HandshakeConfig{PSK: []byte("correct horse battery staple")},
+		HandshakeConfig{PSK: []byte("wrong")},
+	)
+	defer initKit.Close()
+	defer respKit.Close()
+
+	go respKit.ReceivePacket()
+	if err := initKit.Handshake(respConn.addr); !errors.Is(err, ErrHandshakeFailed) {
+		t.Fatalf("expected ErrHandshakeFailed, got %v", err)
+	}
+	if initKit.GetStats().HandshakesFailed != 1 {
+		t.Fatalf("expected HandshakesFailed 1, got %d", initKit.GetStats().HandshakesFailed)
+	}
+}
+
+func TestHandshakeIgnoresSpoofedInit(t *testing.T) {
+	t.Parallel()
+	psk := []byte("correct horse battery staple")
+	initKit, respKit, initConn, _ := newHandshakePair(t, HandshakeConfig{PSK: psk}, HandshakeConfig{PSK: psk})
+	defer initKit.Close()
+	defer respKit.Close()
+
+	spoofedInit := func(suite CipherSuite) []byte {
+		ephemeral, _ := ecdh.X25519().GenerateKey(rand.Reader)
+		init := encodeHandshake(handshakeInit, suite, ephemeral.PublicKey().Bytes(), nil, nil)
+		return AppendHeader(nil, Header{Type: PacketTypeHandshake}, init)
+	}
+	respKit.handleDatagram(spoofedInit(CipherChaCha20Poly1305), initConn.addr)
+	<-initConn.inbox // the response to the spoofed init
+	got := make(chan string, 1)
+	go func() {
+		data, _, err := initKit.ReceivePacket()
+		if err != nil {
+			got <- err.Error()
+			return
+		}
+		got <- string(data)
+	}()
+
+	// the pending session from the spoofed init must not be used to send
+	if err := respKit.SendPacket(Packet{SequenceNumber: 1, Data: []byte("hello")}, initConn.addr); err != nil {
+		t.Fatalf("SendPacket failed: %v", err)
+	}
+	select {
+	case s := <-got:
+		if s != "hello" {
+			t.Fatalf("initiator got '%s'", s)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("packet sealed with the spoofed session")
+	}
+	if s := respKit.GetStats(); s.HandshakesFailed != 0 || s.HandshakesCompleted != 1 {
+		t.Fatalf("unexpected responder handshake stats %+v", s)
+	}
+
+	// an init naming another suite is refused outright
+	respKit.handleDatagram(spoofedInit(CipherAESGCM), initConn.addr)
+	respKit.mu.Lock()
+	_, pending := respKit.handshake.responding[initConn.addr.String()]
+	respKit.mu.Unlock()
+	if pending || respKit.GetStats().HandshakesFailed != 1 {
+		t.Fatalf("suite mismatch accepted: pending %v, stats %+v", pending, respKit.GetStats())
+	}
+}
+
+func TestSharedKeySendersUseOwnKeys(t *testing.T) {
+	t.Parallel()
+	key := make([]byte, 16)
+	a, err := newPacketCipher(CipherAESGCM, key)
+	if err != nil {
+		t.Fatalf("newPacketCipher: %v", err)
+	}
+	b, _ := newPacketCipher(CipherAESGCM, key)
+	recv, _ := newPacketCipher(CipherAESGCM, key)
+
+	// even with the same packet number, the two senders' frames differ
+	header := AppendHeader(nil, Header{Type: PacketTypeData}, nil)
+	fromA := a.seal(append([]byte(nil), header...), []byte("payload"))
+	fromB := b.seal(append([]byte(nil), header...), []byte("payload"))
+	if bytes.Equal(fromA[len(header)+sealPrefix:], fromB[len(header)+sealPrefix:]) {
+		t.Fatal("two senders sealed with the same key and nonce")
+	}
+	for _, sealed := range [][]byte{fromA, fromB} {
+		plain, pn, err := recv.open(header, sealed[len(header):])
+		if err != nil || string(plain) != "payload" || pn != 1 {
+			t.Fatalf("open: %q %d %v", plain, pn, err)
+		}
+	}
+	if len(recv.senders) != 2 {
+		t.Fatalf("expected 2 cached sender keys, got %d", len(recv.senders))
+	}
+	forged := append([]byte(nil), fromA[len(header):]...)
+	forged[0] ^= 1
+	if _, _, err := recv.open(header, forged); !errors.Is(err, ErrAuthenticationFailed) || len(recv.senders) != 2 {
+		t.Fatalf("forged sender ID: %v, %d cached keys", err, len(recv.senders))
+	}
+}
+
+func TestReplayWindow(t *testing.T) {
+	t.Parallel()
+	w := newReplayWindow(64)
+	steps := []struct {
+		pn   uint64
+		want replayVerdict
+	}{
+		{1, replayAccept},
+		{3, replayAccept},
+		{2, replayAccept},
+		{3, replayDuplicate},
+		{100, replayAccept},
+		{36, replayTooOld},
+		{37, replayAccept},
+		{37, replayDuplicate},
+		{0, replayTooOld},
+	}
+	for _, s := range steps {
+		if got := w.check(s.pn); got != s.want {
+			t.Fatalf("check(%d) = %v, want %v", s.pn, got, s.want)
+		}
+	}
+}
+
+func TestReplayedPacketsDropped(t *testing.T) {
+	t.Parallel()
+	retryConfig := RetryConfig{MaxRetries: 1, BaseTimeout: time.Millisecond * 10, BackoffRate: 1.1}
+	qosConfig := QoSConfig{PriorityLevels: 1, PriorityQueues: make([][]Packet, 1)}
+	bufferConfig := BufferConfig{MaxBufferSize: 128, FlushInterval: time.Second}
+	sendConn, recvConn := newMockPeerPair()
+	sendKit, _ := NewGoUDPKit(":0", retryConfig, qosConfig, bufferConfig, sendConn)
+	defer sendKit.Close()
+	recvKit, _ := NewGoUDPKit(":0", retryConfig, qosConfig, bufferConfig, recvConn)
+	defer recvKit.Close()
+	key := make([]byte, 16)
+	sendKit.SetEncryptionKey(CipherAESGCM, key)
+	recvKit.SetEncryptionKey(CipherAESGCM, key)
+	if err := recvKit.SetReplayWindow(4); err != nil {
+		t.Fatalf("SetReplayWindow failed: %v", err)
+	}
+
+	var frames []mockDatagram
+	for i := 0; i < 70; i++ {
+		sendKit.SendPacket(Packet{SequenceNumber: uint32(i), Data: []byte{byte(i)}}, recvConn.addr)
+		frames = append(frames, <-recvConn.inbox)
+	}
+	// the first frame, its replay, the newest, a stale one and the newest
+	// again; only fresh frames are delivered
+	for _, i := range []int{0, 0, 69, 1, 69} {
+		recvConn.inbox <- frames[i]
+	}
+	recvConn.inbox <- frames[68]
+
+	for _, want := range []byte{0, 69, 68} {
+		data, _, err := recvKit.ReceivePacket()
+		if err != nil || data[0] != want {
+			t.Fatalf("expected packet %d, got %v, %v", want, data, err)
+		}
+	}
+	s := recvKit.GetStats()
+	if s.ReplayDuplicates != 2 || s.ReplayTooOld != 1 || s.PacketsDropped != 3 {
+		t.Fatalf("expected 2 duplicates and 1 too old dropped, got %d, %d and %d dropped", s.ReplayDuplicates, s.ReplayTooOld, s.PacketsDropped)
+	}
+
+	// a sender's window is forgotten once it has been idle for ackRetention
+	recvKit.mu.Lock()
+	windows := len(recvKit.replayWindows)
+	recvKit.pruneReplayWindows(time.Now().Add(ackRetention + time.Second))
+	left := len(recvKit.replayWindows)
+	recvKit.mu.Unlock()
+	if windows != 1 || left != 0 {
+		t.Fatalf("expected 1 replay window pruned, had %d and kept %d", windows, left)
+	}
+}
+
+func TestCodecsRoundTrip(t *testing.T) {
+	t.Parallel()
+	text := []byte(strings.Repeat("telemetry cpu=42 mem=1337 disk=99;", 200))
+	random := make([]byte, 4096)
+	rand.Read(random)
+	inputs := [][]byte{nil, []byte("a"), []byte("short input!"), text, random}
+	for _, c := range []Codec{DeflateCodec{Level: 6}, ZlibCodec{Level: 6}, LZWCodec{}, LZ4Codec{}} {
+		for _, in := range inputs {
+			enc, err := c.Encode(in)
+			if err != nil {
+				t.Fatalf("codec %d: Encode failed: %v", c.ID(), err)
+			}
+			out, err := c.Decode(enc, len(in))
+			if err != nil || string(out) != string(in) {
+				t.Fatalf("codec %d: round trip of %d bytes failed: %v", c.ID(), len(in), err)
+			}
+		}
+		enc, _ := c.Encode(text)
+		if len(enc) >= len(text)/4 {
+			t.Fatalf("codec %d: compressed %d bytes to %d", c.ID(), len(text), len(enc))
+		}
+		if _, err := c.Decode(enc, len(text)-1); !errors.Is(err, ErrDecompressedTooLarge) {
+			t.Fatalf("codec %d: expected ErrDecompressedTooLarge, got %v", c.ID(), err)
+		}
+	}
+}
+
+func TestLZ4RejectsForgedSize(t *testing.T) {
+	t.Parallel()
+	// a uvarint size of 16 MiB followed by a single literal
+	forged := []byte{0x80, 0x80, 0x80, 0x08, 0x10, 'a'}
+	if _, err := (LZ4Codec{}).Decode(forged, 16<<20); !errors.Is(err, ErrCorruptCompressed) {
+		t.Fatalf("expected ErrCorruptCompressed, got %v", err)
+	}
+}
+
+func TestCompressedMessagesOnTheWire(t *testing.T) {
+	t.Parallel()
+	retryConfig := RetryConfig{MaxRetries: 1, BaseTimeout: time.Millisecond * 10, BackoffRate: 1.1}
+	qosConfig := QoSConfig{PriorityLevels: 1, PriorityQueues: make([][]Packet, 1)}
+	bufferConfig := BufferConfig{MaxBufferSize: 128, FlushInterval: time.Second}
+	sendConn, recvConn := newMockPeerPair()
+	sendKit, _ := NewGoUDPKit(":0", retryConfig, qosConfig, bufferConfig, sendConn)
+	defer sendKit.Close()
+	recvKit, _ := NewGoUDPKit(":0", retryConfig, qosConfig, bufferConfig, recvConn)
+	defer recvKit.Close()
+	sendKit.SetCompression(LZ4Codec{})
+
+	text := []byte(strings.Repeat("0123456789", 1000))
+	if err := sendKit.SendMessage(text, recvConn.addr); err != nil {
+		t.Fatalf("SendMessage failed: %v", err)
+	}
+	if n := len(recvConn.inbox); n != 1 {
+		t.Fatalf("expected the compressed message in 1 datagram, got %d", n)
+	}
+	data, _, err := recvKit.ReceiveMessage()
+	if err != nil || string(data) != string(text) {
+		t.Fatalf("ReceiveMessage returned %d bytes, %v", len(data), err)
+	}
+
+	random := make([]byte, 500)
+	rand.Read(random)
+	sendKit.SendPacket(Packet{Data: random}, recvConn.addr)
+	d := <-recvConn.inbox
+	if h, _, _ := DecodeHeader(d.data); h.Flags&FlagCompressed != 0 {
+		t.Fatalf("incompressible payload should be sent uncompressed")
+	}
+
+	if err := sendKit.SendMessageWithCodec(text, ZlibCodec{Level: 9}, recvConn.addr); err != nil {
+		t.Fatalf("SendMessageWithCodec failed: %v", err)
+	}
+	recvKit.SetMaxDecompressedSize(1000)
+	if _, _, err := recvKit.ReceiveMessage(); !errors.Is(err, ErrDecompressedTooLarge) {
+		t.Fatalf("expected ErrDecompressedTooLarge, got %v", err)
+	}
+}
+
+func TestContextCancellation(t *testing.T) {
+	t.Parallel()
+	retryConfig := RetryConfig{MaxRetries: 1, BaseTimeout: time.Millisecond * 10, BackoffRate: 1.1}
+	qosConfig := QoSConfig{PriorityLevels: 1, PriorityQueues: make([][]Packet, 1)}
+	bufferConfig := BufferConfig{MaxBufferSize: 128, FlushInterval: time.Second}
+	sendConn, recvConn := newMockPeerPair()
+	sendKit, _ := NewGoUDPKit(":0", retryConfig, qosConfig, bufferConfig, sendConn)
+	defer sendKit.Close()
+	recvKit, _ := NewGoUDPKit(":0", retryConfig, qosConfig, bufferConfig, recvConn)
+	defer recvKit.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, _, err := recvKit.ReceiveContext(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected context.DeadlineExceeded, got %v", err)
+	}
+
+	ctx, cancel = context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		cancel()
+	}()
+	if _, _, err := recvKit.ReceiveContext(ctx); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+	if err := sendKit.SendContext(ctx, Packet{Data: []byte("late")}, recvConn.addr); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled from SendContext, got %v", err)
+	}
+
+	if err := sendKit.SendContext(context.Background(), Packet{Data: []byte("on time")}, recvConn.addr); err != nil {
+		t.Fatalf("SendContext failed: %v", err)
+	}
+	data, _, err := recvKit.ReceiveContext(context.Background())
+	if err != nil || string(data) != "on time" {
+		t.Fatalf("ReceiveContext got '%s', %v", string(data), err)
+	}
+}
+
+func TestServeHandlesRepliesAndPanics(t *testing.T) {
+	t.Parallel()
+	retryConfig := RetryConfig{MaxRetries: 1, BaseTimeout: time.Millisecond * 10, BackoffRate: 1.1}
+	qosConfig := QoSConfig{PriorityLevels: 1, PriorityQueues: make([][]Packet, 1)}
+	bufferConfig := BufferConfig{MaxBufferSize: 128, FlushInterval: time.Second}
+	clientConn, serverConn := newMockPeerPair()
+	client, _ := NewGoUDPKit(":0", retryConfig, qosConfig, bufferConfig, clientConn)
+	defer client.Close()
+	server, _ := NewGoUDPKit(":0", retryConfig, qosConfig, bufferConfig, serverConn)
+	defer server.Close()
+
+	var mu sync.Mutex
+	var order []uint32
+	var panics int
+	handler := HandlerFunc(func(w ResponseWriter, packet Packet, addr *net.UDPAddr) {
+		if string(packet.Data) == "boom" {
+			panic("boom")
+		}
+		time.Sleep(time.Millisecond)
+		mu.Lock()
+		order = append(order, packet.SequenceNumber)
+		mu.Unlock()
+		w.Write(append([]byte("echo:"), packet.Data...))
+	})
+	cfg := ServeConfig{
+		Workers:        4,
+		OrderedPerPeer: true,
+		OnPanic: func(interface{}, Packet, *net.UDPAddr) {
+			mu.Lock()
+			panics++
+			mu.Unlock()
+		},
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan error, 1)
+	go func() { served <- server.Serve(ctx, handler, cfg) }()
+
+	client.SendPacket(Packet{Data: []byte("boom")}, serverConn.addr)
+	for i := 1; i <= 20; i++ {
+		client.SendPacket(Packet{SequenceNumber: uint32(i), Data: []byte("hi")}, serverConn.addr)
+	}
+	for i := 0; i < 20; i++ {
+		data, _, err := client.ReceivePacket()
+		if err != nil || string(data) != "echo:hi" {
+			t.Fatalf("reply %d: got '%s', %v", i, string(data), err)
+		}
+	}
+	cancel()
+	if err := <-served; err != nil {
+		t.Fatalf("Serve returned %v", err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	for i, seq := range order {
+		if seq != uint32(i+1) {
+			t.Fatalf("packets from one peer handled out of order: %v", order)
+		}
+	}
+	if panics != 1 || server.GetStats().HandlerPanics != 1 {
+		t.Fatalf("expected 1 recovered panic, got %d (stats %d)", panics, server.GetStats().HandlerPanics)
+	}
+}
+
+func TestServeSurvivesConcurrentReliableSend(t *testing.T) {
+	t.Parallel()
+	retryConfig := RetryConfig{MaxRetries: 2, BaseTimeout: time.Millisecond * 10, BackoffRate: 1.1}
+	qosConfig := QoSConfig{PriorityLevels: 1, PriorityQueues: make([][]Packet, 1)}
+	bufferConfig := BufferConfig{MaxBufferSize: 128, FlushInterval: time.Second}
+	clientConn, serverConn := newMockPeerPair()
+	client, _ := NewGoUDPKit(":0", retryConfig, qosConfig, bufferConfig, clientConn)
+	defer client.Close()
+	server, _ := NewGoUDPKit(":0", retryConfig, qosConfig, bufferConfig, serverConn)
+	defer server.Close()
+
+	got := make(chan string, 1)
+	handler := HandlerFunc(func(w ResponseWriter, packet Packet, addr *net.UDPAddr) {
+		got <- string(packet.Data)
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan error, 1)
+	go func() { served <- server.Serve(ctx, handler, ServeConfig{Workers: 1}) }()
+
+	// the client never reads, so every retransmission timeout of the send
+	// expires while Serve is reading the same connection
+	results, err := server.SendReliable([]Packet{{SequenceNumber: 1, Data: []byte("ping")}}, clientConn.addr)
+	if err != nil || len(results) != 1 || results[0].Status != GaveUp {
+		t.Fatalf("expected the unacknowledged send to give up, got %+v, %v", results, err)
+	}
+	select {
+	case err := <-served:
+		t.Fatalf("Serve stopped on another reader's deadline: %v", err)
+	default:
+	}
+
+	client.SendPacket(Packet{Data: []byte("hello")}, serverConn.addr)
+	select {
+	case data := <-got:
+		if data != "hello" {
+			t.Fatalf("handled %q", data)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Serve did not handle the packet sent after the reliable send")
+	}
+	cancel()
+	if err := <-served; err != nil {
+		t.Fatalf("Serve returned %v", err)
+	}
+}
+
+// brokenConn holds every write until the test releases it and then fails it.
+type brokenConn struct {
+	*mockPeerConn
+	gate chan struct{}
+}
+
+func (c *brokenConn) WriteToUDP(b []byte, addr *net.UDPAddr) (int, error) {
+	<-c.gate
+	return 0, errors.New("network down")
+}
+
+func TestCloseStopsGoroutinesAndRejectsCalls(t *testing.T) {
+	retryConfig := RetryConfig{MaxRetries: 1, BaseTimeout: time.Millisecond * 10, BackoffRate: 1.1}
+	qosConfig := QoSConfig{PriorityLevels: 1, PriorityQueues: make([][]Packet, 1)}
+	// a zero FlushInterval used to panic the flush ticker
+	bufferConfig := BufferConfig{MaxBufferSize: 128}
+
+	before := runtime.NumGoroutine()
+	for i := 0; i < 200; i++ {
+		conn, _ := newMockPeerPair()
+		kit, err := NewGoUDPKit(":0", retryConfig, qosConfig, bufferConfig, conn)
+		if err != nil {
+			t.Fatalf("Failed to initialize: %v", err)
+		}
+		if err := kit.Close(); err != nil {
+			t.Fatalf("Close: %v", err)
+		}
+	}
+	if after := runtime.NumGoroutine(); after > before {
+		t.Fatalf("goroutines leaked: %d before, %d after", before, after)
+	}
+
+	conn, peer := newMockPeerPair()
+	kit, _ := NewGoUDPKit(":0", retryConfig, qosConfig, bufferConfig, conn)
+	kit.Close()
+	if err := kit.Close(); err != nil {
+		t.Fatalf("second Close returned %v", err)
+	}
+	if err := kit.SendPacket(Packet{Data: []byte("x")}, peer.addr); err != ErrClosed {
+		t.Fatalf("SendPacket after Close: %v", err)
+	}
+	if err := kit.Enqueue(Packet{Data: []byte("x")}, peer.addr); err != ErrClosed {
+		t.Fatalf("Enqueue after Close: %v", err)
+	}
+	if _, _, err := kit.ReceivePacket(); err != ErrClosed {
+		t.Fatalf("ReceivePacket after Close: %v", err)
+	}
+}
+
+func TestCloseReportsUnsentQueuedPackets(t *testing.T) {
+	t.Parallel()
+	retryConfig := RetryConfig{MaxRetries: 1, BaseTimeout: time.Millisecond * 10, BackoffRate: 1.1}
+	qosConfig := QoSConfig{PriorityLevels: 1, PriorityQueues: make([][]Packet, 1)}
+	bufferConfig := BufferConfig{MaxBufferSize: 128, FlushInterval: time.Second}
+	local, remote := newMockPeerPair()
+	conn := &brokenConn{mockPeerConn: local, gate: make(chan struct{})}
+	kit, _ := NewGoUDPKit(":0", retryConfig, qosConfig, bufferConfig, conn)
+
+	for i := 0; i < 3; i++ {
+		if err := kit.Enqueue(Packet{SequenceNumber: uint32(i), Data: []byte("x")}, remote.addr); err != nil {
+			t.Fatalf("Enqueue: %v", err)
+		}
+	}
+	closed := make(chan error, 1)
+	go func() { closed <- kit.Close() }()
+	<-kit.done
+	close(conn.gate)
+
+	var unsent *UnsentError
+	if err := <-closed; !errors.As(err, &unsent) || len(unsent.Packets) != 3 {
+		t.Fatalf("expected 3 unsent packets, got %v", err)
+	}
+}
+
+func TestStatsSnapshotAndReset(t *testing.T) {
+	t.Parallel()
+	retryConfig := RetryConfig{MaxRetries: 1, BaseTimeout: time.Millisecond * 10, BackoffRate: 1.1}
+	qosConfig := QoSConfig{PriorityLevels: 2, PriorityQueues: make([][]Packet, 2)}
+	bufferConfig := BufferConfig{MaxBufferSize: 128, FlushInterval: time.Second}
+	sendConn, recvConn := newMockPeerPair()
+	sendKit, _ := NewGoUDPKit(":0", retryConfig, qosConfig, bufferConfig, sendConn)
+	defer sendKit.Close()
+	recvKit, _ := NewGoUDPKit(":0", retryConfig, qosConfig, bufferConfig, recvConn)
+	defer recvKit.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 8; j++ {
+				sendKit.SendPacket(Packet{Data: []byte("12345678")}, recvConn.addr)
+				sendKit.Snapshot()
+			}
+		}()
+	}
+	for i := 0; i < 32; i++ {
+		if _, _, err := recvKit.ReceivePacket(); err != nil {
+			t.Fatalf("ReceivePacket: %v", err)
+		}
+	}
+	wg.Wait()
+
+	first := sendKit.Snapshot()
+	if first.PacketsSent != 32 || first.BytesSent != 32*(HeaderSize+8) {
+		t.Fatalf("unexpected send counters: %+v", first)
+	}
+	if len(first.QueueDepths) != 2 || first.Uptime <= 0 {
+		t.Fatalf("missing gauges: %+v", first)
+	}
+	if s := recvKit.Snapshot(); s.PacketsReceived != 32 || s.BytesReceived != first.BytesSent {
+		t.Fatalf("unexpected receive counters: %+v", s)
+	}
+
+	recvConn.inbox <- mockDatagram{data: []byte("garbage that is not a frame"), from: sendConn.addr}
+	if _, _, err := recvKit.ReceivePacket(); !errors.Is(err, ErrBadMagic) {
+		t.Fatalf("expected ErrBadMagic, got %v", err)
+	}
+	if s := recvKit.Snapshot(); s.DecodeErrors != 1 || s.PacketsDropped != 1 {
+		t.Fatalf("expected one decode error, got %+v", s)
+	}
+
+	sendKit.SendPacket(Packet{Data: []byte("x")}, recvConn.addr)
+	if d := sendKit.Snapshot().Sub(first); d.PacketsSent != 1 {
+		t.Fatalf("expected a delta of 1 packet, got %d", d.PacketsSent)
+	}
+	if r := sendKit.Reset(); r.PacketsSent != 33 {
+		t.Fatalf("Reset returned %d packets sent, want 33", r.PacketsSent)
+	}
+	if s := sendKit.Snapshot(); s.PacketsSent != 0 || s.BytesSent != 0 {
+		t.Fatalf("counters not reset: %+v", s)
+	}
+}
+
+func TestCollectorPerKit(t *testing.T) {
+	t.Parallel()
+	retryConfig := RetryConfig{MaxRetries: 1, BaseTimeout: time.Millisecond * 10, BackoffRate: 1.1}
+	qosConfig := QoSConfig{PriorityLevels: 1, PriorityQueues: make([][]Packet, 1)}
+	bufferConfig := BufferConfig{MaxBufferSize: 128, FlushInterval: time.Second}
+	connA, connB := newMockPeerPair()
+	kitA, _ := NewGoUDPKit(":0", retryConfig, qosConfig, bufferConfig, connA)
+	defer kitA.Close()
+	kitB, _ := NewGoUDPKit(":0", retryConfig, qosConfig, bufferConfig, connB)
+	defer kitB.Close()
+
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(
+		NewCollector(kitA, CollectorOpts{Name: "a", ConstLabels: prometheus.Labels{"role": "client"}}),
+		NewCollector(kitB, CollectorOpts{Name: "b", ConstLabels: prometheus.Labels{"role": "server"}}),
+	)
+	RegisterMetrics()
+	RegisterMetrics()
+
+	kitA.SendPacket(Packet{Data: []byte("one")}, connB.addr)
+	kitA.SendPacket(Packet{Data: []byte("two")}, connB.addr)
+
+	gatherSent := func() map[string]float64 {
+		families, err := reg.Gather()
+		if err != nil {
+			t.Fatalf("Gather: %v", err)
+		}
+		sent := map[string]float64{}
+		for _, mf := range families {
+			if mf.GetName() != "goudpkit_packets_sent_total" {
+				continue
+			}
+			for _, m := range mf.GetMetric() {
+				labels := map[string]string{}
+				for _, lp := range m.GetLabel() {
+					labels[lp.GetName()] = lp.GetValue()
+				}
+				if labels["local_addr"] == "" {
+					t.Fatalf("missing local_addr label: %v", labels)
+				}
+				sent[labels["kit"]+"/"+labels["role"]] = m.GetCounter().GetValue()
+			}
+		}
+		return sent
+	}
+	if sent := gatherSent(); sent["a/client"] != 2 || sent["b/server"] != 0 || len(sent) != 2 {
+		t.Fatalf("unexpected packets_sent_total: %v", sent)
+	}
+
+	// Reset starts a new interval for Snapshot, but exported counters
+	// must never go backwards
+	if s := kitA.Reset(); s.PacketsSent != 2 {
+		t.Fatalf("Reset returned %d packets sent, want 2", s.PacketsSent)
+	}
+	kitA.SendPacket(Packet{Data: []byte("three")}, connB.addr)
+	if s := kitA.Snapshot(); s.PacketsSent != 1 {
+		t.Fatalf("Snapshot after Reset reports %d packets sent, want 1", s.PacketsSent)
+	}
+	if sent := gatherSent(); sent["a/client"] != 3 {
+		t.Fatalf("exported packets_sent_total went from 2 to %v across Reset", sent["a/client"])
+	}
+}
+
+func TestHistogramQuantile(t *testing.T) {
+	t.Parallel()
+	h := newHistogram([]time.Duration{10 * time.Millisecond, 20 * time.Millisecond, 40 * time.Millisecond})
+	for i := 0; i < 50; i++ {
+		h.observe(5 * time.Millisecond)
+	}
+	for i := 0; i < 50; i++ {
+		h.observe(30 * time.Millisecond)
+	}
+	s := h.load(false).summary()
+	if s.Count != 100 || s.Mean != 17500*time.Microsecond {
+		t.Fatalf("unexpected count or mean: %+v", s)
+	}
+	if s.P50 != 10*time.Millisecond || s.P90 != 36*time.Millisecond {
+		t.Fatalf("unexpected percentiles: %+v", s)
+	}
+	h.observe(time.Second)
+	if p := h.load(false).quantile(1); p != 40*time.Millisecond {
+		t.Fatalf("overflow quantile should clamp to the last bound, got %v", p)
+	}
+}
+
+func TestLatencyHistograms(t *testing.T) {
+	t.Parallel()
+	retryConfig := RetryConfig{MaxRetries: 3, BaseTimeout: time.Millisecond * 50, BackoffRate: 1.5}
+	qosConfig := QoSConfig{PriorityLevels: 1, PriorityQueues: make([][]Packet, 1)}
+	bufferConfig := BufferConfig{MaxBufferSize: 128, FlushInterval: time.Second}
+	sendConn, recvConn := newMockPeerPair()
+	sendKit, _ := NewGoUDPKit(":0", retryConfig, qosConfig, bufferConfig, sendConn)
+	defer sendKit.Close()
+	recvKit, _ := NewGoUDPKit(":0", retryConfig, qosConfig, bufferConfig, recvConn)
+	defer recvKit.Close()
+	if err := sendKit.SetLatencyBuckets([]time.Duration{time.Millisecond, time.Second}); err != nil {
+		t.Fatalf("SetLatencyBuckets: %v", err)
+	}
+	if err := sendKit.SetLatencyBuckets([]time.Duration{time.Second, time.Millisecond}); err == nil {
+		t.Fatalf("expected decreasing buckets to be rejected")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	received := make(chan struct{}, 16)
+	go func() {
+		for {
+			if _, _, err := recvKit.ReceiveContext(ctx); err != nil {
+				if ctx.Err() != nil {
+					return
+				}
+				continue
+			}
+			received <- struct{}{}
+		}
+	}()
+
+	if _, err := sendKit.SendReliable([]Packet{{SequenceNumber: 1, Data: []byte("r")}}, recvConn.addr); err != nil {
+		t.Fatalf("SendReliable: %v", err)
+	}
+	sendKit.SetMTU(HeaderSize + 8)
+	sendKit.SendMessage([]byte("a message in several fragments"), recvConn.addr)
+	sendKit.Enqueue(Packet{Data: []byte("q")}, recvConn.addr)
+	for i := 0; i < 3; i++ {
+		<-received
+	}
+	cancel()
+
+	sent := sendKit.Snapshot().Latency
+	if sent.AckRTT.Count != 1 || sent.Queueing.Count != 1 {
+		t.Fatalf("expected one ack RTT and one queueing sample, got %+v", sent)
+	}
+	// the exported totals must never go backwards
+	if err := sendKit.SetLatencyBuckets([]time.Duration{time.Second}); !errors.Is(err, ErrLatencyObserved) {
+		t.Fatalf("expected ErrLatencyObserved, got %v", err)
+	}
+	got := recvKit.Snapshot().Latency
+	if got.Reassembly.Count != 1 || got.Transit.Count == 0 || got.Transit.P99 <= 0 {
+		t.Fatalf("unexpected receive latencies: %+v", got)
+	}
+
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(NewCollector(sendKit, CollectorOpts{Name: "sender"}))
+	families, err := reg.Gather()
+	if err != nil {
+		t.Fatalf("Gather: %v", err)
+	}
+	for _, mf := range families {
+		if mf.GetName() == "goudpkit_ack_rtt_seconds" {
+			h := mf.GetMetric()[0].GetHistogram()
+			if h.GetSampleCount() != 1 || len(h.GetBucket()) != 2 {
+				t.Fatalf("unexpected ack RTT histogram: %v", h)
+			}
+			return
+		}
+	}
+	t.Fatalf("goudpkit_ack_rtt_seconds not exported")
+}
+
+func TestBurstLossModel(t *testing.T) {
+	t.Parallel()
+	rng := mrand.New(mrand.NewSource(1))
+	ge := BurstLoss(0.2, 4)
+	var lost, bursts int
+	prev := false
+	for i := 0; i < 200000; i++ {
+		l := ge.Lose(rng)
+		if l {
+			lost++
+			if !prev {
+				bursts++
+			}
+		}
+		prev = l
+	}
+	if rate := float64(lost) / 200000; rate < 0.18 || rate > 0.22 {
+		t.Fatalf("expected about 20%% loss, got %.3f", rate)
+	}
+	if mean := float64(lost) / float64(bursts); mean < 3.5 || mean > 4.5 {
+		t.Fatalf("expected bursts of about 4 packets, got %.2f", mean)
+	}
+}
+
+func TestFaultConnInjectsFaults(t *testing.T) {
+	t.Parallel()
+	retryConfig := RetryConfig{MaxRetries: 20, BaseTimeout: time.Millisecond * 10, BackoffRate: 1.2}
+	qosConfig := QoSConfig{PriorityLevels: 1, PriorityQueues: make([][]Packet, 1)}
+	bufferConfig := BufferConfig{MaxBufferSize: 256, FlushInterval: time.Second}
+	sendConn, recvConn := newMockPeerPair()
+	faulty := NewFaultConn(sendConn, FaultConfig{Seed: 5, Outbound: FaultProfile{Loss: BernoulliLoss{P: 1}}})
+	sendKit, _ := NewGoUDPKit(":0", retryConfig, qosConfig, bufferConfig, faulty)
+	defer sendKit.Close()
+	recvFaulty := NewFaultConn(recvConn, FaultConfig{Seed: 6})
+	recvKit, _ := NewGoUDPKit(":0", retryConfig, qosConfig, bufferConfig, recvFaulty)
+	defer recvKit.Close()
+
+	sendKit.SendPacket(Packet{Data: []byte("lost")}, recvConn.addr)
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Millisecond)
+	if _, _, err := recvKit.ReceiveContext(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected the packet to be dropped, got %v", err)
+	}
+	cancel()
+	if faulty.Stats().OutboundDropped != 1 {
+		t.Fatalf("expected 1 outbound drop, got %+v", faulty.Stats())
+	}
+
+	// reordered and duplicated fragments still reassemble, once
+	faulty.SetConfig(FaultConfig{Outbound: FaultProfile{Reorder: 0.5, ReorderDelay: 5 * time.Millisecond, Duplicate: 0.3}})
+	recvFaulty.SetConfig(FaultConfig{Inbound: FaultProfile{Jitter: 3 * time.Millisecond}})
+	sendKit.SetMTU(HeaderSize + 16)
+	message := strings.Repeat("fragmented message ", 20)
+	if err := sendKit.SendMessage([]byte(message), recvConn.addr); err != nil {
+		t.Fatalf("SendMessage: %v", err)
+	}
+	data, _, err := recvKit.ReceiveMessage()
+	if err != nil || string(data) != message {
+		t.Fatalf("reassembly failed: %q, %v", data, err)
+	}
+	if s := faulty.Stats(); s.Reordered == 0 || s.Duplicated == 0 {
+		t.Fatalf("expected reordering and duplication, got %+v", s)
+	}
+
+	// reliable delivery rides out burst loss in both directions
+	faulty.SetConfig(FaultConfig{Outbound: FaultProfile{Loss: BurstLoss(0.3, 3)}})
+	recvFaulty.SetConfig(FaultConfig{Inbound: FaultProfile{Loss: BurstLoss(0.3, 2)}})
+	rctx, rcancel := context.WithCancel(context.Background())
+	defer rcancel()
+	go func() {
+		for rctx.Err() == nil {
+			recvKit.ReceiveContext(rctx)
+		}
+	}()
+	packets := make([]Packet, 40)
+	for i := range packets {
+		packets[i] = Packet{SequenceNumber: uint32(i + 1), Data: []byte("r")}
+	}
+	results, err := sendKit.SendReliable(packets, recvConn.addr)
+	if err != nil {
+		t.Fatalf("SendReliable: %v", err)
+	}
+	for _, r := range results {
+		if r.Status != Delivered {
+			t.Fatalf("packet %d %v after %d attempts", r.SequenceNumber, r.Status, r.Attempts)
+		}
+	}
+	if recvFaulty.Stats().InboundDropped == 0 {
+		t.Fatalf("expected inbound drops, got %+v", recvFaulty.Stats())
+	}
+}
+
+func TestFECReconstruct(t *testing.T) {
+	t.Parallel()
+	for _, cfg := range []FECConfig{
+		{Scheme: FECXOR, DataShards: 5},
+		{Scheme: FECReedSolomon, DataShards: 8, ParityShards: 3},
+		{Scheme: FECReedSolomon, DataShards: 3, ParityShards: 4},
+	} {
+		cfg, err := cfg.normalize()
+		if err != nil {
+			t.Fatalf("%v: normalize failed: %v", cfg.Scheme, err)
+		}
+		rng := mrand.New(mrand.NewSource(int64(cfg.DataShards)))
+		data := make([][]byte, cfg.DataShards)
+		for i := range data {
+			data[i] = make([]byte, 32)
+			rng.Read(data[i])
+		}
+		parity := fecEncode(cfg, data)
+		if len(parity) != cfg.ParityShards {
+			t.Fatalf("%v: got %d repair shards, want %d", cfg.Scheme, len(parity), cfg.ParityShards)
+		}
+
+		// Lose as many shards as there are repairs, mixing data and repair
+		// shards where there is more than one repair.
+		lostData := append([][]byte(nil), data...)
+		lostParity := append([][]byte(nil), parity...)
+		for i := 0; i < cfg.ParityShards; i++ {
+			if i%2 == 0 || cfg.ParityShards == 1 {
+				lostData[(i*3)%cfg.DataShards] = nil
+			} else {
+				lostParity[i] = nil
+			}
+		}
+		if !fecReconstruct(cfg, lostData, lostParity, 32) {
+			t.Fatalf("%v: reconstruction failed", cfg.Scheme)
+		}
+		for i := range data {
+			if !bytes.Equal(lostData[i], data[i]) {
+				t.Fatalf("%v: shard %d not recovered", cfg.Scheme, i)
+			}
+		}
+
+		if cfg.DataShards > cfg.ParityShards && fecReconstruct(cfg, make([][]byte, cfg.DataShards), parity, 32) {
+			t.Fatalf("%v: reconstructed with more losses than repairs", cfg.Scheme)
+		}
+	}
+
+	if _, err := (FECConfig{Scheme: FECReedSolomon, DataShards: 200, ParityShards: 100}).normalize(); !errors.Is(err, ErrBadFECConfig) {
+		t.Fatalf("expected ErrBadFECConfig, got %v", err)
+	}
+}
+
+func TestBulkDataFECRecoversLoss(t *testing.T) {
+	t.Parallel()
+	retryConfig := RetryConfig{MaxRetries: 5, BaseTimeout: time.Millisecond * 20, BackoffRate: 1.5}
+	qosConfig := QoSConfig{PriorityLevels: 2, PriorityQueues: make([][]Packet, 2)}
+	bufferConfig := BufferConfig{MaxBufferSize: 256, FlushInterval: time.Second}
+
+	for _, tc := range []struct {
+		fec  FECConfig
+		lose func(index uint32) bool
+	}{
+		{FECConfig{Scheme: FECXOR, DataShards: 4}, func(i uint32) bool { return i%4 == 1 }},
+		{FECConfig{Scheme: FECReedSolomon, DataShards: 8, ParityShards: 3}, func(i uint32) bool { return i%8 == 0 || i%8 == 3 || i%8 == 7 }},
+	} {
+		sendConn, recvConn := newMockPeerPair()
+		sendKit, err := NewGoUDPKit(":0", retryConfig, qosConfig, bufferConfig, sendConn)
+		if err != nil {
+			t.Fatalf("Failed to initialize sender: %v", err)
+		}
+		recvKit, err := NewGoUDPKit(":0", retryConfig, qosConfig, bufferConfig, recvConn)
+		if err != nil {
+			t.Fatalf("Failed to initialize receiver: %v", err)
+		}
+
+		// Drop data chunks only; repair chunks carry a non-zero repair
+		// index in the last byte of the bulk header.
+		sendConn.setDrop(func(b []byte) bool {
+			h, _, _ := DecodeHeader(b)
+			return h.Type == PacketTypeBulk && b[HeaderSize+bulkHeaderSize-1] == 0 && tc.lose(h.SequenceNumber)
+		})
+		if err := sendKit.SetFEC(tc.fec); err != nil {
+			t.Fatalf("SetFEC failed: %v", err)
+		}
+
+		data := make([]byte, 1000)
+		mrand.New(mrand.NewSource(1)).Read(data)
+		sent := make(chan error, 1)
+		go func() { sent <- sendKit.SendBulkData(data, 30, recvConn.addr) }()
+
+		got, err := recvKit.ReceiveBulkData(0)
+		if err != nil {
+			t.Fatalf("%v: ReceiveBulkData failed: %v", tc.fec.Scheme, err)
+		}
+		if err := <-sent; err != nil {
+			t.Fatalf("%v: SendBulkData failed: %v", tc.fec.Scheme, err)
+		}
+		if !bytes.Equal(got, data) {
+			t.Fatalf("%v: recovered data does not match", tc.fec.Scheme)
+		}
+		if s := recvKit.Snapshot(); s.FECRecovered == 0 {
+			t.Fatalf("%v: expected recovered chunks in stats", tc.fec.Scheme)
+		}
+		sendKit.Close()
+		recvKit.Close()
+	}
+}
+
+func TestReceiveBulkDataOrdersAndSeparatesTransfers(t *testing.T) {
+	t.Parallel()
+	retryConfig := RetryConfig{MaxRetries: 5, BaseTimeout: time.Millisecond * 20, BackoffRate: 1.5}
+	qosConfig := QoSConfig{PriorityLevels: 2, PriorityQueues: make([][]Packet, 2)}
+	bufferConfig := BufferConfig{MaxBufferSize: 256, FlushInterval: time.Second}
+	sendConn, recvConn := newMockPeerPair()
+	sendKit, err := NewGoUDPKit(":0", retryConfig, qosConfig, bufferConfig, sendConn)
+	if err != nil {
+		t.Fatalf("Failed to initialize sender: %v", err)
+	}
+	defer sendKit.Close()
+	recvKit, err := NewGoUDPKit(":0", retryConfig, qosConfig, bufferConfig, recvConn)
+	if err != nil {
+		t.Fatalf("Failed to initialize receiver: %v", err)
+	}
+	defer recvKit.Close()
+
+	// Hold back the first chunk of the first transfer and deliver it after
+	// all of the second transfer.
+	var held []byte
+	sendConn.setDrop(func(b []byte) bool {
+		h, _, _ := DecodeHeader(b)
+		if held == nil && h.Type == PacketTypeBulk && h.SequenceNumber == 0 {
+			held = append([]byte(nil), b...)
+			return true
+		}
+		return false
+	})
+	first := []byte("the first transfer, sent in several chunks")
+	second := []byte("a second transfer that overtakes it")
+	if err := sendKit.SendBulkData(first, 8, recvConn.addr); err != nil {
+		t.Fatalf("SendBulkData failed: %v", err)
+	}
+	if err := sendKit.SendBulkData(second, 8, recvConn.addr); err != nil {
+		t.Fatalf("SendBulkData failed: %v", err)
+	}
+	recvConn.inbox <- mockDatagram{data: held, from: sendConn.addr}
+
+	for _, want := range [][]byte{second, first} {
+		got, from, err := recvKit.ReceiveBulkDataContext(context.Background())
+		if err != nil {
+			t.Fatalf("ReceiveBulkDataContext failed: %v", err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Fatalf("got %q, want %q", got, want)
+		}
+		if from.String() != sendConn.addr.String() {
+			t.Fatalf("got sender %v, want %v", from, sendConn.addr)
+		}
+	}
+}
+
+func TestReceiveBulkDataReportsGaps(t *testing.T) {
+	t.Parallel()
+	retryConfig := RetryConfig{MaxRetries: 5, BaseTimeout: time.Millisecond * 20, BackoffRate: 1.5}
+	qosConfig := QoSConfig{PriorityLevels: 2, PriorityQueues: make([][]Packet, 2)}
+	bufferConfig := BufferConfig{MaxBufferSize: 256, FlushInterval: time.Minute}
+	sendConn, recvConn := newMockPeerPair()
+	sendKit, err := NewGoUDPKit(":0", retryConfig, qosConfig, bufferConfig, sendConn)
+	if err != nil {
+		t.Fatalf("Failed to initialize sender: %v", err)
+	}
+	defer sendKit.Close()
+	recvKit, err := NewGoUDPKit(":0", retryConfig, qosConfig, bufferConfig, recvConn)
+	if err != nil {
+		t.Fatalf("Failed to initialize receiver: %v", err)
+	}
+	defer recvKit.Close()
+
+	sendConn.setDrop(func(b []byte) bool {
+		h, _, _ := DecodeHeader(b)
+		return h.SequenceNumber == 2 || h.SequenceNumber == 3 || h.SequenceNumber == 6
+	})
+	data := []byte("0123456789abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ")
+	if err := sendKit.SendBulkData(data, 8, recvConn.addr); err != nil {
+		t.Fatalf("SendBulkData failed: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	got, _, err := recvKit.ReceiveBulkDataContext(ctx)
+	var incomplete *IncompleteTransferError
+	if !errors.As(err, &incomplete) {
+		t.Fatalf("expected *IncompleteTransferError, got %v", err)
+	}
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected the error to wrap the deadline, got %v", err)
+	}
+	want := []ChunkRange{{First: 2, Last: 3}, {First: 6, Last: 6}}
+	if len(incomplete.Missing) != len(want) || incomplete.Missing[0] != want[0] || incomplete.Missing[1] != want[1] {
+		t.Fatalf("got missing ranges %v, want %v", incomplete.Missing, want)
+	}
+	if got != nil {
+		t.Fatalf("incomplete transfer returned %d bytes of data", len(got))
+	}
+
+	// Nothing is in progress any more, so the wait ends with the context.
+	ctx, cancel = context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, _, err := recvKit.ReceiveBulkDataContext(ctx); !errors.Is(err, context.DeadlineExceeded) || errors.As(err, &incomplete) {
+		t.Fatalf("expected a bare deadline error, got %v", err)
+	}
+}
+
+func TestReceiveBulkDataStalledTransfer(t *testing.T) {
+	t.Parallel()
+	retryConfig := RetryConfig{MaxRetries: 5, BaseTimeout: time.Millisecond * 20, BackoffRate: 1.5}
+	qosConfig := QoSConfig{PriorityLevels: 2, PriorityQueues: make([][]Packet, 2)}
+	bufferConfig := BufferConfig{MaxBufferSize: 256, FlushInterval: 30 * time.Millisecond}
+	sendConn, recvConn := newMockPeerPair()
+	sendKit, err := NewGoUDPKit(":0", retryConfig, qosConfig, bufferConfig, sendConn)
+	if err != nil {
+		t.Fatalf("Failed to initialize sender: %v", err)
+	}
+	defer sendKit.Close()
+	recvKit, err := NewGoUDPKit(":0", retryConfig, qosConfig, bufferConfig, recvConn)
+	if err != nil {
+		t.Fatalf("Failed to initialize receiver: %v", err)
+	}
+	defer recvKit.Close()
+
+	sendConn.setDrop(func(b []byte) bool {
+		h, _, _ := DecodeHeader(b)
+		return h.SequenceNumber == 0
+	})
+	if err := sendKit.SendBulkData([]byte("lost head, then silence"), 4, recvConn.addr); err != nil {
+		t.Fatalf("SendBulkData failed: %v", err)
+	}
+
+	_, err = recvKit.ReceiveBulkData(0)
+	var incomplete *IncompleteTransferError
+	if !errors.As(err, &incomplete) || !errors.Is(err, ErrTransferStalled) {
+		t.Fatalf("expected a stalled transfer, got %v", err)
+	}
+	if len(incomplete.Missing) != 1 || incomplete.Missing[0] != (ChunkRange{}) {
+		t.Fatalf("got missing ranges %v, want [{0 0}]", incomplete.Missing)
+	}
+}
+
+func TestBulkTransferLimits(t *testing.T) {
+	t.Parallel()
+	retryConfig := RetryConfig{MaxRetries: 5, BaseTimeout: time.Millisecond * 20, BackoffRate: 1.5}
+	qosConfig := QoSConfig{PriorityLevels: 2, PriorityQueues: make([][]Packet, 2)}
+	bufferConfig := BufferConfig{MaxBufferSize: 256, FlushInterval: time.Minute}
+	_, recvConn := newMockPeerPair()
+	recvKit, err := NewGoUDPKit(":0", retryConfig, qosConfig, bufferConfig, recvConn)
+	if err != nil {
+		t.Fatalf("Failed to initialize receiver: %v", err)
+	}
+	defer recvKit.Close()
+	from := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 9), Port: 9}
+
+	// one chunk announcing a terabyte must not start a transfer
+	forged := appendBulkHeader(nil, bulkHeader{transfer: 1, total: 1 << 40, chunkSize: 1 << 16, repair: -1})
+	if err := recvKit.handleBulk(append(forged, "01234567"...), from); !errors.Is(err, ErrTransferTooLarge) {
+		t.Fatalf("expected ErrTransferTooLarge for a forged size, got %v", err)
+	}
+
+	recvKit.SetTransferLimits(TransferLimits{MaxChunks: 4})
+	tooMany := appendBulkHeader(nil, bulkHeader{transfer: 2, total: 40, chunkSize: 8, repair: -1})
+	if err := recvKit.handleBulk(append(tooMany, "01234567"...), from); !errors.Is(err, ErrTransferTooLarge) {
+		t.Fatalf("expected ErrTransferTooLarge for 5 chunks with a limit of 4, got %v", err)
+	}
+	allowed := appendBulkHeader(nil, bulkHeader{transfer: 3, total: 32, chunkSize: 8, repair: -1})
+	if err := recvKit.handleBulk(append(allowed, "01234567"...), from); err != nil {
+		t.Fatalf("transfer within the limits rejected: %v", err)
+	}
+	recvKit.mu.Lock()
+	n := len(recvKit.bulkTransfers)
+	recvKit.mu.Unlock()
+	if n != 1 {
+		t.Fatalf("expected only the allowed transfer in progress, got %d", n)
+	}
+
+	// a sender cannot hold more than its share of transfers, nor all
+	// senders together more than the kit's
+	recvKit.SetTransferLimits(TransferLimits{MaxTransfers: 3, MaxPeerTransfers: 2})
+	other := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 10), Port: 10}
+	for _, tc := range []struct {
+		id   uint32
+		from *net.UDPAddr
+		err  error
+	}{
+		{4, from, nil},
+		{5, from, ErrTooManyTransfers},
+		{6, other, nil},
+		{7, other, ErrTooManyTransfers},
+	} {
+		chunk := appendBulkHeader(nil, bulkHeader{transfer: tc.id, total: 32, chunkSize: 8, repair: -1})
+		if err := recvKit.handleBulk(append(chunk, "01234567"...), tc.from); !errors.Is(err, tc.err) {
+			t.Fatalf("transfer %d from %v: expected %v, got %v", tc.id, tc.from, tc.err, err)
+		}
+	}
+
+	// ended transfers nobody collects are dropped after ackRetention
+	recvKit.mu.Lock()
+	for key, tr := range recvKit.bulkTransfers {
+		recvKit.bulkDone = append(recvKit.bulkDone, recvKit.finishBulk(key, tr, ErrTransferStalled))
+	}
+	for i := range recvKit.bulkDone {
+		if recvKit.bulkDone[i].data != nil {
+			t.Fatalf("stalled transfer assembled %d bytes", len(recvKit.bulkDone[i].data))
+		}
+		recvKit.bulkDone[i].at = time.Now().Add(-ackRetention - time.Second)
+	}
+	recvKit.mu.Unlock()
+	recvKit.flushBuffer()
+	recvKit.mu.Lock()
+	n = len(recvKit.bulkDone)
+	recvKit.mu.Unlock()
+	if n != 0 {
+		t.Fatalf("%d uncollected results kept", n)
+	}
+
+	// gaps are found from the chunks held, not by walking every index
+	chunks := memChunks{5: nil, 6: nil, 9: nil}
+	want := []ChunkRange{{First: 0, Last: 4}, {First: 7, Last: 8}, {First: 10, Last: 1<<32 - 2}}
+	if got := chunks.missing(1<<32 - 1); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("got missing ranges %v, want %v", got, want)
+	}
+}
+
+func TestTransferWithManifest(t *testing.T) {
+	t.Parallel()
+	retryConfig := RetryConfig{MaxRetries: 5, BaseTimeout: time.Millisecond * 20, BackoffRate: 1.5}
+	qosConfig := QoSConfig{PriorityLevels: 2, PriorityQueues: make([][]Packet, 2)}
+	bufferConfig := BufferConfig{MaxBufferSize: 256, FlushInterval: time.Second}
+	sendConn, recvConn := newMockPeerPair()
+	sendKit, err := NewGoUDPKit(":0", retryConfig, qosConfig, bufferConfig, sendConn)
+	if err != nil {
+		t.Fatalf("Failed to initialize sender: %v", err)
+	}
+	defer sendKit.Close()
+	recvKit, err := NewGoUDPKit(":0", retryConfig, qosConfig, bufferConfig, recvConn)
+	if err != nil {
+		t.Fatalf("Failed to initialize receiver: %v", err)
+	}
+	defer recvKit.Close()
+
+	// Lose the first manifest, and corrupt a chunk of the second transfer.
+	var manifests, corrupted int
+	sendConn.setDrop(func(b []byte) bool {
+		h, _, _ := DecodeHeader(b)
+		if h.Type == PacketTypeTransfer {
+			manifests++
+			return manifests == 1
+		}
+		if h.Type == PacketTypeBulk && h.SequenceNumber == 1 && manifests > 2 && corrupted == 0 {
+			corrupted++
+			b[len(b)-1] ^= 0xff
+		}
+		return false
+	})
+
+	data := make([]byte, 300)
+	mrand.New(mrand.NewSource(3)).Read(data)
+	results := make(chan *TransferResult, 2)
+	errs := make(chan error, 2)
+	go func() {
+		for i := 0; i < 2; i++ {
+			res, err := recvKit.ReceiveTransfer(context.Background())
+			results <- res
+			errs <- err
+		}
+	}()
+
+	opts := TransferOptions{ChunkSize: 64, Name: "data.bin", Metadata: map[string]string{"type": "test"}}
+	sent, err := sendKit.SendTransfer(context.Background(), data, opts, recvConn.addr)
+	if err != nil {
+		t.Fatalf("SendTransfer failed: %v", err)
+	}
+	res, err := <-results, <-errs
+	if err != nil {
+		t.Fatalf("ReceiveTransfer failed: %v", err)
+	}
+	if !bytes.Equal(res.Data, data) {
+		t.Fatal("received data does not match")
+	}
+	m := res.Manifest
+	if m.TransferID != sent.TransferID || m.Size != 300 || m.ChunkSize != 64 || m.ChunkCount != 5 || m.Digest != sent.Digest {
+		t.Fatalf("unexpected manifest %+v", m)
+	}
+	if m.Name != "data.bin" || m.Metadata["type"] != "test" {
+		t.Fatalf("name or metadata lost: %q %v", m.Name, m.Metadata)
+	}
+
+	if _, err := sendKit.SendTransfer(context.Background(), data, opts, recvConn.addr); err != nil {
+		t.Fatalf("SendTransfer failed: %v", err)
+	}
+	res, err = <-results, <-errs
+	if !errors.Is(err, ErrChecksumMismatch) {
+		t.Fatalf("expected ErrChecksumMismatch, got %v", err)
+	}
+	if res == nil || res.Data != nil {
+		t.Fatal("corrupted transfer returned data")
+	}
+
+	sendConn.setDrop(func([]byte) bool { return true })
+	if _, err := sendKit.SendTransfer(context.Background(), data, opts, recvConn.addr); !errors.Is(err, ErrManifestUnacknowledged) {
+		t.Fatalf("expected ErrManifestUnacknowledged, got %v", err)
+	}
+}
+
+func TestSendFileResumesFromCheckpoint(t *testing.T) {
+	t.Parallel()
+	retryConfig := RetryConfig{MaxRetries: 5, BaseTimeout: time.Millisecond * 20, BackoffRate: 1.5}
+	qosConfig := QoSConfig{PriorityLevels: 2, PriorityQueues: make([][]Packet, 2)}
+	bufferConfig := BufferConfig{MaxBufferSize: 256, FlushInterval: time.Minute}
+	dir := t.TempDir()
+	data := make([]byte, 2000)
+	mrand.New(mrand.NewSource(4)).Read(data)
+	opts := TransferOptions{ChunkSize: 100, Name: "../escape/data.bin"}
+
+	// run sends the file from a fresh pair of kits, dropping chunks at or
+	// past cutoff, and returns the receiver's result and the number of
+	// chunks sent.
+	run := func(cutoff uint32, wait time.Duration) (*TransferResult, int, error) {
+		sendConn, recvConn := newMockPeerPair()
+		sendKit, err := NewGoUDPKit(":0", retryConfig, qosConfig, bufferConfig, sendConn)
+		if err != nil {
+			t.Fatalf("Failed to initialize sender: %v", err)
+		}
+		defer sendKit.Close()
+		recvKit, err := NewGoUDPKit(":0", retryConfig, qosConfig, bufferConfig, recvConn)
+		if err != nil {
+			t.Fatalf("Failed to initialize receiver: %v", err)
+		}
+		defer recvKit.Close()
+		if err := recvKit.SetTransferDir(dir); err != nil {
+			t.Fatalf("SetTransferDir failed: %v", err)
+		}
+
+		var chunks int
+		sendConn.setDrop(func(b []byte) bool {
+			h, _, _ := DecodeHeader(b)
+			if h.Type != PacketTypeBulk {
+				return false
+			}
+			chunks++
+			return h.SequenceNumber >= cutoff
+		})
+		done := make(chan struct{})
+		var res *TransferResult
+		var recvErr error
+		go func() {
+			defer close(done)
+			ctx, cancel := context.WithTimeout(context.Background(), wait)
+			defer cancel()
+			res, recvErr = recvKit.ReceiveTransfer(ctx)
+		}()
+		if _, err := sendKit.SendFile(context.Background(), bytes.NewReader(data), int64(len(data)), opts, recvConn.addr); err != nil {
+			t.Fatalf("SendFile failed: %v", err)
+		}
+		<-done
+		return res, chunks, recvErr
+	}
+
+	_, sent, err := run(12, 200*time.Millisecond)
+	var incomplete *IncompleteTransferError
+	if !errors.As(err, &incomplete) || len(incomplete.Missing) != 1 || incomplete.Missing[0] != (ChunkRange{First: 12, Last: 19}) {
+		t.Fatalf("expected chunks 12-19 missing, got %v", err)
+	}
+	if sent != 20 {
+		t.Fatalf("first attempt sent %d chunks, want 20", sent)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "data.bin.ckpt")); err != nil {
+		t.Fatalf("checkpoint not kept: %v", err)
+	}
+
+	res, sent, err := run(1<<31, 5*time.Second)
+	if err != nil {
+		t.Fatalf("resumed transfer failed: %v", err)
+	}
+	if sent != 8 {
+		t.Fatalf("resumed transfer sent %d chunks, want the 8 missing", sent)
+	}
+	if res.Path != filepath.Join(dir, "data.bin") || res.Data != nil {
+		t.Fatalf("unexpected result path %q", res.Path)
+	}
+	got, err := os.ReadFile(res.Path)
+	if err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("file contents do not match: %v", err)
+	}
+	if _, err := os.Stat(res.Path + ".ckpt"); !os.IsNotExist(err) {
+		t.Fatalf("checkpoint not removed: %v", err)
+	}
+}
+
+func TestReceivedFilesDoNotReplaceExistingOnes(t *testing.T) {
+	t.Parallel()
+	retryConfig := RetryConfig{MaxRetries: 5, BaseTimeout: time.Millisecond * 20, BackoffRate: 1.5}
+	qosConfig := QoSConfig{PriorityLevels: 2, PriorityQueues: make([][]Packet, 2)}
+	bufferConfig := BufferConfig{MaxBufferSize: 256, FlushInterval: time.Minute}
+	dir := t.TempDir()
+	data := []byte("sent by a remote peer")
+	os.WriteFile(filepath.Join(dir, "data.bin"), []byte("keep"), 0o644)
+	os.WriteFile(filepath.Join(dir, "notes.part"), []byte("mine"), 0o644)
+
+	send := func(name string, replace bool) (*TransferResult, error, error) {
+		sendConn, recvConn := newMockPeerPair()
+		sendKit, _ := NewGoUDPKit(":0", retryConfig, qosConfig, bufferConfig, sendConn)
+		defer sendKit.Close()
+		recvKit, _ := NewGoUDPKit(":0", retryConfig, qosConfig, bufferConfig, recvConn)
+		defer recvKit.Close()
+		if err := recvKit.SetTransferDir(dir); err != nil {
+			t.Fatalf("SetTransferDir failed: %v", err)
+		}
+		recvKit.SetTransferReplace(replace)
+		done := make(chan struct{})
+		var res *TransferResult
+		var recvErr error
+		go func() {
+			defer close(done)
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+			res, recvErr = recvKit.ReceiveTransfer(ctx)
+		}()
+		_, sendErr := sendKit.SendTransfer(context.Background(), data, TransferOptions{ChunkSize: 8, Name: name}, recvConn.addr)
+		<-done
+		return res, sendErr, recvErr
+	}
+
+	res, sendErr, recvErr := send("data.bin", false)
+	if sendErr != nil || recvErr != nil {
+		t.Fatalf("transfer failed: %v, %v", sendErr, recvErr)
+	}
+	if res.Path != filepath.Join(dir, "data-1.bin") {
+		t.Fatalf("received into %q, want a fresh name", res.Path)
+	}
+	if got, _ := os.ReadFile(filepath.Join(dir, "data.bin")); string(got) != "keep" {
+		t.Fatalf("existing file overwritten with %q", got)
+	}
+	if got, _ := os.ReadFile(res.Path); !bytes.Equal(got, data) {
+		t.Fatalf("received file holds %q", got)
+	}
+
+	res, sendErr, recvErr = send("data.bin", true)
+	if sendErr != nil || recvErr != nil || res.Path != filepath.Join(dir, "data.bin") {
+		t.Fatalf("replacing transfer failed: %v, %v, %v", res, sendErr, recvErr)
+	}
+	if got, _ := os.ReadFile(res.Path); !bytes.Equal(got, data) {
+		t.Fatalf("opted-in replacement holds %q", got)
+	}
+
+	// a part file the kit did not create is refused, not truncated
+	if _, sendErr, _ = send("notes", false); !errors.Is(sendErr, ErrTransferRefused) {
+		t.Fatalf("expected ErrTransferRefused, got %v", sendErr)
+	}
+	if got, _ := os.ReadFile(filepath.Join(dir, "notes.part")); string(got) != "mine" {
+		t.Fatalf("foreign part file overwritten with %q", got)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "notes.ckpt")); !os.IsNotExist(err) {
+		t.Fatalf("refused transfer left a checkpoint: %v", err)
+	}
+}
+
+func TestManifestAfterTransferFinished(t *testing.T) {
+	t.Parallel()
+	retryConfig := RetryConfig{MaxRetries: 5, BaseTimeout: time.Millisecond * 20, BackoffRate: 1.5}
+	qosConfig := QoSConfig{PriorityLevels: 2, PriorityQueues: make([][]Packet, 2)}
+	bufferConfig := BufferConfig{MaxBufferSize: 256, FlushInterval: time.Minute}
+	sendConn, recvConn := newMockPeerPair()
+	sendKit, _ := NewGoUDPKit(":0", retryConfig, qosConfig, bufferConfig, sendConn)
+	defer sendKit.Close()
+	recvKit, _ := NewGoUDPKit(":0", retryConfig, qosConfig, bufferConfig, recvConn)
+	defer recvKit.Close()
+
+	received := make(chan error, 1)
+	go func() {
+		_, err := recvKit.ReceiveTransfer(context.Background())
+		received <- err
+	}()
+	m, err := sendKit.SendTransfer(context.Background(), []byte("finished transfer"), TransferOptions{ChunkSize: 4}, recvConn.addr)
+	if err != nil {
+		t.Fatalf("SendTransfer failed: %v", err)
+	}
+	if err := <-received; err != nil {
+		t.Fatalf("ReceiveTransfer failed: %v", err)
+	}
+
+	// keep the receiver reading while the manifest is sent again
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	go recvKit.ReceiveTransfer(ctx)
+
+	if missing, err := sendKit.sendManifest(ctx, m, recvConn.addr); err != nil || len(missing) != 0 {
+		t.Fatalf("retransmitted manifest: got %v, %v, want an ack with nothing missing", missing, err)
+	}
+	other := m
+	other.Digest[0] ^= 1
+	if _, err := sendKit.sendManifest(ctx, other, recvConn.addr); !errors.Is(err, ErrTransferRefused) {
+		t.Fatalf("manifest for different data under a finished ID: expected ErrTransferRefused, got %v", err)
+	}
+}
+
+func TestOversizedManifestOpensNoFile(t *testing.T) {
+	t.Parallel()
+	retryConfig := RetryConfig{MaxRetries: 5, BaseTimeout: time.Millisecond * 20, BackoffRate: 1.5}
+	qosConfig := QoSConfig{PriorityLevels: 2, PriorityQueues: make([][]Packet, 2)}
+	bufferConfig := BufferConfig{MaxBufferSize: 256, FlushInterval: time.Minute}
+	_, recvConn := newMockPeerPair()
+	recvKit, err := NewGoUDPKit(":0", retryConfig, qosConfig, bufferConfig, recvConn)
+	if err != nil {
+		t.Fatalf("Failed to initialize receiver: %v", err)
+	}
+	defer recvKit.Close()
+	dir := t.TempDir()
+	if err := recvKit.SetTransferDir(dir); err != nil {
+		t.Fatalf("SetTransferDir: %v", err)
+	}
+	recvKit.SetTransferLimits(TransferLimits{MaxSize: 1000})
+	from := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 9), Port: 9}
+
+	// a forged manifest would otherwise truncate a file to its size
+	for _, m := range []Manifest{
+		{TransferID: 1, Size: 1 << 40, ChunkSize: 1 << 16, Name: "huge"},
+		{TransferID: 2, Size: 1001, ChunkSize: 1, Name: "over"},
+	} {
+		m.ChunkCount = m.header().chunkCount()
+		frame, err := appendManifest(nil, m)
+		if err != nil {
+			t.Fatalf("appendManifest: %v", err)
+		}
+		if err := recvKit.handleTransfer(frame, from); !errors.Is(err, ErrTransferTooLarge) {
+			t.Fatalf("manifest of %d bytes: expected ErrTransferTooLarge, got %v", m.Size, err)
+		}
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		t.Fatalf("oversized manifests left files behind: %v", entries)
+	}
+
+	recvKit.SetTransferLimits(TransferLimits{MaxSize: 1000, MaxChunks: 10})
+	m := Manifest{TransferID: 3, Size: 1000, ChunkSize: 10, Name: "chunky"}
+	m.ChunkCount = m.header().chunkCount()
+	frame, _ := appendManifest(nil, m)
+	if err := recvKit.handleTransfer(frame, from); !errors.Is(err, ErrTransferTooLarge) {
+		t.Fatalf("manifest of %d chunks: expected ErrTransferTooLarge, got %v", m.ChunkCount, err)
+	}
+}
+
+func TestManifestForFileInProgressIsRefused(t *testing.T) {
+	t.Parallel()
+	retryConfig := RetryConfig{MaxRetries: 5, BaseTimeout: time.Millisecond * 20, BackoffRate: 1.5}
+	qosConfig := QoSConfig{PriorityLevels: 2, PriorityQueues: make([][]Packet, 2)}
+	bufferConfig := BufferConfig{MaxBufferSize: 256, FlushInterval: time.Minute}
+	_, recvConn := newMockPeerPair()
+	recvKit, err := NewGoUDPKit(":0", retryConfig, qosConfig, bufferConfig, recvConn)
+	if err != nil {
+		t.Fatalf("Failed to initialize receiver: %v", err)
+	}
+	defer recvKit.Close()
+	dir := t.TempDir()
+	if err := recvKit.SetTransferDir(dir); err != nil {
+		t.Fatalf("SetTransferDir: %v", err)
+	}
+	first := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 8), Port: 8}
+	second := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 9), Port: 9}
+
+	m := Manifest{TransferID: 1, Size: 100, ChunkSize: 10, Name: "shared", Digest: [32]byte{1}}
+	m.ChunkCount = m.header().chunkCount()
+	frame, _ := appendManifest(nil, m)
+	if err := recvKit.handleTransfer(frame, first); err != nil {
+		t.Fatalf("first manifest: %v", err)
+	}
+	h := m.header()
+	if err := recvKit.handleBulk(append(appendBulkHeader(nil, h), "0123456789"...), first); err != nil {
+		t.Fatalf("first chunk: %v", err)
+	}
+	ckpt, _ := os.ReadFile(filepath.Join(dir, "shared.ckpt"))
+
+	// another peer naming the same file must not take over its checkpoint
+	other := Manifest{TransferID: 2, Size: 100, ChunkSize: 10, Name: "shared", Digest: [32]byte{2}}
+	other.ChunkCount = other.header().chunkCount()
+	frame, _ = appendManifest(nil, other)
+	if err := recvKit.handleTransfer(frame, second); !errors.Is(err, ErrTransferFileExists) {
+		t.Fatalf("expected ErrTransferFileExists, got %v", err)
+	}
+	if got, _ := os.ReadFile(filepath.Join(dir, "shared.ckpt")); !bytes.Equal(got, ckpt) {
+		t.Fatal("checkpoint of the transfer in progress was rewritten")
+	}
+	// and the refused sender's chunks are not taken as a bulk transfer
+	if err := recvKit.handleBulk(append(appendBulkHeader(nil, other.header()), "abcdefghij"...), second); err != nil {
+		t.Fatalf("refused chunk: %v", err)
+	}
+	recvKit.mu.Lock()
+	_, firstOK := recvKit.bulkTransfers[messageKey{peer: first.String(), id: 1}]
+	_, secondOK := recvKit.bulkTransfers[messageKey{peer: second.String(), id: 2}]
+	recvKit.mu.Unlock()
+	if !firstOK || secondOK {
+		t.Fatalf("transfers in progress: first %v, second %v", firstOK, secondOK)
+	}
+}
+
+func TestCongestionControllers(t *testing.T) {
+	const mss = 1000
+	for name, newController := range map[string]func(int) CongestionController{
+		"newreno": NewNewReno,
+		"cubic":   NewCUBIC,
+		"delay":   NewDelayBased,
+	} {
+		cc := newController(mss)
+		initial := cc.Window()
+		if initial != initialWindowPackets*mss {
+			t.Fatalf("%s: initial window %d", name, initial)
+		}
+		// a window's worth of acks at a steady RTT grows the window
+		for i := 0; i < initialWindowPackets; i++ {
+			cc.OnAck(mss, 10*time.Millisecond)
+		}
+		grown := cc.Window()
+		if grown <= initial {
+			t.Fatalf("%s: window %d did not grow from %d", name, grown, initial)
+		}
+		cc.OnLoss(mss)
+		if w := cc.Window(); w >= grown || w < minWindowPackets*mss {
+			t.Fatalf("%s: window %d after loss from %d", name, w, grown)
+		}
+		for i := 0; i < 100; i++ {
+			cc.OnLoss(mss)
+		}
+		if w := cc.Window(); w < minWindowPackets*mss {
+			t.Fatalf("%s: window %d fell below the minimum", name, w)
+		}
+	}
+
+	// rising RTTs mean a queue is building, so the delay-based controller
+	// shrinks without any loss
+	cc := NewDelayBased(mss)
+	for i := 0; i < 5; i++ {
+		cc.OnAck(mss, 10*time.Millisecond)
+	}
+	before := cc.Window()
+	for i := 0; i < 20; i++ {
+		cc.OnAck(mss, 40*time.Millisecond)
+	}
+	if w := cc.Window(); w >= before {
+		t.Fatalf("delay-based window %d did not shrink from %d as RTT rose", w, before)
+	}
+}
+
+func TestCongestionLossesInOneRTTCutOnce(t *testing.T) {
+	const mss = 1000
+	for name, newController := range map[string]func(int) CongestionController{
+		"newreno": NewNewReno,
+		"cubic":   NewCUBIC,
+		"delay":   NewDelayBased,
+	} {
+		cc := newController(mss)
+		for i := 0; i < initialWindowPackets; i++ {
+			cc.OnAck(mss, time.Second)
+		}
+		// a window's worth of losses reported within one round trip
+		cc.OnLoss(mss)
+		cut := cc.Window()
+		for i := 0; i < initialWindowPackets; i++ {
+			cc.OnLoss(mss)
+		}
+		if w := cc.Window(); w != cut {
+			t.Fatalf("%s: window %d after one congestion event, want %d", name, w, cut)
+		}
+	}
+}
+
+func TestPacing(t *testing.T) {
+	t.Parallel()
+	retryConfig := RetryConfig{MaxRetries: 1, BaseTimeout: 10 * time.Millisecond, BackoffRate: 1}
+	qosConfig := QoSConfig{PriorityLevels: 1}
+	bufferConfig := BufferConfig{MaxBufferSize: 128, FlushInterval: time.Second}
+	sendConn, recvConn := newMockPeerPair()
+	kit, err := NewGoUDPKit(":0", retryConfig, qosConfig, bufferConfig, sendConn)
+	if err != nil {
+		t.Fatalf("NewGoUDPKit: %v", err)
+	}
+	defer kit.Close()
+	other := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 3), Port: 3000}
+
+	if err := kit.SetPacing(PacingConfig{Kit: RateLimit{BytesPerSecond: -1}}); !errors.Is(err, ErrBadPacingConfig) {
+		t.Fatalf("expected ErrBadPacingConfig, got %v", err)
+	}
+
+	// with no burst, six packets at 100/s take five intervals
+	kit.SetPacing(PacingConfig{Kit: RateLimit{PacketsPerSecond: 100}})
+	start := time.Now()
+	for i := 0; i < 6; i++ {
+		if err := kit.SendPacket(Packet{SequenceNumber: uint32(i), Data: []byte("p")}, recvConn.addr); err != nil {
+			t.Fatalf("SendPacket: %v", err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed < 45*time.Millisecond {
+		t.Fatalf("six packets at 100/s sent in %v", elapsed)
+	}
+	if s := kit.Snapshot(); s.SendsThrottled != 5 {
+		t.Fatalf("expected 5 throttled sends, got %d", s.SendsThrottled)
+	}
+
+	// a burst goes out at once after an idle period
+	kit.SetPacing(PacingConfig{Kit: RateLimit{PacketsPerSecond: 10, BurstPackets: 4}})
+	start = time.Now()
+	for i := 0; i < 4; i++ {
+		kit.SendPacket(Packet{Data: []byte("b")}, recvConn.addr)
+	}
+	if elapsed := time.Since(start); elapsed > 50*time.Millisecond {
+		t.Fatalf("burst of 4 took %v", elapsed)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := kit.SendContext(ctx, Packet{Data: []byte("late")}, recvConn.addr); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected the paced send to time out, got %v", err)
+	}
+
+	// sends that give up waiting return their tokens, so they do not
+	// delay the ones after them
+	kit.SetPacing(PacingConfig{Kit: RateLimit{PacketsPerSecond: 10}})
+	kit.SendPacket(Packet{Data: []byte("x")}, recvConn.addr)
+	for i := 0; i < 10; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+		if err := kit.SendContext(ctx, Packet{Data: []byte("abandoned")}, recvConn.addr); !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("expected the paced send to time out, got %v", err)
+		}
+		cancel()
+	}
+	ctx, cancel = context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	if err := kit.SendContext(ctx, Packet{Data: []byte("next")}, recvConn.addr); err != nil {
+		t.Fatalf("send after abandoned ones: %v", err)
+	}
+
+	// non-blocking, per destination
+	kit.SetPacing(PacingConfig{PerDestination: RateLimit{BytesPerSecond: 1000}, NonBlocking: true})
+	before := kit.Snapshot()
+	if err := kit.SendPacket(Packet{Data: make([]byte, 100)}, recvConn.addr); err != nil {
+		t.Fatalf("first send: %v", err)
+	}
+	if err := kit.SendPacket(Packet{Data: make([]byte, 100)}, recvConn.addr); !errors.Is(err, ErrRateLimited) {
+		t.Fatalf("expected ErrRateLimited, got %v", err)
+	}
+	if err := kit.SendPacket(Packet{Data: make([]byte, 100)}, other); err != nil {
+		t.Fatalf("send to another destination: %v", err)
+	}
+	if d := kit.Snapshot().Sub(before); d.SendsThrottled != 1 || d.PacketsSent != 2 {
+		t.Fatalf("unexpected stats delta %+v", d)
+	}
+
+	kit.SetPacing(PacingConfig{})
+	if err := kit.SendPacket(Packet{Data: make([]byte, 100)}, recvConn.addr); err != nil {
+		t.Fatalf("send with pacing off: %v", err)
+	}
+}
+
+func newFlowControlPair(t *testing.T, recvBuffer BufferConfig) (*GoUDPKit, *GoUDPKit, *mockPeerConn, *mockPeerConn) {
+	t.Helper()
+	retryConfig := RetryConfig{MaxRetries: 20, BaseTimeout: 50 * time.Millisecond, BackoffRate: 1.2}
+	qosConfig := QoSConfig{PriorityLevels: 1}
+	sendConn, recvConn := newMockPeerPair()
+	sendKit, err := NewGoUDPKit(":0", retryConfig, qosConfig, BufferConfig{SendWindow: 2, FlushInterval: time.Second}, sendConn)
+	if err != nil {
+		t.Fatalf("NewGoUDPKit: %v", err)
+	}
+	t.Cleanup(func() { sendKit.Close() })
+	recvKit, err := NewGoUDPKit(":0", retryConfig, qosConfig, recvBuffer, recvConn)
+	if err != nil {
+		t.Fatalf("NewGoUDPKit: %v", err)
+	}
+	t.Cleanup(func() { recvKit.Close() })
+	return sendKit, recvKit, sendConn, recvConn
+}
+
+func reliablePackets(n int) []Packet {
+	packets := make([]Packet, n)
+	for i := range packets {
+		packets[i] = Packet{SequenceNumber: uint32(i + 1), Data: []byte(fmt.Sprint(i))}
+	}
+	return packets
+}
+
+func TestFlowControlLimitsUnreadPackets(t *testing.T) {
+	t.Parallel()
+	sendKit, recvKit, _, recvConn := newFlowControlPair(t, BufferConfig{ReceiveWindow: 4, FlushInterval: time.Second})
+
+	// a slow reader sees no more than the window waiting in its socket
+	done := make(chan int)
+	go func() {
+		most := 0
+		for i := 0; i < 20; i++ {
+			most = max(most, len(recvConn.inbox))
+			time.Sleep(5 * time.Millisecond)
+			if _, _, err := recvKit.ReceivePacket(); err != nil {
+				t.Errorf("ReceivePacket: %v", err)
+				break
+			}
+		}
+		done <- most
+	}()
+	results, err := sendKit.SendReliable(reliablePackets(20), recvConn.addr)
+	if err != nil {
+		t.Fatalf("SendReliable: %v", err)
+	}
+	for _, r := range results {
+		if r.Status != Delivered {
+			t.Fatalf("packet %d: %v", r.SequenceNumber, r.Status)
+		}
+	}
+	if most := <-done; most > 4 {
+		t.Fatalf("%d packets waited unread with a window of 4", most)
+	}
+	if s := sendKit.Snapshot(); s.FlowControlStalls == 0 || s.RetryCount != 0 {
+		t.Fatalf("expected stalls and no retries, stats %+v", s)
+	}
+}
+
+func TestFlowControlWindowUpdates(t *testing.T) {
+	t.Parallel()
+	sendKit, recvKit, _, recvConn := newFlowControlPair(t, BufferConfig{MaxBufferSize: 4, FlushInterval: time.Second})
+
+	// a slow handler fills the window, and the receiver reopens it as
+	// the backlog drains
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var handled atomic.Int32
+	go recvKit.Serve(ctx, HandlerFunc(func(ResponseWriter, Packet, *net.UDPAddr) {
+		time.Sleep(5 * time.Millisecond)
+		handled.Add(1)
+	}), ServeConfig{Workers: 1, QueueSize: 1})
+
+	results, err := sendKit.SendReliable(reliablePackets(30), recvConn.addr)
+	if err != nil {
+		t.Fatalf("SendReliable: %v", err)
+	}
+	for _, r := range results {
+		if r.Status != Delivered {
+			t.Fatalf("packet %d: %v", r.SequenceNumber, r.Status)
+		}
+	}
+	if s := sendKit.Snapshot(); s.FlowControlStalls == 0 {
+		t.Fatalf("expected the sender to stall, stats %+v", s)
+	}
+	deadline := time.Now().Add(time.Second)
+	for handled.Load() < 30 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if n := handled.Load(); n != 30 {
+		t.Fatalf("handled %d of 30 packets", n)
+	}
+}
+
+func TestMaxBufferSizeDropsUnreadPackets(t *testing.T) {
+	t.Parallel()
+	sendKit, recvKit, _, recvConn := newFlowControlPair(t, BufferConfig{MaxBufferSize: 2, FlushInterval: 20 * time.Millisecond})
+	for i := 0; i < 5; i++ {
+		sendKit.SendPacket(Packet{SequenceNumber: uint32(i), Data: []byte{byte(i)}}, recvConn.addr)
+	}
+
+	// receiving bulk data holds the data packets it reads for
+	// ReceivePacket, up to MaxBufferSize
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	recvKit.ReceiveBulkDataContext(ctx)
+	if s := recvKit.Snapshot(); s.PacketsDropped != 3 {
+		t.Fatalf("expected 3 packets dropped, stats %+v", s)
+	}
+	for i := 0; i < 2; i++ {
+		data, _, err := recvKit.ReceivePacket()
+		if err != nil || !bytes.Equal(data, []byte{byte(i)}) {
+			t.Fatalf("packet %d: %v %v", i, data, err)
+		}
+	}
+}
+
+func newSessionPair(t *testing.T) (*GoUDPKit, *GoUDPKit, *mockPeerConn) {
+	t.Helper()
+	retryConfig := RetryConfig{MaxRetries: 5, BaseTimeout: 20 * time.Millisecond, BackoffRate: 1.5}
+	qosConfig := QoSConfig{PriorityLevels: 1}
+	bufferConfig := BufferConfig{MaxBufferSize: 64, FlushInterval: 20 * time.Millisecond}
+	clientConn, serverConn := newMockPeerPair()
+	client, err := NewGoUDPKit(":0", retryConfig, qosConfig, bufferConfig, clientConn)
+	if err != nil {
+		t.Fatalf("NewGoUDPKit: %v", err)
+	}
+	t.Cleanup(func() { client.Close() })
+	server, err := NewGoUDPKit(":0", retryConfig, qosConfig, bufferConfig, serverConn)
+	if err != nil {
+		t.Fatalf("NewGoUDPKit: %v", err)
+	}
+	t.Cleanup(func() { server.Close() })
+	return client, server, serverConn
+}
+
+func TestSessionConnectAccept(t *testing.T) {
+	t.Parallel()
+	client, server, serverConn := newSessionPair(t)
+	server.SetSessionConfig(SessionConfig{Accept: true})
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	accepted := make(chan *Session, 2)
+	go func() {
+		for i := 0; i < 2; i++ {
+			s, err := server.Accept(ctx)
+			if err != nil {
+				t.Errorf("Accept: %v", err)
+				return
+			}
+			accepted <- s
+		}
+	}()
+	a, err := client.Connect(ctx, serverConn.addr)
+	if err != nil {
+		t.Fatalf("Connect: %v", err)
+	}
+	b, err := client.Connect(ctx, serverConn.addr)
+	if err != nil {
+		t.Fatalf("second Connect: %v", err)
+	}
+	if a.ID() == b.ID() || a.State() != SessionEstablished {
+		t.Fatalf("sessions %v (%v) and %v", a.ID(), a.State(), b.ID())
+	}
+	peers := map[ConnectionID]*Session{}
+	for i := 0; i < 2; i++ {
+		s := <-accepted
+		if s.State() != SessionEstablished || !s.RemoteAddr().IP.Equal(net.IPv4(10, 0, 0, 1)) {
+			t.Fatalf("accepted session %v in state %v from %v", s.ID(), s.State(), s.RemoteAddr())
+		}
+		peers[s.ID()] = s
+	}
+	if got, ok := server.LookupSession(a.ID()); !ok || got != peers[a.ID()] || len(server.Sessions()) != 2 {
+		t.Fatalf("peer table does not hold both sessions")
+	}
+
+	// each session numbers its packets from 1 and keeps its own
+	for i := 0; i < 3; i++ {
+		a.Send([]byte(fmt.Sprint("a", i)))
+	}
+	b.Send([]byte("b0"))
+	for i := 0; i < 3; i++ {
+		p, err := peers[a.ID()].Receive(ctx)
+		if err != nil || p.SequenceNumber != uint32(i+1) || string(p.Data) != fmt.Sprint("a", i) {
+			t.Fatalf("session a packet %d: %+v %v", i, p, err)
+		}
+	}
+	p, err := peers[b.ID()].Receive(ctx)
+	if err != nil || p.SequenceNumber != 1 || string(p.Data) != "b0" {
+		t.Fatalf("session b packet: %+v %v", p, err)
+	}
+
+	peers[b.ID()].Send([]byte("reply"))
+	if p, err := b.Receive(ctx); err != nil || string(p.Data) != "reply" {
+		t.Fatalf("reply: %+v %v", p, err)
+	}
+	if s := client.Snapshot(); s.SessionsEstablished != 2 {
+		t.Fatalf("expected 2 sessions established, stats %+v", s)
+	}
+}
+
+func TestSessionLifecycleCallbacks(t *testing.T) {
+	t.Parallel()
+	client, server, serverConn := newSessionPair(t)
+	type event struct {
+		kind string
+		id   ConnectionID
+		err  error
+	}
+	events := make(chan event, 8)
+	callbacks := func(name string) SessionConfig {
+		return SessionConfig{
+			Accept:       name == "server",
+			OnConnect:    func(s *Session) { events <- event{name + " connect", s.ID(), nil} },
+			OnDisconnect: func(s *Session, err error) { events <- event{name + " disconnect", s.ID(), err} },
+		}
+	}
+	client.SetSessionConfig(callbacks("client"))
+	server.SetSessionConfig(callbacks("server"))
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	go server.Serve(ctx, HandlerFunc(func(ResponseWriter, Packet, *net.UDPAddr) {}))
+
+	s, err := client.Connect(ctx, serverConn.addr)
+	if err != nil {
+		t.Fatalf("Connect: %v", err)
+	}
+	expect := func(kinds ...string) {
+		t.Helper()
+		want := map[string]bool{}
+		for _, k := range kinds {
+			want[k] = true
+		}
+		for range kinds {
+			select {
+			case e := <-events:
+				if !want[e.kind] || e.id != s.ID() || e.err != nil {
+					t.Fatalf("unexpected event %+v, want %v", e, kinds)
+				}
+				delete(want, e.kind)
+			case <-ctx.Done():
+				t.Fatalf("missing events %v", want)
+			}
+		}
+	}
+	expect("client connect", "server connect")
+
+	if err := s.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	expect("client disconnect", "server disconnect")
+	if s.State() != SessionClosed || len(client.Sessions()) != 0 || len(server.Sessions()) != 0 {
+		t.Fatalf("session still open: %v, %d and %d in the peer tables", s.State(), len(client.Sessions()), len(server.Sessions()))
+	}
+	if err := s.Send([]byte("late")); !errors.Is(err, ErrSessionClosed) {
+		t.Fatalf("expected ErrSessionClosed, got %v", err)
+	}
+	if st := server.Snapshot(); st.SessionsEstablished != 1 || st.SessionsClosed != 1 {
+		t.Fatalf("unexpected server stats %+v", st)
+	}
+}
+
+func TestSessionRefusedAndReset(t *testing.T) {
+	t.Parallel()
+	client, server, serverConn := newSessionPair(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	go server.Serve(ctx, HandlerFunc(func(ResponseWriter, Packet, *net.UDPAddr) {}))
+
+	if _, err := client.Connect(ctx, serverConn.addr); !errors.Is(err, ErrConnectionRefused) {
+		t.Fatalf("expected ErrConnectionRefused, got %v", err)
+	}
+	if len(client.Sessions()) != 0 {
+		t.Fatalf("refused session left in the peer table")
+	}
+
+	// a server that lost the session resets it
+	server.SetSessionConfig(SessionConfig{Accept: true})
+	s, err := client.Connect(ctx, serverConn.addr)
+	if err != nil {
+		t.Fatalf("Connect: %v", err)
+	}
+	server.mu.Lock()
+	delete(server.sessions, s.ID())
+	server.mu.Unlock()
+	s.Send([]byte("lost"))
+	if _, err := s.Receive(ctx); !errors.Is(err, ErrSessionClosed) || !errors.Is(s.Err(), ErrSessionReset) {
+		t.Fatalf("expected the session to be reset, got %v and %v", err, s.Err())
+	}
+}
+
+func TestSessionClosedIDsAndUnknownResets(t *testing.T) {
+	t.Parallel()
+	client, server, serverConn := newSessionPair(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	server.SetSessionConfig(SessionConfig{Accept: true, OnConnect: func(*Session) {}})
+	go server.Serve(ctx, HandlerFunc(func(ResponseWriter, Packet, *net.UDPAddr) {}))
+	var resets atomic.Int32
+	serverConn.setDrop(func(b []byte) bool {
+		if _, p, err := DecodeHeader(b); err == nil && len(p) > 0 && p[0] == sessionReset {
+			resets.Add(1)
+		}
+		return false
+	})
+
+	s, err := client.Connect(ctx, serverConn.addr)
+	if err != nil {
+		t.Fatalf("Connect: %v", err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	// a connect retransmitted after the close must not reopen the session
+	clientAddr := serverConn.peer.addr
+	if err := server.handleSession(Header{Type: PacketTypeSession}, appendSessionFrame(sessionConnect, s.ID(), nil), clientAddr); err != nil {
+		t.Fatalf("handleSession: %v", err)
+	}
+	if n := len(server.Sessions()); n != 0 || resets.Load() != 1 {
+		t.Fatalf("late connect: %d sessions open, %d resets sent", n, resets.Load())
+	}
+
+	// data for IDs nobody had is only answered at a bounded rate
+	spoofed := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 66), Port: 66}
+	for i := 0; i < 2*maxUnknownResets; i++ {
+		server.handleSession(Header{Type: PacketTypeSession}, appendSessionFrame(sessionData, ConnectionID(1000+i), nil), spoofed)
+	}
+	if n := resets.Load() - 1; n != maxUnknownResets {
+		t.Fatalf("sent %d resets for unknown sessions, want %d", n, maxUnknownResets)
+	}
+	// but the address a session was closed with still gets its reset
+	server.handleSession(Header{Type: PacketTypeSession}, appendSessionFrame(sessionData, s.ID(), nil), clientAddr)
+	if n := resets.Load() - 1; n != maxUnknownResets+1 {
+		t.Fatalf("no reset for data on a closed session")
+	}
+}
+
+func TestSessionBacklogAndIdleTimeout(t *testing.T) {
+	t.Parallel()
+	client, server, serverConn := newSessionPair(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	closed := make(chan error, 4)
+	server.SetSessionConfig(SessionConfig{
+		Accept:        true,
+		AcceptBacklog: 2,
+		OnDisconnect:  func(_ *Session, err error) { closed <- err },
+	})
+	// sessions go idle with their peer
+	if err := server.SetKeepalive(KeepaliveConfig{Interval: time.Hour, IdleTimeout: 100 * time.Millisecond}); err != nil {
+		t.Fatalf("SetKeepalive: %v", err)
+	}
+	go server.Serve(ctx, HandlerFunc(func(ResponseWriter, Packet, *net.UDPAddr) {}))
+
+	// nobody calls Accept, so the backlog fills up
+	a, err := client.Connect(ctx, serverConn.addr)
+	if err != nil {
+		t.Fatalf("Connect: %v", err)
+	}
+	if _, err := client.Connect(ctx, serverConn.addr); err != nil {
+		t.Fatalf("Connect: %v", err)
+	}
+	if _, err := client.Connect(ctx, serverConn.addr); !errors.Is(err, ErrConnectionRefused) {
+		t.Fatalf("expected ErrConnectionRefused with the backlog full, got %v", err)
+	}
+
+	for i := 0; i < 2; i++ {
+		select {
+		case err := <-closed:
+			if !errors.Is(err, ErrSessionIdle) {
+				t.Fatalf("expected ErrSessionIdle, got %v", err)
+			}
+		case <-ctx.Done():
+			t.Fatal("idle sessions were not expired")
+		}
+	}
+	server.mu.Lock()
+	queued := len(server.acceptQueue)
+	server.mu.Unlock()
+	if queued != 0 || len(server.Sessions()) != 0 {
+		t.Fatalf("expired sessions left behind: %d queued, %d open", queued, len(server.Sessions()))
+	}
+	// the client is told the session ended
+	if _, err := a.Receive(ctx); !errors.Is(err, ErrSessionClosed) || a.Err() != nil {
+		t.Fatalf("expected an orderly close, got %v and %v", err, a.Err())
+	}
+
+	if _, err := client.Connect(ctx, serverConn.addr); err != nil {
+		t.Fatalf("Connect after the backlog drained: %v", err)
+	}
+}
+
+func TestKeepalivePingsSilentPeer(t *testing.T) {
+	t.Parallel()
+	client, server, serverConn := newSessionPair(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	go server.Serve(ctx, HandlerFunc(func(ResponseWriter, Packet, *net.UDPAddr) {}))
+	go client.Serve(ctx, HandlerFunc(func(ResponseWriter, Packet, *net.UDPAddr) {}))
+
+	if err := client.SetKeepalive(KeepaliveConfig{Interval: 20 * time.Millisecond, IdleTimeout: time.Second}); err != nil {
+		t.Fatalf("SetKeepalive: %v", err)
+	}
+	if err := client.SendPacket(Packet{Data: []byte("hello")}, serverConn.addr); err != nil {
+		t.Fatalf("SendPacket: %v", err)
+	}
+	for client.Snapshot().Latency.KeepaliveRTT.Count < 2 {
+		select {
+		case <-ctx.Done():
+			t.Fatalf("no keepalive answered, stats %+v", client.Snapshot())
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	p, ok := client.LookupPeer(serverConn.addr)
+	if !ok || p.RTT <= 0 || p.LastReceived.IsZero() || p.LastSent.Before(p.FirstSeen) {
+		t.Fatalf("unexpected peer entry %+v", p)
+	}
+	if s := client.Snapshot(); s.KeepalivesSent < 2 || s.PeersEvicted != 0 || s.Peers != 1 {
+		t.Fatalf("unexpected client stats %+v", s)
+	}
+	// the server only answers, and keeps no peer table without keepalives
+	if peers := server.Peers(); len(peers) != 0 {
+		t.Fatalf("unexpected server peer table %+v", peers)
+	}
+	if s := server.Snapshot(); s.KeepalivesSent != 0 || s.Peers != 0 {
+		t.Fatalf("unexpected server stats %+v", s)
+	}
+}
+
+func TestKeepalivePeerTableIsCapped(t *testing.T) {
+	t.Parallel()
+	client, _, serverConn := newSessionPair(t)
+	if err := client.SetKeepalive(KeepaliveConfig{IdleTimeout: time.Minute, MaxPeers: 1}); err != nil {
+		t.Fatalf("SetKeepalive: %v", err)
+	}
+	if err := client.SetKeepalive(KeepaliveConfig{MaxPeers: -1}); !errors.Is(err, ErrBadKeepaliveConfig) {
+		t.Fatalf("expected ErrBadKeepaliveConfig, got %v", err)
+	}
+	other := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 3), Port: 3000}
+	for _, addr := range []*net.UDPAddr{serverConn.addr, other} {
+		if err := client.SendPacket(Packet{Data: []byte("hello")}, addr); err != nil {
+			t.Fatalf("SendPacket: %v", err)
+		}
+	}
+	// neither has answered, so the second replaced the first
+	client.mu.Lock()
+	_, first := client.peers[serverConn.addr.String()]
+	_, second := client.peers[other.String()]
+	client.mu.Unlock()
+	if first || !second {
+		t.Fatalf("unconfirmed entry not replaced: %v %v", first, second)
+	}
+	if peers := client.Peers(); len(peers) != 0 {
+		t.Fatalf("unconfirmed peers reported: %+v", peers)
+	}
+
+	// turning keepalives off drops the table and stops tracking
+	if err := client.SetKeepalive(KeepaliveConfig{}); err != nil {
+		t.Fatalf("SetKeepalive: %v", err)
+	}
+	if err := client.SendPacket(Packet{Data: []byte("hello")}, other); err != nil {
+		t.Fatalf("SendPacket: %v", err)
+	}
+	if peers := client.Peers(); len(peers) != 0 {
+		t.Fatalf("peers tracked with keepalives off: %+v", peers)
+	}
+}
+
+func TestKeepaliveDoesNotStartHandshake(t *testing.T) {
+	t.Parallel()
+	psk := []byte("correct horse battery staple")
+	initKit, respKit, _, respConn := newHandshakePair(t, HandshakeConfig{PSK: psk}, HandshakeConfig{PSK: psk})
+	defer initKit.Close()
+	defer respKit.Close()
+	if err := initKit.SetKeepalive(KeepaliveConfig{Interval: time.Hour, IdleTimeout: 2 * time.Hour}); err != nil {
+		t.Fatalf("SetKeepalive: %v", err)
+	}
+
+	// a peer whose session is gone stays in the table until it goes idle
+	now := time.Now()
+	initKit.mu.Lock()
+	initKit.peers[respConn.addr.String()] = &peerState{Peer: Peer{Addr: respConn.addr, FirstSeen: now.Add(-time.Hour)}}
+	initKit.mu.Unlock()
+	initKit.checkPeers(now)
+
+	err := initKit.writeFrame(context.Background(), Header{Type: PacketTypeKeepalive}, appendKeepaliveFrame(keepalivePing, now), respConn.addr)
+	if !errors.Is(err, errNoPeerSession) {
+		t.Fatalf("expected errNoPeerSession, got %v", err)
+	}
+	if n := len(respConn.inbox); n != 0 {
+		t.Fatalf("%d datagrams sent to a peer without a session", n)
+	}
+	if s := initKit.Snapshot(); s.KeepalivesSent != 0 || s.HandshakesCompleted != 0 || s.HandshakesFailed != 0 {
+		t.Fatalf("unexpected stats %+v", s)
+	}
+}
+
+func TestKeepaliveEvictsIdlePeer(t *testing.T) {
+	t.Parallel()
+	client, server, serverConn := newSessionPair(t)
+	evicted := make(chan Peer, 1)
+	err := client.SetKeepalive(KeepaliveConfig{
+		Interval:     10 * time.Millisecond,
+		IdleTimeout:  60 * time.Millisecond,
+		OnDisconnect: func(p Peer) { evicted <- p },
+	})
+	if err != nil {
+		t.Fatalf("SetKeepalive: %v", err)
+	}
+	if err := client.SetKeepalive(KeepaliveConfig{Interval: -time.Second}); !errors.Is(err, ErrBadKeepaliveConfig) {
+		t.Fatalf("expected ErrBadKeepaliveConfig, got %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	go client.Serve(ctx, HandlerFunc(func(ResponseWriter, Packet, *net.UDPAddr) {}))
+
+	// the server answers the first ping and then stops reading
+	serveCtx, stopServing := context.WithCancel(ctx)
+	go server.Serve(serveCtx, HandlerFunc(func(ResponseWriter, Packet, *net.UDPAddr) {}))
+	if err := client.SendPacket(Packet{Data: []byte("hello")}, serverConn.addr); err != nil {
+		t.Fatalf("SendPacket: %v", err)
+	}
+	for {
+		if _, ok := client.LookupPeer(serverConn.addr); ok {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			t.Fatal("peer never answered a ping")
+		case <-time.After(5 * time.Millisecond):
+		}
+	}
+	stopServing()
+
+	select {
+	case p := <-evicted:
+		if p.Addr.String() != serverConn.addr.String() || p.LastReceived.IsZero() || p.RTT <= 0 {
+			t.Fatalf("unexpected evicted peer %+v", p)
+		}
+		if silent := time.Since(p.LastReceived); silent < 60*time.Millisecond {
+			t.Fatalf("peer evicted after only %v", silent)
+		}
+	case <-ctx.Done():
+		t.Fatal("idle peer was not evicted")
+	}
+	if _, ok := client.LookupPeer(serverConn.addr); ok || len(client.Peers()) != 0 {
+		t.Fatal("evicted peer left in the peer table")
+	}
+	if s := client.Snapshot(); s.PeersEvicted != 1 || s.KeepalivesSent == 0 || s.Latency.KeepaliveRTT.Count == 0 {
+		t.Fatalf("unexpected stats %+v", s)
+	}
+}
+
+func TestKeepaliveIgnoresSpoofedPeers(t *testing.T) {
+	t.Parallel()
+	client, server, serverConn := newSessionPair(t)
+	evicted := make(chan Peer, 16)
+	err := client.SetKeepalive(KeepaliveConfig{
+		Interval:     10 * time.Millisecond,
+		IdleTimeout:  60 * time.Millisecond,
+		MaxPeers:     2,
+		OnDisconnect: func(p Peer) { evicted <- p },
+	})
+	if err != nil {
+		t.Fatalf("SetKeepalive: %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	go client.Serve(ctx, HandlerFunc(func(ResponseWriter, Packet, *net.UDPAddr) {}))
+	go server.Serve(ctx, HandlerFunc(func(ResponseWriter, Packet, *net.UDPAddr) {}))
+	if err := client.SendPacket(Packet{Data: []byte("hello")}, serverConn.addr); err != nil {
+		t.Fatalf("SendPacket: %v", err)
+	}
+
+	// plain datagrams from made-up addresses only push each other out
+	for i := 0; i < 16; i++ {
+		from := &net.UDPAddr{IP: net.IPv4(10, 0, 1, byte(i)), Port: 1000 + i}
+		h := Header{Type: PacketTypeData, MessageID: uint32(i)}
+		client.handleDatagram(AppendHeader(nil, h, []byte("spoof")), from)
+	}
+	for {
+		if _, ok := client.LookupPeer(serverConn.addr); ok {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			t.Fatal("real peer was not tracked")
+		case <-time.After(5 * time.Millisecond):
+		}
+	}
+
+	// the spoofed entries go idle without being reported
+	time.Sleep(150 * time.Millisecond)
+	if peers := client.Peers(); len(peers) != 1 || peers[0].Addr.String() != serverConn.addr.String() {
+		t.Fatalf("unexpected peer table %+v", peers)
+	}
+	if n := len(evicted); n != 0 {
+		t.Fatalf("OnDisconnect called for %d spoofed peers", n)
+	}
+	if s := client.Snapshot(); s.Peers != 1 || s.PeersEvicted != 0 {
+		t.Fatalf("unexpected stats %+v", s)
+	}
+}
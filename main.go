@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"log"
 	"net"
 	"time"
@@ -42,12 +43,10 @@ func main() {
 		log.Printf("Error sending packet: %v", err)
 	}
 
-	for {
-		data, addr, err := kit.ReceivePacket()
-		if err != nil {
-			log.Printf("Error receiving packet: %v", err)
-			continue
-		}
-		log.Printf("Received from %v: %s", addr, string(data))
+	err = kit.Serve(context.Background(), goudpkit.HandlerFunc(func(w goudpkit.ResponseWriter, packet goudpkit.Packet, addr *net.UDPAddr) {
+		log.Printf("Received from %v: %s", addr, string(packet.Data))
+	}))
+	if err != nil {
+		log.Fatal(err)
 	}
 }